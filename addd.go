@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	"reflect"
 	"strings"
 	"time"
 
@@ -18,9 +19,28 @@ var (
 	logLevel string
 	pidFile  string
 	// dns flags
-	dnsDomain string
-	dnsTsig   string
-	dnsPort   int
+	dnsDomain  string
+	dnsTsig    string
+	dnsPolicy  string
+	updSigned  bool
+	updAllow   string
+	dnsPort    int
+	dnsEdns    int
+	dotPort    int
+	dotCert    string
+	dotKey     string
+	dnsReverse string
+	dnsDateSn  bool
+	xfrAllow   string
+	xfrKeys    string
+	xfrJournal int
+	xfrNotify  string
+	fwdServers string
+	fwdAllow   string
+	rrlRate    int
+	rrlSlip    int
+	rrlExempt  string
+	geoFile    string
 	// api flags
 	apiListen string
 	apiToken  string
@@ -41,9 +61,33 @@ func init() {
 	flag.StringVar(&pidFile, "pid", "./addd.pid", "pid file location")
 
 	// Parse DNS flags
-	flag.StringVar(&dnsDomain, "domain", "local.", "Parent domain to serve.")
+	flag.StringVar(&dnsDomain, "domain", "local.", "Zone created at startup if missing (other zones are managed through the API)")
 	flag.IntVar(&dnsPort, "port", 53, "server port")
-	flag.StringVar(&dnsTsig, "tsig", "", "use MD5 hmac tsig: keyname:base64")
+	flag.IntVar(&dotPort, "dot_port", 853, "DNS-over-TLS server port (used with -dot_cert and -dot_key)")
+	flag.StringVar(&dotCert, "dot_cert", "", "DNS-over-TLS certificate file (PEM), reloaded when modified")
+	flag.StringVar(&dotKey, "dot_key", "", "DNS-over-TLS private key file (PEM), reloaded when modified")
+	flag.IntVar(&dnsEdns, "edns_size", 1232, "Largest UDP payload advertised and sent with EDNS0")
+	flag.StringVar(&dnsTsig, "tsig", "", "TSIG keys 'keyname:[algorithm:]base64' split by a comma ',' (hmac-md5 by default, other keys are managed through the API)")
+	flag.StringVar(&dnsPolicy, "policy", "", "Update policies of the TSIG keys 'grant keyname self|subdomain|wildcard|name name [types]' split by a semicolon ';', unsigned updates are then refused")
+	flag.BoolVar(&updSigned, "update_tsig", false, "Refuse dynamic updates which aren't signed by one of our TSIG keys")
+	flag.StringVar(&updAllow, "update_allow", "", "Networks (CIDR) allowed to send unsigned dynamic updates with -update_tsig split by a comma ','")
+	flag.BoolVar(&dnsDateSn, "serial_date", false, "Use YYYYMMDDnn SOA serials")
+	flag.StringVar(&dnsReverse, "reverse", "", "Prefixes (CIDR) split by a comma ',' for which PTR records are served")
+
+	flag.StringVar(&xfrAllow, "xfr_allow", "", "Networks (CIDR) allowed to transfer our zones split by a comma ','")
+	flag.StringVar(&xfrKeys, "xfr_keys", "", "TSIG key names allowed to transfer our zones split by a comma ','")
+
+	flag.StringVar(&xfrNotify, "notify", "", "Secondaries 'host[:port]' notified of our changes split by a comma ','")
+	flag.IntVar(&xfrJournal, "journal", 100, "Number of changes kept for incremental transfers (0 to disable IXFR)")
+
+	flag.StringVar(&fwdServers, "forward", "", "Upstream resolvers 'host[:port]' queried for names outside our zones split by a comma ','")
+	flag.StringVar(&fwdAllow, "forward_allow", "127.0.0.0/8,::1/128", "Networks (CIDR) allowed to use our upstream resolvers split by a comma ','")
+
+	flag.IntVar(&rrlRate, "rrl_rate", 0, "Identical UDP responses per second sent to a client prefix (0 to disable rate limiting)")
+	flag.IntVar(&rrlSlip, "rrl_slip", 2, "One out of rrl_slip rate limited responses is sent truncated (0 to drop them all)")
+	flag.StringVar(&rrlExempt, "rrl_exempt", "", "Networks (CIDR) exempted from rate limiting split by a comma ','")
+
+	flag.StringVar(&geoFile, "geo_file", "", "File of 'CIDR region' lines giving the regions of the clients for geo selections, reloaded when modified")
 
 	// Parse API flags
 	flag.StringVar(&apiListen, "api", ":1632", "RestAPI listening string ([ip]:port)")
@@ -81,8 +125,68 @@ func main() {
 	// Define LogLevel
 	addd.SetLoglevel(logLevel)
 
-	// Extract TSIG key:secret
-	dnsName, dnsSecret := ddns.ExtractTSIG(dnsTsig)
+	// Define SOA serial scheme
+	addd.UseDateSerial(dnsDateSn)
+
+	// Define changes journal size
+	addd.SetJournalSize(xfrJournal)
+
+	// Serialize our changes across the cluster
+	addd.UseClusterLock(isHa)
+
+	// Define reverse zones
+	if dnsReverse != "" {
+		if err = addd.SetReverse(strings.Split(dnsReverse, ",")); err != nil {
+			addd.Log.Critical("Couldn't parse reverse prefixes")
+			panic(err.Error())
+		}
+	}
+
+	// Define zone transfer ACL
+	if err = ddns.SetTransfer(strings.Split(xfrAllow, ","), strings.Split(xfrKeys, ",")); err != nil {
+		addd.Log.Critical("Couldn't parse transfer ACL")
+		panic(err.Error())
+	}
+
+	// Define EDNS0 UDP payload size
+	ddns.SetEdnsSize(dnsEdns)
+
+	// Define DNS-over-TLS
+	if dotCert != "" && dotKey != "" {
+		if err = ddns.SetDoT(dotPort, dotCert, dotKey); err != nil {
+			addd.Log.Critical("Couldn't load DoT certificate")
+			panic(err.Error())
+		}
+	}
+
+	// Define dynamic updates authentication
+	if err = ddns.SetUpdateAuth(updSigned, strings.Split(updAllow, ",")); err != nil {
+		addd.Log.Critical("Couldn't parse update ACL")
+		panic(err.Error())
+	}
+
+	// Define forwarding to upstream resolvers
+	if err = ddns.SetForward(strings.Split(fwdServers, ","), strings.Split(fwdAllow, ",")); err != nil {
+		addd.Log.Critical("Couldn't parse forward ACL")
+		panic(err.Error())
+	}
+
+	// Define response rate limiting
+	if err = ddns.SetRateLimit(rrlRate, rrlSlip, strings.Split(rrlExempt, ",")); err != nil {
+		addd.Log.Critical("Couldn't parse rate limiting")
+		panic(err.Error())
+	}
+
+	// Define the regions of the clients
+	if geoFile != "" {
+		if err = ddns.SetGeo(geoFile); err != nil {
+			addd.Log.Critical("Couldn't read the regions file")
+			panic(err.Error())
+		}
+	}
+
+	// Define secondaries to notify
+	ddns.SetNotify(strings.Split(xfrNotify, ","))
 
 	output, err = habolt.NewOutputStr(logLevel)
 	if err != nil {
@@ -129,7 +233,7 @@ func main() {
 	}
 
 	// Link DNS to DNS & API
-	if err = addd.NewDB(kvStore); err != nil {
+	if err = addd.NewDB(dbStore{kvStore}); err != nil {
 		panic(err.Error())
 	}
 	defer addd.CloseDB()
@@ -139,8 +243,81 @@ func main() {
 		panic(err.Error())
 	}
 
+	// Store our TSIG keys with their update policies
+	policies := make(map[string][]addd.Policy)
+	for _, rule := range strings.Split(dnsPolicy, ";") {
+		if strings.TrimSpace(rule) == "" {
+			continue
+		}
+		name, policy, err := addd.ParsePolicy(rule)
+		if err != nil {
+			addd.Log.Critical("Couldn't parse update policies")
+			panic(err.Error())
+		}
+		policies[name] = append(policies[name], *policy)
+	}
+	keys := make([]*addd.TsigKey, 0)
+	if dnsTsig != "" {
+		for _, spec := range strings.Split(dnsTsig, ",") {
+			key, err := addd.ParseTsigKey(spec)
+			if err != nil {
+				addd.Log.Critical("Couldn't parse TSIG keys")
+				panic(err.Error())
+			}
+			key.Policies = policies[key.Name]
+			delete(policies, key.Name)
+			keys = append(keys, key)
+		}
+	}
+	for name := range policies {
+		addd.Log.WarningF("Update policies of %v ignored, the key isn't given by -tsig", name)
+	}
+
+	// Create our startup zones, reverse ones share its name servers
+	defZone := addd.DefaultZone(dnsDomain)
+	zones := []*addd.Zone{defZone}
+	for _, name := range addd.ReverseZones() {
+		revZone := addd.DefaultZone(name)
+		revZone.NS, revZone.Mbox = defZone.NS, defZone.Mbox
+		zones = append(zones, revZone)
+	}
+
+	// Wait for our writes to be applied, once a leader is elected
+	if err = addd.WaitDB(30 * time.Second); err != nil {
+		addd.Log.Critical("Couldn't write in our KV store")
+		panic(err.Error())
+	}
+
+	// Our startup keys always replace the stored ones, so their secrets and policies are the ones of our flags
+	for _, key := range keys {
+		if old, err := addd.GetTsigKey(key.Name); err == nil && !reflect.DeepEqual(old, key) {
+			addd.Log.WarningF("TSIG key %v and its update policies replaced by the ones of -tsig and -policy", key.Name)
+		}
+		if err = addd.StoreTsigKey(key); err != nil {
+			addd.Log.Critical("Couldn't store TSIG keys")
+			panic(err.Error())
+		}
+	}
+
+	// Our startup zones are created by the node starting the cluster, the other ones get them once joined.
+	// Those already stored are kept as they may have been changed through the API.
+	if !isHa || haJoin == "" {
+		for _, zone := range zones {
+			if err = addd.InitZone(zone); err != nil {
+				addd.Log.CriticalF("Couldn't create zone %v", zone.Name)
+				panic(err.Error())
+			}
+		}
+	}
+
+	// Records stored by previous versions are migrated once our writes are applied and our zones exist
+	if err = addd.MigrateRecords(); err != nil {
+		addd.Log.Critical("Couldn't migrate our records")
+		panic(err.Error())
+	}
+
 	// Start DNS server
-	go ddns.Serve(dnsDomain, dnsName, dnsSecret, dnsPort)
+	go ddns.Serve(dnsPort)
 
 	// Start API server
 	go api.Serve(apiListen, apiToken, uiPath, strings.EqualFold(logLevel, "DEBUG"))
@@ -148,3 +325,21 @@ func main() {
 	// Wait SIGINT/SIGTERM
 	addd.WaitSig()
 }
+
+// dbStore adapts our habolt store to our DB
+type dbStore struct {
+	habolt.Store
+}
+
+// Addresses returns the addresses of the members of our cluster
+func (s dbStore) Addresses() ([]string, error) {
+	lst, err := s.Store.Addresses()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]string, 0, len(lst))
+	for _, addr := range lst {
+		result = append(result, addr.Address)
+	}
+	return result, nil
+}
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redsux/addd/core"
+)
+
+// change is one operation of a batch request :
+// "add" or "delete" a Record, "replace" or "delete" a whole RRSet
+type change struct {
+	Action string       `json:"action" binding:"required"`
+	Record *addd.Record `json:"record,omitempty"`
+	RRSet  *addd.RRSet  `json:"rrset,omitempty"`
+}
+
+// batchBody is the body of a batch request, its changes are committed all-or-nothing
+type batchBody struct {
+	Changes []change `json:"changes" binding:"required"`
+}
+
+func forBatch(router *gin.RouterGroup) {
+	router.POST("", newBatch)
+	router.POST("/", newBatch)
+}
+
+func newBatch(c *gin.Context) {
+	var err error
+	body := &batchBody{}
+
+	// Bind body
+	if err = c.BindJSON(body); err != nil {
+		return
+	}
+
+	batch := addd.NewBatch()
+	for _, chg := range body.Changes {
+		if err = stageChange(batch, &chg); err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			addd.Log.DebugF("[API] %v", err.Error())
+			return
+		}
+	}
+	if err = batch.Commit(); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		addd.Log.DebugF("[API] %v", err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "committed",
+		"changes": body.Changes,
+	})
+}
+
+// stageChange adds chg to batch
+func stageChange(batch *addd.Batch, chg *change) error {
+	switch {
+	case chg.Record != nil && chg.RRSet != nil:
+		return fmt.Errorf("Change can't hold both a record and an rrset")
+	case chg.Record != nil:
+		rec := chg.Record
+		if rec.Class == "" {
+			rec.Class = addd.DefaultRecord().Class
+		}
+		if rec.TTL == 0 {
+			rec.TTL = addd.DefaultRecord().TTL
+		}
+		switch chg.Action {
+		case "add":
+			return batch.StoreRecord(rec)
+		case "delete":
+			return batch.DeleteRecord(rec)
+		}
+	case chg.RRSet != nil:
+		switch chg.Action {
+		case "replace":
+			set := addd.NewRRSet(chg.RRSet.Name, chg.RRSet.Type)
+			if err := fillRRSet(set, chg.RRSet); err != nil {
+				return err
+			}
+			return batch.StoreRRSet(set)
+		case "delete":
+			return batch.DeleteRRSet(chg.RRSet.Name, chg.RRSet.Type)
+		}
+	default:
+		return fmt.Errorf("Change without record nor rrset")
+	}
+	return fmt.Errorf("Action %v not supported", chg.Action)
+}
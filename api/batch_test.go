@@ -0,0 +1,54 @@
+package api
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/redsux/addd/core"
+)
+
+func TestBatchRoute(t *testing.T) {
+	router := newRouter(t)
+	if code := request(t, router, "POST", "/records", `{"fqdn": "www.example.com", "address": "10.0.0.1"}`, nil); code != http.StatusOK {
+		t.Fatalf("POST /records = %v", code)
+	}
+	tests := []struct {
+		body string
+		code int
+		www  []string // addresses of www.example.com after the request
+	}{
+		{`{"changes": [
+			{"action": "add", "record": {"fqdn": "www.example.com", "type": "A", "address": "10.0.0.2"}},
+			{"action": "replace", "rrset": {"fqdn": "mail.example.com", "type": "A", "records": [{"address": "10.0.0.3"}]}}
+		]}`, http.StatusOK, []string{"10.0.0.1", "10.0.0.2"}},
+		// Nothing is committed if a change fails
+		{`{"changes": [
+			{"action": "delete", "record": {"fqdn": "www.example.com", "type": "A", "address": "10.0.0.1"}},
+			{"action": "add", "record": {"fqdn": "www.example.org", "type": "A", "address": "10.0.0.4"}}
+		]}`, http.StatusInternalServerError, []string{"10.0.0.1", "10.0.0.2"}},
+		{`{"changes": [
+			{"action": "delete", "record": {"fqdn": "www.example.com", "type": "A", "address": "10.0.0.1"}},
+			{"action": "delete", "record": {"fqdn": "www.example.com", "type": "A", "address": "10.0.0.9"}}
+		]}`, http.StatusInternalServerError, []string{"10.0.0.1", "10.0.0.2"}},
+		{`{"changes": [{"action": "replace", "record": {"fqdn": "www.example.com", "type": "A", "address": "10.0.0.5"}}]}`,
+			http.StatusBadRequest, []string{"10.0.0.1", "10.0.0.2"}},
+		{`{"changes": [{"action": "delete"}]}`, http.StatusBadRequest, []string{"10.0.0.1", "10.0.0.2"}},
+		{`{"changes": [{"action": "delete", "rrset": {"fqdn": "www.example.com", "type": "A"}}]}`, http.StatusOK, nil},
+	}
+	for _, tt := range tests {
+		if code := request(t, router, "POST", "/batch", tt.body, nil); code != tt.code {
+			t.Errorf("POST /batch %s = %v, want %v", tt.body, code, tt.code)
+		}
+		set, err := addd.GetRRSet("www.example.com", "A")
+		switch {
+		case tt.www == nil && err == nil:
+			t.Errorf("after %s, RRSet %v kept", tt.body, addresses(set))
+		case tt.www != nil && (err != nil || !reflect.DeepEqual(addresses(set), tt.www)):
+			t.Errorf("after %s, RRSet = %v, want %v", tt.body, set, tt.www)
+		}
+	}
+	if set, err := addd.GetRRSet("mail.example.com", "A"); err != nil || !reflect.DeepEqual(addresses(set), []string{"10.0.0.3"}) {
+		t.Errorf("mail.example.com = %v, %v", set, err)
+	}
+}
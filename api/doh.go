@@ -0,0 +1,205 @@
+package api
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/miekg/dns"
+	"github.com/redsux/addd/core"
+	"github.com/redsux/addd/ddns"
+)
+
+const (
+	dnsMessage = "application/dns-message"
+	dnsJSON    = "application/dns-json"
+)
+
+// jsonQuestion and jsonRR are the question and records of the JSON DNS answers
+type jsonQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+type jsonRR struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+// jsonMsg is a DNS answer in the JSON format of the public DoH resolvers
+type jsonMsg struct {
+	Status     int            `json:"Status"`
+	TC         bool           `json:"TC"`
+	RD         bool           `json:"RD"`
+	RA         bool           `json:"RA"`
+	AD         bool           `json:"AD"`
+	CD         bool           `json:"CD"`
+	Question   []jsonQuestion `json:"Question"`
+	Answer     []jsonRR       `json:"Answer,omitempty"`
+	Authority  []jsonRR       `json:"Authority,omitempty"`
+	Additional []jsonRR       `json:"Additional,omitempty"`
+}
+
+// registerDoH serves DNS over HTTPS (RFC 8484) and its JSON variant, without authentication
+func registerDoH(router *gin.RouterGroup) {
+	router.GET("", getDNSQuery)
+	router.POST("", postDNSQuery)
+}
+
+func getDNSQuery(c *gin.Context) {
+	if c.Query("name") != "" || strings.Contains(c.GetHeader("Accept"), dnsJSON) || c.Query("ct") == dnsJSON {
+		jsonDNSQuery(c)
+		return
+	}
+	param := strings.TrimRight(c.Query("dns"), "=")
+	req, err := base64.RawURLEncoding.DecodeString(param)
+	if err != nil || param == "" {
+		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("Invalid dns parameter"))
+		return
+	}
+	wireDNSQuery(c, req)
+}
+
+func postDNSQuery(c *gin.Context) {
+	if ct := c.ContentType(); ct != dnsMessage {
+		c.AbortWithError(http.StatusUnsupportedMediaType, fmt.Errorf("Content type %v not supported", ct))
+		return
+	}
+	req, err := ioutil.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, dns.MaxMsgSize))
+	if err != nil {
+		c.AbortWithError(http.StatusRequestEntityTooLarge, err)
+		return
+	}
+	wireDNSQuery(c, req)
+}
+
+// wireDNSQuery answers the DNS message req in the wire format
+func wireDNSQuery(c *gin.Context, req []byte) {
+	reply, err := ddns.HandleMsg(req, remoteIP(c))
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		addd.Log.DebugF("[API] %v", err.Error())
+		return
+	}
+	m := new(dns.Msg)
+	if err = m.Unpack(reply); err == nil {
+		c.Header("Cache-Control", fmt.Sprintf("max-age=%d", maxAge(m)))
+	}
+	c.Data(http.StatusOK, dnsMessage, reply)
+}
+
+// jsonDNSQuery answers the query made of the parameters name, type (A by default), do and cd
+func jsonDNSQuery(c *gin.Context) {
+	name := c.Query("name")
+	if _, ok := dns.IsDomainName(name); !ok || name == "" {
+		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("Invalid name %v", name))
+		return
+	}
+	qtype := uint16(dns.TypeA)
+	if t := c.Query("type"); t != "" {
+		if n, err := strconv.ParseUint(t, 10, 16); err == nil {
+			qtype = uint16(n)
+		} else if n, ok := dns.StringToType[strings.ToUpper(t)]; ok {
+			qtype = n
+		} else {
+			c.AbortWithError(http.StatusBadRequest, fmt.Errorf("Invalid type %v", t))
+			return
+		}
+	}
+
+	r := new(dns.Msg)
+	r.SetQuestion(dns.Fqdn(name), qtype)
+	r.CheckingDisabled = flag(c.Query("cd"))
+	r.SetEdns0(dns.MaxMsgSize, flag(c.Query("do")))
+	req, err := r.Pack()
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	reply, err := ddns.HandleMsg(req, remoteIP(c))
+	m := new(dns.Msg)
+	if err == nil {
+		err = m.Unpack(reply)
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		addd.Log.DebugF("[API] %v", err.Error())
+		return
+	}
+
+	body := &jsonMsg{
+		Status:     m.Rcode,
+		TC:         m.Truncated,
+		RD:         m.RecursionDesired,
+		RA:         m.RecursionAvailable,
+		AD:         m.AuthenticatedData,
+		CD:         m.CheckingDisabled,
+		Answer:     jsonRRs(m.Answer),
+		Authority:  jsonRRs(m.Ns),
+		Additional: jsonRRs(m.Extra),
+	}
+	for _, q := range m.Question {
+		body.Question = append(body.Question, jsonQuestion{Name: q.Name, Type: q.Qtype})
+	}
+	c.Header("Cache-Control", fmt.Sprintf("max-age=%d", maxAge(m)))
+	c.Header("Content-Type", dnsJSON)
+	c.JSON(http.StatusOK, body)
+}
+
+// jsonRRs converts rrs to the JSON format, without the OPT record
+func jsonRRs(rrs []dns.RR) []jsonRR {
+	lst := make([]jsonRR, 0, len(rrs))
+	for _, rr := range rrs {
+		header := rr.Header()
+		if header.Rrtype == dns.TypeOPT {
+			continue
+		}
+		lst = append(lst, jsonRR{
+			Name: header.Name,
+			Type: header.Rrtype,
+			TTL:  header.Ttl,
+			Data: strings.TrimPrefix(rr.String(), header.String()),
+		})
+	}
+	return lst
+}
+
+// maxAge returns how long m may be cached : its lowest TTL (RFC 8484, 5.1),
+// or its SOA minimum if it is negative (RFC 2308, 5)
+func maxAge(m *dns.Msg) uint32 {
+	age, found := uint32(0), false
+	for _, section := range [][]dns.RR{m.Answer, m.Ns} {
+		for _, rr := range section {
+			ttl := rr.Header().Ttl
+			if soa, ok := rr.(*dns.SOA); ok && len(m.Answer) == 0 && soa.Minttl < ttl {
+				ttl = soa.Minttl
+			}
+			if !found || ttl < age {
+				age, found = ttl, true
+			}
+		}
+	}
+	return age
+}
+
+// flag returns true for the parameters set to 1 or true
+func flag(param string) bool {
+	return param == "1" || strings.EqualFold(param, "true")
+}
+
+// remoteIP returns the address of the connection, forwarded headers aren't trusted
+// since views and rate limiting are chosen by the client's address
+func remoteIP(c *gin.Context) net.IP {
+	host, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+	if err != nil {
+		host = c.Request.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
@@ -0,0 +1,159 @@
+package api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/miekg/dns"
+	"github.com/redsux/addd/core"
+	"github.com/redsux/addd/core/dbtest"
+)
+
+// newDoHRouter opens an in-memory DB holding the zone example.com and returns our DoH routes
+func newDoHRouter(t *testing.T) http.Handler {
+	if err := addd.NewDB(dbtest.NewStore()); err != nil {
+		t.Fatal(err)
+	}
+	if err := addd.StoreZone(addd.DefaultZone("example.com")); err != nil {
+		t.Fatal(err)
+	}
+	rec := addd.DefaultRecord()
+	rec.Name, rec.Type, rec.Address, rec.TTL = "www.example.com", "A", "10.0.0.1", 300
+	if err := addd.StoreRecord(rec); err != nil {
+		t.Fatal(err)
+	}
+	router := gin.New()
+	registerDoH(router.Group("/dns-query"))
+	return router
+}
+
+// query packs a query of qname
+func query(t *testing.T, qname string, qtype uint16) []byte {
+	r := new(dns.Msg)
+	r.SetQuestion(qname, qtype)
+	req, err := r.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+// dohReply returns the code and the DNS message replied by router to req, without authentication
+func dohReply(t *testing.T, router http.Handler, req *http.Request) (int, *dns.Msg, http.Header) {
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		return w.Code, nil, w.Header()
+	}
+	if ct := w.Header().Get("Content-Type"); ct != dnsMessage {
+		t.Fatalf("Content-Type = %v", ct)
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(w.Body.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	return w.Code, m, w.Header()
+}
+
+func TestDoH(t *testing.T) {
+	router := newDoHRouter(t)
+	req := query(t, "www.example.com.", dns.TypeA)
+
+	tests := []*http.Request{
+		httptest.NewRequest("GET", "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(req), nil),
+		httptest.NewRequest("GET", "/dns-query?dns="+base64.URLEncoding.EncodeToString(req), nil),
+		httptest.NewRequest("POST", "/dns-query", bytes.NewReader(req)),
+	}
+	tests[2].Header.Set("Content-Type", dnsMessage)
+	for _, r := range tests {
+		code, m, header := dohReply(t, router, r)
+		if code != http.StatusOK || m.Rcode != dns.RcodeSuccess || len(m.Answer) != 1 {
+			t.Errorf("%s %s = %v %v", r.Method, r.URL, code, m)
+			continue
+		}
+		if cc := header.Get("Cache-Control"); cc != "max-age=300" {
+			t.Errorf("%s %s Cache-Control = %v", r.Method, r.URL, cc)
+		}
+	}
+
+	invalid := []struct {
+		req  *http.Request
+		code int
+	}{
+		{httptest.NewRequest("GET", "/dns-query", nil), http.StatusBadRequest},
+		{httptest.NewRequest("GET", "/dns-query?dns=%25%25", nil), http.StatusBadRequest},
+		{httptest.NewRequest("GET", "/dns-query?dns=AAAA", nil), http.StatusBadRequest},
+		{httptest.NewRequest("POST", "/dns-query", bytes.NewReader(req)), http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range invalid {
+		if code, _, _ := dohReply(t, router, tt.req); code != tt.code {
+			t.Errorf("%s %s = %v, want %v", tt.req.Method, tt.req.URL, code, tt.code)
+		}
+	}
+
+	// Zone transfers aren't served over HTTP
+	r := httptest.NewRequest("GET", "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(query(t, "example.com.", dns.TypeAXFR)), nil)
+	if code, m, _ := dohReply(t, router, r); code != http.StatusOK || m.Rcode != dns.RcodeRefused {
+		t.Errorf("AXFR = %v %v", code, m)
+	}
+}
+
+func TestDoHJSON(t *testing.T) {
+	router := newDoHRouter(t)
+	tests := []struct {
+		path   string
+		code   int
+		status int
+		answer []jsonRR
+	}{
+		{"/dns-query?name=www.example.com", http.StatusOK, dns.RcodeSuccess, []jsonRR{{"www.example.com.", dns.TypeA, 300, "10.0.0.1"}}},
+		{"/dns-query?name=www.example.com&type=a", http.StatusOK, dns.RcodeSuccess, []jsonRR{{"www.example.com.", dns.TypeA, 300, "10.0.0.1"}}},
+		{"/dns-query?name=www.example.com&type=28", http.StatusOK, dns.RcodeSuccess, nil},
+		{"/dns-query?name=none.example.com", http.StatusOK, dns.RcodeNameError, nil},
+		{"/dns-query?name=www.example.com&type=none", http.StatusBadRequest, 0, nil},
+		{"/dns-query?name=host..example.com", http.StatusBadRequest, 0, nil},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+		if w.Code != tt.code {
+			t.Errorf("GET %s = %v, want %v", tt.path, w.Code, tt.code)
+			continue
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		if ct := w.Header().Get("Content-Type"); ct != dnsJSON {
+			t.Errorf("GET %s Content-Type = %v", tt.path, ct)
+		}
+		body := &jsonMsg{}
+		if err := json.Unmarshal(w.Body.Bytes(), body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Status != tt.status || len(body.Question) != 1 || len(body.Answer) != len(tt.answer) {
+			t.Errorf("GET %s = %+v", tt.path, body)
+			continue
+		}
+		for i, rr := range tt.answer {
+			if body.Answer[i] != rr {
+				t.Errorf("GET %s answered %+v, want %+v", tt.path, body.Answer[i], rr)
+			}
+		}
+	}
+}
+
+func TestDoHRemoteIP(t *testing.T) {
+	r := httptest.NewRequest("GET", "/dns-query", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Set("X-Forwarded-For", "10.0.0.1")
+	c := &gin.Context{Request: r}
+	if ip := remoteIP(c); !ip.Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Errorf("remoteIP() = %v, want the address of the connection", ip)
+	}
+}
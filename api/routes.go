@@ -1,11 +1,15 @@
 package api
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/redsux/addd/core"
+	"github.com/redsux/addd/ddns"
 )
 
 func registerRoutes(apigroup *gin.RouterGroup) {
@@ -20,9 +24,31 @@ func registerRoutes(apigroup *gin.RouterGroup) {
 			wtype := record.Group("/:type")
 			{
 				forOne(wtype)
+				forSelection(wtype.Group("/selection"))
 			}
 		}
 	}
+	zones := apigroup.Group("/zones")
+	{
+		forZones(zones)
+	}
+	tsig := apigroup.Group("/tsig")
+	{
+		forTsig(tsig)
+	}
+	views := apigroup.Group("/views")
+	{
+		forViews(views)
+	}
+	batch := apigroup.Group("/batch")
+	{
+		forBatch(batch)
+	}
+	rrl := apigroup.Group("/rrl")
+	{
+		rrl.GET("", getRateLimit)
+		rrl.GET("/", getRateLimit)
+	}
 	members := apigroup.Group("/members")
 	{
 		members.Use(authRequired())
@@ -43,6 +69,13 @@ func getMembers(c *gin.Context) {
 	})
 }
 
+// getRateLimit returns the counters of the response rate limiting, for monitoring
+func getRateLimit(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"rrl": ddns.RateLimitCounters(),
+	})
+}
+
 func forAll(router *gin.RouterGroup) {
 	router.GET("", allRecords)
 	router.GET("/", allRecords)
@@ -83,8 +116,8 @@ func newRecord(c *gin.Context) {
 		return
 	}
 
-	// Not existing
-	if _, err = addd.GetRecord(newRec.Name, newRec.Type); err != nil {
+	// Not existing in its RRSet
+	if set, gerr := addd.GetRRSet(newRec.Name, newRec.Type); gerr != nil || set.Find(newRec) < 0 {
 		if err = addd.StoreRecord(newRec); err == nil {
 			c.JSON(http.StatusOK, gin.H{
 				"status": "created",
@@ -100,49 +133,76 @@ func newRecord(c *gin.Context) {
 }
 
 func getRecord(c *gin.Context) {
-	rec := c.MustGet("record").(*addd.Record)
-	c.JSON(http.StatusOK, rec)
+	set := c.MustGet("rrset").(*addd.RRSet)
+	c.JSON(http.StatusOK, set)
 }
 
 func updRecord(c *gin.Context) {
-	var err error
-	rec := c.MustGet("record").(*addd.Record)
-	newRec := &addd.Record{
-		Type:  rec.Type,
-		Class: rec.Class,
-		TTL:   rec.TTL,
-	}
+	set := c.MustGet("rrset").(*addd.RRSet)
+	body := &addd.RRSet{}
 
-	// Bind body
-	if err = c.BindJSON(newRec); err != nil {
+	// Bind body, a single record (the body before RRSets) replaces the RRSet by itself
+	data, err := c.GetRawData()
+	if err == nil {
+		err = json.Unmarshal(data, body)
+	}
+	if err == nil && body.Records == nil {
+		rec := addd.DefaultRecord()
+		if err = json.Unmarshal(data, rec); err == nil {
+			body.Records = []addd.Record{*rec}
+		}
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
 		return
 	}
 
-	if rec.Name == newRec.Name && rec.Type == newRec.Type {
-		// Delete existing
-		if err = addd.DeleteRecord(rec); err == nil {
-			// Save new
-			if err = addd.StoreRecord(newRec); err == nil {
-				c.JSON(http.StatusOK, gin.H{
-					"status":     "updated",
-					"old-record": rec,
-					"new-record": newRec,
-				})
-				return
-			}
+	newSet := addd.NewRRSet(set.Name, set.Type)
+	if err = fillRRSet(newSet, body); err == nil {
+		if err = addd.StoreRRSet(newSet); err == nil {
+			c.JSON(http.StatusOK, gin.H{
+				"status":    "updated",
+				"old-rrset": set,
+				"new-rrset": newSet,
+			})
+			return
 		}
-	} else {
-		err = fmt.Errorf("Body doesn't suit URI path")
 	}
 	c.AbortWithError(http.StatusInternalServerError, err)
 	addd.Log.DebugF("[API] %v", err.Error())
 }
 
 func delRecord(c *gin.Context) {
-	rec := c.MustGet("record").(*addd.Record)
+	set := c.MustGet("rrset").(*addd.RRSet)
 
-	if err := addd.DeleteRecord(rec); err != nil {
-		c.AbortWithError(http.StatusInternalServerError, err)
+	data, err := c.GetRawData()
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	// Without body the whole RRSet is deleted, else only the given member
+	if len(bytes.TrimSpace(data)) == 0 {
+		if err = addd.DeleteRRSet(set.Name, set.Type); err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"status": "deleted",
+			"rrset":  set,
+		})
+		return
+	}
+
+	rec := addd.DefaultRecord()
+	if err = json.Unmarshal(data, rec); err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	rec.Name, rec.Type = set.Name, set.Type
+	if err = addd.DeleteRecord(rec); err != nil {
+		c.AbortWithError(http.StatusNotFound, err)
+		addd.Log.DebugF("[API] %v", err.Error())
 		return
 	}
 
@@ -152,6 +212,91 @@ func delRecord(c *gin.Context) {
 	})
 }
 
+func forSelection(router *gin.RouterGroup) {
+	router.GET("", getSelection)
+	router.PUT("", updSelection)
+	router.DELETE("", delSelection)
+}
+
+func getSelection(c *gin.Context) {
+	set := c.MustGet("rrset").(*addd.RRSet)
+	sel, err := addd.GetSelection(set.Name, set.Type)
+	if err != nil {
+		c.AbortWithError(http.StatusNotFound, err)
+		addd.Log.DebugF("[API] %v", err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, sel)
+}
+
+// updSelection creates or replaces how the records of the RRSet are selected in answers
+func updSelection(c *gin.Context) {
+	var err error
+	set := c.MustGet("rrset").(*addd.RRSet)
+	sel := &addd.Selection{}
+
+	// Bind body
+	if err = c.BindJSON(sel); err != nil {
+		return
+	}
+
+	if (sel.Name != "" && addd.NewRRSet(sel.Name, sel.Type).Name != set.Name) ||
+		(sel.Type != "" && !strings.EqualFold(sel.Type, set.Type)) {
+		err = fmt.Errorf("Body doesn't suit URI path")
+	} else {
+		sel.Name, sel.Type = set.Name, set.Type
+		if err = addd.StoreSelection(sel); err == nil {
+			c.JSON(http.StatusOK, gin.H{
+				"status":    "updated",
+				"selection": sel,
+			})
+			return
+		}
+	}
+	c.AbortWithError(http.StatusInternalServerError, err)
+	addd.Log.DebugF("[API] %v", err.Error())
+}
+
+func delSelection(c *gin.Context) {
+	set := c.MustGet("rrset").(*addd.RRSet)
+
+	if err := addd.DeleteSelection(set.Name, set.Type); err != nil {
+		c.AbortWithError(http.StatusNotFound, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": "deleted",
+		"rrset":  set,
+	})
+}
+
+// fillRRSet adds all body's records in set, checking they suit the URI path
+func fillRRSet(set, body *addd.RRSet) error {
+	if (body.Name != "" && addd.NewRRSet(body.Name, body.Type).Name != set.Name) ||
+		(body.Type != "" && !strings.EqualFold(body.Type, set.Type)) {
+		return fmt.Errorf("Body doesn't suit URI path")
+	}
+	for _, rec := range body.Records {
+		if rec.Name == "" {
+			rec.Name = set.Name
+		}
+		if rec.Type == "" {
+			rec.Type = set.Type
+		}
+		if rec.Class == "" {
+			rec.Class = addd.DefaultRecord().Class
+		}
+		if rec.TTL == 0 {
+			rec.TTL = addd.DefaultRecord().TTL
+		}
+		if addd.NewRRSet(rec.Name, rec.Type).Name != set.Name || !strings.EqualFold(rec.Type, set.Type) {
+			return fmt.Errorf("Record %v doesn't suit URI path", rec)
+		}
+		set.Add(&rec)
+	}
+	return nil
+}
+
 func parseParams(c *gin.Context) {
 	name := c.Param("name")
 	rtype := c.Param("type")
@@ -159,13 +304,13 @@ func parseParams(c *gin.Context) {
 		rtype = "A"
 	}
 
-	rec, err := addd.GetRecord(name, rtype)
+	set, err := addd.GetRRSet(name, rtype)
 	if err != nil {
 		c.AbortWithError(http.StatusNotFound, err)
 		addd.Log.DebugF("[API] %v", err.Error())
 		return
 	}
 
-	c.Set("record", rec)
+	c.Set("rrset", set)
 	c.Next()
 }
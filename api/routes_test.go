@@ -0,0 +1,151 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redsux/addd/core"
+	"github.com/redsux/addd/core/dbtest"
+	"github.com/redsux/addd/ddns"
+)
+
+// newRouter opens an in-memory DB holding the zone example.com and returns our routes
+func newRouter(t *testing.T) http.Handler {
+	if err := addd.NewDB(dbtest.NewStore()); err != nil {
+		t.Fatal(err)
+	}
+	if err := addd.StoreZone(addd.DefaultZone("example.com")); err != nil {
+		t.Fatal(err)
+	}
+	router := gin.New()
+	registerRoutes(router.Group("/"))
+	return router
+}
+
+// request sends the body (none if empty) to router, the JSON replied is decoded in reply
+func request(t *testing.T, router http.Handler, method, path, body string, reply interface{}) int {
+	var reader io.Reader
+	if body != "" {
+		// Without Content-Length, as a chunked body
+		reader = ioutil.NopCloser(strings.NewReader(body))
+	}
+	req := httptest.NewRequest(method, path, reader)
+	req.Header.Set("X-AUTH-TOKEN", secret)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if reply != nil && w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), reply); err != nil {
+			t.Fatalf("%s %s replied %q: %v", method, path, w.Body.String(), err)
+		}
+	}
+	return w.Code
+}
+
+// addresses returns the sorted addresses of the records of set
+func addresses(set *addd.RRSet) []string {
+	lst := make([]string, 0, len(set.Records))
+	for _, rec := range set.Records {
+		lst = append(lst, rec.Address)
+	}
+	sort.Strings(lst)
+	return lst
+}
+
+func TestRecordRoutes(t *testing.T) {
+	router := newRouter(t)
+	for _, body := range []string{
+		`{"fqdn": "www.example.com", "address": "10.0.0.1"}`,
+		`{"fqdn": "www.example.com", "address": "10.0.0.2"}`,
+	} {
+		if code := request(t, router, "POST", "/records", body, nil); code != http.StatusOK {
+			t.Fatalf("POST %s = %v", body, code)
+		}
+	}
+	tests := []struct {
+		method, body string
+		code         int
+		want         []string // addresses of the RRSet after the request, nil if deleted
+	}{
+		{"GET", "", http.StatusOK, []string{"10.0.0.1", "10.0.0.2"}},
+		{"PUT", `{"records": [{"address": "10.0.0.3"}, {"address": "10.0.0.4"}]}`, http.StatusOK, []string{"10.0.0.3", "10.0.0.4"}},
+		{"PUT", `{"fqdn": "mail.example.com", "records": [{"address": "10.0.0.5"}]}`, http.StatusInternalServerError, []string{"10.0.0.3", "10.0.0.4"}},
+		{"PUT", `{"records": [`, http.StatusBadRequest, []string{"10.0.0.3", "10.0.0.4"}},
+		// A single record as before RRSets
+		{"PUT", `{"fqdn": "www.example.com", "address": "10.0.0.5", "TTL": 60}`, http.StatusOK, []string{"10.0.0.5"}},
+		{"PUT", `{"records": [{"address": "10.0.0.1"}, {"address": "10.0.0.2"}]}`, http.StatusOK, []string{"10.0.0.1", "10.0.0.2"}},
+		{"DELETE", `{"address": "10.0.0.9"}`, http.StatusNotFound, []string{"10.0.0.1", "10.0.0.2"}},
+		// A body without Content-Length only deletes its record
+		{"DELETE", `{"address": "10.0.0.1"}`, http.StatusOK, []string{"10.0.0.2"}},
+		{"DELETE", "", http.StatusOK, nil},
+	}
+	for _, tt := range tests {
+		set := &addd.RRSet{}
+		if code := request(t, router, tt.method, "/records/www.example.com/A", tt.body, set); code != tt.code {
+			t.Errorf("%s %s = %v, want %v", tt.method, tt.body, code, tt.code)
+		}
+		stored, err := addd.GetRRSet("www.example.com", "A")
+		switch {
+		case tt.want == nil && err == nil:
+			t.Errorf("after %s %s, RRSet %v kept", tt.method, tt.body, addresses(stored))
+		case tt.want != nil && err != nil:
+			t.Errorf("after %s %s, RRSet deleted", tt.method, tt.body)
+		case tt.want != nil && !reflect.DeepEqual(addresses(stored), tt.want):
+			t.Errorf("after %s %s, RRSet = %v, want %v", tt.method, tt.body, addresses(stored), tt.want)
+		}
+		if tt.method == "GET" && !reflect.DeepEqual(addresses(set), tt.want) {
+			t.Errorf("GET = %v, want %v", addresses(set), tt.want)
+		}
+	}
+}
+
+func TestRateLimitRoute(t *testing.T) {
+	router := newRouter(t)
+	var reply struct {
+		RRL ddns.RRLCounters `json:"rrl"`
+	}
+	if code := request(t, router, "GET", "/rrl", "", &reply); code != http.StatusOK || reply.RRL != ddns.RateLimitCounters() {
+		t.Errorf("GET /rrl = %v, %+v", code, reply.RRL)
+	}
+}
+
+func TestSelectionRoutes(t *testing.T) {
+	router := newRouter(t)
+	if code := request(t, router, "POST", "/records", `{"fqdn": "www.example.com", "address": "10.0.0.1"}`, nil); code != http.StatusOK {
+		t.Fatalf("POST = %v", code)
+	}
+	tests := []struct {
+		method, path, body string
+		code               int
+	}{
+		{"GET", "/records/www.example.com/A/selection", "", http.StatusNotFound},
+		{"PUT", "/records/www.example.com/A/selection", `{"mode": "failover", "order": ["10.0.0.1"]}`, http.StatusOK},
+		{"PUT", "/records/www.example.com/A/selection", `{"mode": "random"}`, http.StatusInternalServerError},
+		{"PUT", "/records/www.example.com/A/selection", `{"fqdn": "mail.example.com", "mode": "geo"}`, http.StatusInternalServerError},
+		{"PUT", "/records/www.example.com/A/selection", `{"order": ["10.0.0.1"]}`, http.StatusBadRequest},
+		{"PUT", "/records/mail.example.com/A/selection", `{"mode": "failover"}`, http.StatusNotFound},
+		{"GET", "/records/www.example.com/A/selection", "", http.StatusOK},
+		{"DELETE", "/records/www.example.com/A/selection", "", http.StatusOK},
+		{"DELETE", "/records/www.example.com/A/selection", "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if code := request(t, router, tt.method, tt.path, tt.body, nil); code != tt.code {
+			t.Errorf("%s %s %s = %v, want %v", tt.method, tt.path, tt.body, code, tt.code)
+		}
+	}
+	if code := request(t, router, "PUT", "/records/www.example.com/A/selection", `{"mode": "Weighted", "weights": {"10.0.0.1": 2}}`, nil); code != http.StatusOK {
+		t.Fatalf("PUT = %v", code)
+	}
+	sel := &addd.Selection{}
+	want := &addd.Selection{Name: "www.example.com", Type: "A", Mode: addd.SelectWeighted, Weights: map[string]int{"10.0.0.1": 2}}
+	if code := request(t, router, "GET", "/records/www.example.com/A/selection", "", sel); code != http.StatusOK || !reflect.DeepEqual(sel, want) {
+		t.Errorf("GET = %v %+v, want %+v", code, sel, want)
+	}
+}
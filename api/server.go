@@ -33,6 +33,7 @@ func Serve(listen, auth, uipath string, debug ...bool) {
 		}
 	}
 	registerStatic(uipath, engine.Group("/ui"))
+	registerDoH(engine.Group("/dns-query"))
 	registerRoutes(engine.Group("/"))
 
 	if err := engine.Run(listen); err != nil {
@@ -0,0 +1,130 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redsux/addd/core"
+)
+
+func forTsig(router *gin.RouterGroup) {
+	router.GET("", allTsigKeys)
+	router.GET("/", allTsigKeys)
+
+	router.POST("", newTsigKey)
+	router.POST("/", newTsigKey)
+
+	key := router.Group("/:key")
+	{
+		key.Use(parseTsigKey)
+
+		key.GET("", getTsigKey)
+		key.GET("/", getTsigKey)
+
+		key.PUT("", updTsigKey)
+		key.PUT("/", updTsigKey)
+
+		key.DELETE("", delTsigKey)
+		key.DELETE("/", delTsigKey)
+	}
+}
+
+// Secrets are never sent back
+func allTsigKeys(c *gin.Context) {
+	lst, err := addd.ListTsigKeys()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		addd.Log.DebugF("[API] %v", err.Error())
+		return
+	}
+	for i := range lst {
+		lst[i].Secret = ""
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"keys": lst,
+	})
+}
+
+func newTsigKey(c *gin.Context) {
+	var err error
+	key := &addd.TsigKey{}
+
+	// Bind body
+	if err = c.BindJSON(key); err != nil {
+		return
+	}
+
+	// Not existing
+	if _, err = addd.GetTsigKey(key.Name); err != nil {
+		if err = addd.StoreTsigKey(key); err == nil {
+			c.JSON(http.StatusOK, gin.H{
+				"status": "created",
+				"key":    key.Name,
+			})
+			return
+		}
+	} else {
+		err = fmt.Errorf("TSIG key already exist")
+	}
+	c.AbortWithError(http.StatusInternalServerError, err)
+	addd.Log.DebugF("[API] %v", err.Error())
+}
+
+func getTsigKey(c *gin.Context) {
+	key := *c.MustGet("key").(*addd.TsigKey)
+	key.Secret = ""
+	c.JSON(http.StatusOK, key)
+}
+
+func updTsigKey(c *gin.Context) {
+	var err error
+	key := c.MustGet("key").(*addd.TsigKey)
+	newKey := *key
+
+	// Bind body
+	if err = c.BindJSON(&newKey); err != nil {
+		return
+	}
+
+	if err = newKey.Validate(); err == nil && newKey.Name != key.Name {
+		err = fmt.Errorf("Body doesn't suit URI path")
+	}
+	if err == nil {
+		if err = addd.StoreTsigKey(&newKey); err == nil {
+			c.JSON(http.StatusOK, gin.H{
+				"status": "updated",
+				"key":    newKey.Name,
+			})
+			return
+		}
+	}
+	c.AbortWithError(http.StatusInternalServerError, err)
+	addd.Log.DebugF("[API] %v", err.Error())
+}
+
+func delTsigKey(c *gin.Context) {
+	key := c.MustGet("key").(*addd.TsigKey)
+
+	if err := addd.DeleteTsigKey(key.Name); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "deleted",
+		"key":    key.Name,
+	})
+}
+
+func parseTsigKey(c *gin.Context) {
+	key, err := addd.GetTsigKey(c.Param("key"))
+	if err != nil {
+		c.AbortWithError(http.StatusNotFound, err)
+		addd.Log.DebugF("[API] %v", err.Error())
+		return
+	}
+
+	c.Set("key", key)
+	c.Next()
+}
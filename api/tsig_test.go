@@ -0,0 +1,48 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/redsux/addd/core"
+)
+
+func TestTsigRoutes(t *testing.T) {
+	router := newRouter(t)
+	tests := []struct {
+		method, path, body string
+		code               int
+	}{
+		{"POST", "/tsig", `{"key": "xfr.example.com", "secret": "c2VjcmV0"}`, http.StatusOK},
+		{"POST", "/tsig", `{"key": "xfr.example.com.", "secret": "c2VjcmV0"}`, http.StatusInternalServerError},
+		{"POST", "/tsig", `{"key": "other.example.com", "secret": "not base64"}`, http.StatusInternalServerError},
+		{"POST", "/tsig", `{"key": "other.example.com", "algorithm": "hmac-sha1", "secret": "c2VjcmV0"}`, http.StatusOK},
+		{"GET", "/tsig/Xfr.Example.com.", "", http.StatusOK},
+		{"GET", "/tsig/none.example.com", "", http.StatusNotFound},
+		{"PUT", "/tsig/xfr.example.com", `{"algorithm": "hmac-sha512", "secret": "bmV3"}`, http.StatusOK},
+		{"PUT", "/tsig/xfr.example.com", `{"key": "other.example.com"}`, http.StatusInternalServerError},
+		{"DELETE", "/tsig/other.example.com", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		if code := request(t, router, tt.method, tt.path, tt.body, nil); code != tt.code {
+			t.Errorf("%s %s %s = %v, want %v", tt.method, tt.path, tt.body, code, tt.code)
+		}
+	}
+	if keys, err := addd.ListTsigKeys(); err != nil || len(keys) != 1 || keys[0].Secret != "bmV3" {
+		t.Errorf("ListTsigKeys() = %v, %v", keys, err)
+	}
+
+	// Secrets are never sent back
+	key := &addd.TsigKey{}
+	if code := request(t, router, "GET", "/tsig/xfr.example.com", "", key); code != http.StatusOK ||
+		key.Secret != "" || !strings.HasPrefix(key.Algorithm, "hmac-sha512") {
+		t.Errorf("GET = %v %+v", code, key)
+	}
+	var lst struct {
+		Keys []addd.TsigKey `json:"keys"`
+	}
+	if code := request(t, router, "GET", "/tsig", "", &lst); code != http.StatusOK || len(lst.Keys) != 1 || lst.Keys[0].Secret != "" {
+		t.Errorf("GET /tsig = %v %+v", code, lst.Keys)
+	}
+}
@@ -0,0 +1,244 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redsux/addd/core"
+)
+
+func forViews(router *gin.RouterGroup) {
+	router.GET("", allViews)
+	router.GET("/", allViews)
+
+	router.POST("", newView)
+	router.POST("/", newView)
+
+	view := router.Group("/:view")
+	{
+		view.Use(parseView)
+
+		view.GET("", getView)
+		view.GET("/", getView)
+
+		view.PUT("", updView)
+		view.PUT("/", updView)
+
+		view.DELETE("", delView)
+		view.DELETE("/", delView)
+
+		view.GET("/records", allViewRecords)
+		view.POST("/records", newViewRecord)
+
+		set := view.Group("/records/:name/:type")
+		{
+			set.Use(parseViewRRSet)
+
+			set.GET("", getRecord)
+			set.PUT("", updViewRRSet)
+			set.DELETE("", delViewRRSet)
+		}
+	}
+}
+
+func allViews(c *gin.Context) {
+	lst, err := addd.ListViews()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		addd.Log.DebugF("[API] %v", err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"views": lst,
+	})
+}
+
+func newView(c *gin.Context) {
+	var err error
+	view := &addd.View{}
+
+	// Bind body
+	if err = c.BindJSON(view); err != nil {
+		return
+	}
+
+	// Not existing
+	if _, err = addd.GetView(view.Name); err != nil {
+		if err = addd.StoreView(view); err == nil {
+			c.JSON(http.StatusOK, gin.H{
+				"status": "created",
+				"view":   view,
+			})
+			return
+		}
+	} else {
+		err = fmt.Errorf("View already exist")
+	}
+	c.AbortWithError(http.StatusInternalServerError, err)
+	addd.Log.DebugF("[API] %v", err.Error())
+}
+
+func getView(c *gin.Context) {
+	view := c.MustGet("view").(*addd.View)
+	c.JSON(http.StatusOK, view)
+}
+
+func updView(c *gin.Context) {
+	var err error
+	view := c.MustGet("view").(*addd.View)
+	newView := *view
+
+	// Bind body
+	if err = c.BindJSON(&newView); err != nil {
+		return
+	}
+
+	if err = newView.Validate(); err == nil && newView.Name != view.Name {
+		err = fmt.Errorf("Body doesn't suit URI path")
+	}
+	if err == nil {
+		if err = addd.StoreView(&newView); err == nil {
+			c.JSON(http.StatusOK, gin.H{
+				"status":   "updated",
+				"old-view": view,
+				"new-view": newView,
+			})
+			return
+		}
+	}
+	c.AbortWithError(http.StatusInternalServerError, err)
+	addd.Log.DebugF("[API] %v", err.Error())
+}
+
+func delView(c *gin.Context) {
+	view := c.MustGet("view").(*addd.View)
+
+	if err := addd.DeleteView(view.Name); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "deleted",
+		"view":   view,
+	})
+}
+
+func allViewRecords(c *gin.Context) {
+	view := c.MustGet("view").(*addd.View)
+	lst, err := addd.ListViewRRSets(view.Name)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		addd.Log.DebugF("[API] %v", err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"rrsets": lst,
+	})
+}
+
+// newViewRecord adds the record to its RRSet in the view, a new CNAME replaces the previous one
+func newViewRecord(c *gin.Context) {
+	var err error
+	view := c.MustGet("view").(*addd.View)
+	newRec := addd.DefaultRecord()
+
+	// Bind body
+	if err = c.BindJSON(newRec); err != nil {
+		return
+	}
+
+	set, gerr := addd.GetViewRRSet(view.Name, newRec.Name, newRec.Type)
+	if gerr != nil {
+		set = addd.NewRRSet(newRec.Name, newRec.Type)
+	}
+	if set.Find(newRec) < 0 {
+		if set.Type == "CNAME" {
+			set.Records = set.Records[:0]
+		}
+		set.Add(newRec)
+		if err = addd.StoreViewRRSet(view.Name, set); err == nil {
+			c.JSON(http.StatusOK, gin.H{
+				"status": "created",
+				"record": newRec,
+			})
+			return
+		}
+	} else {
+		err = fmt.Errorf("Record already exist")
+	}
+	c.AbortWithError(http.StatusInternalServerError, err)
+	addd.Log.DebugF("[API] %v", err.Error())
+}
+
+func updViewRRSet(c *gin.Context) {
+	var err error
+	view := c.MustGet("view").(*addd.View)
+	set := c.MustGet("rrset").(*addd.RRSet)
+	body := &addd.RRSet{}
+
+	// Bind body
+	if err = c.BindJSON(body); err != nil {
+		return
+	}
+
+	newSet := addd.NewRRSet(set.Name, set.Type)
+	if err = fillRRSet(newSet, body); err == nil {
+		if err = addd.StoreViewRRSet(view.Name, newSet); err == nil {
+			newSet.View = set.View
+			c.JSON(http.StatusOK, gin.H{
+				"status":    "updated",
+				"old-rrset": set,
+				"new-rrset": newSet,
+			})
+			return
+		}
+	}
+	c.AbortWithError(http.StatusInternalServerError, err)
+	addd.Log.DebugF("[API] %v", err.Error())
+}
+
+func delViewRRSet(c *gin.Context) {
+	view := c.MustGet("view").(*addd.View)
+	set := c.MustGet("rrset").(*addd.RRSet)
+
+	if err := addd.DeleteViewRRSet(view.Name, set.Name, set.Type); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": "deleted",
+		"rrset":  set,
+	})
+}
+
+func parseView(c *gin.Context) {
+	view, err := addd.GetView(c.Param("view"))
+	if err != nil {
+		c.AbortWithError(http.StatusNotFound, err)
+		addd.Log.DebugF("[API] %v", err.Error())
+		return
+	}
+
+	c.Set("view", view)
+	c.Next()
+}
+
+// parseViewRRSet retrieves the RRSet of the view, an empty one if missing so it can be created with PUT
+func parseViewRRSet(c *gin.Context) {
+	view := c.MustGet("view").(*addd.View)
+	set, err := addd.GetViewRRSet(view.Name, c.Param("name"), c.Param("type"))
+	if err != nil {
+		if c.Request.Method != http.MethodPut {
+			c.AbortWithError(http.StatusNotFound, err)
+			addd.Log.DebugF("[API] %v", err.Error())
+			return
+		}
+		set = addd.NewRRSet(c.Param("name"), c.Param("type"))
+		set.View = view.Name
+	}
+
+	c.Set("rrset", set)
+	c.Next()
+}
@@ -0,0 +1,63 @@
+package api
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/redsux/addd/core"
+)
+
+func TestViewRoutes(t *testing.T) {
+	router := newRouter(t)
+	tests := []struct {
+		method, path, body string
+		code               int
+	}{
+		{"POST", "/views", `{"view": "Internal", "networks": ["10.0.0.0/8"]}`, http.StatusOK},
+		{"POST", "/views", `{"view": "internal"}`, http.StatusInternalServerError},
+		{"POST", "/views", `{"view": "default"}`, http.StatusInternalServerError},
+		{"POST", "/views", `{"networks": ["10.0.0.0/8"]}`, http.StatusBadRequest},
+		{"GET", "/views/internal", "", http.StatusOK},
+		{"GET", "/views/vpn", "", http.StatusNotFound},
+		{"PUT", "/views/internal", `{"keys": ["internal.example.com"]}`, http.StatusOK},
+		{"PUT", "/views/internal", `{"view": "vpn"}`, http.StatusInternalServerError},
+		{"POST", "/views/internal/records", `{"fqdn": "www.example.com", "type": "A", "address": "10.0.0.1"}`, http.StatusOK},
+		{"POST", "/views/internal/records", `{"fqdn": "www.example.com", "type": "A", "address": "10.0.0.1"}`, http.StatusInternalServerError},
+		{"POST", "/views/internal/records", `{"fqdn": "www.example.org", "type": "A", "address": "10.0.0.1"}`, http.StatusInternalServerError},
+		{"POST", "/views/vpn/records", `{"fqdn": "www.example.com", "type": "A", "address": "10.0.0.1"}`, http.StatusNotFound},
+		{"PUT", "/views/internal/records/mail.example.com/A", `{"records": [{"address": "10.0.0.2"}, {"address": "10.0.0.3"}]}`, http.StatusOK},
+		{"GET", "/views/internal/records/mail.example.com/A", "", http.StatusOK},
+		{"GET", "/views/internal/records/ftp.example.com/A", "", http.StatusNotFound},
+		{"DELETE", "/views/internal/records/mail.example.com/A", "", http.StatusOK},
+		{"DELETE", "/views/internal/records/mail.example.com/A", "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if code := request(t, router, tt.method, tt.path, tt.body, nil); code != tt.code {
+			t.Errorf("%s %s %s = %v, want %v", tt.method, tt.path, tt.body, code, tt.code)
+		}
+	}
+
+	view := &addd.View{}
+	want := &addd.View{Name: "internal", Networks: []string{"10.0.0.0/8"}, Keys: []string{"internal.example.com."}}
+	if code := request(t, router, "GET", "/views/Internal", "", view); code != http.StatusOK || !reflect.DeepEqual(view, want) {
+		t.Errorf("GET = %v %+v, want %+v", code, view, want)
+	}
+	var lst struct {
+		RRSets []addd.RRSet `json:"rrsets"`
+	}
+	if code := request(t, router, "GET", "/views/internal/records", "", &lst); code != http.StatusOK || len(lst.RRSets) != 1 || lst.RRSets[0].View != "internal" {
+		t.Errorf("GET records = %v %+v", code, lst.RRSets)
+	}
+	// The records of the view aren't those of the default view
+	if _, err := addd.GetRRSet("www.example.com", "A"); err == nil {
+		t.Error("record of the view stored in the default view")
+	}
+
+	if code := request(t, router, "DELETE", "/views/internal", "", nil); code != http.StatusOK {
+		t.Errorf("DELETE = %v", code)
+	}
+	if code := request(t, router, "GET", "/views/internal", "", nil); code != http.StatusNotFound {
+		t.Errorf("GET after DELETE = %v", code)
+	}
+}
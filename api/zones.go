@@ -0,0 +1,261 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/miekg/dns"
+	"github.com/redsux/addd/core"
+)
+
+func forZones(router *gin.RouterGroup) {
+	router.GET("", allZones)
+	router.GET("/", allZones)
+
+	router.POST("", newZone)
+	router.POST("/", newZone)
+
+	zone := router.Group("/:zone")
+	{
+		zone.Use(parseZone)
+
+		zone.GET("", getZone)
+		zone.GET("/", getZone)
+
+		zone.PUT("", updZone)
+		zone.PUT("/", updZone)
+
+		zone.DELETE("", delZone)
+		zone.DELETE("/", delZone)
+
+		zone.GET("/keys", getZoneKeys)
+		zone.POST("/keys", newZoneKey)
+		zone.DELETE("/keys/:tag", delZoneKey)
+
+		zone.GET("/ds", getZoneDS)
+	}
+}
+
+// zoneKeyBody is the body to generate a DNSSEC key (with its algorithm) or to import one
+type zoneKeyBody struct {
+	KSK       bool   `json:"ksk"`
+	Algorithm string `json:"algorithm"`
+	DNSKEY    string `json:"dnskey"`
+	Private   string `json:"private"`
+}
+
+func allZones(c *gin.Context) {
+	lst, err := addd.ListZones()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		addd.Log.DebugF("[API] %v", err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"zones": lst,
+	})
+}
+
+func newZone(c *gin.Context) {
+	var err error
+	zone := &addd.Zone{}
+
+	// Bind body
+	if err = c.BindJSON(zone); err != nil {
+		return
+	}
+	zoneDefaults(zone)
+
+	// Not existing
+	if _, err = addd.GetZone(zone.Name); err != nil {
+		if err = addd.StoreZone(zone); err == nil {
+			c.JSON(http.StatusOK, gin.H{
+				"status": "created",
+				"zone":   zone,
+			})
+			return
+		}
+	} else {
+		err = fmt.Errorf("Zone already exist")
+	}
+	c.AbortWithError(http.StatusInternalServerError, err)
+	addd.Log.DebugF("[API] %v", err.Error())
+}
+
+func getZone(c *gin.Context) {
+	zone := c.MustGet("zone").(*addd.Zone)
+	c.JSON(http.StatusOK, zone)
+}
+
+func updZone(c *gin.Context) {
+	var err error
+	zone := c.MustGet("zone").(*addd.Zone)
+	newZone := *zone
+
+	// Bind body
+	if err = c.BindJSON(&newZone); err != nil {
+		return
+	}
+	zoneDefaults(&newZone)
+
+	if addd.DefaultZone(newZone.Name).Name == zone.Name {
+		if err = addd.StoreZone(&newZone); err == nil {
+			c.JSON(http.StatusOK, gin.H{
+				"status":   "updated",
+				"old-zone": zone,
+				"new-zone": newZone,
+			})
+			return
+		}
+	} else {
+		err = fmt.Errorf("Body doesn't suit URI path")
+	}
+	c.AbortWithError(http.StatusInternalServerError, err)
+	addd.Log.DebugF("[API] %v", err.Error())
+}
+
+func delZone(c *gin.Context) {
+	zone := c.MustGet("zone").(*addd.Zone)
+
+	if err := addd.DeleteZone(zone.Name); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "deleted",
+		"zone":   zone,
+	})
+}
+
+// Private parts of the keys are never sent back
+func getZoneKeys(c *gin.Context) {
+	zone := c.MustGet("zone").(*addd.Zone)
+	keys, err := addd.ZoneKeys(zone.Name)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		addd.Log.DebugF("[API] %v", err.Error())
+		return
+	}
+	for i := range keys {
+		keys[i].Private = ""
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"keys": keys,
+	})
+}
+
+func newZoneKey(c *gin.Context) {
+	var (
+		err error
+		key *addd.ZoneKey
+	)
+	zone := c.MustGet("zone").(*addd.Zone)
+	body := &zoneKeyBody{Algorithm: "ECDSAP256SHA256"}
+
+	// Bind body
+	if err = c.BindJSON(body); err != nil {
+		return
+	}
+
+	if body.DNSKEY != "" {
+		key, err = addd.ImportZoneKey(zone.Name, body.DNSKEY, body.Private)
+	} else {
+		key, err = addd.GenerateZoneKey(zone.Name, body.KSK, body.Algorithm)
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		addd.Log.DebugF("[API] %v", err.Error())
+		return
+	}
+	created := *key
+	created.Private = ""
+	c.JSON(http.StatusOK, gin.H{
+		"status": "created",
+		"key":    created,
+	})
+}
+
+func delZoneKey(c *gin.Context) {
+	zone := c.MustGet("zone").(*addd.Zone)
+	tag, err := strconv.ParseUint(c.Param("tag"), 10, 16)
+	if err == nil {
+		err = addd.DeleteZoneKey(zone.Name, uint16(tag))
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusNotFound, err)
+		addd.Log.DebugF("[API] %v", err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": "deleted",
+		"tag":    tag,
+	})
+}
+
+// getZoneDS returns the DS records of the KSKs (all keys if none) to publish in the parent zone
+func getZoneDS(c *gin.Context) {
+	zone := c.MustGet("zone").(*addd.Zone)
+	keys, err := addd.ZoneKeys(zone.Name)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		addd.Log.DebugF("[API] %v", err.Error())
+		return
+	}
+	hasKSK := false
+	for _, key := range keys {
+		hasKSK = hasKSK || key.KSK
+	}
+	ds := make([]string, 0)
+	for _, key := range keys {
+		if hasKSK && !key.KSK {
+			continue
+		}
+		dnskey, _, err := key.Parse()
+		if err != nil {
+			addd.Log.DebugF("[API] %v", err.Error())
+			continue
+		}
+		dnskey.Hdr.Ttl = uint32(zone.TTL)
+		ds = append(ds, dnskey.ToDS(dns.SHA256).String())
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"ds": ds,
+	})
+}
+
+// zoneDefaults fills the missing values of zone with the default ones
+func zoneDefaults(zone *addd.Zone) {
+	def := addd.DefaultZone(zone.Name)
+	if len(zone.NS) == 0 {
+		zone.NS = def.NS
+	}
+	if zone.Mbox == "" {
+		zone.Mbox = def.Mbox
+	}
+	for _, v := range []struct{ value, def *int }{
+		{&zone.Refresh, &def.Refresh},
+		{&zone.Retry, &def.Retry},
+		{&zone.Expire, &def.Expire},
+		{&zone.Minimum, &def.Minimum},
+		{&zone.TTL, &def.TTL},
+	} {
+		if *v.value == 0 {
+			*v.value = *v.def
+		}
+	}
+}
+
+func parseZone(c *gin.Context) {
+	zone, err := addd.GetZone(c.Param("zone"))
+	if err != nil {
+		c.AbortWithError(http.StatusNotFound, err)
+		addd.Log.DebugF("[API] %v", err.Error())
+		return
+	}
+
+	c.Set("zone", zone)
+	c.Next()
+}
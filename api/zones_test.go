@@ -0,0 +1,119 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/redsux/addd/core"
+)
+
+func TestZoneRoutes(t *testing.T) {
+	router := newRouter(t)
+	tests := []struct {
+		method, path, body string
+		code               int
+	}{
+		{"POST", "/zones", `{"zone": "Example.org", "ttl": 3600}`, http.StatusOK},
+		{"POST", "/zones", `{"zone": "example.org."}`, http.StatusInternalServerError},
+		{"POST", "/zones", `{"ttl": 3600}`, http.StatusBadRequest},
+		{"POST", "/zones", `{"zone": "host..example.net"}`, http.StatusInternalServerError},
+		{"GET", "/zones/example.org", "", http.StatusOK},
+		{"GET", "/zones/example.net", "", http.StatusNotFound},
+		{"PUT", "/zones/example.org", `{"ns": ["ns1.example.org", "ns2.example.org"]}`, http.StatusOK},
+		{"PUT", "/zones/example.org", `{"zone": "example.net"}`, http.StatusInternalServerError},
+		{"POST", "/records", `{"fqdn": "www.example.org", "address": "10.0.0.1"}`, http.StatusOK},
+		{"POST", "/records", `{"fqdn": "www.example.net", "address": "10.0.0.1"}`, http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		if code := request(t, router, tt.method, tt.path, tt.body, nil); code != tt.code {
+			t.Errorf("%s %s %s = %v, want %v", tt.method, tt.path, tt.body, code, tt.code)
+		}
+	}
+
+	zone := &addd.Zone{}
+	if code := request(t, router, "GET", "/zones/example.org.", "", zone); code != http.StatusOK {
+		t.Fatalf("GET = %v", code)
+	}
+	// The values not given keep their defaults, the serial follows the NS and the records
+	want := addd.DefaultZone("example.org")
+	want.NS, want.TTL, want.Serial = []string{"ns1.example.org", "ns2.example.org"}, 3600, 3
+	if !reflect.DeepEqual(zone, want) {
+		t.Errorf("GET = %+v, want %+v", zone, want)
+	}
+	var lst struct {
+		Zones []addd.Zone `json:"zones"`
+	}
+	if code := request(t, router, "GET", "/zones", "", &lst); code != http.StatusOK || len(lst.Zones) != 2 {
+		t.Errorf("GET /zones = %v, %v", code, lst.Zones)
+	}
+
+	if code := request(t, router, "DELETE", "/zones/example.org", "", nil); code != http.StatusOK {
+		t.Errorf("DELETE = %v", code)
+	}
+	if _, err := addd.GetRRSet("www.example.org", "A"); err == nil {
+		t.Error("records of the zone deleted kept")
+	}
+}
+
+func TestZoneKeyRoutes(t *testing.T) {
+	router := newRouter(t)
+	var created struct {
+		Key addd.ZoneKey `json:"key"`
+	}
+	if code := request(t, router, "POST", "/zones/example.com/keys", `{"ksk": true}`, &created); code != http.StatusOK {
+		t.Fatalf("POST key = %v", code)
+	}
+	if !created.Key.KSK || created.Key.Private != "" || created.Key.DNSKEY == "" {
+		t.Errorf("POST key = %+v", created.Key)
+	}
+	tests := []struct {
+		method, path, body string
+		code               int
+	}{
+		{"POST", "/zones/example.com/keys", `{"algorithm": "ed25519"}`, http.StatusOK},
+		{"POST", "/zones/example.com/keys", `{"algorithm": "RSASHA1"}`, http.StatusInternalServerError},
+		{"POST", "/zones/example.com/keys", `{"dnskey": "example.com. 3600 IN A 10.0.0.1"}`, http.StatusInternalServerError},
+		{"POST", "/zones/example.org/keys", `{}`, http.StatusNotFound},
+		{"DELETE", "/zones/example.com/keys/x", "", http.StatusNotFound},
+		{"DELETE", "/zones/example.com/keys/0", "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if code := request(t, router, tt.method, tt.path, tt.body, nil); code != tt.code {
+			t.Errorf("%s %s %s = %v, want %v", tt.method, tt.path, tt.body, code, tt.code)
+		}
+	}
+
+	var lst struct {
+		Keys []addd.ZoneKey `json:"keys"`
+	}
+	if code := request(t, router, "GET", "/zones/example.com/keys", "", &lst); code != http.StatusOK || len(lst.Keys) != 2 {
+		t.Fatalf("GET keys = %v, %v", code, lst.Keys)
+	}
+	for _, key := range lst.Keys {
+		if key.Private != "" {
+			t.Errorf("private part of the key %d sent", key.Tag)
+		}
+	}
+	// Only the KSK is published in the parent zone
+	var ds struct {
+		DS []string `json:"ds"`
+	}
+	if code := request(t, router, "GET", "/zones/example.com/ds", "", &ds); code != http.StatusOK || len(ds.DS) != 1 {
+		t.Fatalf("GET ds = %v, %v", code, ds.DS)
+	}
+	if rr, err := dns.NewRR(ds.DS[0]); err != nil || rr.(*dns.DS).KeyTag != created.Key.Tag {
+		t.Errorf("GET ds = %v, want the DS of the key %d", ds.DS, created.Key.Tag)
+	}
+
+	path := fmt.Sprintf("/zones/example.com/keys/%d", created.Key.Tag)
+	if code := request(t, router, "DELETE", path, "", nil); code != http.StatusOK {
+		t.Errorf("DELETE %s = %v", path, code)
+	}
+	if code := request(t, router, "GET", "/zones/example.com/ds", "", &ds); code != http.StatusOK || len(ds.DS) != 1 || strings.Contains(ds.DS[0], fmt.Sprint(" ", created.Key.Tag, " ")) {
+		t.Errorf("GET ds = %v, %v after deleting the KSK", code, ds.DS)
+	}
+}
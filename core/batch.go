@@ -0,0 +1,528 @@
+package addd
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+const (
+	txnKey = "addd/txn"
+)
+
+// batchLock serializes our commits, with the cluster lock a single transaction is pending at a time.
+// Our RRSets are read under its read lock.
+var batchLock sync.RWMutex
+
+// Batch groups changes of RRSets which are committed all-or-nothing.
+// Changes are staged as operations, they are applied to the RRSets as they are
+// when the batch is committed, while no other batch, of any member, can change them.
+// A batch is committed by the single write of its txn, every member then reads its RRSets
+// and serials, see readTxn.
+type Batch struct {
+	ops []func(s *Stage) error
+}
+
+// Stage holds the RRSets changed by the operations of a batch being committed
+type Stage struct {
+	// RRSets as they are in our DB and as they will be, by key
+	old, cur map[string]*RRSet
+	keys     []string
+}
+
+// txn is the DB object holding the RRSets of a batch being committed and the changes of each zone.
+// It is written in a single operation before the RRSets themselves, so a batch
+// interrupted halfway is replayed when our DB is opened again, or by the next commit in a cluster.
+// Once the batch ended, the txn is kept without its RRSets, Seq numbering the batches.
+type txn struct {
+	Seq   uint64    `json:"seq"`
+	Sets  []RRSet   `json:"txn"`
+	Zones []txnZone `json:"zones"`
+}
+
+// txnZone holds the records of a zone removed and added by a transaction, with the serial planned
+// once they are journaled. Done once its serial was bumped.
+type txnZone struct {
+	Zone    string   `json:"zone"`
+	From    uint32   `json:"from"`
+	To      uint32   `json:"to"`
+	Removed []Record `json:"removed"`
+	Added   []Record `json:"added"`
+	Done    bool     `json:"done"`
+}
+
+// NewBatch create an empty Batch
+func NewBatch() *Batch {
+	return &Batch{}
+}
+
+// Do stages fn, called at commit time to make changes depending on the RRSets as they are then.
+// An error returned by fn aborts the commit.
+func (b *Batch) Do(fn func(s *Stage) error) {
+	b.ops = append(b.ops, fn)
+}
+
+// StoreRRSet replaces the whole RRSet
+func (b *Batch) StoreRRSet(set *RRSet) error {
+	if _, err := getKey(set.Name, set.Type); err != nil {
+		return err
+	}
+	stored := *set
+	stored.Records = append([]Record{}, set.Records...)
+	b.Do(func(s *Stage) error { return s.StoreRRSet(&stored) })
+	return nil
+}
+
+// DeleteRRSet deletes all the records of domain with the type rtype
+func (b *Batch) DeleteRRSet(domain string, rtype string) error {
+	if _, err := getKey(domain, rtype); err != nil {
+		return err
+	}
+	b.Do(func(s *Stage) error { return s.DeleteRRSet(domain, rtype) })
+	return nil
+}
+
+// StoreViewRRSet replaces the whole RRSet in view
+func (b *Batch) StoreViewRRSet(view string, set *RRSet) error {
+	if _, err := getKey(set.Name, set.Type); err != nil {
+		return err
+	}
+	stored := *set
+	stored.Records = append([]Record{}, set.Records...)
+	b.Do(func(s *Stage) error {
+		cur, err := s.ViewRRSet(view, stored.Name, stored.Type)
+		if err != nil {
+			return err
+		}
+		cur.Records = cur.Records[:0]
+		for i := range stored.Records {
+			cur.Add(&stored.Records[i])
+		}
+		return nil
+	})
+	return nil
+}
+
+// DeleteViewRRSet deletes all the records of domain with the type rtype in view
+func (b *Batch) DeleteViewRRSet(view, domain, rtype string) error {
+	if _, err := getKey(domain, rtype); err != nil {
+		return err
+	}
+	b.Do(func(s *Stage) error {
+		cur, err := s.ViewRRSet(view, domain, rtype)
+		if err != nil {
+			return err
+		}
+		cur.Records = cur.Records[:0]
+		return nil
+	})
+	return nil
+}
+
+// DeleteName deletes all the RRSet of domain
+func (b *Batch) DeleteName(domain string) error {
+	b.Do(func(s *Stage) error { return s.DeleteName(domain) })
+	return nil
+}
+
+// StoreRecord adds the record to its RRSet
+func (b *Batch) StoreRecord(rr *Record) error {
+	if _, err := getKey(rr.Name, rr.Type); err != nil {
+		return err
+	}
+	rec := *rr
+	b.Do(func(s *Stage) error { return s.StoreRecord(&rec) })
+	return nil
+}
+
+// DeleteRecord removes the record from its RRSet, the commit fails if it doesn't exist
+func (b *Batch) DeleteRecord(rr *Record) error {
+	if _, err := getKey(rr.Name, rr.Type); err != nil {
+		return err
+	}
+	rec := *rr
+	b.Do(func(s *Stage) error { return s.DeleteRecord(&rec) })
+	return nil
+}
+
+// Commit applies the staged operations, then validates and commits all the changes of the batch.
+// Nothing is changed if they are invalid or if its txn can't be stored. Once it is, the batch is committed :
+// a failure to store its RRSets or to journal them leaves it pending, it is completed by the next commit
+// of any member, and read meanwhile.
+func (b *Batch) Commit() error {
+	checkBdp()
+	batchLock.Lock()
+	defer batchLock.Unlock()
+	unlock, err := lockCluster()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// The operations must see the RRSets of the previous batch
+	if err := replayTxn(); err != nil {
+		return fmt.Errorf("Previous batch not completed: %v", err)
+	}
+	s := newStage()
+	for _, op := range b.ops {
+		if err := op(s); err != nil {
+			return err
+		}
+	}
+	if err := s.syncPTR(); err != nil {
+		return err
+	}
+
+	t := &txn{Seq: pendingTxn().Seq + 1, Sets: make([]RRSet, 0), Zones: make([]txnZone, 0)}
+	zones := make(map[string]int)
+	for _, key := range s.keys {
+		set := s.cur[key]
+		removed, added := diffRecords(s.old[key], set)
+		if len(removed) == 0 && len(added) == 0 {
+			continue
+		}
+		if !set.Empty() {
+			if _, err := ZoneOf(set.Name); err != nil {
+				return fmt.Errorf("%v doesn't belong to any zone", set.Name)
+			}
+			for _, rec := range set.Records {
+				if err := rec.Validate(); err != nil {
+					return err
+				}
+			}
+			if err := s.checkCNAME(set); err != nil {
+				return err
+			}
+		}
+		t.Sets = append(t.Sets, *set)
+
+		// Views aren't transferred nor journaled, their changes don't bump the serial
+		zone, err := ZoneOf(set.Name)
+		if err != nil || set.View != "" {
+			continue
+		}
+		i, ok := zones[zone.Name]
+		if !ok {
+			i = len(t.Zones)
+			zones[zone.Name] = i
+			t.Zones = append(t.Zones, txnZone{Zone: zone.Name, From: zone.Serial, To: nextSerial(zone.Serial)})
+		}
+		t.Zones[i].Removed = append(t.Zones[i].Removed, removed...)
+		t.Zones[i].Added = append(t.Zones[i].Added, added...)
+	}
+	if len(t.Sets) == 0 {
+		return nil
+	}
+
+	if err := bdb.Set(txnKey, t); err != nil {
+		return err
+	}
+	if err := applyTxn(t); err != nil {
+		Log.WarningF("[DB] Batch committed but not completed, it will be replayed: %v", err)
+	}
+	return nil
+}
+
+// newStage creates a Stage without any change
+func newStage() *Stage {
+	return &Stage{
+		old: make(map[string]*RRSet),
+		cur: make(map[string]*RRSet),
+	}
+}
+
+// RRSet returns the RRSet of domain with the type rtype as it will be once the batch committed.
+// Changes made to the returned RRSet are part of the batch.
+func (s *Stage) RRSet(domain string, rtype string) (*RRSet, error) {
+	return s.ViewRRSet("", domain, rtype)
+}
+
+// ViewRRSet returns the RRSet of domain with the type rtype in view as it will be once the batch committed,
+// see RRSet
+func (s *Stage) ViewRRSet(view, domain string, rtype string) (*RRSet, error) {
+	old := NewRRSet(domain, rtype)
+	old.View = viewName(view)
+	key, err := old.key()
+	if err != nil {
+		return nil, err
+	}
+	if cur, ok := s.cur[key]; ok {
+		return cur, nil
+	}
+	if err := bdb.Get(key, old); err != nil {
+		old = NewRRSet(domain, rtype)
+		old.View = viewName(view)
+	}
+	cur := *old
+	cur.Records = append(make([]Record, 0, len(old.Records)), old.Records...)
+	s.old[key], s.cur[key] = old, &cur
+	s.keys = append(s.keys, key)
+	return &cur, nil
+}
+
+// Name returns all the RRSets of domain as they will be once the batch committed
+func (s *Stage) Name(domain string) ([]*RRSet, error) {
+	return s.ViewName("", domain)
+}
+
+// ViewName returns all the RRSets of domain seen in view, its own ones and those of the default view,
+// as they will be once the batch committed
+func (s *Stage) ViewName(view, domain string) ([]*RRSet, error) {
+	view = viewName(view)
+	// The batch pending was replayed before the operations
+	sets, err := listName(&txn{}, "", domain)
+	if err != nil {
+		return nil, err
+	}
+	if view != "" {
+		own, err := listName(&txn{}, "view/"+view+"/", domain)
+		if err != nil {
+			return nil, err
+		}
+		sets = append(sets, own...)
+	}
+	for _, set := range sets {
+		if _, err := s.ViewRRSet(set.View, set.Name, set.Type); err != nil {
+			return nil, err
+		}
+	}
+	name := cleanName(domain)
+	result := make([]*RRSet, 0)
+	for _, key := range s.keys {
+		if set := s.cur[key]; set.Name == name && (set.View == "" || set.View == view) && !set.Empty() {
+			result = append(result, set)
+		}
+	}
+	return result, nil
+}
+
+// StoreRRSet replaces the whole RRSet
+func (s *Stage) StoreRRSet(set *RRSet) error {
+	cur, err := s.RRSet(set.Name, set.Type)
+	if err != nil {
+		return err
+	}
+	cur.Records = append(cur.Records[:0], set.Records...)
+	return nil
+}
+
+// DeleteRRSet deletes all the records of domain with the type rtype
+func (s *Stage) DeleteRRSet(domain string, rtype string) error {
+	cur, err := s.RRSet(domain, rtype)
+	if err != nil {
+		return err
+	}
+	cur.Records = cur.Records[:0]
+	return nil
+}
+
+// DeleteName deletes all the RRSet of domain
+func (s *Stage) DeleteName(domain string) error {
+	sets, err := s.Name(domain)
+	if err != nil {
+		return err
+	}
+	for _, set := range sets {
+		set.Records = set.Records[:0]
+	}
+	return nil
+}
+
+// StoreRecord adds the record to its RRSet
+func (s *Stage) StoreRecord(rr *Record) error {
+	set, err := s.RRSet(rr.Name, rr.Type)
+	if err != nil {
+		return err
+	}
+	// A name has a single CNAME, adding one replaces the previous (RFC 2136, 3.4.2.2)
+	if set.Type == "CNAME" && set.Find(rr) < 0 {
+		set.Records = set.Records[:0]
+	}
+	set.Add(rr)
+	return nil
+}
+
+// DeleteRecord removes the record from its RRSet
+func (s *Stage) DeleteRecord(rr *Record) error {
+	set, err := s.RRSet(rr.Name, rr.Type)
+	if err != nil {
+		return err
+	}
+	if !set.Remove(rr) {
+		return fmt.Errorf("Record %v not found", rr)
+	}
+	return nil
+}
+
+// checkCNAME ensures a CNAME is alone at its name once the batch committed (RFC 1034, 3.6.2),
+// in the view of set with the records of the default view it falls back to. A change of the default view
+// is also checked in every view, which sees it beside its own records.
+func (s *Stage) checkCNAME(set *RRSet) error {
+	if set.Type == "CNAME" && len(set.Records) > 1 {
+		return fmt.Errorf("%v can't have more than one CNAME", set.Name)
+	}
+	views := []string{set.View}
+	if set.View == "" {
+		lst, err := getViews()
+		if err != nil {
+			return err
+		}
+		for name := range lst.Views {
+			views = append(views, name)
+		}
+	}
+	for _, view := range views {
+		others, err := s.ViewName(view, set.Name)
+		if err != nil {
+			return err
+		}
+		for _, other := range others {
+			if other.Type != set.Type && (set.Type == "CNAME" || other.Type == "CNAME") {
+				return ErrCNAMEConflict
+			}
+		}
+	}
+	return nil
+}
+
+// applyTxn stores the RRSets of t, journals the changes of each zone and ends the transaction.
+// The zones' changes were computed at commit time, the RRSets may already be stored when replayed.
+func applyTxn(t *txn) error {
+	if err := storeTxn(t); err != nil {
+		return err
+	}
+	return journalTxn(t)
+}
+
+// storeTxn stores the RRSets of t
+func storeTxn(t *txn) error {
+	for i := range t.Sets {
+		set := &t.Sets[i]
+		key, err := set.key()
+		if err != nil {
+			return err
+		}
+		if set.Empty() {
+			err = bdb.Delete(key)
+		} else {
+			err = bdb.Set(key, set)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// journalTxn journals the changes of each zone of t not done yet, then ends the transaction
+func journalTxn(t *txn) error {
+	for i := range t.Zones {
+		zone := &t.Zones[i]
+		if zone.Done {
+			continue
+		}
+		if err := commit(zone); err != nil {
+			return err
+		}
+		// A replay mustn't bump the serial of this zone again
+		zone.Done = true
+		if err := bdb.Set(txnKey, t); err != nil {
+			return err
+		}
+	}
+	return bdb.Set(txnKey, &txn{Seq: t.Seq})
+}
+
+// replayTxn finishes the batch which was being committed when we stopped or failed, if any.
+// batchLock and the cluster lock must be held, or our DB being opened out of a cluster.
+func replayTxn() error {
+	t := pendingTxn()
+	if len(t.Sets) == 0 {
+		return nil
+	}
+	Log.WarningF("[DB] Replay of an interrupted batch of %d RRSets", len(t.Sets))
+	return applyTxn(t)
+}
+
+// pendingTxn returns the txn of the last batch, without RRSets once it ended
+func pendingTxn() *txn {
+	t := &txn{}
+	if err := bdb.Get(txnKey, t); err != nil {
+		return &txn{}
+	}
+	return t
+}
+
+// readTxn calls read with the txn of the batch pending, to apply it over what read reads from our DB.
+// read is called again if a batch started or ended meanwhile, so a batch is seen all at once,
+// from the single write of its txn, by every member.
+func readTxn(read func(t *txn) error) error {
+	for {
+		t := pendingTxn()
+		err := read(t)
+		if after := pendingTxn(); after.Seq == t.Seq && len(after.Sets) == len(t.Sets) {
+			return err
+		}
+	}
+}
+
+// getSet reads the RRSet of set's name, type and view in set, from t if it holds it
+func (t *txn) getSet(set *RRSet) error {
+	key, err := set.key()
+	if err != nil {
+		return err
+	}
+	for i := range t.Sets {
+		if k, _ := t.Sets[i].key(); k == key {
+			if t.Sets[i].Empty() {
+				return fmt.Errorf("RRSet %v %v not found", set.Name, set.Type)
+			}
+			*set = t.Sets[i]
+			set.Records = append([]Record{}, t.Sets[i].Records...)
+			return nil
+		}
+	}
+	return bdb.Get(key, set)
+}
+
+// apply returns sets, read from our DB, with the RRSets of t whose key is accepted by match
+// replacing them, ordered by key as listed
+func (t *txn) apply(sets []RRSet, match func(key string) bool) []RRSet {
+	if len(t.Sets) == 0 {
+		return sets
+	}
+	byKey := make(map[string]RRSet, len(sets))
+	for _, set := range sets {
+		if key, err := set.key(); err == nil {
+			byKey[key] = set
+		}
+	}
+	for _, set := range t.Sets {
+		if key, err := set.key(); err == nil && match(key) {
+			if set.Empty() {
+				delete(byKey, key)
+			} else {
+				byKey[key] = set
+			}
+		}
+	}
+	keys := make([]string, 0, len(byKey))
+	for key := range byKey {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	result := make([]RRSet, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, byKey[key])
+	}
+	return result
+}
+
+// applySerials sets the serials planned by t in the zones of lst, which are still the ones planned from
+func (t *txn) applySerials(lst *zoneList) {
+	for _, tz := range t.Zones {
+		if zone, ok := lst.Zones[tz.Zone]; ok && !tz.Done && tz.To != 0 && zone.Serial == tz.From {
+			zone.Serial = tz.To
+		}
+	}
+}
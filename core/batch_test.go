@@ -0,0 +1,423 @@
+package addd
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/redsux/addd/core/dbtest"
+)
+
+func TestBatchCommit(t *testing.T) {
+	errFailed := errors.New("failed")
+	tests := []struct {
+		name   string
+		stored []*Record
+		batch  func(b *Batch)
+		err    error // nil if the batch is committed, errFailed for any other error
+		want   []string
+	}{
+		{
+			name: "add and replace",
+			stored: []*Record{
+				record("www.example.com", "A", "10.0.0.1"),
+				record("mail.example.com", "A", "10.0.0.2"),
+			},
+			batch: func(b *Batch) {
+				b.StoreRecord(record("www.example.com", "A", "10.0.0.3"))
+				b.StoreRRSet(&RRSet{Name: "mail.example.com", Type: "A", Records: []Record{*record("mail.example.com", "A", "10.0.0.4")}})
+				b.StoreRecord(record("example.com", "TXT", "v=spf1 -all"))
+			},
+			want: []string{
+				"example.com 300 IN TXT \"v=spf1 -all\"",
+				"mail.example.com 300 IN A 10.0.0.4",
+				"www.example.com 300 IN A 10.0.0.1",
+				"www.example.com 300 IN A 10.0.0.3",
+			},
+		},
+		{
+			name: "delete name",
+			stored: []*Record{
+				record("www.example.com", "A", "10.0.0.1"),
+				record("www.example.com", "TXT", "web"),
+				record("mail.example.com", "A", "10.0.0.2"),
+			},
+			batch: func(b *Batch) {
+				b.DeleteName("www.example.com")
+			},
+			want: []string{"mail.example.com 300 IN A 10.0.0.2"},
+		},
+		{
+			name:   "record outside our zones",
+			stored: []*Record{record("www.example.com", "A", "10.0.0.1")},
+			batch: func(b *Batch) {
+				b.DeleteRRSet("www.example.com", "A")
+				b.StoreRecord(record("www.example.org", "A", "10.0.0.2"))
+			},
+			err:  errFailed,
+			want: []string{"www.example.com 300 IN A 10.0.0.1"},
+		},
+		{
+			name:   "invalid record",
+			stored: []*Record{record("www.example.com", "A", "10.0.0.1")},
+			batch: func(b *Batch) {
+				b.DeleteRRSet("www.example.com", "A")
+				b.StoreRecord(record("mail.example.com", "A", "not an address"))
+			},
+			err:  errFailed,
+			want: []string{"www.example.com 300 IN A 10.0.0.1"},
+		},
+		{
+			name:   "negative TTL",
+			stored: []*Record{record("www.example.com", "A", "10.0.0.1")},
+			batch: func(b *Batch) {
+				rec := record("mail.example.com", "A", "10.0.0.2")
+				rec.TTL = -1
+				b.StoreRecord(rec)
+			},
+			err:  errFailed,
+			want: []string{"www.example.com 300 IN A 10.0.0.1"},
+		},
+		{
+			name:   "unknown class",
+			stored: []*Record{record("www.example.com", "A", "10.0.0.1")},
+			batch: func(b *Batch) {
+				rec := record("mail.example.com", "A", "10.0.0.2")
+				rec.Class = "BOGUS"
+				b.StoreRecord(rec)
+			},
+			err:  errFailed,
+			want: []string{"www.example.com 300 IN A 10.0.0.1"},
+		},
+		{
+			name:   "CNAME added beside stored data",
+			stored: []*Record{record("www.example.com", "A", "10.0.0.1")},
+			batch: func(b *Batch) {
+				b.StoreRecord(record("mail.example.com", "A", "10.0.0.2"))
+				b.StoreRecord(record("www.example.com", "CNAME", "web.example.com"))
+			},
+			err:  ErrCNAMEConflict,
+			want: []string{"www.example.com 300 IN A 10.0.0.1"},
+		},
+		{
+			name:   "data added beside a stored CNAME",
+			stored: []*Record{record("www.example.com", "CNAME", "web.example.com")},
+			batch: func(b *Batch) {
+				b.StoreRecord(record("www.example.com", "TXT", "web"))
+			},
+			err:  ErrCNAMEConflict,
+			want: []string{"www.example.com 300 IN CNAME web.example.com."},
+		},
+		{
+			name: "CNAME and data added together",
+			batch: func(b *Batch) {
+				b.StoreRecord(record("www.example.com", "A", "10.0.0.1"))
+				b.StoreRecord(record("www.example.com", "CNAME", "web.example.com"))
+			},
+			err:  ErrCNAMEConflict,
+			want: []string{},
+		},
+		{
+			name:   "data replacing a CNAME",
+			stored: []*Record{record("www.example.com", "CNAME", "web.example.com")},
+			batch: func(b *Batch) {
+				b.DeleteRRSet("www.example.com", "CNAME")
+				b.StoreRecord(record("www.example.com", "A", "10.0.0.1"))
+			},
+			want: []string{"www.example.com 300 IN A 10.0.0.1"},
+		},
+		{
+			name:   "missing record deleted",
+			stored: []*Record{record("www.example.com", "A", "10.0.0.1")},
+			batch: func(b *Batch) {
+				b.DeleteRecord(record("www.example.com", "A", "10.0.0.1"))
+				b.DeleteRecord(record("www.example.com", "A", "10.0.0.9"))
+			},
+			err:  errFailed,
+			want: []string{"www.example.com 300 IN A 10.0.0.1"},
+		},
+		{
+			name:   "CNAME replacing a CNAME",
+			stored: []*Record{record("www.example.com", "CNAME", "web.example.com")},
+			batch: func(b *Batch) {
+				b.StoreRecord(record("www.example.com", "CNAME", "web2.example.com"))
+			},
+			want: []string{"www.example.com 300 IN CNAME web2.example.com."},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useMemStore(t, "example.com")
+			for _, rec := range tt.stored {
+				if err := StoreRecord(rec); err != nil {
+					t.Fatal(err)
+				}
+			}
+			serial, _ := GetSerial("example.com")
+
+			b := NewBatch()
+			tt.batch(b)
+			err := b.Commit()
+			switch {
+			case tt.err == nil && err != nil:
+				t.Fatalf("Commit() = %v, want nil", err)
+			case tt.err == errFailed && err == nil:
+				t.Fatal("Commit() = nil, want an error")
+			case tt.err != nil && tt.err != errFailed && err != tt.err:
+				t.Fatalf("Commit() = %v, want %v", err, tt.err)
+			}
+			if got := storedRecords(t); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("records = %q, want %q", got, tt.want)
+			}
+			// A failed batch doesn't bump the serial, nor leaves a transaction to replay
+			cur, _ := GetSerial("example.com")
+			if changed := cur != serial; changed != (err == nil) {
+				t.Errorf("serial %v => %v after Commit() = %v", serial, cur, err)
+			}
+			if len(pendingTxn().Sets) != 0 {
+				t.Error("transaction left in our DB")
+			}
+		})
+	}
+
+}
+
+func TestBatchStagedOperations(t *testing.T) {
+	useMemStore(t, "example.com")
+	if err := StoreRecord(record("www.example.com", "A", "10.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+	// Operations apply to the RRSets as they are when the batch is committed
+	b := NewBatch()
+	b.StoreRecord(record("www.example.com", "A", "10.0.0.3"))
+	b.DeleteRecord(record("www.example.com", "A", "10.0.0.2"))
+	if err := StoreRecord(record("www.example.com", "A", "10.0.0.2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"www.example.com 300 IN A 10.0.0.1", "www.example.com 300 IN A 10.0.0.3"}
+	if got := storedRecords(t); !reflect.DeepEqual(got, want) {
+		t.Errorf("records = %q, want %q", got, want)
+	}
+
+	// An operation failing aborts the commit
+	b = NewBatch()
+	b.DeleteRecord(record("www.example.com", "A", "10.0.0.1"))
+	b.Do(func(s *Stage) error { return ErrCNAMEConflict })
+	if err := b.Commit(); err != ErrCNAMEConflict {
+		t.Errorf("Commit() = %v, want %v", err, ErrCNAMEConflict)
+	}
+	if got := storedRecords(t); !reflect.DeepEqual(got, want) {
+		t.Errorf("records = %q after a failed commit, want %q", got, want)
+	}
+}
+
+func TestReplayTxn(t *testing.T) {
+	store := useMemStore(t, "example.com")
+	if err := StoreRecord(record("www.example.com", "A", "10.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+	// A batch interrupted after the first of its RRSets was stored
+	set := NewRRSet("mail.example.com", "A")
+	set.Add(record("mail.example.com", "A", "10.0.0.2"))
+	pending := &txn{
+		Sets: []RRSet{*set, *NewRRSet("www.example.com", "A")},
+		Zones: []txnZone{{
+			Zone:    "example.com.",
+			Removed: []Record{*record("www.example.com", "A", "10.0.0.1")},
+			Added:   []Record{*record("mail.example.com", "A", "10.0.0.2")},
+		}},
+	}
+	store.Set(txnKey, pending)
+	store.Set("com.example.mail_A", set)
+
+	if err := NewDB(store); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := storedRecords(t), []string{"mail.example.com 300 IN A 10.0.0.2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("records = %q, want %q", got, want)
+	}
+	if serial, _ := GetSerial("example.com"); serial != 3 {
+		t.Errorf("GetSerial() = %v after the replay, want 3", serial)
+	}
+	entries, err := Journal("example.com", 2)
+	if err != nil || len(entries) != 1 || len(entries[0].Removed) != 1 || len(entries[0].Added) != 1 {
+		t.Errorf("Journal(example.com, 2) = %+v, %v after the replay", entries, err)
+	}
+	if len(pendingTxn().Sets) != 0 {
+		t.Error("transaction left in our DB")
+	}
+
+	// The zones whose serial was already bumped aren't changed again
+	pending.Zones[0].Done = true
+	store.Set(txnKey, pending)
+	if err := NewDB(store); err != nil {
+		t.Fatal(err)
+	}
+	if serial, _ := GetSerial("example.com"); serial != 3 {
+		t.Errorf("GetSerial() = %v after replaying a zone done, want 3", serial)
+	}
+}
+
+// failingStore fails to store the key fail and to delete the key failDelete
+type failingStore struct {
+	*dbtest.Store
+	fail, failDelete string
+}
+
+func (s *failingStore) Set(key string, value interface{}) error {
+	if key == s.fail {
+		return errors.New("Set failed")
+	}
+	return s.Store.Set(key, value)
+}
+
+func (s *failingStore) Delete(key string) error {
+	if key == s.failDelete {
+		return errors.New("Delete failed")
+	}
+	return s.Store.Delete(key)
+}
+
+func TestBatchAllOrNothing(t *testing.T) {
+	store := &failingStore{Store: dbtest.NewStore()}
+	if err := NewDB(store); err != nil {
+		t.Fatal(err)
+	}
+	if err := StoreZone(DefaultZone("example.com")); err != nil {
+		t.Fatal(err)
+	}
+	if err := StoreRecord(record("www.example.com", "A", "10.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Its txn not stored, the batch changes nothing
+	store.fail = txnKey
+	b := NewBatch()
+	b.StoreRecord(record("www.example.com", "A", "10.0.0.3"))
+	b.StoreRecord(record("mail.example.com", "A", "10.0.0.2"))
+	if err := b.Commit(); err == nil {
+		t.Fatal("Commit() = nil with its txn not stored")
+	}
+	if got, want := storedRecords(t), []string{"www.example.com 300 IN A 10.0.0.1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("records = %q after a failed commit, want %q", got, want)
+	}
+	if serial, _ := GetSerial("example.com"); serial != 2 {
+		t.Errorf("GetSerial() = %v after a failed commit, want 2", serial)
+	}
+
+	// Once its txn stored, the batch is committed and read whole until completed
+	store.fail = "com.example.mail_A"
+	if err := b.Commit(); err != nil {
+		t.Fatalf("Commit() = %v with an RRSet not stored", err)
+	}
+	want := []string{"mail.example.com 300 IN A 10.0.0.2", "www.example.com 300 IN A 10.0.0.1", "www.example.com 300 IN A 10.0.0.3"}
+	if got := storedRecords(t); !reflect.DeepEqual(got, want) {
+		t.Errorf("records = %q after a commit not completed, want %q", got, want)
+	}
+	if set, err := GetRRSet("mail.example.com", "A"); err != nil || len(set.Records) != 1 {
+		t.Errorf("GetRRSet() = %v, %v after a commit not completed", set, err)
+	}
+	if exists, err := NameExists("mail.example.com"); err != nil || !exists {
+		t.Errorf("NameExists() = %v, %v after a commit not completed", exists, err)
+	}
+	if serial, _ := GetSerial("example.com"); serial != 3 {
+		t.Errorf("GetSerial() = %v after a commit not completed, want 3", serial)
+	}
+	if len(pendingTxn().Sets) == 0 {
+		t.Fatal("transaction not completed ended")
+	}
+
+	// The transaction left pending is completed before the next commit
+	if err := StoreRecord(record("ftp.example.com", "A", "10.0.0.4")); err == nil {
+		t.Error("Commit() = nil with a transaction pending which can't be completed")
+	}
+	store.fail = ""
+	if err := StoreRecord(record("ftp.example.com", "A", "10.0.0.4")); err != nil {
+		t.Fatal(err)
+	}
+	want = append([]string{"ftp.example.com 300 IN A 10.0.0.4"}, want...)
+	if got := storedRecords(t); !reflect.DeepEqual(got, want) {
+		t.Errorf("records = %q, want %q", got, want)
+	}
+	if serial, _ := GetSerial("example.com"); serial != 4 {
+		t.Errorf("GetSerial() = %v, want 4", serial)
+	}
+	if entries, err := Journal("example.com", 2); err != nil || len(entries) != 2 {
+		t.Errorf("Journal(example.com, 2) = %+v, %v", entries, err)
+	}
+}
+
+func TestBatchReaders(t *testing.T) {
+	useMemStore(t, "example.com")
+	read := make(chan *RRSet)
+	b := NewBatch()
+	b.StoreRecord(record("www.example.com", "A", "10.0.0.1"))
+	b.Do(func(s *Stage) error {
+		go func() {
+			set, _ := GetRRSet("www.example.com", "A")
+			read <- set
+		}()
+		// Left the time to read, the reader must wait for the end of the commit
+		time.Sleep(20 * time.Millisecond)
+		return nil
+	})
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if set := <-read; set == nil || len(set.Records) != 1 {
+		t.Errorf("GetRRSet() during the commit = %v", set)
+	}
+}
+
+// committingStore stores txn, as another member committing it, when RRSets are first listed
+type committingStore struct {
+	*dbtest.Store
+	txn *txn
+}
+
+func (s *committingStore) List(values interface{}, patterns ...string) error {
+	if s.txn != nil {
+		s.Store.Set(txnKey, s.txn)
+		s.txn = nil
+	}
+	return s.Store.List(values, patterns...)
+}
+
+func TestReadTxn(t *testing.T) {
+	store := &committingStore{Store: dbtest.NewStore()}
+	if err := NewDB(store); err != nil {
+		t.Fatal(err)
+	}
+	if err := StoreZone(DefaultZone("example.com")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The batch committed while reading is read whole, with its serial
+	set := NewRRSet("www.example.com", "A")
+	set.Add(record("www.example.com", "A", "10.0.0.1"))
+	store.txn = &txn{
+		Seq:   1,
+		Sets:  []RRSet{*set},
+		Zones: []txnZone{{Zone: "example.com.", From: 1, To: 2, Added: set.Records}},
+	}
+	if sets, err := ListName("www.example.com"); err != nil || len(sets) != 1 || len(sets[0].Records) != 1 {
+		t.Errorf("ListName() = %v, %v during a commit", sets, err)
+	}
+	if serial, _ := GetSerial("example.com"); serial != 2 {
+		t.Errorf("GetSerial() = %v during a commit, want 2", serial)
+	}
+	if err := StoreRecord(record("mail.example.com", "A", "10.0.0.2")); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"mail.example.com 300 IN A 10.0.0.2", "www.example.com 300 IN A 10.0.0.1"}
+	if got := storedRecords(t); !reflect.DeepEqual(got, want) {
+		t.Errorf("records = %q, want %q", got, want)
+	}
+	if serial, _ := GetSerial("example.com"); serial != 3 {
+		t.Errorf("GetSerial() = %v, want 3", serial)
+	}
+}
@@ -0,0 +1,204 @@
+package addd
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const (
+	lockPrefix = "addd/lock/"
+	// lockTimeout is the longest time waited for the cluster lock
+	lockTimeout = 10 * time.Second
+	// lockLease is the time after which the ticket of a member not refreshed is ignored,
+	// the member being considered dead. It is measured by our clock, from the time we first
+	// read the ticket unchanged, as the clocks of the members may differ.
+	lockLease = 30 * time.Second
+	// applyPoll is the interval between two reads of a write being applied
+	applyPoll = 10 * time.Millisecond
+)
+
+var (
+	clustered     bool
+	clusterMutex  sync.Mutex // a single ticket per member
+	clusterLocked bool       // true while we hold the cluster lock, under clusterMutex
+	nodeID        = newNodeID()
+	// lockRefresh is the interval between two refreshes of our ticket while we hold the lock
+	lockRefresh = lockLease / 3
+	// ticketsSeen are the tickets of the other members as we first read them, under clusterMutex
+	ticketsSeen = make(map[string]ticketSeen)
+
+	errNotApplied = errors.New("Write not applied")
+	errNotLocked  = errors.New("Cluster lock not held")
+)
+
+// lockTicket is the DB object by which a member of the cluster asks for the cluster lock,
+// the lowest Number (then Node) gets it once no member is choosing its own
+type lockTicket struct {
+	Node     string `json:"node"`
+	Choosing bool   `json:"choosing"`
+	Number   uint64 `json:"number"`
+	Stamp    int64  `json:"stamp"` // time of the write by the clock of the member, changed by every refresh
+}
+
+// ticketSeen is a ticket of another member and the time we first read it
+type ticketSeen struct {
+	stamp int64
+	at    time.Time
+}
+
+// UseClusterLock enables the lock serializing our changes across the members of an HA cluster,
+// whose DB doesn't provide any atomic operation. It must be enabled before NewDB.
+func UseClusterLock(enable bool) {
+	clustered = enable
+}
+
+// newNodeID returns a random identifier of this member
+func newNodeID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
+
+// lockCluster acquires the cluster lock with the bakery algorithm of Lamport,
+// and returns the function releasing it. It does nothing if the cluster lock isn't enabled.
+// Every read follows a write of our ticket applied by our DB, so it sees the writes of the
+// other members applied before.
+func lockCluster() (unlock func(), err error) {
+	if !clustered {
+		return func() {}, nil
+	}
+	clusterMutex.Lock()
+	key := lockPrefix + nodeID
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	unlock = func() {
+		if clusterLocked {
+			close(stop)
+			<-stopped
+		}
+		// Our ticket is deleted after our writes, a member seeing it deleted sees them
+		clusterLocked = false
+		if err := bdb.Delete(key); err != nil {
+			Log.WarningF("[DB] Cluster lock not released, it expires in %v: %v", lockLease, err)
+		}
+		clusterMutex.Unlock()
+	}
+	deadline := time.Now().Add(lockTimeout)
+
+	own := &lockTicket{Node: nodeID, Choosing: true, Stamp: time.Now().UnixNano()}
+	if err = setApplied(key, own, lockTimeout); err != nil {
+		unlock()
+		return nil, err
+	}
+	others, err := lockTickets()
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	own = &lockTicket{Node: nodeID, Number: 1, Stamp: time.Now().UnixNano()}
+	for _, other := range others {
+		if other.Number >= own.Number {
+			own.Number = other.Number + 1
+		}
+	}
+	for {
+		if err = setApplied(key, own, time.Until(deadline)); err != nil {
+			unlock()
+			return nil, err
+		}
+		if others, err = lockTickets(); err != nil {
+			unlock()
+			return nil, err
+		}
+		first := true
+		for _, other := range others {
+			if other.Choosing || other.Number != 0 &&
+				(other.Number < own.Number || other.Number == own.Number && other.Node < own.Node) {
+				first = false
+			}
+		}
+		if first {
+			clusterLocked = true
+			go refreshTicket(key, *own, stop, stopped)
+			return unlock, nil
+		}
+		if time.Now().After(deadline) {
+			unlock()
+			return nil, fmt.Errorf("Cluster lock not acquired after %v", lockTimeout)
+		}
+		time.Sleep(applyPoll)
+		// Refreshed, our ticket doesn't expire while waiting
+		own.Stamp = time.Now().UnixNano()
+	}
+}
+
+// refreshTicket refreshes our ticket while we hold the lock, until stop is closed
+func refreshTicket(key string, own lockTicket, stop <-chan struct{}, stopped chan<- struct{}) {
+	defer close(stopped)
+	ticker := time.NewTicker(lockRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			own.Stamp = time.Now().UnixNano()
+			if err := bdb.Set(key, &own); err != nil {
+				Log.WarningF("[DB] Cluster lock not refreshed: %v", err)
+			}
+		}
+	}
+}
+
+// lockTickets returns the live tickets of the other members, those changed by their member
+// within lockLease as seen by our clock
+func lockTickets() ([]lockTicket, error) {
+	all := make([]lockTicket, 0)
+	if err := bdb.List(&all, lockPrefix+"*"); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	seen := make(map[string]ticketSeen, len(all))
+	tickets := make([]lockTicket, 0, len(all))
+	for _, ticket := range all {
+		if ticket.Node == nodeID {
+			continue
+		}
+		last, ok := ticketsSeen[ticket.Node]
+		if !ok || last.stamp != ticket.Stamp {
+			last = ticketSeen{stamp: ticket.Stamp, at: now}
+		}
+		seen[ticket.Node] = last
+		if now.Sub(last.at) < lockLease {
+			tickets = append(tickets, ticket)
+		}
+	}
+	ticketsSeen = seen
+	return tickets, nil
+}
+
+// setApplied stores value, a pointer, at key and waits for our DB to apply it, writing it again
+// as an HA store drops the writes received before the election of its leader.
+// value must differ from the one stored.
+func setApplied(key string, value interface{}, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if err := bdb.Set(key, value); err != nil {
+			return err
+		}
+		for i := 0; i < 100 && time.Now().Before(deadline); i++ {
+			stored := reflect.New(reflect.TypeOf(value).Elem())
+			if bdb.Get(key, stored.Interface()) == nil && reflect.DeepEqual(stored.Interface(), value) {
+				return nil
+			}
+			time.Sleep(applyPoll)
+		}
+	}
+	return errNotApplied
+}
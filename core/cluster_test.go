@@ -0,0 +1,134 @@
+package addd
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// otherTicket stores the ticket of another member of the cluster, as it would
+func otherTicket(t *testing.T, ticket *lockTicket) {
+	if err := bdb.Set(lockPrefix+ticket.Node, ticket); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClusterLock(t *testing.T) {
+	UseClusterLock(true)
+	defer UseClusterLock(false)
+	useMemStore(t, "example.com")
+
+	tests := []struct {
+		name    string
+		ticket  *lockTicket
+		waiting bool
+	}{
+		{"lock held", &lockTicket{Node: "other", Number: 1, Stamp: time.Now().UnixNano()}, true},
+		{"member choosing", &lockTicket{Node: "other", Choosing: true, Stamp: time.Now().UnixNano()}, true},
+		{"member expired", &lockTicket{Node: "other", Number: 1, Stamp: 1}, false},
+		// Its clock being late doesn't make the ticket of a live member expire
+		{"member clock late", &lockTicket{Node: "other", Number: 1, Stamp: time.Now().Add(-time.Hour).UnixNano()}, true},
+	}
+	for _, tt := range tests {
+		otherTicket(t, tt.ticket)
+		// The expired ticket was read unchanged for the lease
+		clusterMutex.Lock()
+		ticketsSeen = map[string]ticketSeen{"other": {stamp: 1, at: time.Now().Add(-lockLease)}}
+		clusterMutex.Unlock()
+		done := make(chan error)
+		go func() {
+			done <- StoreRecord(record("www.example.com", "A", "10.0.0.1"))
+		}()
+		select {
+		case err := <-done:
+			if tt.waiting {
+				t.Errorf("%s: commit not waiting, %v", tt.name, err)
+			}
+		case <-time.After(100 * time.Millisecond):
+			if !tt.waiting {
+				t.Errorf("%s: commit waiting", tt.name)
+			}
+			bdb.Delete(lockPrefix + "other")
+			if err := <-done; err != nil {
+				t.Errorf("%s: commit = %v", tt.name, err)
+			}
+		}
+		bdb.Delete(lockPrefix + "other")
+		tickets := make([]lockTicket, 0)
+		if bdb.List(&tickets, lockPrefix+"*"); len(tickets) != 0 {
+			t.Errorf("%s: tickets %v left", tt.name, tickets)
+		}
+	}
+}
+
+func TestClusterCommits(t *testing.T) {
+	UseClusterLock(true)
+	defer UseClusterLock(false)
+	store := useMemStore(t, "example.com")
+
+	// Another member commits while we wait, our batch applies to its changes
+	otherTicket(t, &lockTicket{Node: "other", Number: 1, Stamp: time.Now().UnixNano()})
+	done := make(chan error)
+	go func() {
+		done <- StoreRecord(record("www.example.com", "A", "10.0.0.2"))
+	}()
+	time.Sleep(50 * time.Millisecond)
+	set := NewRRSet("www.example.com", "A")
+	set.Add(record("www.example.com", "A", "10.0.0.1"))
+	store.Set("com.example.www_A", set)
+	store.Delete(lockPrefix + "other")
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"www.example.com 300 IN A 10.0.0.1", "www.example.com 300 IN A 10.0.0.2"}
+	if got := storedRecords(t); !reflect.DeepEqual(got, want) {
+		t.Errorf("records = %q, want %q", got, want)
+	}
+
+	// The batch left pending by another member is completed by our next commit, not when our DB is opened
+	set = NewRRSet("mail.example.com", "A")
+	set.Add(record("mail.example.com", "A", "10.0.0.3"))
+	store.Set(txnKey, &txn{
+		Sets:  []RRSet{*set},
+		Zones: []txnZone{{Zone: "example.com.", Added: set.Records}},
+	})
+	if err := NewDB(store); err != nil {
+		t.Fatal(err)
+	}
+	if len(pendingTxn().Sets) == 0 {
+		t.Error("pending batch replayed without the cluster lock")
+	}
+	if err := StoreRecord(record("ftp.example.com", "A", "10.0.0.4")); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"ftp.example.com 300 IN A 10.0.0.4", "mail.example.com 300 IN A 10.0.0.3",
+		"www.example.com 300 IN A 10.0.0.1", "www.example.com 300 IN A 10.0.0.2"}
+	if got := storedRecords(t); !reflect.DeepEqual(got, want) {
+		t.Errorf("records = %q after the replay, want %q", got, want)
+	}
+}
+
+func TestClusterLockRefreshed(t *testing.T) {
+	UseClusterLock(true)
+	defer UseClusterLock(false)
+	useMemStore(t, "example.com")
+	defer func(refresh time.Duration) { lockRefresh = refresh }(lockRefresh)
+	lockRefresh = 10 * time.Millisecond
+
+	unlock, err := lockCluster()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var first, last lockTicket
+	bdb.Get(lockPrefix+nodeID, &first)
+	time.Sleep(50 * time.Millisecond)
+	bdb.Get(lockPrefix+nodeID, &last)
+	unlock()
+	if last.Stamp == first.Stamp || last.Number != first.Number {
+		t.Errorf("ticket %+v held then %+v, want refreshed", first, last)
+	}
+	tickets := make([]lockTicket, 0)
+	if bdb.List(&tickets, lockPrefix+"*"); len(tickets) != 0 {
+		t.Errorf("tickets %v left", tickets)
+	}
+}
@@ -1,22 +1,128 @@
 package addd
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
-
-	"github.com/redsux/habolt"
+	"sort"
+	"strings"
+	"time"
 )
 
+// readyKey is written by WaitDB to know when our writes are applied
+const readyKey = "addd/ready"
+
+// Store is the key/value store holding our DB, values are encoded in JSON.
+// List decodes the values whose key matches one of the shell patterns (all if none) in the slice pointed by values,
+// ListRaw returns all the encoded values by key and Addresses the ones of the members of our cluster.
+type Store interface {
+	Close() error
+	Get(key string, value interface{}) error
+	Set(key string, value interface{}) error
+	Delete(key string) error
+	List(values interface{}, patterns ...string) error
+	ListRaw() (map[string]string, error)
+	Addresses() ([]string, error)
+}
+
 var (
-	bdb habolt.Store
+	bdb Store
+
+	// ErrCNAMEConflict is returned when a CNAME would coexist with other data at the same name
+	ErrCNAMEConflict = errors.New("CNAME and other data can't coexist")
 )
 
 // NewDB initialize our key/value store
-func NewDB(db habolt.Store) error {
+func NewDB(db Store) error {
 	if db == nil {
 		return errors.New("NewDB nil argument not allowed")
 	}
 	bdb = db
+	// The members of a cluster replay it under the cluster lock, at their next commit
+	if !clustered {
+		if err := replayTxn(); err != nil {
+			Log.WarningF("[DB] Batch not completed, it will be replayed: %v", err)
+		}
+	}
+	return nil
+}
+
+// MigrateRecords converts the single Records stored by previous versions into RRSets holding
+// them, at the key of their name and type which is now case insensitive. Each RRSet is stored
+// through a Batch, our DB must accept our writes and the zones of the records must exist.
+// The records which can't be migrated are kept and logged.
+func MigrateRecords() error {
+	checkBdp()
+	raw, err := bdb.ListRaw()
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(raw))
+	for key := range raw {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// Records whose keys only differ by case are merged in the same RRSet
+	legacy := make(map[string][]string)
+	records := make(map[string][]*Record)
+	newKeys := make([]string, 0)
+	for _, key := range keys {
+		var fields map[string]json.RawMessage
+		if json.Unmarshal([]byte(raw[key]), &fields) != nil || fields["fqdn"] == nil ||
+			fields["address"] == nil || fields["records"] != nil {
+			continue
+		}
+		rec := DefaultRecord()
+		if err := json.Unmarshal([]byte(raw[key]), rec); err != nil {
+			Log.WarningF("[DB] Record %v can't be migrated: %v", key, err)
+			continue
+		}
+		newKey, err := getKey(rec.Name, rec.Type)
+		if err != nil {
+			Log.WarningF("[DB] Record %v can't be migrated: %v", key, err)
+			continue
+		}
+		if _, ok := records[newKey]; !ok {
+			newKeys = append(newKeys, newKey)
+		}
+		records[newKey] = append(records[newKey], rec)
+		legacy[newKey] = append(legacy[newKey], key)
+	}
+
+	// An RRSet may already be stored for a record whose key differs by case, the batch adds to it
+	migrated := make([]string, 0, len(newKeys))
+	for _, newKey := range newKeys {
+		rec := records[newKey][0]
+		Log.NoticeF("[DB] Migration of the records %v %v to an RRSet", rec.Name, rec.Type)
+		b := NewBatch()
+		for _, rec := range records[newKey] {
+			b.StoreRecord(rec)
+		}
+		if err := b.Commit(); err != nil {
+			Log.WarningF("[DB] Records %v %v not migrated, they are kept: %v", rec.Name, rec.Type, err)
+			continue
+		}
+		migrated = append(migrated, newKey)
+	}
+	if len(migrated) == 0 {
+		return nil
+	}
+
+	unlock, err := lockCluster()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	for _, newKey := range migrated {
+		for _, key := range legacy[newKey] {
+			if key != newKey {
+				if err := bdb.Delete(key); err != nil {
+					return err
+				}
+			}
+		}
+	}
 	return nil
 }
 
@@ -26,61 +132,200 @@ func CloseDB() error {
 	return bdb.Close()
 }
 
-// ListRecords returns all Record stored in our DB
-func ListRecords() (rec []Record, err error) {
+// WaitDB waits for our DB to apply our writes, which an HA store only does once its leader is elected,
+// and fails after timeout
+func WaitDB(timeout time.Duration) error {
 	checkBdp()
-	rec = make([]Record, 0)
-	err = bdb.List(&rec)
-	return
+	mark := map[string]int64{"time": time.Now().UnixNano()}
+	if err := setApplied(readyKey, &mark, timeout); err != errNotApplied {
+		return err
+	}
+	return fmt.Errorf("Writes not applied after %v, no leader elected", timeout)
 }
 
-// GetRecord retrieves the record
-func GetRecord(domain string, rtype string) (rr *Record, err error) {
-	checkBdp()
-	key, err := getKey(domain, rtype)
+// ListRRSets returns all RRSet of the default view stored in our DB
+func ListRRSets() (sets []RRSet, err error) {
+	all, err := listSets()
 	if err != nil {
 		return
 	}
-	rr = DefaultRecord()
-	err = bdb.Get(key, rr)
+	sets = make([]RRSet, 0, len(all))
+	for _, set := range all {
+		if set.View == "" {
+			sets = append(sets, set)
+		}
+	}
 	return
 }
 
-// StoreRecord stores the record in our DB
-func StoreRecord(rr *Record) (err error) {
+// listSets returns the RRSets of all the views stored in our DB
+func listSets() (sets []RRSet, err error) {
 	checkBdp()
-	key, err := getKey(rr.Name, rr.Type)
+	batchLock.RLock()
+	defer batchLock.RUnlock()
+	err = readTxn(func(t *txn) error {
+		all := make([]RRSet, 0)
+		if err := bdb.List(&all); err != nil {
+			return err
+		}
+		// Our DB also stores internal objects (zones, journal...), they have no fqdn
+		sets = make([]RRSet, 0, len(all))
+		for _, set := range all {
+			if set.Name != "" {
+				sets = append(sets, set)
+			}
+		}
+		sets = t.apply(sets, func(string) bool { return true })
+		return nil
+	})
+	return
+}
+
+// ListRecords returns all Record stored in our DB
+func ListRecords() (rec []Record, err error) {
+	sets, err := ListRRSets()
 	if err != nil {
 		return
 	}
-	err = bdb.Set(key, rr)
+	rec = make([]Record, 0)
+	for _, set := range sets {
+		rec = append(rec, set.Records...)
+	}
 	return
 }
 
-// DeleteRecord deletes the record in our DB
-func DeleteRecord(rr *Record) (err error) {
+// GetRRSet retrieves all the records of domain with the type rtype
+func GetRRSet(domain string, rtype string) (*RRSet, error) {
 	checkBdp()
-	key, err := getKey(rr.Name, rr.Type)
-	if err != nil {
-		return
+	batchLock.RLock()
+	defer batchLock.RUnlock()
+	set := NewRRSet(domain, rtype)
+	if _, err := set.key(); err != nil {
+		return nil, err
 	}
-	err = bdb.Delete(key)
-	return
+	err := readTxn(func(t *txn) error {
+		set = NewRRSet(domain, rtype)
+		return t.getSet(set)
+	})
+	return set, err
 }
 
-// IPs returns list of IPs related to our Store
-func IPs() ([]string, error) {
-	lst, err := bdb.Addresses()
+// StoreRRSet replaces the whole RRSet in our DB
+func StoreRRSet(set *RRSet) error {
+	b := NewBatch()
+	if err := b.StoreRRSet(set); err != nil {
+		return err
+	}
+	return b.Commit()
+}
+
+// DeleteRRSet deletes all the records of domain with the type rtype
+func DeleteRRSet(domain string, rtype string) error {
+	b := NewBatch()
+	if err := b.DeleteRRSet(domain, rtype); err != nil {
+		return err
+	}
+	return b.Commit()
+}
+
+// ListName returns all the RRSet of domain
+func ListName(domain string) ([]RRSet, error) {
+	checkBdp()
+	batchLock.RLock()
+	defer batchLock.RUnlock()
+	var sets []RRSet
+	err := readTxn(func(t *txn) (err error) {
+		sets, err = listName(t, "", domain)
+		return
+	})
+	return sets, err
+}
+
+// listName returns the RRSets of domain stored at keys starting with prefix, with those of t.
+// batchLock must be held.
+func listName(t *txn, prefix, domain string) ([]RRSet, error) {
+	key, err := reverseKey(domain)
 	if err != nil {
 		return nil, err
 	}
-	result := make([]string, 0)
-	for _, addr := range lst {
-		result = append(result, addr.Address)
+	sets := make([]RRSet, 0)
+	if err := bdb.List(&sets, prefix+escapePattern(key)+"_*"); err != nil {
+		return nil, err
+	}
+	sets = t.apply(sets, func(k string) bool { return strings.HasPrefix(k, prefix+key+"_") })
+	// The key of a name whose first label continues with an underscore matches too
+	name := cleanName(domain)
+	result := make([]RRSet, 0, len(sets))
+	for _, set := range sets {
+		if set.Name == name {
+			result = append(result, set)
+		}
 	}
 	return result, nil
 }
 
+// NameExists returns true if domain owns records or is an empty non-terminal (RFC 8020),
+// i.e. if a key starts with its reversed name
+func NameExists(domain string) (bool, error) {
+	checkBdp()
+	batchLock.RLock()
+	defer batchLock.RUnlock()
+	var exists bool
+	err := readTxn(func(t *txn) (err error) {
+		exists, err = nameExists(t, "", domain)
+		return
+	})
+	return exists, err
+}
+
+// nameExists returns true if a key starts with prefix followed by the reversed name of domain,
+// with the RRSets of t. batchLock must be held.
+func nameExists(t *txn, prefix, domain string) (bool, error) {
+	// Its own RRSets first, then those of its subdomains
+	if sets, err := listName(t, prefix, domain); err != nil || len(sets) > 0 {
+		return len(sets) > 0, err
+	}
+	key, _ := reverseKey(domain)
+	sets := make([]RRSet, 0)
+	if err := bdb.List(&sets, prefix+escapePattern(key)+".*"); err != nil {
+		return false, err
+	}
+	sets = t.apply(sets, func(k string) bool { return strings.HasPrefix(k, prefix+key+".") })
+	return len(sets) > 0, nil
+}
+
+// DeleteName deletes all the RRSet of domain
+func DeleteName(domain string) error {
+	b := NewBatch()
+	if err := b.DeleteName(domain); err != nil {
+		return err
+	}
+	return b.Commit()
+}
+
+// StoreRecord adds the record to its RRSet in our DB
+func StoreRecord(rr *Record) error {
+	b := NewBatch()
+	if err := b.StoreRecord(rr); err != nil {
+		return err
+	}
+	return b.Commit()
+}
+
+// DeleteRecord removes the record from its RRSet in our DB
+func DeleteRecord(rr *Record) error {
+	b := NewBatch()
+	if err := b.DeleteRecord(rr); err != nil {
+		return err
+	}
+	return b.Commit()
+}
+
+// IPs returns list of IPs related to our Store
+func IPs() ([]string, error) {
+	return bdb.Addresses()
+}
+
 func checkBdp() {
 	if bdb == nil {
 		err := fmt.Errorf("Internal database not define")
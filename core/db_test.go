@@ -0,0 +1,300 @@
+package addd
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redsux/addd/core/dbtest"
+)
+
+var _ Store = (*dbtest.Store)(nil)
+
+// errInvalid stands for any error of an invalid record
+var errInvalid = errors.New("invalid")
+
+// useMemStore opens an empty in-memory DB holding the zones named
+func useMemStore(t *testing.T, zones ...string) *dbtest.Store {
+	store := dbtest.NewStore()
+	if err := NewDB(store); err != nil {
+		t.Fatal(err)
+	}
+	for _, zone := range zones {
+		if err := StoreZone(DefaultZone(zone)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return store
+}
+
+func record(name, rtype, data string) *Record {
+	rec := DefaultRecord()
+	rec.Name, rec.Type, rec.TTL = name, rtype, 300
+	switch strings.ToUpper(rtype) {
+	case "A", "AAAA":
+		rec.Address = data
+	case "TXT":
+		rec.Text = []string{data}
+	default:
+		rec.Target = data
+	}
+	return rec
+}
+
+// storedRecords returns the records of our DB as sorted strings
+func storedRecords(t *testing.T) []string {
+	recs, err := ListRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lst := make([]string, 0, len(recs))
+	for _, rec := range recs {
+		lst = append(lst, rec.String())
+	}
+	sort.Strings(lst)
+	return lst
+}
+
+func TestRecordsInRRSets(t *testing.T) {
+	useMemStore(t, "example.com")
+	for _, rec := range []*Record{
+		record("www.example.com", "A", "10.0.0.1"),
+		record("WWW.example.com.", "a", "10.0.0.2"),
+		record("www.example.com", "A", "10.0.0.2"),
+		record("www.example.com", "AAAA", "2001:db8::1"),
+		record("mail.example.com", "A", "10.0.0.3"),
+	} {
+		if err := StoreRecord(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	set, err := GetRRSet("Www.Example.com", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set.Name != "www.example.com" || set.Type != "A" || len(set.Records) != 2 {
+		t.Errorf("GetRRSet() = %v %v %v", set.Name, set.Type, set.Records)
+	}
+
+	if err := DeleteRecord(record("www.example.com", "A", "10.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteRecord(record("www.example.com", "A", "10.0.0.9")); err == nil {
+		t.Error("missing record deleted")
+	}
+	want := []string{
+		"mail.example.com 300 IN A 10.0.0.3",
+		"www.example.com 300 IN A 10.0.0.2",
+		"www.example.com 300 IN AAAA 2001:db8::1",
+	}
+	if got := storedRecords(t); !reflect.DeepEqual(got, want) {
+		t.Errorf("records = %q, want %q", got, want)
+	}
+
+	// The last member removed, the RRSet is deleted
+	if err := DeleteRecord(record("www.example.com", "A", "10.0.0.2")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetRRSet("www.example.com", "A"); err == nil {
+		t.Error("empty RRSet kept")
+	}
+	if err := DeleteName("WWW.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := storedRecords(t), want[:1]; !reflect.DeepEqual(got, want) {
+		t.Errorf("records = %q, want %q", got, want)
+	}
+}
+
+func TestRRSetTTL(t *testing.T) {
+	set := NewRRSet("www.example.com.", "a")
+	if !set.Add(record("www.example.com", "A", "10.0.0.1")) {
+		t.Error("Add() = false for a new member")
+	}
+	if set.Add(record("www.example.com", "A", "10.0.0.1")) {
+		t.Error("Add() = true for an existing member")
+	}
+	// All members share the TTL of the last one added
+	rec := record("www.example.com", "A", "10.0.0.2")
+	rec.TTL = 60
+	set.Add(rec)
+	for _, member := range set.Records {
+		if member.TTL != 60 {
+			t.Errorf("member %v kept its TTL", member)
+		}
+	}
+	if set.Remove(record("www.example.com", "A", "10.0.0.9")) || !set.Remove(rec) || len(set.Records) != 1 {
+		t.Errorf("Remove() left %v", set.Records)
+	}
+}
+
+func TestMigrateRecords(t *testing.T) {
+	store := dbtest.NewStore()
+	// Records stored alone by previous versions, at keys keeping the case of their name and type
+	legacy := map[string]*Record{
+		"com.example.www_A":  record("www.example.com", "A", "10.0.0.1"),
+		"com.example.WWW_A":  record("WWW.example.com", "A", "10.0.0.2"),
+		"com.example.Mail_a": record("Mail.example.com", "a", "10.0.0.3"),
+	}
+	for key, rec := range legacy {
+		if err := store.Set(key, rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// An RRSet stored since, with a member at a key differing by case
+	set := NewRRSet("ftp.example.com", "A")
+	set.Add(record("ftp.example.com", "A", "10.0.0.4"))
+	store.Set("com.example.ftp_A", set)
+	store.Set("com.example.FTP_A", record("FTP.example.com", "A", "10.0.0.5"))
+	// Outside our zones, a record is kept
+	store.Set("org.example.www_A", record("www.example.org", "A", "10.0.0.6"))
+
+	if err := NewDB(store); err != nil {
+		t.Fatal(err)
+	}
+	if err := StoreZone(DefaultZone("example.com")); err != nil {
+		t.Fatal(err)
+	}
+	if err := MigrateRecords(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"ftp.example.com 300 IN A 10.0.0.4",
+		"ftp.example.com 300 IN A 10.0.0.5",
+		"mail.example.com 300 IN A 10.0.0.3",
+		"www.example.com 300 IN A 10.0.0.1",
+		"www.example.com 300 IN A 10.0.0.2",
+	}
+	if got := storedRecords(t); !reflect.DeepEqual(got, want) {
+		t.Errorf("records = %q, want %q", got, want)
+	}
+	raw, _ := store.ListRaw()
+	keys := make([]string, 0, len(raw))
+	for key := range raw {
+		if !strings.HasPrefix(key, "addd/") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	if want := []string{"com.example.ftp_A", "com.example.mail_A", "com.example.www_A", "org.example.www_A"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("keys = %q, want %q", keys, want)
+	}
+	// Each RRSet migrated is journaled
+	if serial, _ := GetSerial("example.com"); serial != 4 {
+		t.Errorf("GetSerial() = %v after the migration, want 4", serial)
+	}
+
+	// Migrating again changes nothing
+	if err := MigrateRecords(); err != nil {
+		t.Fatal(err)
+	}
+	if got := storedRecords(t); !reflect.DeepEqual(got, want) {
+		t.Errorf("records = %q after a second migration, want %q", got, want)
+	}
+	if serial, _ := GetSerial("example.com"); serial != 4 {
+		t.Errorf("GetSerial() = %v after a second migration, want 4", serial)
+	}
+}
+
+func TestCNAMEConflict(t *testing.T) {
+	useMemStore(t, "example.com")
+	steps := []struct {
+		rec *Record
+		err error
+	}{
+		{record("www.example.com", "A", "10.0.0.1"), nil},
+		{record("www.example.com", "CNAME", "web.example.com"), ErrCNAMEConflict},
+		{record("web.example.com", "CNAME", "host.example.com"), nil},
+		{record("web.example.com", "AAAA", "2001:db8::1"), ErrCNAMEConflict},
+		// A name has a single CNAME, the new one replaces it
+		{record("web.example.com", "CNAME", "host2.example.com"), nil},
+		{record("web.example.com", "CNAME", "host..example.com"), errInvalid},
+	}
+	for _, step := range steps {
+		err := StoreRecord(step.rec)
+		if (step.err == errInvalid && err == nil) || (step.err != errInvalid && err != step.err) {
+			t.Errorf("StoreRecord(%v) = %v, want %v", step.rec, err, step.err)
+		}
+	}
+	want := []string{
+		"web.example.com 300 IN CNAME host2.example.com.",
+		"www.example.com 300 IN A 10.0.0.1",
+	}
+	if got := storedRecords(t); !reflect.DeepEqual(got, want) {
+		t.Errorf("records = %q, want %q", got, want)
+	}
+}
+
+func TestNameExists(t *testing.T) {
+	useMemStore(t, "example.com")
+	for _, rec := range []*Record{
+		record("www.example.com", "A", "10.0.0.1"),
+		record("host.sub.example.com", "A", "10.0.0.2"),
+		record("*.dyn.example.com", "A", "10.0.0.3"),
+		record("wwwx.example.com", "A", "10.0.0.4"),
+		record("_sip_x._tcp.example.com", "TXT", "sip"),
+	} {
+		if err := StoreRecord(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"www.example.com", true},
+		{"WWW.example.com.", true},
+		{"sub.example.com", true},
+		{"example.com", true},
+		{"com", true},
+		{"host.sub.example.com", true},
+		{"*.dyn.example.com", true},
+		{"dyn.example.com", true},
+		{"a.www.example.com", false},
+		{"ww.example.com", false},
+		{"none.example.com", false},
+		// Characters of the patterns listing our DB match themselves
+		{"*.example.com", false},
+		{"?ww.example.com", false},
+		{"[w]ww.example.com", false},
+		{"a.dyn.example.com", false},
+		{"_tcp.example.com", true},
+		{"_sip._tcp.example.com", false},
+	}
+	for _, tt := range tests {
+		got, err := NameExists(tt.name)
+		if err != nil || got != tt.want {
+			t.Errorf("NameExists(%v) = %v, %v, want %v", tt.name, got, err, tt.want)
+		}
+	}
+	for name, want := range map[string]int{"www.example.com": 1, "_sip._tcp.example.com": 0, "sub.example.com": 0} {
+		if sets, err := ListName(name); err != nil || len(sets) != want {
+			t.Errorf("ListName(%v) = %v, %v, want %d RRSets", name, sets, err, want)
+		}
+	}
+}
+
+// droppingStore drops the writes, as an HA store without leader
+type droppingStore struct {
+	*dbtest.Store
+}
+
+func (s droppingStore) Set(key string, value interface{}) error {
+	return nil
+}
+
+func TestWaitDB(t *testing.T) {
+	useMemStore(t)
+	if err := WaitDB(time.Second); err != nil {
+		t.Errorf("WaitDB() = %v", err)
+	}
+	if err := NewDB(droppingStore{dbtest.NewStore()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := WaitDB(200 * time.Millisecond); err == nil {
+		t.Error("WaitDB() = nil without the writes applied")
+	}
+}
@@ -0,0 +1,125 @@
+// Package dbtest provides an in-memory Store for the tests of our packages
+package dbtest
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// ErrKeyNotFound is returned when getting a missing key
+var ErrKeyNotFound = errors.New("Key not found")
+
+// Store is an in-memory Store of our DB, values are kept in JSON as in BoltDB
+type Store struct {
+	mutex   sync.Mutex
+	values  map[string]string
+	members []string
+}
+
+// NewStore creates an empty Store, members are the addresses of the cluster (127.0.0.1 by default)
+func NewStore(members ...string) *Store {
+	if len(members) == 0 {
+		members = []string{"127.0.0.1"}
+	}
+	return &Store{
+		values:  make(map[string]string),
+		members: members,
+	}
+}
+
+// Close does nothing, the values stay available
+func (s *Store) Close() error {
+	return nil
+}
+
+// ListRaw returns a copy of all the "key"/"value"
+func (s *Store) ListRaw() (map[string]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	raw := make(map[string]string, len(s.values))
+	for key, val := range s.values {
+		raw[key] = val
+	}
+	return raw, nil
+}
+
+// List decodes the values whose key matches one of the patterns (all if none) in the slice
+// pointed by values, in the order of their keys. As BoltDB, it fails on the first value not decoded.
+func (s *Store) List(values interface{}, patterns ...string) error {
+	vtype := reflect.TypeOf(values)
+	if vtype.Kind() != reflect.Ptr || vtype.Elem().Kind() != reflect.Slice {
+		return errors.New("Not a Pointer of Slice")
+	}
+	slice := reflect.ValueOf(values).Elem()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	keys := make([]string, 0, len(s.values))
+	for key := range s.values {
+		if found(key, patterns) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := reflect.New(slice.Type().Elem())
+		if err := json.Unmarshal([]byte(s.values[key]), value.Interface()); err != nil {
+			return err
+		}
+		slice.Set(reflect.Append(slice, value.Elem()))
+	}
+	return nil
+}
+
+// Get decodes the value of key in value, ErrKeyNotFound is returned if missing
+func (s *Store) Get(key string, value interface{}) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	val, ok := s.values[key]
+	if !ok {
+		return ErrKeyNotFound
+	}
+	return json.Unmarshal([]byte(val), value)
+}
+
+// Set stores value encoded at key
+func (s *Store) Set(key string, value interface{}) error {
+	val, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.values[key] = string(val)
+	return nil
+}
+
+// Delete removes key, deleting a missing key is not an error
+func (s *Store) Delete(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.values, key)
+	return nil
+}
+
+// Addresses returns the members given to NewStore
+func (s *Store) Addresses() ([]string, error) {
+	return append([]string{}, s.members...), nil
+}
+
+// found returns true if str matches one of the patterns, or if there is no pattern
+func found(str string, patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, err := filepath.Match(pattern, str); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,199 @@
+package addd
+
+import (
+	"crypto"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	dnssecKey = "addd/dnssec"
+)
+
+var (
+	dnssecLock sync.Mutex
+
+	// dnssecAlgorithms are the algorithms we can generate keys with, by their name
+	dnssecAlgorithms = map[string]uint8{
+		"ECDSAP256SHA256": dns.ECDSAP256SHA256,
+		"ED25519":         dns.ED25519,
+	}
+)
+
+// ZoneKey is a DNSSEC key of a zone, used to sign the DNSKEY RRSet (KSK) or all the others (ZSK)
+type ZoneKey struct {
+	Zone    string `json:"zone"`
+	Tag     uint16 `json:"tag"`
+	KSK     bool   `json:"ksk"`
+	DNSKEY  string `json:"dnskey"            binding:"required"`
+	Private string `json:"private,omitempty" binding:"required"`
+}
+
+// dnssecList is the DB object holding the DNSSEC keys of all our zones
+type dnssecList struct {
+	Keys map[string][]*ZoneKey `json:"dnssec"`
+}
+
+// GenerateZoneKey creates a new key for zone with the algorithm ECDSAP256SHA256 or ED25519
+func GenerateZoneKey(zone string, ksk bool, algorithm string) (*ZoneKey, error) {
+	alg, ok := dnssecAlgorithms[strings.ToUpper(algorithm)]
+	if !ok {
+		return nil, fmt.Errorf("DNSSEC algorithm %v not supported", algorithm)
+	}
+	key := &dns.DNSKEY{
+		Hdr: dns.RR_Header{
+			Name:   zoneName(zone),
+			Rrtype: dns.TypeDNSKEY,
+			Class:  dns.ClassINET,
+			Ttl:    3600,
+		},
+		Flags:     dns.ZONE,
+		Protocol:  3,
+		Algorithm: alg,
+	}
+	if ksk {
+		key.Flags |= dns.SEP
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		return nil, err
+	}
+	return ImportZoneKey(zone, key.String(), key.PrivateKeyString(priv))
+}
+
+// ImportZoneKey stores for zone the key made of its DNSKEY record and its private part
+// (BIND Private-key-format), the KSK flag is read from the DNSKEY
+func ImportZoneKey(zone string, dnskey, private string) (*ZoneKey, error) {
+	zk := &ZoneKey{
+		Zone:    zoneName(zone),
+		DNSKEY:  dnskey,
+		Private: private,
+	}
+	key, _, err := zk.Parse()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := GetZone(zk.Zone); err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(key.Hdr.Name, zk.Zone) {
+		return nil, fmt.Errorf("DNSKEY %v doesn't belong to zone %v", key.Hdr.Name, zk.Zone)
+	}
+	zk.Tag, zk.KSK = key.KeyTag(), key.Flags&dns.SEP != 0
+
+	dnssecLock.Lock()
+	defer dnssecLock.Unlock()
+	lst, err := getDnssec()
+	if err != nil {
+		return nil, err
+	}
+	for _, other := range lst.Keys[zk.Zone] {
+		if other.Tag == zk.Tag {
+			return nil, fmt.Errorf("Zone %v has already a key with the tag %d", zk.Zone, zk.Tag)
+		}
+	}
+	lst.Keys[zk.Zone] = append(lst.Keys[zk.Zone], zk)
+	if err := bdb.Set(dnssecKey, lst); err != nil {
+		return nil, err
+	}
+	return zk, nil
+}
+
+// Parse returns the DNSKEY record and the signer of the key, checking they match
+func (k ZoneKey) Parse() (*dns.DNSKEY, crypto.Signer, error) {
+	rr, err := dns.NewRR(k.DNSKEY)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, ok := rr.(*dns.DNSKEY)
+	if !ok || key.Flags&dns.ZONE == 0 {
+		return nil, nil, fmt.Errorf("%v is not a DNSKEY of a zone", k.DNSKEY)
+	}
+	priv, err := key.NewPrivateKey(k.Private)
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("DNSSEC key %d can't sign", key.KeyTag())
+	}
+	// A signature of the DNSKEY itself proves both parts match
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: key.Hdr.Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: key.Hdr.Ttl},
+		Algorithm:  key.Algorithm,
+		SignerName: key.Hdr.Name,
+		KeyTag:     key.KeyTag(),
+		Inception:  uint32(time.Now().Unix()) - 3600,
+		Expiration: uint32(time.Now().Unix()) + 3600,
+	}
+	if err := sig.Sign(signer, []dns.RR{key}); err != nil {
+		return nil, nil, err
+	}
+	if err := sig.Verify(key, []dns.RR{key}); err != nil {
+		return nil, nil, fmt.Errorf("DNSSEC key %d doesn't match its private part", key.KeyTag())
+	}
+	return key, signer, nil
+}
+
+// ZoneKeys returns the DNSSEC keys of zone, in their creation order
+func ZoneKeys(zone string) ([]ZoneKey, error) {
+	lst, err := getDnssec()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]ZoneKey, 0)
+	for _, key := range lst.Keys[zoneName(zone)] {
+		keys = append(keys, *key)
+	}
+	return keys, nil
+}
+
+// DeleteZoneKey deletes the DNSSEC key of zone with the tag
+func DeleteZoneKey(zone string, tag uint16) error {
+	dnssecLock.Lock()
+	defer dnssecLock.Unlock()
+	lst, err := getDnssec()
+	if err != nil {
+		return err
+	}
+	name := zoneName(zone)
+	for i, key := range lst.Keys[name] {
+		if key.Tag == tag {
+			lst.Keys[name] = append(lst.Keys[name][:i], lst.Keys[name][i+1:]...)
+			if len(lst.Keys[name]) == 0 {
+				delete(lst.Keys, name)
+			}
+			return bdb.Set(dnssecKey, lst)
+		}
+	}
+	return fmt.Errorf("Zone %v has no key with the tag %d", name, tag)
+}
+
+// dropZoneKeys deletes all the DNSSEC keys of zone
+func dropZoneKeys(zone string) error {
+	dnssecLock.Lock()
+	defer dnssecLock.Unlock()
+	lst, err := getDnssec()
+	if err != nil {
+		return err
+	}
+	if _, ok := lst.Keys[zoneName(zone)]; !ok {
+		return nil
+	}
+	delete(lst.Keys, zoneName(zone))
+	return bdb.Set(dnssecKey, lst)
+}
+
+// getDnssec reads all our DNSSEC keys, an empty list is returned if none was created
+func getDnssec() (*dnssecList, error) {
+	checkBdp()
+	lst := &dnssecList{}
+	if err := bdb.Get(dnssecKey, lst); err != nil || lst.Keys == nil {
+		lst.Keys = make(map[string][]*ZoneKey)
+	}
+	return lst, nil
+}
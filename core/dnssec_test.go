@@ -0,0 +1,74 @@
+package addd
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestZoneKeys(t *testing.T) {
+	useMemStore(t, "example.com", "example.org")
+	ksk, err := GenerateZoneKey("Example.com", true, "ecdsap256sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zsk, err := GenerateZoneKey("example.com.", false, "ED25519")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ksk.Zone != "example.com." || !ksk.KSK || zsk.KSK || ksk.Tag == zsk.Tag {
+		t.Errorf("keys generated = %+v, %+v", ksk, zsk)
+	}
+	if _, err := GenerateZoneKey("example.com", false, "RSASHA1"); err == nil {
+		t.Error("key generated with an algorithm not supported")
+	}
+	if _, err := GenerateZoneKey("example.net", false, "ED25519"); err == nil {
+		t.Error("key generated for a missing zone")
+	}
+
+	// Imported keys must belong to the zone, be new and match their private part
+	if _, err := ImportZoneKey("example.com", ksk.DNSKEY, ksk.Private); err == nil {
+		t.Error("key imported twice")
+	}
+	if _, err := ImportZoneKey("example.org", ksk.DNSKEY, ksk.Private); err == nil {
+		t.Error("key of example.com. imported in example.org.")
+	}
+	if _, err := ImportZoneKey("example.com", ksk.DNSKEY, zsk.Private); err == nil {
+		t.Error("key imported with the private part of another")
+	}
+	if _, err := ImportZoneKey("example.com", "example.com. 3600 IN A 10.0.0.1", ksk.Private); err == nil {
+		t.Error("A record imported as a key")
+	}
+	key, _, err := ksk.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Algorithm != dns.ECDSAP256SHA256 || key.KeyTag() != ksk.Tag {
+		t.Errorf("Parse() = %v", key)
+	}
+
+	keys, err := ZoneKeys("example.com")
+	if err != nil || len(keys) != 2 || keys[0].Tag != ksk.Tag || keys[1].Tag != zsk.Tag {
+		t.Fatalf("ZoneKeys() = %v, %v", keys, err)
+	}
+	if err := DeleteZoneKey("example.com", ksk.Tag); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteZoneKey("example.com", ksk.Tag); err == nil {
+		t.Error("missing key deleted")
+	}
+	if keys, err := ZoneKeys("example.com"); err != nil || len(keys) != 1 || keys[0].Tag != zsk.Tag {
+		t.Errorf("ZoneKeys() = %v, %v after deleting the KSK", keys, err)
+	}
+
+	// Keys are deleted with their zone
+	if err := DeleteZone("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := StoreZone(DefaultZone("example.com")); err != nil {
+		t.Fatal(err)
+	}
+	if keys, err := ZoneKeys("example.com"); err != nil || len(keys) != 0 {
+		t.Errorf("ZoneKeys() = %v, %v after deleting the zone", keys, err)
+	}
+}
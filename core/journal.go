@@ -0,0 +1,189 @@
+package addd
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+const (
+	journalKey = "addd/journal"
+)
+
+var (
+	journalSize = 100
+	journalLock sync.Mutex
+	commitHooks = []func(zone string, serial uint32){}
+
+	// ErrJournalMissing is returned when the journal doesn't go back to the requested serial
+	ErrJournalMissing = errors.New("Journal doesn't contain this serial")
+)
+
+// JournalEntry lists the records removed and added when the serial changed from From to To
+type JournalEntry struct {
+	From    uint32   `json:"from"`
+	To      uint32   `json:"to"`
+	Removed []Record `json:"removed"`
+	Added   []Record `json:"added"`
+}
+
+// journalInfo locates the journal's entries in our DB
+type journalInfo struct {
+	First uint32 `json:"first"`
+	Count int    `json:"count"`
+}
+
+// SetJournalSize defines how many changes are kept for incremental transfers, 0 disables the journal
+func SetJournalSize(size int) {
+	if size >= 0 {
+		journalSize = size
+	}
+}
+
+// Journal returns the changes made in zone since the serial from, oldest first
+func Journal(zone string, from uint32) ([]JournalEntry, error) {
+	checkBdp()
+	cur, err := GetSerial(zone)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]JournalEntry, 0)
+	for serial := from; serial != cur; {
+		if len(entries) > journalSize {
+			return nil, ErrJournalMissing
+		}
+		entry := &JournalEntry{}
+		if err := bdb.Get(journalEntryKey(zone, serial), entry); err != nil {
+			return nil, ErrJournalMissing
+		}
+		entries = append(entries, *entry)
+		serial = entry.To
+	}
+	return entries, nil
+}
+
+// OnCommit registers fn to be called with the zone and its new serial after every change of our zones,
+// fn must not block
+func OnCommit(fn func(zone string, serial uint32)) {
+	commitHooks = append(commitHooks, fn)
+}
+
+// commit bumps the SOA serial of the zone of a transaction to the one planned, and journalizes the changes leading to it
+func commit(tz *txnZone) error {
+	if len(tz.Removed) == 0 && len(tz.Added) == 0 {
+		return nil
+	}
+	from, to, err := bumpSerial(tz.Zone, tz.From, tz.To)
+	if err != nil {
+		return err
+	}
+	if from != 0 && journalSize > 0 {
+		err = journalize(tz.Zone, &JournalEntry{
+			From:    from,
+			To:      to,
+			Removed: tz.Removed,
+			Added:   tz.Added,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	committed(tz.Zone, to)
+	return nil
+}
+
+// committed calls the commit hooks after a change of zone
+func committed(zone string, serial uint32) {
+	for _, fn := range commitHooks {
+		fn(zoneName(zone), serial)
+	}
+}
+
+// journalize appends entry to the journal of zone, dropping the oldest entries above journalSize.
+// It fails if another entry already starts from its serial, which was then given twice.
+func journalize(zone string, entry *JournalEntry) error {
+	journalLock.Lock()
+	defer journalLock.Unlock()
+
+	// Journaled by a replay interrupted before the end of its transaction
+	if old := (&JournalEntry{}); bdb.Get(journalEntryKey(zone, entry.From), old) == nil {
+		if old.To == entry.To {
+			return nil
+		}
+		return fmt.Errorf("Changes of %v from the serial %d already journaled", zoneName(zone), entry.From)
+	}
+	info := &journalInfo{}
+	if err := bdb.Get(journalInfoKey(zone), info); err != nil || info.Count == 0 {
+		info.First, info.Count = entry.From, 0
+	}
+	if err := bdb.Set(journalEntryKey(zone, entry.From), entry); err != nil {
+		return err
+	}
+	info.Count++
+	for info.Count > journalSize {
+		oldest := &JournalEntry{}
+		if err := bdb.Get(journalEntryKey(zone, info.First), oldest); err != nil {
+			// Broken chain, restart the journal from this entry
+			info.First, info.Count = entry.From, 1
+			break
+		}
+		if err := bdb.Delete(journalEntryKey(zone, info.First)); err != nil {
+			return err
+		}
+		info.First = oldest.To
+		info.Count--
+	}
+	return bdb.Set(journalInfoKey(zone), info)
+}
+
+// dropJournal deletes all the journal's entries of zone
+func dropJournal(zone string) error {
+	journalLock.Lock()
+	defer journalLock.Unlock()
+
+	info := &journalInfo{}
+	if err := bdb.Get(journalInfoKey(zone), info); err != nil {
+		return nil
+	}
+	for serial := info.First; info.Count > 0; info.Count-- {
+		entry := &JournalEntry{}
+		if err := bdb.Get(journalEntryKey(zone, serial), entry); err != nil {
+			break
+		}
+		if err := bdb.Delete(journalEntryKey(zone, serial)); err != nil {
+			return err
+		}
+		serial = entry.To
+	}
+	return bdb.Delete(journalInfoKey(zone))
+}
+
+func journalInfoKey(zone string) string {
+	return fmt.Sprintf("%s/%s", journalKey, zoneName(zone))
+}
+
+func journalEntryKey(zone string, serial uint32) string {
+	return fmt.Sprintf("%s/%d", journalInfoKey(zone), serial)
+}
+
+// diffRecords returns the members of old missing in cur and the ones of cur missing in old
+func diffRecords(old, cur *RRSet) (removed, added []Record) {
+	removed, added = make([]Record, 0), make([]Record, 0)
+	if old == nil {
+		old = &RRSet{}
+	}
+	if cur == nil {
+		cur = &RRSet{}
+	}
+	for _, rec := range old.Records {
+		if i := cur.Find(&rec); i < 0 || cur.Records[i].TTL != rec.TTL {
+			removed = append(removed, rec)
+		}
+	}
+	for _, rec := range cur.Records {
+		if i := old.Find(&rec); i < 0 || old.Records[i].TTL != rec.TTL {
+			added = append(added, rec)
+		}
+	}
+	return
+}
@@ -0,0 +1,150 @@
+package addd
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// entryString returns the records of entry in a comparable form
+func entryString(entry JournalEntry) []string {
+	lst := []string{}
+	for _, rec := range entry.Removed {
+		lst = append(lst, "-"+rec.String())
+	}
+	for _, rec := range entry.Added {
+		lst = append(lst, "+"+rec.String())
+	}
+	return lst
+}
+
+// journalChanges stores each record (deleting it if its name is prefixed by "-") from the serial 1
+func journalChanges(t *testing.T, recs ...*Record) {
+	if serial, err := GetSerial("example.com"); err != nil || serial != 1 {
+		t.Fatalf("GetSerial(example.com) = %v, %v", serial, err)
+	}
+	for _, rec := range recs {
+		var err error
+		if rec.Name[0] == '-' {
+			rec.Name = rec.Name[1:]
+			err = DeleteRecord(rec)
+		} else {
+			err = StoreRecord(rec)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestJournal(t *testing.T) {
+	useMemStore(t, "example.com")
+	// Serials 1 => 2 => 3 => 4 => 5
+	journalChanges(t,
+		record("www.example.com", "A", "10.0.0.1"),
+		record("www.example.com", "A", "10.0.0.2"),
+		record("-www.example.com", "A", "10.0.0.1"),
+		record("mail.example.com", "A", "10.0.0.3"),
+	)
+	// The TTL of an RRSet is shared, changing it replaces its members
+	rec := record("www.example.com", "A", "10.0.0.2")
+	rec.TTL = 60
+	if err := StoreRecord(rec); err != nil {
+		t.Fatal(err)
+	}
+
+	changes := [][]string{
+		{"+www.example.com 300 IN A 10.0.0.1"},
+		{"+www.example.com 300 IN A 10.0.0.2"},
+		{"-www.example.com 300 IN A 10.0.0.1"},
+		{"+mail.example.com 300 IN A 10.0.0.3"},
+		{"-www.example.com 300 IN A 10.0.0.2", "+www.example.com 60 IN A 10.0.0.2"},
+	}
+	tests := []struct {
+		from uint32
+		want [][]string
+		err  error
+	}{
+		{1, changes, nil},
+		{3, changes[2:], nil},
+		{6, [][]string{}, nil},
+		{0, nil, ErrJournalMissing},
+		{7, nil, ErrJournalMissing},
+	}
+	for _, tt := range tests {
+		entries, err := Journal("example.com", tt.from)
+		if err != tt.err {
+			t.Errorf("Journal(%v) = %v, want %v", tt.from, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		got := make([][]string, 0, len(entries))
+		for i, entry := range entries {
+			if entry.From != tt.from+uint32(i) || entry.To != entry.From+1 {
+				t.Errorf("Journal(%v) entry %d goes from %v to %v", tt.from, i, entry.From, entry.To)
+			}
+			got = append(got, entryString(entry))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Journal(%v) = %q, want %q", tt.from, got, tt.want)
+		}
+	}
+}
+
+func TestJournalSize(t *testing.T) {
+	defer SetJournalSize(journalSize)
+	SetJournalSize(2)
+	useMemStore(t, "example.com")
+	journalChanges(t,
+		record("www.example.com", "A", "10.0.0.1"),
+		record("www.example.com", "A", "10.0.0.2"),
+		record("www.example.com", "A", "10.0.0.3"),
+	)
+	// Serial 1 fell out of the journal
+	if _, err := Journal("example.com", 1); err != ErrJournalMissing {
+		t.Errorf("Journal(1) = %v, want %v", err, ErrJournalMissing)
+	}
+	if entries, err := Journal("example.com", 2); err != nil || len(entries) != 2 {
+		t.Errorf("Journal(2) = %d entries, %v", len(entries), err)
+	}
+
+	// Without journal, only the serial changes
+	SetJournalSize(0)
+	if err := DeleteName("www.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if serial, _ := GetSerial("example.com"); serial != 5 {
+		t.Errorf("GetSerial(example.com) = %v, want 5", serial)
+	}
+	if _, err := Journal("example.com", 4); err != ErrJournalMissing {
+		t.Errorf("Journal(4) = %v, want %v", err, ErrJournalMissing)
+	}
+}
+
+func TestOnCommit(t *testing.T) {
+	defer func(hooks []func(string, uint32)) { commitHooks = hooks }(commitHooks)
+	useMemStore(t, "example.com", "example.org")
+	serials := []string{}
+	OnCommit(func(zone string, serial uint32) { serials = append(serials, fmt.Sprintf("%s %d", zone, serial)) })
+
+	rec := record("www.example.com", "A", "10.0.0.1")
+	for _, change := range []func(*Record) error{StoreRecord, StoreRecord, DeleteRecord} {
+		if err := change(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := StoreRecord(record("www.example.org", "A", "10.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+	zone := DefaultZone("example.org")
+	zone.TTL = 60
+	if err := StoreZone(zone); err != nil {
+		t.Fatal(err)
+	}
+	// Storing an existing record changes nothing, a change of the zone is committed
+	if want := []string{"example.com. 2", "example.com. 3", "example.org. 2", "example.org. 3"}; !reflect.DeepEqual(serials, want) {
+		t.Errorf("serials committed = %v, want %v", serials, want)
+	}
+}
@@ -0,0 +1,133 @@
+package addd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Policy grants a TSIG key the right to update some names with some types, like BIND's update-policy.
+// Match is one of :
+//   - self : only the name of the key itself (Name is ignored)
+//   - subdomain : Name and all the names below
+//   - wildcard : the names matched by the wildcard Name, e.g. *.dyn.example.com
+//   - name : Name only
+//
+// All types may be updated if Types is empty.
+type Policy struct {
+	Match string   `json:"match" binding:"required"`
+	Name  string   `json:"name,omitempty"`
+	Types []string `json:"types,omitempty"`
+}
+
+// ParsePolicy create a Policy from a BIND rule 'grant keyname match name [types]',
+// the name of the key it applies to is returned too
+func ParsePolicy(rule string) (key string, p *Policy, err error) {
+	a := strings.Fields(rule)
+	if len(a) < 4 || !strings.EqualFold(a[0], "grant") {
+		return "", nil, fmt.Errorf("Policy '%v' is not 'grant keyname match name [types]'", rule)
+	}
+	p = &Policy{
+		Match: a[2],
+		Name:  a[3],
+		Types: a[4:],
+	}
+	if err = p.Validate(); err != nil {
+		return "", nil, err
+	}
+	return dns.Fqdn(strings.ToLower(a[1])), p, nil
+}
+
+// Validate checks the policy's match, name and types, they are made canonical
+func (p *Policy) Validate() error {
+	p.Match = strings.ToLower(p.Match)
+	if p.Name != "" {
+		p.Name = dns.Fqdn(strings.ToLower(p.Name))
+	}
+	switch p.Match {
+	case "self":
+	case "wildcard":
+		if !strings.HasPrefix(p.Name, "*.") {
+			return fmt.Errorf("Policy %v has not a wildcard name %v", p.Match, p.Name)
+		}
+		fallthrough
+	case "subdomain", "name":
+		if _, ok := dns.IsDomainName(p.Name); !ok || p.Name == "" {
+			return fmt.Errorf("Policy %v has not a valid name %v", p.Match, p.Name)
+		}
+	default:
+		return fmt.Errorf("Policy match %v not supported", p.Match)
+	}
+	for i, rtype := range p.Types {
+		p.Types[i] = strings.ToUpper(rtype)
+		if _, ok := dns.StringToType[p.Types[i]]; !ok {
+			return fmt.Errorf("Policy %v %v has an unknown type %v", p.Match, p.Name, rtype)
+		}
+	}
+	return nil
+}
+
+// Allows returns true if the key called key may update the RRSet of name with the type rtype,
+// "ANY" stands for all the types
+func (p Policy) Allows(key, name, rtype string) bool {
+	name = dns.Fqdn(strings.ToLower(name))
+	switch p.Match {
+	case "self":
+		if name != dns.Fqdn(strings.ToLower(key)) {
+			return false
+		}
+	case "subdomain":
+		if !dns.IsSubDomain(p.Name, name) {
+			return false
+		}
+	case "wildcard":
+		if parent := strings.TrimPrefix(p.Name, "*."); name == parent || !dns.IsSubDomain(parent, name) {
+			return false
+		}
+	case "name":
+		if name != p.Name {
+			return false
+		}
+	default:
+		return false
+	}
+	if len(p.Types) == 0 {
+		return true
+	}
+	for _, t := range p.Types {
+		if t == "ANY" || strings.EqualFold(t, rtype) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows returns true if one of the key's policies allows the update of name with the type rtype.
+// A key without any policy may update everything.
+func (k *TsigKey) Allows(name, rtype string) bool {
+	if len(k.Policies) == 0 {
+		return true
+	}
+	for _, p := range k.Policies {
+		if p.Allows(k.Name, name, rtype) {
+			return true
+		}
+	}
+	return false
+}
+
+// PoliciesEnabled returns true if one of our TSIG keys has update policies,
+// only the updates signed by a key are then accepted
+func PoliciesEnabled() bool {
+	keys, err := ListTsigKeys()
+	if err != nil {
+		return false
+	}
+	for _, key := range keys {
+		if len(key.Policies) > 0 {
+			return true
+		}
+	}
+	return false
+}
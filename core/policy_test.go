@@ -0,0 +1,112 @@
+package addd
+
+import "testing"
+
+func TestPolicyAllows(t *testing.T) {
+	const key = "host.example.com."
+	tests := []struct {
+		rule  string
+		name  string
+		rtype string
+		want  bool
+	}{
+		{"grant host.example.com self . A", "host.example.com", "A", true},
+		{"grant host.example.com self . A", "HOST.example.com.", "A", true},
+		{"grant host.example.com self . A", "other.example.com", "A", false},
+		{"grant host.example.com self . A", "sub.host.example.com", "A", false},
+		{"grant host.example.com self .", "host.example.com", "TXT", true},
+
+		{"grant host.example.com subdomain dyn.example.com", "dyn.example.com", "A", true},
+		{"grant host.example.com subdomain dyn.example.com", "a.b.dyn.example.com", "A", true},
+		{"grant host.example.com subdomain dyn.example.com", "example.com", "A", false},
+		{"grant host.example.com subdomain dyn.example.com", "xdyn.example.com", "A", false},
+
+		{"grant host.example.com wildcard *.dyn.example.com", "a.dyn.example.com", "A", true},
+		{"grant host.example.com wildcard *.dyn.example.com", "a.b.dyn.example.com", "A", true},
+		{"grant host.example.com wildcard *.dyn.example.com", "dyn.example.com", "A", false},
+		{"grant host.example.com wildcard *.dyn.example.com", "a.example.com", "A", false},
+
+		{"grant host.example.com name www.example.com", "www.example.com", "A", true},
+		{"grant host.example.com name www.example.com", "a.www.example.com", "A", false},
+
+		{"grant host.example.com name www.example.com a aaaa", "www.example.com", "AAAA", true},
+		{"grant host.example.com name www.example.com a aaaa", "www.example.com", "a", true},
+		{"grant host.example.com name www.example.com a aaaa", "www.example.com", "TXT", false},
+		{"grant host.example.com name www.example.com any", "www.example.com", "TXT", true},
+	}
+	for _, tt := range tests {
+		_, p, err := ParsePolicy(tt.rule)
+		if err != nil {
+			t.Fatalf("ParsePolicy(%q) = %v", tt.rule, err)
+		}
+		if got := p.Allows(key, tt.name, tt.rtype); got != tt.want {
+			t.Errorf("%q Allows(%v, %v) = %v, want %v", tt.rule, tt.name, tt.rtype, got, tt.want)
+		}
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	tests := []struct {
+		rule string
+		key  string
+		ok   bool
+	}{
+		{"grant Host.Example.com self . A", "host.example.com.", true},
+		{"GRANT host.example.com subdomain dyn.example.com", "host.example.com.", true},
+		{"grant host.example.com wildcard *.dyn.example.com TXT", "host.example.com.", true},
+		{"grant host.example.com", "", false},
+		{"deny host.example.com name www.example.com", "", false},
+		{"grant host.example.com wildcard dyn.example.com", "", false},
+		{"grant host.example.com zone example.com", "", false},
+		{"grant host.example.com name www.example.com BOGUS", "", false},
+	}
+	for _, tt := range tests {
+		key, _, err := ParsePolicy(tt.rule)
+		if (err == nil) != tt.ok || key != tt.key {
+			t.Errorf("ParsePolicy(%q) = %q, %v", tt.rule, key, err)
+		}
+	}
+}
+
+func TestTsigKeyAllows(t *testing.T) {
+	key := &TsigKey{Name: "host.example.com."}
+	if !key.Allows("www.example.com", "A") {
+		t.Error("key without policy refused")
+	}
+	key.Policies = []Policy{
+		{Match: "self"},
+		{Match: "name", Name: "www.example.com.", Types: []string{"TXT"}},
+	}
+	tests := []struct {
+		name  string
+		rtype string
+		want  bool
+	}{
+		{"host.example.com", "A", true},
+		{"www.example.com", "TXT", true},
+		{"www.example.com", "A", false},
+		{"mail.example.com", "TXT", false},
+	}
+	for _, tt := range tests {
+		if got := key.Allows(tt.name, tt.rtype); got != tt.want {
+			t.Errorf("Allows(%v, %v) = %v, want %v", tt.name, tt.rtype, got, tt.want)
+		}
+	}
+}
+
+func TestPoliciesEnabled(t *testing.T) {
+	useMemStore(t)
+	if err := StoreTsigKey(&TsigKey{Name: "a.example.com", Secret: "c2VjcmV0"}); err != nil {
+		t.Fatal(err)
+	}
+	if PoliciesEnabled() {
+		t.Error("PoliciesEnabled() = true without policy")
+	}
+	key := &TsigKey{Name: "b.example.com", Secret: "c2VjcmV0", Policies: []Policy{{Match: "self"}}}
+	if err := StoreTsigKey(key); err != nil {
+		t.Fatal(err)
+	}
+	if !PoliciesEnabled() {
+		t.Error("PoliciesEnabled() = false with the policies of b.example.com.")
+	}
+}
@@ -3,18 +3,38 @@ package addd
 import (
 	"encoding/json"
 	"fmt"
+	"math"
+	"net"
+	"strconv"
 	"strings"
 
 	"github.com/miekg/dns"
 )
 
 // Record represent our DNS entry object with its Name, Address and types ...
+// Only the RDATA fields related to the Type are used :
+//
+//	A, AAAA : Address
+//	CNAME   : Target
+//	PTR     : Target
+//	TXT     : Text
+//	MX      : Priority (preference), Target (exchange)
+//	SRV     : Priority, Weight, Port, Target
+//	CAA     : Flag, Tag, Value
 type Record struct {
-	Name    string `json:"fqdn"    binding:"required"`
-	Address string `json:"address" binding:"required"`
-	Type    string `json:"type"`
-	Class   string `json:"class"`
-	TTL     int    `json:"TTL"`
+	Name     string   `json:"fqdn"               binding:"required"`
+	Address  string   `json:"address,omitempty"`
+	Target   string   `json:"target,omitempty"`
+	Text     []string `json:"text,omitempty"`
+	Priority int      `json:"priority,omitempty"`
+	Weight   int      `json:"weight,omitempty"`
+	Port     int      `json:"port,omitempty"`
+	Flag     int      `json:"flag,omitempty"`
+	Tag      string   `json:"tag,omitempty"`
+	Value    string   `json:"value,omitempty"`
+	Type     string   `json:"type"`
+	Class    string   `json:"class"`
+	TTL      int      `json:"TTL"`
 }
 
 // DefaultRecord create a Record with all default values
@@ -43,39 +63,128 @@ func NewRecordFromDNS(rr dns.RR) (*Record, error) {
 		rTTL   = int(rr.Header().Ttl)
 	)
 	rec := &Record{
-		Name:    strings.TrimRight(rname, "."),
-		Class:   rclass,
-		Type:    rtype,
-		TTL:     rTTL,
+		Name:  strings.TrimRight(rname, "."),
+		Class: rclass,
+		Type:  rtype,
+		TTL:   rTTL,
 	}
-	if _, ok := dns.IsDomainName(rname); ok {
-		var ipAddr string
-		var v6 bool
-		switch a := rr.(type) {
-		case *dns.A:
-			ipAddr = a.A.String()
-			v6 = false
-		case *dns.AAAA:
-			ipAddr = a.AAAA.String()
-			v6 = true
-		default:
-			err := fmt.Errorf("Record %v with type %v not supported", rname, rtype)
-			return nil, err
+	switch a := rr.(type) {
+	case *dns.A:
+		rec.Address = a.A.String()
+	case *dns.AAAA:
+		rec.Address = a.AAAA.String()
+	case *dns.CNAME:
+		rec.Target = cleanName(a.Target)
+	case *dns.PTR:
+		rec.Target = cleanName(a.Ptr)
+	case *dns.TXT:
+		for _, txt := range a.Txt {
+			rec.Text = append(rec.Text, unescape(txt))
 		}
-		if err := IsValidIp(ipAddr, v6); err != nil {
-			err := fmt.Errorf("Record %v has invalid ip address %s", rname, ipAddr)
-			return nil, err
-		}
-		rec.Address = ipAddr
-	} else {
-		err := fmt.Errorf("Record %v has not a valid domain", rname)
+	case *dns.MX:
+		rec.Priority = int(a.Preference)
+		rec.Target = cleanName(a.Mx)
+	case *dns.SRV:
+		rec.Priority = int(a.Priority)
+		rec.Weight = int(a.Weight)
+		rec.Port = int(a.Port)
+		rec.Target = cleanName(a.Target)
+	case *dns.CAA:
+		rec.Flag = int(a.Flag)
+		rec.Tag = a.Tag
+		rec.Value = unescape(a.Value)
+	default:
+		err := fmt.Errorf("Record %v with type %v not supported", rname, rtype)
+		return nil, err
+	}
+	if err := rec.Validate(); err != nil {
 		return nil, err
 	}
 	return rec, nil
 }
 
+// Validate checks the record's name, TTL, class and its data according to its type
+func (r Record) Validate() error {
+	if _, ok := dns.IsDomainName(r.Name); !ok {
+		return fmt.Errorf("Record %v has not a valid domain", r.Name)
+	}
+	// TTLs are positive 32 bits integers (RFC 2181, 8)
+	if r.TTL < 0 || r.TTL > math.MaxInt32 {
+		return fmt.Errorf("Record %v has invalid TTL %d", r.Name, r.TTL)
+	}
+	// An empty class stands for IN
+	if _, ok := dns.StringToClass[strings.ToUpper(r.Class)]; !ok && r.Class != "" {
+		return fmt.Errorf("Record %v has invalid class %s", r.Name, r.Class)
+	}
+	switch strings.ToUpper(r.Type) {
+	case "A", "AAAA":
+		if err := IsValidIp(r.Address, strings.EqualFold(r.Type, "AAAA")); err != nil {
+			return fmt.Errorf("Record %v has invalid ip address %s", r.Name, r.Address)
+		}
+	case "CNAME", "PTR", "MX":
+		if _, ok := dns.IsDomainName(r.Target); !ok || r.Target == "" {
+			return fmt.Errorf("Record %v has invalid target %s", r.Name, r.Target)
+		}
+	case "SRV":
+		// "." means the service is not available (RFC 2782)
+		if _, ok := dns.IsDomainName(dns.Fqdn(r.Target)); !ok {
+			return fmt.Errorf("Record %v has invalid target %s", r.Name, r.Target)
+		}
+		if !isUint16(r.Weight) || !isUint16(r.Port) {
+			return fmt.Errorf("Record %v has invalid weight %d or port %d", r.Name, r.Weight, r.Port)
+		}
+	case "TXT":
+		if len(r.Text) == 0 {
+			return fmt.Errorf("Record %v has no text", r.Name)
+		}
+		for _, txt := range r.Text {
+			if len(txt) > 255 {
+				return fmt.Errorf("Record %v has a text longer than 255 characters", r.Name)
+			}
+		}
+	case "CAA":
+		if r.Flag < 0 || r.Flag > 255 {
+			return fmt.Errorf("Record %v has invalid flag %d", r.Name, r.Flag)
+		}
+		if r.Tag == "" || strings.IndexFunc(r.Tag, notAlnum) >= 0 {
+			return fmt.Errorf("Record %v has invalid tag %s", r.Name, r.Tag)
+		}
+	default:
+		return fmt.Errorf("Record %v with type %v not supported", r.Name, r.Type)
+	}
+	if !isUint16(r.Priority) {
+		return fmt.Errorf("Record %v has invalid priority %d", r.Name, r.Priority)
+	}
+	return nil
+}
+
+// Data returns the record's RDATA in its presentation format
+func (r Record) Data() string {
+	switch strings.ToUpper(r.Type) {
+	case "CNAME", "PTR":
+		return dns.Fqdn(cleanName(r.Target))
+	case "MX":
+		return fmt.Sprintf("%d %s", r.Priority, dns.Fqdn(cleanName(r.Target)))
+	case "SRV":
+		return fmt.Sprintf("%d %d %d %s", r.Priority, r.Weight, r.Port, dns.Fqdn(cleanName(r.Target)))
+	case "TXT":
+		txt := make([]string, 0, len(r.Text))
+		for _, t := range r.Text {
+			txt = append(txt, quote(t))
+		}
+		return strings.Join(txt, " ")
+	case "CAA":
+		return fmt.Sprintf("%d %s %s", r.Flag, strings.ToLower(r.Tag), quote(r.Value))
+	default:
+		if ip := net.ParseIP(r.Address); ip != nil {
+			return ip.String()
+		}
+		return r.Address
+	}
+}
+
 func (r Record) String() string {
-	return fmt.Sprintf("%s %v %s %s %s", r.Name, r.TTL, r.Class, r.Type, r.Address)
+	return fmt.Sprintf("%s %v %s %s %s", r.Name, r.TTL, r.Class, r.Type, r.Data())
 }
 
 // DNSRR transforms our object in a dns.RR
@@ -90,17 +199,77 @@ func (r Record) JSON() (string, error) {
 	return string(jso), err
 }
 
-func getKey(domain string, rtype string) (r string, e error) {
-	if n, ok := dns.IsDomainName(domain); ok {
-		labels := dns.SplitDomainName(domain)
-		last := n - 1
-		for i := 0; i < n/2; i++ {
-			labels[i], labels[last-i] = labels[last-i], labels[i]
+// quote returns s as a character-string, escaping quotes and backslashes
+func quote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	return `"` + strings.Replace(s, `"`, `\"`, -1) + `"`
+}
+
+// unescape reverts the escaping kept by the dns package in character-strings
+func unescape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+			if i+2 < len(s) && isDigit(s[i]) && isDigit(s[i+1]) && isDigit(s[i+2]) {
+				if n, err := strconv.Atoi(s[i : i+3]); err == nil && n < 256 {
+					b.WriteByte(byte(n))
+					i += 2
+					continue
+				}
+			}
 		}
-		reverseDomain := strings.Join(labels, ".")
-		r = strings.Join([]string{reverseDomain, rtype}, "_")
-	} else {
-		e = fmt.Errorf("Invalid domain: %v", domain)
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func isDigit(b byte) bool {
+	return '0' <= b && b <= '9'
+}
+
+func isUint16(i int) bool {
+	return i >= 0 && i <= 65535
+}
+
+func notAlnum(r rune) bool {
+	return !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9')
+}
+
+// getKey returns the key of the RRSet of domain with the type rtype, names are case insensitive
+func getKey(domain string, rtype string) (r string, e error) {
+	reverseDomain, e := reverseKey(domain)
+	if e == nil {
+		r = strings.Join([]string{reverseDomain, strings.ToUpper(rtype)}, "_")
 	}
 	return r, e
 }
+
+// reverseKey returns domain with its labels in reverse order ("a.b.local" => "local.b.a"),
+// so that all the keys of a domain and its subdomains share the same prefix
+func reverseKey(domain string) (string, error) {
+	domain = strings.ToLower(domain)
+	n, ok := dns.IsDomainName(domain)
+	if !ok {
+		return "", fmt.Errorf("Invalid domain: %v", domain)
+	}
+	labels := dns.SplitDomainName(domain)
+	last := n - 1
+	for i := 0; i < n/2; i++ {
+		labels[i], labels[last-i] = labels[last-i], labels[i]
+	}
+	return strings.Join(labels, "."), nil
+}
+
+// escapePattern escapes the characters of key having a meaning in the patterns listing our DB
+func escapePattern(key string) string {
+	var b strings.Builder
+	for _, c := range key {
+		switch c {
+		case '*', '?', '[', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
@@ -0,0 +1,78 @@
+package addd
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestRecordFromDNS(t *testing.T) {
+	for _, s := range []string{
+		"www.example.com. 300 IN A 10.0.0.1",
+		"www.example.com. 300 IN AAAA 2001:db8::1",
+		"www.example.com. 300 IN CNAME web.example.com.",
+		`www.example.com. 300 IN TXT "v=spf1 -all" "with \"quotes\" and \\ backslash"`,
+		"example.com. 300 IN MX 10 mail.example.com.",
+		"_sip._tcp.example.com. 300 IN SRV 10 60 5060 sip.example.com.",
+		"_sip._tcp.example.com. 300 IN SRV 0 0 0 .",
+		`example.com. 300 IN CAA 0 issue "letsencrypt.org"`,
+	} {
+		want, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec, err := NewRecordFromDNS(want)
+		if err != nil {
+			t.Errorf("NewRecordFromDNS(%v) = %v", s, err)
+			continue
+		}
+		// Through our DB in JSON
+		jso, err := rec.JSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec, err = NewRecordFromJSON(jso); err != nil {
+			t.Fatal(err)
+		}
+		got, err := rec.DNSRR()
+		if err != nil {
+			t.Errorf("DNSRR() of %v = %v", s, err)
+			continue
+		}
+		if got.String() != want.String() {
+			t.Errorf("record of %v gives %v", want, got)
+		}
+	}
+}
+
+func TestRecordValidate(t *testing.T) {
+	tests := []struct {
+		rec Record
+		ok  bool
+	}{
+		{Record{Name: "www.example.com", Type: "A", Address: "10.0.0.1"}, true},
+		{Record{Name: "www.example.com", Type: "A", Address: "2001:db8::1"}, false},
+		{Record{Name: "www.example.com", Type: "AAAA", Address: "10.0.0.1"}, false},
+		{Record{Name: "www.example.com", Type: "MX", Priority: 10, Target: "mail.example.com"}, true},
+		{Record{Name: "www.example.com", Type: "MX", Priority: 70000, Target: "mail.example.com"}, false},
+		{Record{Name: "www.example.com", Type: "MX", Priority: 10}, false},
+		{Record{Name: "www.example.com", Type: "SRV", Port: 80, Target: "."}, true},
+		{Record{Name: "www.example.com", Type: "SRV", Port: 65536, Target: "web.example.com"}, false},
+		{Record{Name: "www.example.com", Type: "TXT"}, false},
+		{Record{Name: "www.example.com", Type: "TXT", Text: []string{string(make([]byte, 256))}}, false},
+		{Record{Name: "www.example.com", Type: "CAA", Tag: "issue", Value: "ca.example.net"}, true},
+		{Record{Name: "www.example.com", Type: "CAA", Tag: "is-sue", Value: "ca.example.net"}, false},
+		{Record{Name: "www.example.com", Type: "CAA", Flag: 256, Tag: "issue"}, false},
+		{Record{Name: "www.example.com", Type: "HINFO"}, false},
+		{Record{Name: "www.example.com", Type: "A", Address: "10.0.0.1", TTL: -1}, false},
+		{Record{Name: "www.example.com", Type: "A", Address: "10.0.0.1", TTL: 1 << 31}, false},
+		{Record{Name: "www.example.com", Type: "A", Address: "10.0.0.1", TTL: 1<<31 - 1}, true},
+		{Record{Name: "www.example.com", Type: "A", Address: "10.0.0.1", Class: "ch"}, true},
+		{Record{Name: "www.example.com", Type: "A", Address: "10.0.0.1", Class: "BOGUS"}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.rec.Validate(); (err == nil) != tt.ok {
+			t.Errorf("Validate(%+v) = %v", tt.rec, err)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package addd
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	reverseNets []*net.IPNet
+)
+
+// SetReverse defines the prefixes for which PTR records are automatically managed
+func SetReverse(prefixes []string) error {
+	nets := make([]*net.IPNet, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		prefix = strings.TrimSpace(prefix)
+		if prefix == "" {
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(prefix)
+		if err != nil {
+			return fmt.Errorf("Invalid reverse prefix %v", prefix)
+		}
+		nets = append(nets, ipnet)
+	}
+	reverseNets = nets
+	return nil
+}
+
+// ReverseZones returns the in-addr.arpa and ip6.arpa zones covering our prefixes,
+// prefixes are rounded down to the nearest octet (IPv4) or nibble (IPv6) boundary
+func ReverseZones() []string {
+	zones := make([]string, 0, len(reverseNets))
+	for _, ipnet := range reverseNets {
+		ones, bits := ipnet.Mask.Size()
+		labels := dns.SplitDomainName(reverseName(ipnet.IP))
+		if bits == 32 {
+			labels = labels[4-ones/8:]
+		} else {
+			labels = labels[32-ones/4:]
+		}
+		zones = append(zones, dns.Fqdn(strings.Join(labels, ".")))
+	}
+	return zones
+}
+
+// reverseName returns the PTR owner name of ip
+func reverseName(ip net.IP) string {
+	name, _ := dns.ReverseAddr(ip.String())
+	return name
+}
+
+// ptrFor returns the PTR record pointing to rec, nil if rec isn't an address of our prefixes
+func ptrFor(rec Record) *Record {
+	if rec.Type != "A" && rec.Type != "AAAA" {
+		return nil
+	}
+	ip := net.ParseIP(rec.Address)
+	if ip == nil {
+		return nil
+	}
+	for _, ipnet := range reverseNets {
+		if ipnet.Contains(ip) {
+			return &Record{
+				Name:   cleanName(reverseName(ip)),
+				Type:   "PTR",
+				Class:  rec.Class,
+				TTL:    rec.TTL,
+				Target: cleanName(rec.Name),
+			}
+		}
+	}
+	return nil
+}
+
+// syncPTR stages the creation or deletion of the PTR records
+// following its changes of A and AAAA records, in served reverse zones only
+func (s *Stage) syncPTR() error {
+	if len(reverseNets) == 0 {
+		return nil
+	}
+	// PTR RRSets are appended to s.keys while we iterate
+	keys := append([]string{}, s.keys...)
+	for _, key := range keys {
+		old, cur := s.old[key], s.cur[key]
+		// The records of the views have no PTR
+		if cur.View != "" {
+			continue
+		}
+		for _, rec := range old.Records {
+			if cur.Find(&rec) >= 0 {
+				continue
+			}
+			if ptr := ptrFor(rec); ptr != nil {
+				if set, err := s.RRSet(ptr.Name, ptr.Type); err == nil {
+					set.Remove(ptr)
+				}
+			}
+		}
+		for _, rec := range cur.Records {
+			ptr := ptrFor(rec)
+			if ptr == nil {
+				continue
+			}
+			if _, err := ZoneOf(ptr.Name); err != nil {
+				continue
+			}
+			if err := s.StoreRecord(ptr); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package addd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestReverseZones(t *testing.T) {
+	defer SetReverse(nil)
+	if err := SetReverse([]string{"10.0.0.0/8", " 192.0.2.0/24", "172.16.0.0/20", "2001:db8::/32", ""}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"10.in-addr.arpa.", "2.0.192.in-addr.arpa.", "16.172.in-addr.arpa.", "8.b.d.0.1.0.0.2.ip6.arpa."}
+	if got := ReverseZones(); !reflect.DeepEqual(got, want) {
+		t.Errorf("ReverseZones() = %q, want %q", got, want)
+	}
+	if err := SetReverse([]string{"10.0.0.0"}); err == nil {
+		t.Error("SetReverse() accepted an address without length")
+	}
+}
+
+func TestSyncPTR(t *testing.T) {
+	defer SetReverse(nil)
+	useMemStore(t, "example.com", "0.0.10.in-addr.arpa", "8.b.d.0.1.0.0.2.ip6.arpa")
+	if err := SetReverse([]string{"10.0.0.0/24", "2001:db8::/32"}); err != nil {
+		t.Fatal(err)
+	}
+	steps := []struct {
+		store, del *Record
+		want       []string
+	}{
+		{store: record("www.example.com", "A", "10.0.0.1"), want: []string{
+			"1.0.0.10.in-addr.arpa 300 IN PTR www.example.com.",
+			"www.example.com 300 IN A 10.0.0.1",
+		}},
+		{store: record("www.example.com", "AAAA", "2001:db8::1"), want: []string{
+			"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa 300 IN PTR www.example.com.",
+			"1.0.0.10.in-addr.arpa 300 IN PTR www.example.com.",
+			"www.example.com 300 IN A 10.0.0.1",
+			"www.example.com 300 IN AAAA 2001:db8::1",
+		}},
+		// Outside our prefixes
+		{store: record("mail.example.com", "A", "10.0.1.1"), del: record("www.example.com", "AAAA", "2001:db8::1"), want: []string{
+			"1.0.0.10.in-addr.arpa 300 IN PTR www.example.com.",
+			"mail.example.com 300 IN A 10.0.1.1",
+			"www.example.com 300 IN A 10.0.0.1",
+		}},
+		{store: record("web.example.com", "A", "10.0.0.1"), want: []string{
+			"1.0.0.10.in-addr.arpa 300 IN PTR web.example.com.",
+			"1.0.0.10.in-addr.arpa 300 IN PTR www.example.com.",
+			"mail.example.com 300 IN A 10.0.1.1",
+			"web.example.com 300 IN A 10.0.0.1",
+			"www.example.com 300 IN A 10.0.0.1",
+		}},
+		{del: record("www.example.com", "A", "10.0.0.1"), want: []string{
+			"1.0.0.10.in-addr.arpa 300 IN PTR web.example.com.",
+			"mail.example.com 300 IN A 10.0.1.1",
+			"web.example.com 300 IN A 10.0.0.1",
+		}},
+	}
+	for i, step := range steps {
+		if step.store != nil {
+			if err := StoreRecord(step.store); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if step.del != nil {
+			if err := DeleteRecord(step.del); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := storedRecords(t); !reflect.DeepEqual(got, step.want) {
+			t.Errorf("step %d: records = %q, want %q", i, got, step.want)
+		}
+	}
+
+	// Replacing the RRSet moves the PTR records
+	set := NewRRSet("web.example.com", "A")
+	set.Add(record("web.example.com", "A", "10.0.0.2"))
+	if err := StoreRRSet(set); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"2.0.0.10.in-addr.arpa 300 IN PTR web.example.com.",
+		"mail.example.com 300 IN A 10.0.1.1",
+		"web.example.com 300 IN A 10.0.0.2",
+	}
+	if got := storedRecords(t); !reflect.DeepEqual(got, want) {
+		t.Errorf("records = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,100 @@
+package addd
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// RRSet represent all the Records sharing the same name and type, in the default view
+// or in the View named
+type RRSet struct {
+	Name    string   `json:"fqdn"`
+	Type    string   `json:"type"`
+	View    string   `json:"view,omitempty"`
+	Records []Record `json:"records"`
+}
+
+// NewRRSet create an empty RRSet for name and type
+func NewRRSet(name, rtype string) *RRSet {
+	return &RRSet{
+		Name:    cleanName(name),
+		Type:    strings.ToUpper(rtype),
+		Records: make([]Record, 0),
+	}
+}
+
+// Find returns the index of the member having the same data than rec, -1 if missing
+func (s *RRSet) Find(rec *Record) int {
+	for i, member := range s.Records {
+		if member.sameData(rec) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Add inserts rec in the RRSet, false is returned if an identical member already exists.
+// As all members of an RRSet must share the same TTL (RFC 2181), rec's TTL is applied to all of them.
+func (s *RRSet) Add(rec *Record) bool {
+	changed := false
+	for i := range s.Records {
+		if s.Records[i].TTL != rec.TTL {
+			s.Records[i].TTL = rec.TTL
+			changed = true
+		}
+	}
+	if s.Find(rec) >= 0 {
+		return changed
+	}
+	member := *rec
+	member.Name, member.Type = s.Name, s.Type
+	s.Records = append(s.Records, member)
+	return true
+}
+
+// Remove deletes the member having the same data than rec, false is returned if not found
+func (s *RRSet) Remove(rec *Record) bool {
+	i := s.Find(rec)
+	if i < 0 {
+		return false
+	}
+	s.Records = append(s.Records[:i], s.Records[i+1:]...)
+	return true
+}
+
+// Empty returns true when the RRSet has no more member
+func (s *RRSet) Empty() bool {
+	return len(s.Records) == 0
+}
+
+// DNSRR transforms all members in dns.RR objects
+func (s RRSet) DNSRR() ([]dns.RR, error) {
+	rrs := make([]dns.RR, 0, len(s.Records))
+	for _, rec := range s.Records {
+		rr, err := rec.DNSRR()
+		if err != nil {
+			return nil, err
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs, nil
+}
+
+// key returns the key of the RRSet in our DB, those of the views are kept apart
+func (s RRSet) key() (string, error) {
+	key, err := getKey(s.Name, s.Type)
+	if err == nil && s.View != "" {
+		key = "view/" + s.View + "/" + key
+	}
+	return key, err
+}
+
+// cleanName returns the lower case domain name without its trailing dot
+func cleanName(name string) string {
+	return strings.ToLower(strings.TrimRight(name, "."))
+}
+
+func (r Record) sameData(o *Record) bool {
+	return strings.EqualFold(r.Type, o.Type) && r.Data() == o.Data()
+}
@@ -0,0 +1,279 @@
+package addd
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	selectionsKey = "addd/selections"
+
+	// SelectWeighted, SelectFailover and SelectGeo are the modes of a Selection
+	SelectWeighted = "weighted"
+	SelectFailover = "failover"
+	SelectGeo      = "geo"
+	// DefaultRegion is the region of the clients without any other region
+	DefaultRegion = "default"
+)
+
+var (
+	selectionsLock sync.Mutex
+
+	randLock sync.Mutex
+	random   = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// Selection chooses the records of an RRSet of the default view sent in answers instead of all of them.
+// Records are identified by their data (e.g. their address), Mode is one of :
+//   - weighted : a single record, drawn at random in proportion to Weights (1 if missing, 0 to disable)
+//   - failover : the first record of Order which isn't down, the records missing in Order are backups
+//   - geo : the records listed in Regions for the client's region, or for the "default" region
+//
+// Records listed in Down are never sent, unless all the selected ones are down.
+type Selection struct {
+	Name    string              `json:"fqdn"`
+	Type    string              `json:"type"`
+	Mode    string              `json:"mode"              binding:"required"`
+	Weights map[string]int      `json:"weights,omitempty"`
+	Order   []string            `json:"order,omitempty"`
+	Regions map[string][]string `json:"regions,omitempty"`
+	Down    []string            `json:"down,omitempty"`
+}
+
+// selectionList is the DB object holding the selections of all our RRSets
+type selectionList struct {
+	Selections map[string]*Selection `json:"selections"`
+}
+
+// Validate checks the selection's RRSet, mode and weights, the data are made canonical
+func (s *Selection) Validate() error {
+	if _, ok := dns.IsDomainName(s.Name); !ok || s.Name == "" {
+		return fmt.Errorf("Selection of %v has not a valid domain", s.Name)
+	}
+	s.Name, s.Type, s.Mode = cleanName(s.Name), strings.ToUpper(s.Type), strings.ToLower(s.Mode)
+	if _, ok := dns.StringToType[s.Type]; !ok {
+		return fmt.Errorf("Selection of %v has an unknown type %v", s.Name, s.Type)
+	}
+	switch s.Mode {
+	case SelectWeighted, SelectFailover, SelectGeo:
+	default:
+		return fmt.Errorf("Selection mode %v not supported", s.Mode)
+	}
+	weights := make(map[string]int, len(s.Weights))
+	for data, weight := range s.Weights {
+		if weight < 0 {
+			return fmt.Errorf("Selection of %v has a negative weight for %v", s.Name, data)
+		}
+		weights[canonicalData(data)] = weight
+	}
+	s.Weights = weights
+	for i, data := range s.Order {
+		s.Order[i] = canonicalData(data)
+	}
+	regions := make(map[string][]string, len(s.Regions))
+	for region, lst := range s.Regions {
+		for i, data := range lst {
+			lst[i] = canonicalData(data)
+		}
+		regions[strings.ToLower(region)] = lst
+	}
+	s.Regions = regions
+	for i, data := range s.Down {
+		s.Down[i] = canonicalData(data)
+	}
+	return nil
+}
+
+// Select returns the records of set to send to a client of region (empty if unknown)
+func (s *Selection) Select(set *RRSet, region string) *RRSet {
+	down := make(map[string]bool, len(s.Down))
+	for _, data := range s.Down {
+		down[data] = true
+	}
+	up := make([]Record, 0, len(set.Records))
+	for _, rec := range set.Records {
+		if !down[rec.Data()] {
+			up = append(up, rec)
+		}
+	}
+	if len(up) == 0 {
+		return set
+	}
+
+	var selected []Record
+	switch s.Mode {
+	case SelectWeighted:
+		selected = s.weighted(up)
+	case SelectFailover:
+		selected = s.failover(up)
+	case SelectGeo:
+		selected = s.geo(up, strings.ToLower(region))
+	}
+	if len(selected) == 0 {
+		selected = up
+	}
+	result := *set
+	result.Records = selected
+	return &result
+}
+
+// weighted draws one of recs in proportion to their weights
+func (s *Selection) weighted(recs []Record) []Record {
+	total := 0
+	for _, rec := range recs {
+		total += s.weight(rec)
+	}
+	if total == 0 {
+		return nil
+	}
+	randLock.Lock()
+	n := random.Intn(total)
+	randLock.Unlock()
+	for _, rec := range recs {
+		if n -= s.weight(rec); n < 0 {
+			return []Record{rec}
+		}
+	}
+	return nil
+}
+
+func (s *Selection) weight(rec Record) int {
+	if weight, ok := s.Weights[rec.Data()]; ok {
+		return weight
+	}
+	return 1
+}
+
+// failover returns the first of recs in Order, or the first backup if none is ordered
+func (s *Selection) failover(recs []Record) []Record {
+	for _, data := range s.Order {
+		for _, rec := range recs {
+			if rec.Data() == data {
+				return []Record{rec}
+			}
+		}
+	}
+	return recs[:1]
+}
+
+// geo returns the records of recs listed for region, or for the default region
+func (s *Selection) geo(recs []Record, region string) []Record {
+	for _, name := range []string{region, DefaultRegion} {
+		wanted := make(map[string]bool)
+		for _, data := range s.Regions[name] {
+			wanted[data] = true
+		}
+		selected := make([]Record, 0)
+		for _, rec := range recs {
+			if wanted[rec.Data()] {
+				selected = append(selected, rec)
+			}
+		}
+		if len(selected) > 0 {
+			return selected
+		}
+	}
+	return nil
+}
+
+// GetSelection retrieves the selection of the RRSet of domain with the type rtype
+func GetSelection(domain, rtype string) (*Selection, error) {
+	lst, err := getSelections()
+	if err != nil {
+		return nil, err
+	}
+	key, err := getKey(cleanName(domain), rtype)
+	if err != nil {
+		return nil, err
+	}
+	if sel, ok := lst.Selections[key]; ok {
+		return sel, nil
+	}
+	return nil, fmt.Errorf("Selection of %v %v not found", domain, rtype)
+}
+
+// StoreSelection creates or replaces the selection of an RRSet
+func StoreSelection(sel *Selection) error {
+	if err := sel.Validate(); err != nil {
+		return err
+	}
+	key, err := getKey(sel.Name, sel.Type)
+	if err != nil {
+		return err
+	}
+	selectionsLock.Lock()
+	defer selectionsLock.Unlock()
+	lst, err := getSelections()
+	if err != nil {
+		return err
+	}
+	lst.Selections[key] = sel
+	return bdb.Set(selectionsKey, lst)
+}
+
+// DeleteSelection deletes the selection of the RRSet of domain with the type rtype,
+// all its records are sent again
+func DeleteSelection(domain, rtype string) error {
+	sel, err := GetSelection(domain, rtype)
+	if err != nil {
+		return err
+	}
+	key, _ := getKey(sel.Name, sel.Type)
+	selectionsLock.Lock()
+	defer selectionsLock.Unlock()
+	lst, err := getSelections()
+	if err != nil {
+		return err
+	}
+	delete(lst.Selections, key)
+	return bdb.Set(selectionsKey, lst)
+}
+
+// dropSelections deletes the selections of all the RRSets of zone
+func dropSelections(zone string) error {
+	selectionsLock.Lock()
+	defer selectionsLock.Unlock()
+	lst, err := getSelections()
+	if err != nil {
+		return err
+	}
+	changed := false
+	for key, sel := range lst.Selections {
+		if owner, err := ZoneOf(sel.Name); err == nil && owner.Name == zoneName(zone) {
+			delete(lst.Selections, key)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return bdb.Set(selectionsKey, lst)
+}
+
+// getSelections reads all our selections, an empty list is returned if none was created
+func getSelections() (*selectionList, error) {
+	checkBdp()
+	lst := &selectionList{}
+	if err := bdb.Get(selectionsKey, lst); err != nil || lst.Selections == nil {
+		lst.Selections = make(map[string]*Selection)
+	}
+	return lst, nil
+}
+
+// canonicalData returns data as Record.Data does : addresses in their canonical form, names fully qualified
+func canonicalData(data string) string {
+	data = strings.TrimSpace(data)
+	if ip := net.ParseIP(data); ip != nil {
+		return ip.String()
+	}
+	if _, ok := dns.IsDomainName(data); ok && !strings.ContainsAny(data, " \"") {
+		return dns.Fqdn(strings.ToLower(data))
+	}
+	return data
+}
@@ -0,0 +1,103 @@
+package addd
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// selected returns the sorted addresses of the records selected by sel in set for region
+func selected(sel *Selection, set *RRSet, region string) []string {
+	lst := make([]string, 0)
+	for _, rec := range sel.Select(set, region).Records {
+		lst = append(lst, rec.Address)
+	}
+	sort.Strings(lst)
+	return lst
+}
+
+func TestSelect(t *testing.T) {
+	set := NewRRSet("www.example.com", "A")
+	for _, addr := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		set.Add(record("www.example.com", "A", addr))
+	}
+	tests := []struct {
+		name   string
+		sel    Selection
+		region string
+		want   []string
+	}{
+		{"weight of a single record", Selection{Mode: SelectWeighted, Weights: map[string]int{"10.0.0.1": 0, "10.0.0.2": 5, "10.0.0.3": 0}}, "", []string{"10.0.0.2"}},
+		{"no weight", Selection{Mode: SelectWeighted, Weights: map[string]int{"10.0.0.1": 0, "10.0.0.2": 0, "10.0.0.3": 0}}, "", []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}},
+		{"weighted record down", Selection{Mode: SelectWeighted, Weights: map[string]int{"10.0.0.1": 0}, Down: []string{"10.0.0.2"}}, "", []string{"10.0.0.3"}},
+		{"primary", Selection{Mode: SelectFailover, Order: []string{"10.0.0.2", "10.0.0.1"}}, "", []string{"10.0.0.2"}},
+		{"primary down", Selection{Mode: SelectFailover, Order: []string{"10.0.0.2", "10.0.0.1"}, Down: []string{"10.0.0.2"}}, "", []string{"10.0.0.1"}},
+		{"backup", Selection{Mode: SelectFailover, Order: []string{"10.0.0.2"}, Down: []string{"10.0.0.2"}}, "", []string{"10.0.0.1"}},
+		{"all down", Selection{Mode: SelectFailover, Down: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}}, "", []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}},
+		{"region", Selection{Mode: SelectGeo, Regions: map[string][]string{"eu": {"10.0.0.1", "10.0.0.2"}, "default": {"10.0.0.3"}}}, "eu", []string{"10.0.0.1", "10.0.0.2"}},
+		{"default region", Selection{Mode: SelectGeo, Regions: map[string][]string{"eu": {"10.0.0.1"}, "default": {"10.0.0.3"}}}, "us", []string{"10.0.0.3"}},
+		{"region down", Selection{Mode: SelectGeo, Regions: map[string][]string{"eu": {"10.0.0.1"}, "default": {"10.0.0.3"}}, Down: []string{"10.0.0.1"}}, "eu", []string{"10.0.0.3"}},
+		{"no region", Selection{Mode: SelectGeo, Regions: map[string][]string{"eu": {"10.0.0.1"}}}, "", []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}},
+	}
+	for _, tt := range tests {
+		tt.sel.Name, tt.sel.Type = "www.example.com", "A"
+		if err := tt.sel.Validate(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := selected(&tt.sel, set, tt.region); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Select() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// Records are drawn in proportion to their weights
+	sel := &Selection{Name: "www.example.com", Type: "A", Mode: SelectWeighted, Weights: map[string]int{"10.0.0.1": 3, "10.0.0.3": 0}}
+	counts := map[string]int{}
+	for i := 0; i < 4000; i++ {
+		counts[selected(sel, set, "")[0]]++
+	}
+	if counts["10.0.0.3"] != 0 || counts["10.0.0.1"] < 2700 || counts["10.0.0.1"] > 3300 {
+		t.Errorf("records drawn %v times", counts)
+	}
+}
+
+func TestStoreSelection(t *testing.T) {
+	useMemStore(t, "example.com", "example.org")
+	invalid := []*Selection{
+		{Name: "host..example.com", Type: "A", Mode: SelectWeighted},
+		{Name: "www.example.com", Type: "NONE", Mode: SelectWeighted},
+		{Name: "www.example.com", Type: "A", Mode: "random"},
+		{Name: "www.example.com", Type: "A", Mode: SelectWeighted, Weights: map[string]int{"10.0.0.1": -1}},
+	}
+	for _, sel := range invalid {
+		if err := StoreSelection(sel); err == nil {
+			t.Errorf("StoreSelection(%+v) accepted", sel)
+		}
+	}
+	for _, sel := range []*Selection{
+		{Name: "WWW.example.com.", Type: "a", Mode: "Failover", Order: []string{" 2001:DB8::1", "Host.example.com"}},
+		{Name: "www.example.org", Type: "A", Mode: SelectGeo, Regions: map[string][]string{"EU": {"10.0.0.1"}}},
+	} {
+		if err := StoreSelection(sel); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sel, err := GetSelection("www.example.com", "A")
+	want := &Selection{Name: "www.example.com", Type: "A", Mode: SelectFailover, Order: []string{"2001:db8::1", "host.example.com."}}
+	if err != nil || !reflect.DeepEqual(sel, want) {
+		t.Errorf("GetSelection() = %+v, %v, want %+v", sel, err, want)
+	}
+
+	if err := DeleteSelection("www.example.com", "A"); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteSelection("www.example.com", "A"); err == nil {
+		t.Error("missing selection deleted")
+	}
+	// Selections are deleted with their zone
+	if err := DeleteZone("example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetSelection("www.example.org", "A"); err == nil {
+		t.Error("selection of a zone deleted kept")
+	}
+}
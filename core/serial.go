@@ -0,0 +1,67 @@
+package addd
+
+import (
+	"strconv"
+	"time"
+)
+
+var (
+	dateSerial bool
+)
+
+// UseDateSerial enables the YYYYMMDDnn serial scheme
+func UseDateSerial(enable bool) {
+	dateSerial = enable
+}
+
+// GetSerial returns the current SOA serial of zone
+func GetSerial(zone string) (uint32, error) {
+	z, err := GetZone(zone)
+	if err != nil {
+		return 0, err
+	}
+	return z.Serial, nil
+}
+
+// bumpSerial sets the SOA serial of zone to to, planned from the serial from after a change of its records,
+// returning the previous and new ones. If the serial isn't from anymore, or none was planned, it's the one
+// following the current serial. Serials live in our DB, so every HA member advertises the same one.
+// In a cluster, the cluster lock must be held so no other member reads or bumps the serial meanwhile.
+func bumpSerial(zone string, from, to uint32) (uint32, uint32, error) {
+	if clustered && !clusterLocked {
+		return 0, 0, errNotLocked
+	}
+	zonesLock.Lock()
+	defer zonesLock.Unlock()
+	lst, err := getZones()
+	if err != nil {
+		return 0, 0, err
+	}
+	z, ok := lst.Zones[zoneName(zone)]
+	if !ok {
+		return 0, 0, ErrNoZone
+	}
+	switch {
+	case to != 0 && z.Serial == to:
+		// Bumped by a replay interrupted before the end of its transaction
+		return from, to, nil
+	case to == 0 || z.Serial != from:
+		from, to = z.Serial, nextSerial(z.Serial)
+	}
+	z.Serial = to
+	return from, to, bdb.Set(zonesKey, lst)
+}
+
+// nextSerial returns the serial following cur, 0 meaning "no serial yet"
+func nextSerial(cur uint32) uint32 {
+	if dateSerial {
+		today, _ := strconv.ParseUint(time.Now().UTC().Format("20060102")+"00", 10, 32)
+		if cur < uint32(today) {
+			return uint32(today)
+		}
+	}
+	if cur++; cur == 0 { // serial arithmetic wraps (RFC 1982), but 0 is reserved to "no serial"
+		cur++
+	}
+	return cur
+}
@@ -0,0 +1,117 @@
+package addd
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNextSerial(t *testing.T) {
+	defer UseDateSerial(false)
+	today64, _ := strconv.ParseUint(time.Now().UTC().Format("20060102")+"00", 10, 32)
+	today := uint32(today64)
+	tests := []struct {
+		date      bool
+		cur, want uint32
+	}{
+		{false, 0, 1},
+		{false, 41, 42},
+		{false, 0xffffffff, 1},
+		{true, 0, today},
+		{true, 42, today},
+		{true, today, today + 1},
+		{true, today + 150, today + 151},
+	}
+	for _, tt := range tests {
+		UseDateSerial(tt.date)
+		if got := nextSerial(tt.cur); got != tt.want {
+			t.Errorf("nextSerial(%v) with dates %v = %v, want %v", tt.cur, tt.date, got, tt.want)
+		}
+	}
+}
+
+func TestSerialBumped(t *testing.T) {
+	useMemStore(t, "example.com")
+	serial, err := GetSerial("example.com")
+	if err != nil || serial != 1 {
+		t.Fatalf("GetSerial(example.com) = %v, %v, want 1", serial, err)
+	}
+	steps := []struct {
+		change func() error
+		bumped bool
+	}{
+		{func() error { return StoreRecord(record("www.example.com", "A", "10.0.0.1")) }, true},
+		{func() error { return StoreRecord(record("www.example.com", "A", "10.0.0.1")) }, false},
+		{func() error { return StoreRecord(record("www.example.com", "A", "10.0.0.2")) }, true},
+		{func() error { return DeleteRecord(record("www.example.com", "A", "10.0.0.2")) }, true},
+		{func() error { return DeleteRRSet("mail.example.com", "A") }, false},
+		{func() error { return DeleteName("www.example.com") }, true},
+	}
+	for i, step := range steps {
+		if err := step.change(); err != nil {
+			t.Fatal(err)
+		}
+		cur, err := GetSerial("example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bumped := cur != serial; bumped != step.bumped || (bumped && cur != serial+1) {
+			t.Errorf("step %d: serial %v => %v", i, serial, cur)
+		}
+		serial = cur
+	}
+}
+
+func TestSerialBumpedInCluster(t *testing.T) {
+	UseClusterLock(true)
+	defer UseClusterLock(false)
+	store := useMemStore(t, "example.com")
+	if err := StoreRecord(record("www.example.com", "A", "10.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another member bumps the serial while we wait, ours follows it
+	otherTicket(t, &lockTicket{Node: "other", Number: 1, Stamp: time.Now().UnixNano()})
+	done := make(chan error)
+	go func() {
+		done <- StoreRecord(record("www.example.com", "A", "10.0.0.3"))
+	}()
+	time.Sleep(50 * time.Millisecond)
+	lst, _ := getZones()
+	lst.Zones["example.com."].Serial = 3
+	store.Set(zonesKey, lst)
+	store.Set(journalEntryKey("example.com", 2), &JournalEntry{
+		From:  2,
+		To:    3,
+		Added: []Record{*record("www.example.com", "A", "10.0.0.2")},
+	})
+	store.Set(journalInfoKey("example.com"), &journalInfo{First: 2, Count: 1})
+	store.Delete(lockPrefix + "other")
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if serial, _ := GetSerial("example.com"); serial != 4 {
+		t.Errorf("GetSerial() = %v, want 4", serial)
+	}
+	if entries, err := Journal("example.com", 2); err != nil || len(entries) != 2 || entries[1].From != 3 {
+		t.Errorf("Journal(example.com, 2) = %+v, %v", entries, err)
+	}
+
+	// A serial given twice isn't journaled again, the batch stays pending
+	store.Set(journalEntryKey("example.com", 4), &JournalEntry{From: 4, To: 9})
+	if err := StoreRecord(record("www.example.com", "A", "10.0.0.4")); err != nil {
+		t.Fatal(err)
+	}
+	entry := &JournalEntry{}
+	if store.Get(journalEntryKey("example.com", 4), entry); entry.To != 9 || len(entry.Added) != 0 {
+		t.Errorf("journal entry from 4 replaced by %+v", entry)
+	}
+	if len(pendingTxn().Sets) == 0 {
+		t.Error("batch not journaled ended")
+	}
+
+	// The serial isn't bumped without the cluster lock
+	if _, _, err := bumpSerial("example.com", 0, 0); err != errNotLocked {
+		t.Errorf("bumpSerial() = %v without the cluster lock", err)
+	}
+}
@@ -0,0 +1,151 @@
+package addd
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	tsigKey = "addd/tsig"
+)
+
+var (
+	tsigLock sync.Mutex
+
+	// tsigAlgorithms are the HMAC algorithms we support, by their name
+	tsigAlgorithms = map[string]string{
+		"hmac-md5":                 dns.HmacMD5,
+		"hmac-md5.sig-alg.reg.int": dns.HmacMD5,
+		"hmac-sha1":                dns.HmacSHA1,
+		"hmac-sha256":              dns.HmacSHA256,
+		"hmac-sha512":              dns.HmacSHA512,
+	}
+)
+
+// TsigKey represent a shared secret used to sign messages (RFC 2845)
+type TsigKey struct {
+	Name      string   `json:"key"              binding:"required"`
+	Algorithm string   `json:"algorithm"`
+	Secret    string   `json:"secret,omitempty" binding:"required"`
+	Policies  []Policy `json:"policies,omitempty"`
+}
+
+// tsigList is the DB object holding all our TSIG keys
+type tsigList struct {
+	Keys map[string]*TsigKey `json:"tsig"`
+}
+
+// ParseTsigKey create a TsigKey from its 'keyname:[algorithm:]base64' form,
+// hmac-md5 is used when the algorithm is omitted
+func ParseTsigKey(spec string) (*TsigKey, error) {
+	a := strings.SplitN(spec, ":", 3)
+	key := &TsigKey{Name: a[0]}
+	switch len(a) {
+	case 2:
+		key.Algorithm, key.Secret = dns.HmacMD5, a[1]
+	case 3:
+		key.Algorithm, key.Secret = a[1], a[2]
+	default:
+		return nil, fmt.Errorf("TSIG key %v is not 'keyname:[algorithm:]base64'", a[0])
+	}
+	if err := key.Validate(); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Validate checks the key's name, algorithm and secret.
+// Names are made canonical, HMAC-SHA256 is used if no algorithm is set.
+func (k *TsigKey) Validate() error {
+	k.Name = dns.Fqdn(strings.ToLower(k.Name))
+	if _, ok := dns.IsDomainName(k.Name); !ok || k.Name == "." {
+		return fmt.Errorf("TSIG key %v has not a valid name", k.Name)
+	}
+	if k.Algorithm == "" {
+		k.Algorithm = dns.HmacSHA256
+	}
+	alg, ok := tsigAlgorithms[strings.TrimRight(strings.ToLower(k.Algorithm), ".")]
+	if !ok {
+		return fmt.Errorf("TSIG key %v has an unsupported algorithm %v", k.Name, k.Algorithm)
+	}
+	k.Algorithm = alg
+	if _, err := base64.StdEncoding.DecodeString(k.Secret); err != nil || k.Secret == "" {
+		return fmt.Errorf("TSIG key %v has not a valid base64 secret", k.Name)
+	}
+	for i := range k.Policies {
+		if err := k.Policies[i].Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListTsigKeys returns all our TSIG keys
+func ListTsigKeys() ([]TsigKey, error) {
+	lst, err := getTsigKeys()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]TsigKey, 0, len(lst.Keys))
+	for _, key := range lst.Keys {
+		keys = append(keys, *key)
+	}
+	return keys, nil
+}
+
+// GetTsigKey retrieves the TSIG key called name
+func GetTsigKey(name string) (*TsigKey, error) {
+	lst, err := getTsigKeys()
+	if err != nil {
+		return nil, err
+	}
+	if key, ok := lst.Keys[dns.Fqdn(strings.ToLower(name))]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("TSIG key %v not found", name)
+}
+
+// StoreTsigKey creates or replaces a TSIG key
+func StoreTsigKey(key *TsigKey) error {
+	if err := key.Validate(); err != nil {
+		return err
+	}
+	tsigLock.Lock()
+	defer tsigLock.Unlock()
+	lst, err := getTsigKeys()
+	if err != nil {
+		return err
+	}
+	lst.Keys[key.Name] = key
+	return bdb.Set(tsigKey, lst)
+}
+
+// DeleteTsigKey deletes the TSIG key called name
+func DeleteTsigKey(name string) error {
+	key, err := GetTsigKey(name)
+	if err != nil {
+		return err
+	}
+	tsigLock.Lock()
+	defer tsigLock.Unlock()
+	lst, err := getTsigKeys()
+	if err != nil {
+		return err
+	}
+	delete(lst.Keys, key.Name)
+	return bdb.Set(tsigKey, lst)
+}
+
+// getTsigKeys reads all our TSIG keys, an empty list is returned if none was created
+func getTsigKeys() (*tsigList, error) {
+	checkBdp()
+	lst := &tsigList{}
+	if err := bdb.Get(tsigKey, lst); err != nil || lst.Keys == nil {
+		lst.Keys = make(map[string]*TsigKey)
+	}
+	return lst, nil
+}
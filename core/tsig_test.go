@@ -0,0 +1,74 @@
+package addd
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseTsigKey(t *testing.T) {
+	tests := []struct {
+		spec string
+		want *TsigKey // nil if invalid
+	}{
+		{"Key.Example.com:c2VjcmV0", &TsigKey{Name: "key.example.com.", Algorithm: dns.HmacMD5, Secret: "c2VjcmV0"}},
+		{"key:hmac-sha256:c2VjcmV0", &TsigKey{Name: "key.", Algorithm: dns.HmacSHA256, Secret: "c2VjcmV0"}},
+		{"key:HMAC-SHA512.:c2VjcmV0", &TsigKey{Name: "key.", Algorithm: dns.HmacSHA512, Secret: "c2VjcmV0"}},
+		{"key:hmac-md5.sig-alg.reg.int:c2VjcmV0", &TsigKey{Name: "key.", Algorithm: dns.HmacMD5, Secret: "c2VjcmV0"}},
+		{"key", nil},
+		{"key:", nil},
+		{"key:not base64", nil},
+		{"key:hmac-sha384:c2VjcmV0", nil},
+		{"key..example.com:c2VjcmV0", nil},
+	}
+	for _, tt := range tests {
+		got, err := ParseTsigKey(tt.spec)
+		switch {
+		case tt.want == nil && err == nil:
+			t.Errorf("ParseTsigKey(%v) = %+v, want an error", tt.spec, got)
+		case tt.want != nil && (err != nil || !reflect.DeepEqual(got, tt.want)):
+			t.Errorf("ParseTsigKey(%v) = %+v, %v, want %+v", tt.spec, got, err, tt.want)
+		}
+	}
+	// Keys created through the API default to HMAC-SHA256
+	key := &TsigKey{Name: "key", Secret: "c2VjcmV0"}
+	if err := key.Validate(); err != nil || key.Algorithm != dns.HmacSHA256 {
+		t.Errorf("Validate() = %v, algorithm %v", err, key.Algorithm)
+	}
+}
+
+func TestStoreTsigKey(t *testing.T) {
+	useMemStore(t)
+
+	for _, key := range []*TsigKey{
+		{Name: "a.example.com", Secret: "c2VjcmV0"},
+		{Name: "b.example.com", Algorithm: "hmac-md5", Secret: "c2VjcmV0"},
+		{Name: "A.example.com.", Secret: "bmV3"},
+	} {
+		if err := StoreTsigKey(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := StoreTsigKey(&TsigKey{Name: "c.example.com", Secret: "not base64"}); err == nil {
+		t.Error("invalid key stored")
+	}
+	for name, secret := range map[string]string{"a.example.com.": "bmV3", "b.example.com.": "c2VjcmV0"} {
+		if key, err := GetTsigKey(name); err != nil || key.Secret != secret {
+			t.Errorf("GetTsigKey(%v) = %+v, %v, want the secret %v", name, key, err, secret)
+		}
+	}
+	if keys, err := ListTsigKeys(); err != nil || len(keys) != 2 {
+		t.Errorf("ListTsigKeys() = %v, %v, want 2 keys", keys, err)
+	}
+
+	if err := DeleteTsigKey("B.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteTsigKey("b.example.com"); err == nil {
+		t.Error("missing key deleted")
+	}
+	if keys, err := ListTsigKeys(); err != nil || len(keys) != 1 || keys[0].Name != "a.example.com." {
+		t.Errorf("ListTsigKeys() = %v, %v", keys, err)
+	}
+}
@@ -39,7 +39,7 @@ func DeletePid() {
 
 // WaitSig wait SIGINT, SIGTERM, SIGKILL and SIGQUIT signals
 func WaitSig() {
-	sig := make(chan os.Signal)
+	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL, syscall.SIGQUIT)
 	s := <-sig
 	DeletePid()
@@ -49,7 +49,7 @@ func WaitSig() {
 // IsValidIp return an error if the ip address is invalid
 func IsValidIp(ipAddr string, v6 bool) error {
 	err := fmt.Errorf("Invalid ip address %s", ipAddr)
-	ip := net.ParseIP( ipAddr )
+	ip := net.ParseIP(ipAddr)
 	if ip == nil {
 		return err
 	}
@@ -58,4 +58,4 @@ func IsValidIp(ipAddr string, v6 bool) error {
 		return err
 	}
 	return nil
-}
\ No newline at end of file
+}
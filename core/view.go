@@ -0,0 +1,317 @@
+package addd
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	viewsKey = "addd/views"
+	// DefaultView is the name of the view holding the records seen by all clients
+	DefaultView = "default"
+)
+
+var (
+	viewsLock sync.Mutex
+
+	viewNameRE = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+)
+
+// View is a named set of records served instead of the default ones to the clients
+// of its networks (CIDR) or signing their queries with one of its TSIG keys.
+// Names and types without records in the view are answered from the default view.
+type View struct {
+	Name     string   `json:"view"     binding:"required"`
+	Networks []string `json:"networks"`
+	Keys     []string `json:"keys"`
+}
+
+// viewList is the DB object holding all our views
+type viewList struct {
+	Views map[string]*View `json:"views"`
+}
+
+// Validate checks the view's name, networks and keys, they are made canonical
+func (v *View) Validate() error {
+	v.Name = strings.ToLower(v.Name)
+	if !viewNameRE.MatchString(v.Name) || v.Name == DefaultView {
+		return fmt.Errorf("View %v has not a valid name", v.Name)
+	}
+	for i, cidr := range v.Networks {
+		_, ipnet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return fmt.Errorf("View %v has an invalid network %v", v.Name, cidr)
+		}
+		v.Networks[i] = ipnet.String()
+	}
+	for i, key := range v.Keys {
+		v.Keys[i] = dns.Fqdn(strings.ToLower(key))
+		if _, ok := dns.IsDomainName(v.Keys[i]); !ok || v.Keys[i] == "." {
+			return fmt.Errorf("View %v has an invalid TSIG key %v", v.Name, key)
+		}
+	}
+	if v.Networks == nil {
+		v.Networks = make([]string, 0)
+	}
+	if v.Keys == nil {
+		v.Keys = make([]string, 0)
+	}
+	return nil
+}
+
+// hasKey returns true if the queries signed by key select the view
+func (v *View) hasKey(key string) bool {
+	for _, k := range v.Keys {
+		if key != "" && strings.EqualFold(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasNetwork returns true if the queries sent from ip select the view
+func (v *View) hasNetwork(ip net.IP) bool {
+	for _, cidr := range v.Networks {
+		if _, ipnet, err := net.ParseCIDR(cidr); err == nil && ip != nil && ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ListViews returns all our views, sorted by name
+func ListViews() ([]View, error) {
+	lst, err := getViews()
+	if err != nil {
+		return nil, err
+	}
+	views := make([]View, 0, len(lst.Views))
+	for _, view := range lst.Views {
+		views = append(views, *view)
+	}
+	sort.Slice(views, func(i, j int) bool { return views[i].Name < views[j].Name })
+	return views, nil
+}
+
+// GetView retrieves the view called name
+func GetView(name string) (*View, error) {
+	lst, err := getViews()
+	if err != nil {
+		return nil, err
+	}
+	if view, ok := lst.Views[strings.ToLower(name)]; ok {
+		return view, nil
+	}
+	return nil, fmt.Errorf("View %v not found", name)
+}
+
+// StoreView creates or updates a view
+func StoreView(view *View) error {
+	if err := view.Validate(); err != nil {
+		return err
+	}
+	viewsLock.Lock()
+	defer viewsLock.Unlock()
+	lst, err := getViews()
+	if err != nil {
+		return err
+	}
+	lst.Views[view.Name] = view
+	return bdb.Set(viewsKey, lst)
+}
+
+// DeleteView deletes a view with all its records, removed through a single Batch
+func DeleteView(name string) error {
+	view, err := GetView(name)
+	if err != nil {
+		return err
+	}
+	sets, err := ListViewRRSets(view.Name)
+	if err != nil {
+		return err
+	}
+	b := NewBatch()
+	for _, set := range sets {
+		if err := b.DeleteViewRRSet(view.Name, set.Name, set.Type); err != nil {
+			return err
+		}
+	}
+	if err := b.Commit(); err != nil {
+		return err
+	}
+	viewsLock.Lock()
+	defer viewsLock.Unlock()
+	lst, err := getViews()
+	if err != nil {
+		return err
+	}
+	delete(lst.Views, view.Name)
+	return bdb.Set(viewsKey, lst)
+}
+
+// MatchView returns the name of the view selected by a query sent from ip and signed
+// by key (empty if unsigned), an empty string for the default view.
+// Views selected by the key take precedence over those selected by the network.
+func MatchView(ip net.IP, key string) string {
+	views, err := ListViews()
+	if err != nil {
+		return ""
+	}
+	for _, view := range views {
+		if view.hasKey(key) {
+			return view.Name
+		}
+	}
+	for _, view := range views {
+		if view.hasNetwork(ip) {
+			return view.Name
+		}
+	}
+	return ""
+}
+
+// ListViewRRSets returns all the RRSets of view
+func ListViewRRSets(view string) ([]RRSet, error) {
+	all, err := listSets()
+	if err != nil {
+		return nil, err
+	}
+	view = viewName(view)
+	sets := make([]RRSet, 0)
+	for _, set := range all {
+		if set.View == view {
+			sets = append(sets, set)
+		}
+	}
+	return sets, nil
+}
+
+// GetViewRRSet retrieves the records of domain with the type rtype in view, without falling back
+func GetViewRRSet(view, domain, rtype string) (*RRSet, error) {
+	if viewName(view) == "" {
+		return GetRRSet(domain, rtype)
+	}
+	checkBdp()
+	batchLock.RLock()
+	defer batchLock.RUnlock()
+	set := NewRRSet(domain, rtype)
+	set.View = viewName(view)
+	if _, err := set.key(); err != nil {
+		return nil, err
+	}
+	err := readTxn(func(t *txn) error {
+		set = NewRRSet(domain, rtype)
+		set.View = viewName(view)
+		return t.getSet(set)
+	})
+	return set, err
+}
+
+// ResolveRRSet retrieves the records of domain with the type rtype in view,
+// from the default view if view has none
+func ResolveRRSet(view, domain, rtype string) (*RRSet, error) {
+	if viewName(view) != "" {
+		if set, err := GetViewRRSet(view, domain, rtype); err == nil && !set.Empty() {
+			return set, nil
+		}
+	}
+	return GetRRSet(domain, rtype)
+}
+
+// StoreViewRRSet replaces the whole RRSet in view through a Batch. A CNAME is checked against
+// the records seen in the view, including those of the default view.
+// Views aren't transferred nor journaled, so their changes don't bump the serial.
+func StoreViewRRSet(view string, set *RRSet) error {
+	if viewName(view) == "" {
+		return StoreRRSet(set)
+	}
+	if _, err := GetView(view); err != nil {
+		return err
+	}
+	b := NewBatch()
+	if err := b.StoreViewRRSet(view, set); err != nil {
+		return err
+	}
+	return b.Commit()
+}
+
+// DeleteViewRRSet deletes all the records of domain with the type rtype in view
+func DeleteViewRRSet(view, domain, rtype string) error {
+	if viewName(view) == "" {
+		return DeleteRRSet(domain, rtype)
+	}
+	b := NewBatch()
+	if err := b.DeleteViewRRSet(view, domain, rtype); err != nil {
+		return err
+	}
+	return b.Commit()
+}
+
+// ViewNameExists returns true if domain exists in view or in the default view
+func ViewNameExists(view, domain string) (bool, error) {
+	checkBdp()
+	batchLock.RLock()
+	defer batchLock.RUnlock()
+	var exists bool
+	err := readTxn(func(t *txn) (err error) {
+		if exists, err = nameExists(t, "", domain); err != nil || exists || viewName(view) == "" {
+			return
+		}
+		exists, err = nameExists(t, "view/"+viewName(view)+"/", domain)
+		return
+	})
+	return exists, err
+}
+
+// ViewTypes returns the types of the RRSets owned by domain in view or in the default view
+func ViewTypes(view, domain string) ([]string, error) {
+	checkBdp()
+	batchLock.RLock()
+	defer batchLock.RUnlock()
+	var sets []RRSet
+	err := readTxn(func(t *txn) (err error) {
+		if sets, err = listName(t, "", domain); err != nil || viewName(view) == "" {
+			return
+		}
+		own, err := listName(t, "view/"+viewName(view)+"/", domain)
+		sets = append(sets, own...)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	types := make([]string, 0, len(sets))
+	for _, set := range sets {
+		if !seen[set.Type] {
+			seen[set.Type] = true
+			types = append(types, set.Type)
+		}
+	}
+	return types, nil
+}
+
+// getViews reads all our views, an empty list is returned if none was created
+func getViews() (*viewList, error) {
+	checkBdp()
+	lst := &viewList{}
+	if err := bdb.Get(viewsKey, lst); err != nil || lst.Views == nil {
+		lst.Views = make(map[string]*View)
+	}
+	return lst, nil
+}
+
+// viewName returns the stored name of a view, empty for the default one
+func viewName(view string) string {
+	view = strings.ToLower(view)
+	if view == DefaultView {
+		return ""
+	}
+	return view
+}
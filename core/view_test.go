@@ -0,0 +1,246 @@
+package addd
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/redsux/addd/core/dbtest"
+)
+
+// useViews stores the views internal (10.0.0.0/8) and vpn (10.8.0.0/16 or the key vpn.example.com)
+func useViews(t *testing.T) {
+	for _, view := range []*View{
+		{Name: "Internal", Networks: []string{"10.0.0.0/8"}},
+		{Name: "vpn", Networks: []string{" 10.8.0.1/16"}, Keys: []string{"VPN.example.com"}},
+	} {
+		if err := StoreView(view); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// viewSet returns the RRSet of domain/rtype in view holding the records of data
+func viewSet(view, domain, rtype string, data ...string) *RRSet {
+	set := NewRRSet(domain, rtype)
+	set.View = view
+	for _, d := range data {
+		set.Add(record(domain, rtype, d))
+	}
+	return set
+}
+
+func TestViews(t *testing.T) {
+	useMemStore(t, "example.com")
+	useViews(t)
+	invalid := []*View{
+		{Name: "default"},
+		{Name: "-vpn"},
+		{Name: "lan", Networks: []string{"10.0.0.1"}},
+		{Name: "lan", Keys: []string{"key..example.com"}},
+	}
+	for _, view := range invalid {
+		if err := StoreView(view); err == nil {
+			t.Errorf("StoreView(%+v) accepted", view)
+		}
+	}
+	views, err := ListViews()
+	want := []View{
+		{Name: "internal", Networks: []string{"10.0.0.0/8"}, Keys: []string{}},
+		{Name: "vpn", Networks: []string{"10.8.0.0/16"}, Keys: []string{"vpn.example.com."}},
+	}
+	if err != nil || !reflect.DeepEqual(views, want) {
+		t.Errorf("ListViews() = %+v, %v, want %+v", views, err, want)
+	}
+
+	tests := []struct {
+		ip   string
+		key  string
+		want string
+	}{
+		{"10.1.0.1", "", "internal"},
+		{"10.8.0.1", "", "internal"},
+		{"192.0.2.1", "vpn.example.com.", "vpn"},
+		{"10.1.0.1", "VPN.example.com.", "vpn"},
+		{"192.0.2.1", "other.example.com.", ""},
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		if got := MatchView(net.ParseIP(tt.ip), tt.key); got != tt.want {
+			t.Errorf("MatchView(%v, %v) = %q, want %q", tt.ip, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestViewRRSets(t *testing.T) {
+	useMemStore(t, "example.com")
+	useViews(t)
+	storeAll := func(sets ...*RRSet) {
+		for _, set := range sets {
+			if err := StoreViewRRSet(set.View, set); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	storeAll(
+		viewSet("", "www.example.com", "A", "192.0.2.1"),
+		viewSet("", "mail.example.com", "A", "192.0.2.2"),
+		viewSet("internal", "www.example.com", "A", "10.0.0.1"),
+		viewSet("internal", "host.lan.example.com", "A", "10.0.0.2"),
+	)
+
+	// The records of the views are apart, those missing come from the default view
+	if got := storedRecords(t); !reflect.DeepEqual(got, []string{"mail.example.com 300 IN A 192.0.2.2", "www.example.com 300 IN A 192.0.2.1"}) {
+		t.Errorf("records of the default view = %q", got)
+	}
+	resolved := []struct {
+		view, name, want string
+	}{
+		{"internal", "www.example.com", "10.0.0.1"},
+		{"internal", "mail.example.com", "192.0.2.2"},
+		{"vpn", "www.example.com", "192.0.2.1"},
+		{"", "www.example.com", "192.0.2.1"},
+		{DefaultView, "www.example.com", "192.0.2.1"},
+	}
+	for _, tt := range resolved {
+		set, err := ResolveRRSet(tt.view, tt.name, "A")
+		if err != nil || len(set.Records) != 1 || set.Records[0].Address != tt.want {
+			t.Errorf("ResolveRRSet(%v, %v) = %v, %v, want %v", tt.view, tt.name, set, err, tt.want)
+		}
+	}
+	if _, err := GetViewRRSet("vpn", "www.example.com", "A"); err == nil {
+		t.Error("GetViewRRSet() fell back to the default view")
+	}
+	exists := []struct {
+		view, name string
+		want       bool
+	}{
+		{"internal", "host.lan.example.com", true},
+		{"internal", "lan.example.com", true},
+		{"internal", "mail.example.com", true},
+		{"vpn", "lan.example.com", false},
+		{"", "host.lan.example.com", false},
+		{"internal", "none.example.com", false},
+	}
+	for _, tt := range exists {
+		if got, err := ViewNameExists(tt.view, tt.name); err != nil || got != tt.want {
+			t.Errorf("ViewNameExists(%v, %v) = %v, %v, want %v", tt.view, tt.name, got, err, tt.want)
+		}
+	}
+
+	// Wildcards and types are those of the view merged with the default view
+	storeAll(
+		viewSet("internal", "*.lan.example.com", "A", "10.0.0.3"),
+		viewSet("internal", "www.example.com", "TXT", "internal"),
+	)
+	wildcards := []struct {
+		view, name, want string
+	}{
+		{"internal", "other.lan.example.com", "*.lan.example.com"},
+		{"internal", "host.lan.example.com", ""},
+		{"vpn", "other.lan.example.com", ""},
+		{"", "other.lan.example.com", ""},
+	}
+	for _, tt := range wildcards {
+		if got, err := ViewWildcard(tt.view, tt.name); err != nil || got != tt.want {
+			t.Errorf("ViewWildcard(%v, %v) = %q, %v, want %q", tt.view, tt.name, got, err, tt.want)
+		}
+	}
+	for view, want := range map[string][]string{"internal": {"A", "TXT"}, "vpn": {"A"}} {
+		if got, err := ViewTypes(view, "www.example.com"); err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("ViewTypes(%v) = %v, %v, want %v", view, got, err, want)
+		}
+	}
+
+	// The records of a view are checked as those of the default view
+	invalid := []*RRSet{
+		viewSet("lan", "www.example.com", "A", "10.0.0.1"),
+		viewSet("internal", "www.example.org", "A", "10.0.0.1"),
+		viewSet("internal", "www.example.com", "CNAME", "host.lan.example.com"),
+		viewSet("internal", "web.example.com", "CNAME", "host.lan.example.com", "www.example.com"),
+		viewSet("internal", "host.lan.example.com", "A", "10.0.0.256"),
+		// The view falls back to the A of the default view
+		viewSet("internal", "mail.example.com", "CNAME", "www.example.com"),
+	}
+	for _, set := range invalid {
+		if err := StoreViewRRSet(set.View, set); err == nil {
+			t.Errorf("StoreViewRRSet(%v, %v %v %v) accepted", set.View, set.Name, set.Type, set.Records)
+		}
+	}
+
+	// Nor the default view beside the CNAME of a view, which would see both
+	storeAll(viewSet("vpn", "ftp.example.com", "CNAME", "www.example.com"))
+	if err := StoreRecord(record("ftp.example.com", "A", "10.0.0.9")); err != ErrCNAMEConflict {
+		t.Errorf("StoreRecord() beside the CNAME of a view = %v", err)
+	}
+	if err := StoreRecord(record("ftp.example.com", "CNAME", "mail.example.com")); err != nil {
+		t.Errorf("StoreRecord() of a CNAME overridden by a view = %v", err)
+	}
+
+	// An empty RRSet is deleted, as are the records of a view deleted
+	storeAll(viewSet("internal", "www.example.com", "A"))
+	if _, err := GetViewRRSet("internal", "www.example.com", "A"); err == nil {
+		t.Error("empty RRSet kept in the view")
+	}
+	if err := DeleteView("internal"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetView("internal"); err == nil {
+		t.Error("view deleted kept")
+	}
+	if err := StoreView(&View{Name: "internal"}); err != nil {
+		t.Fatal(err)
+	}
+	if sets, err := ListViewRRSets("internal"); err != nil || len(sets) != 0 {
+		t.Errorf("ListViewRRSets() = %v, %v after deleting the view", sets, err)
+	}
+
+	// And those of a zone deleted
+	storeAll(viewSet("vpn", "www.example.com", "A", "10.8.0.1"))
+	if err := DeleteZone("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if sets, err := ListViewRRSets("vpn"); err != nil || len(sets) != 0 {
+		t.Errorf("ListViewRRSets() = %v, %v after deleting the zone", sets, err)
+	}
+}
+
+func TestDeleteViewAllOrNothing(t *testing.T) {
+	store := &failingStore{Store: dbtest.NewStore()}
+	if err := NewDB(store); err != nil {
+		t.Fatal(err)
+	}
+	if err := StoreZone(DefaultZone("example.com")); err != nil {
+		t.Fatal(err)
+	}
+	useViews(t)
+	for _, set := range []*RRSet{
+		viewSet("internal", "mail.example.com", "A", "10.0.0.1"),
+		viewSet("internal", "www.example.com", "A", "10.0.0.2"),
+	} {
+		if err := StoreViewRRSet(set.View, set); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Its batch not committed, the RRSets and the view are kept
+	store.fail = txnKey
+	if err := DeleteView("internal"); err == nil {
+		t.Fatal("DeleteView() = nil")
+	}
+	if sets, err := ListViewRRSets("internal"); err != nil || len(sets) != 2 {
+		t.Errorf("ListViewRRSets() = %v, %v after a failed deletion", sets, err)
+	}
+	if _, err := GetView("internal"); err != nil {
+		t.Error(err)
+	}
+
+	// Once committed, the RRSets not deleted yet aren't read
+	store.fail, store.failDelete = "", "view/internal/com.example.www_A"
+	if err := DeleteView("internal"); err != nil {
+		t.Fatal(err)
+	}
+	if sets, err := ListViewRRSets("internal"); err != nil || len(sets) != 0 {
+		t.Errorf("ListViewRRSets() = %v, %v after deleting the view", sets, err)
+	}
+}
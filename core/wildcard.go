@@ -0,0 +1,41 @@
+package addd
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Wildcard returns the wildcard name synthesizing domain (RFC 4592), an empty string
+// if domain exists or if its closest encloser has no wildcard child
+func Wildcard(domain string) (string, error) {
+	return ViewWildcard("", domain)
+}
+
+// ViewWildcard returns the wildcard name synthesizing domain in view, see Wildcard.
+// The names of the default view also exist in view.
+func ViewWildcard(view, domain string) (string, error) {
+	labels := dns.SplitDomainName(cleanName(domain))
+	if len(labels) == 0 {
+		return "", nil
+	}
+	if exists, err := ViewNameExists(view, strings.Join(labels, ".")); err != nil || exists {
+		return "", err
+	}
+	// Up to the closest encloser, the first ancestor existing
+	for i := 1; i < len(labels); i++ {
+		encloser := strings.Join(labels[i:], ".")
+		wild := "*." + encloser
+		exists, err := ViewNameExists(view, wild)
+		if err != nil {
+			return "", err
+		}
+		if exists {
+			return wild, nil
+		}
+		if exists, err := ViewNameExists(view, encloser); err != nil || exists {
+			return "", err
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,41 @@
+package addd
+
+import "testing"
+
+func TestWildcard(t *testing.T) {
+	useMemStore(t, "example.com")
+	for _, rec := range []*Record{
+		record("*.example.com", "A", "10.0.0.1"),
+		record("www.example.com", "A", "10.0.0.2"),
+		record("host.sub.example.com", "A", "10.0.0.3"),
+		record("*.dyn.example.com", "CNAME", "www.example.com"),
+		record("a.*.ent.example.com", "A", "10.0.0.4"),
+	} {
+		if err := StoreRecord(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name, want string
+	}{
+		{"foo.example.com", "*.example.com"},
+		{"a.b.example.com.", "*.example.com"},
+		{"FOO.Example.com", "*.example.com"},
+		{"www.example.com", ""},
+		{"a.www.example.com", ""},
+		// sub.example.com exists as an empty non-terminal
+		{"sub.example.com", ""},
+		{"other.sub.example.com", ""},
+		{"a.dyn.example.com", "*.dyn.example.com"},
+		{"*.example.com", ""},
+		// A wildcard existing as an empty non-terminal still matches
+		{"x.ent.example.com", "*.ent.example.com"},
+		{"example.org", ""},
+	}
+	for _, tt := range tests {
+		got, err := Wildcard(tt.name)
+		if err != nil || got != tt.want {
+			t.Errorf("Wildcard(%v) = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package addd
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	zonesKey = "addd/zones"
+)
+
+var (
+	zonesLock sync.Mutex
+
+	// ErrNoZone is returned when a name doesn't belong to any of our zones
+	ErrNoZone = errors.New("No zone found")
+)
+
+// Zone represent a DNS zone served by addd with its SOA parameters
+type Zone struct {
+	Name    string   `json:"zone"    binding:"required"`
+	NS      []string `json:"ns"`
+	Mbox    string   `json:"mbox"`
+	Serial  uint32   `json:"serial"`
+	Refresh int      `json:"refresh"`
+	Retry   int      `json:"retry"`
+	Expire  int      `json:"expire"`
+	Minimum int      `json:"minimum"`
+	TTL     int      `json:"ttl"`
+}
+
+// zoneList is the DB object holding all our zones
+type zoneList struct {
+	Zones map[string]*Zone `json:"zones"`
+}
+
+// DefaultZone create a Zone with all default values
+func DefaultZone(name string) *Zone {
+	name = zoneName(name)
+	return &Zone{
+		Name:    name,
+		NS:      []string{"ns." + strings.TrimLeft(name, ".")},
+		Mbox:    "admin." + strings.TrimLeft(name, "."),
+		Refresh: 3600,
+		Retry:   1800,
+		Expire:  604800,
+		Minimum: 604800,
+		TTL:     604800,
+	}
+}
+
+// Validate checks the zone's names and SOA values
+func (z *Zone) Validate() error {
+	if _, ok := dns.IsDomainName(z.Name); !ok || z.Name == "" {
+		return fmt.Errorf("Zone %v has not a valid domain", z.Name)
+	}
+	if len(z.NS) == 0 {
+		return fmt.Errorf("Zone %v has no name server", z.Name)
+	}
+	for _, ns := range append([]string{z.Mbox}, z.NS...) {
+		if _, ok := dns.IsDomainName(ns); !ok || ns == "" {
+			return fmt.Errorf("Zone %v has an invalid name %v", z.Name, ns)
+		}
+	}
+	for _, v := range []int{z.Refresh, z.Retry, z.Expire, z.Minimum, z.TTL} {
+		if v < 0 {
+			return fmt.Errorf("Zone %v has a negative timer", z.Name)
+		}
+	}
+	return nil
+}
+
+// ListZones returns all our zones
+func ListZones() ([]Zone, error) {
+	lst, err := readZones()
+	if err != nil {
+		return nil, err
+	}
+	zones := make([]Zone, 0, len(lst.Zones))
+	for _, zone := range lst.Zones {
+		zones = append(zones, *zone)
+	}
+	return zones, nil
+}
+
+// GetZone retrieves the zone called name
+func GetZone(name string) (*Zone, error) {
+	lst, err := readZones()
+	if err != nil {
+		return nil, err
+	}
+	if zone, ok := lst.Zones[zoneName(name)]; ok {
+		return zone, nil
+	}
+	return nil, fmt.Errorf("Zone %v not found", name)
+}
+
+// ZoneOf returns the closest zone containing domain
+func ZoneOf(domain string) (*Zone, error) {
+	lst, err := readZones()
+	if err != nil {
+		return nil, err
+	}
+	if found := lst.zoneOf(domain); found != nil {
+		return found, nil
+	}
+	return nil, ErrNoZone
+}
+
+// ZoneContent returns the zone name and the RRSets of its names in the default view,
+// those of its subzones excluded. They are read together, matching the serial of the zone.
+func ZoneContent(name string) (*Zone, []RRSet, error) {
+	checkBdp()
+	batchLock.RLock()
+	defer batchLock.RUnlock()
+	var zone *Zone
+	var sets []RRSet
+	err := readTxn(func(t *txn) error {
+		lst, err := getZones()
+		if err != nil {
+			return err
+		}
+		t.applySerials(lst)
+		var ok bool
+		if zone, ok = lst.Zones[zoneName(name)]; !ok {
+			return fmt.Errorf("Zone %v not found", name)
+		}
+		all := make([]RRSet, 0)
+		if err := bdb.List(&all); err != nil {
+			return err
+		}
+		sets = make([]RRSet, 0, len(all))
+		for _, set := range t.apply(all, func(string) bool { return true }) {
+			if set.Name != "" && set.View == "" && lst.zoneOf(set.Name) == zone {
+				sets = append(sets, set)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return zone, sets, nil
+}
+
+// StoreZone creates or updates a zone, its serial can't be changed.
+// A change of the SOA or NS records bumps the serial, the journal is dropped
+// as it only holds the changes of our records.
+func StoreZone(zone *Zone) error {
+	zone.Name = zoneName(zone.Name)
+	if err := zone.Validate(); err != nil {
+		return err
+	}
+	unlock, err := lockCluster()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	zonesLock.Lock()
+	lst, err := getZones()
+	if err != nil {
+		zonesLock.Unlock()
+		return err
+	}
+	changed := false
+	if old, ok := lst.Zones[zone.Name]; ok {
+		zone.Serial = old.Serial
+		if changed = !reflect.DeepEqual(old, zone); changed {
+			zone.Serial = nextSerial(old.Serial)
+		}
+	} else {
+		zone.Serial = nextSerial(0)
+	}
+	lst.Zones[zone.Name] = zone
+	err = bdb.Set(zonesKey, lst)
+	zonesLock.Unlock()
+	if err != nil || !changed {
+		return err
+	}
+	if err := dropJournal(zone.Name); err != nil {
+		return err
+	}
+	committed(zone.Name, zone.Serial)
+	return nil
+}
+
+// InitZone creates zone if it doesn't exist yet
+func InitZone(zone *Zone) error {
+	if _, err := GetZone(zone.Name); err == nil {
+		return nil
+	}
+	return StoreZone(zone)
+}
+
+// DeleteZone deletes a zone with all its records (in all the views) and their selections,
+// its journal and its DNSSEC keys
+func DeleteZone(name string) error {
+	zone, err := GetZone(name)
+	if err != nil {
+		return err
+	}
+	sets, err := listSets()
+	if err != nil {
+		return err
+	}
+	// Records of all the views go through a single Batch, removing their PTR records
+	b := NewBatch()
+	for _, set := range sets {
+		if owner, err := ZoneOf(set.Name); err != nil || owner.Name != zone.Name {
+			continue
+		}
+		if err := b.DeleteViewRRSet(set.View, set.Name, set.Type); err != nil {
+			return err
+		}
+	}
+	if err := b.Commit(); err != nil {
+		return err
+	}
+	unlock, err := lockCluster()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := dropJournal(zone.Name); err != nil {
+		return err
+	}
+	if err := dropZoneKeys(zone.Name); err != nil {
+		return err
+	}
+	if err := dropSelections(zone.Name); err != nil {
+		return err
+	}
+	zonesLock.Lock()
+	defer zonesLock.Unlock()
+	lst, err := getZones()
+	if err != nil {
+		return err
+	}
+	delete(lst.Zones, zone.Name)
+	return bdb.Set(zonesKey, lst)
+}
+
+// getZones reads all our zones, an empty list is returned if none was created
+func getZones() (*zoneList, error) {
+	checkBdp()
+	lst := &zoneList{}
+	if err := bdb.Get(zonesKey, lst); err != nil || lst.Zones == nil {
+		lst.Zones = make(map[string]*Zone)
+	}
+	return lst, nil
+}
+
+// readZones reads all our zones as getZones, with the serials planned by the batch pending
+func readZones() (lst *zoneList, err error) {
+	err = readTxn(func(t *txn) error {
+		if lst, err = getZones(); err == nil {
+			t.applySerials(lst)
+		}
+		return err
+	})
+	return
+}
+
+// zoneOf returns the closest zone of domain in lst, nil if none
+func (lst *zoneList) zoneOf(domain string) *Zone {
+	domain = dns.Fqdn(strings.ToLower(domain))
+	var found *Zone
+	for name, zone := range lst.Zones {
+		if dns.IsSubDomain(name, domain) && (found == nil || len(name) > len(found.Name)) {
+			found = zone
+		}
+	}
+	return found
+}
+
+// zoneName returns the lower case fqdn of a zone
+func zoneName(name string) string {
+	name = dns.Fqdn(strings.ToLower(name))
+	if name != "." {
+		name = strings.TrimLeft(name, ".")
+	}
+	return name
+}
@@ -0,0 +1,181 @@
+package addd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestZoneOf(t *testing.T) {
+	useMemStore(t, "example.com", "Sub.Example.com.", "0.0.10.in-addr.arpa")
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"example.com", "example.com."},
+		{"WWW.example.com.", "example.com."},
+		{"sub.example.com", "sub.example.com."},
+		{"www.sub.example.com", "sub.example.com."},
+		{"1.0.0.10.in-addr.arpa", "0.0.10.in-addr.arpa."},
+		{"www.example.org", ""},
+		{"com", ""},
+	}
+	for _, tt := range tests {
+		zone, err := ZoneOf(tt.name)
+		switch {
+		case tt.want == "" && err != ErrNoZone:
+			t.Errorf("ZoneOf(%v) = %v, %v, want %v", tt.name, zone, err, ErrNoZone)
+		case tt.want != "" && (err != nil || zone.Name != tt.want):
+			t.Errorf("ZoneOf(%v) = %v, %v, want %v", tt.name, zone, err, tt.want)
+		}
+	}
+	if err := StoreRecord(record("www.example.org", "A", "10.0.0.1")); err == nil {
+		t.Error("record stored outside our zones")
+	}
+}
+
+func TestZoneContent(t *testing.T) {
+	store := useMemStore(t, "example.com", "sub.example.com")
+	useViews(t)
+	for _, rec := range []*Record{
+		record("www.example.com", "A", "10.0.0.1"),
+		record("www.sub.example.com", "A", "10.0.0.2"),
+	} {
+		if err := StoreRecord(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	vpn := NewRRSet("www.example.com", "A")
+	vpn.Add(record("www.example.com", "A", "192.0.2.1"))
+	if err := StoreViewRRSet("vpn", vpn); err != nil {
+		t.Fatal(err)
+	}
+	// A batch committed, not completed yet, is read with its serial
+	set := NewRRSet("mail.example.com", "A")
+	set.Add(record("mail.example.com", "A", "10.0.0.3"))
+	serial, _ := GetSerial("example.com")
+	store.Set(txnKey, &txn{
+		Seq:   pendingTxn().Seq + 1,
+		Sets:  []RRSet{*set},
+		Zones: []txnZone{{Zone: "example.com.", From: serial, To: serial + 1, Added: set.Records}},
+	})
+
+	zone, sets, err := ZoneContent("Example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(sets))
+	for _, set := range sets {
+		names = append(names, set.Name+" "+set.Records[0].Address)
+	}
+	// Neither the records of its sub-zone nor those of a view
+	want := []string{"mail.example.com 10.0.0.3", "www.example.com 10.0.0.1"}
+	if zone.Serial != serial+1 || !reflect.DeepEqual(names, want) {
+		t.Errorf("ZoneContent() = %v, %q, want serial %v, %q", zone.Serial, names, serial+1, want)
+	}
+	if _, _, err := ZoneContent("www.example.com"); err == nil {
+		t.Error("content of a name not a zone")
+	}
+}
+
+func TestStoreZone(t *testing.T) {
+	useMemStore(t, "example.com")
+	invalid := []*Zone{
+		DefaultZone("host..example.com"),
+		{Name: "example.org", Mbox: "admin.example.org"},
+		{Name: "example.org", NS: []string{"ns..example.org"}, Mbox: "admin.example.org"},
+		{Name: "example.org", NS: []string{"ns.example.org"}, Mbox: "admin.example.org", Retry: -1},
+	}
+	for _, zone := range invalid {
+		if err := StoreZone(zone); err == nil {
+			t.Errorf("StoreZone(%v) accepted an invalid zone", zone)
+		}
+	}
+
+	// The serial follows the changes of the records and of the SOA or NS, it can't be set
+	if err := StoreRecord(record("www.example.com", "A", "10.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+	zone := DefaultZone("EXAMPLE.com")
+	zone.NS, zone.Serial, zone.TTL = []string{"ns1.example.com", "ns2.example.com"}, 42, 3600
+	if err := StoreZone(zone); err != nil {
+		t.Fatal(err)
+	}
+	got, err := GetZone("example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Serial != 3 || got.TTL != 3600 || !reflect.DeepEqual(got.NS, zone.NS) {
+		t.Errorf("GetZone() = %+v after StoreZone(%+v)", got, zone)
+	}
+	// The journal only held the changes of the records
+	if _, err := Journal("example.com", 2); err != ErrJournalMissing {
+		t.Errorf("Journal(2) = %v after a change of the zone, want %v", err, ErrJournalMissing)
+	}
+	// The same zone stored again changes nothing
+	if err := StoreZone(got); err != nil {
+		t.Fatal(err)
+	}
+	if serial, _ := GetSerial("example.com"); serial != 3 {
+		t.Errorf("GetSerial() = %v after storing the same zone", serial)
+	}
+	// InitZone keeps an existing zone
+	if err := InitZone(DefaultZone("example.com")); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := GetZone("example.com"); got.TTL != 3600 {
+		t.Errorf("InitZone() replaced the zone by %+v", got)
+	}
+	if zones, err := ListZones(); err != nil || len(zones) != 1 {
+		t.Errorf("ListZones() = %v, %v", zones, err)
+	}
+}
+
+func TestDeleteZone(t *testing.T) {
+	defer SetReverse(nil)
+	useMemStore(t, "example.com", "sub.example.com", "example.org", "0.0.10.in-addr.arpa")
+	if err := SetReverse([]string{"10.0.0.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range []*Record{
+		record("www.example.com", "A", "10.0.0.1"),
+		record("www.sub.example.com", "A", "10.0.0.2"),
+		record("www.example.org", "A", "10.0.0.3"),
+	} {
+		if err := StoreRecord(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := DeleteZone("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	// The records of its sub-zone stay, the PTR records of the zone are deleted with it
+	want := []string{
+		"2.0.0.10.in-addr.arpa 300 IN PTR www.sub.example.com.",
+		"3.0.0.10.in-addr.arpa 300 IN PTR www.example.org.",
+		"www.example.org 300 IN A 10.0.0.3",
+		"www.sub.example.com 300 IN A 10.0.0.2",
+	}
+	if got := storedRecords(t); !reflect.DeepEqual(got, want) {
+		t.Errorf("records = %q, want %q", got, want)
+	}
+	if _, err := GetZone("example.com"); err == nil {
+		t.Error("zone deleted still found")
+	}
+	if _, err := Journal("example.com", 1); err == nil {
+		t.Error("journal of the deleted zone kept")
+	}
+	if err := DeleteZone("example.com"); err == nil {
+		t.Error("missing zone deleted")
+	}
+
+	// Created again, the zone starts empty
+	if err := StoreZone(DefaultZone("example.com")); err != nil {
+		t.Fatal(err)
+	}
+	if serial, _ := GetSerial("example.com"); serial != 1 {
+		t.Errorf("GetSerial() = %v for a new zone", serial)
+	}
+	if _, err := Journal("example.com", 1); err != nil {
+		t.Errorf("Journal(1) = %v for a new zone", err)
+	}
+}
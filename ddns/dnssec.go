@@ -0,0 +1,238 @@
+package ddns
+
+import (
+	"crypto"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/redsux/addd/core"
+)
+
+const (
+	// sigValidity is the validity period of our signatures
+	sigValidity = 7 * 24 * time.Hour
+	// sigSkew is the margin given to validators with clocks late
+	sigSkew = time.Hour
+)
+
+var (
+	signersLock sync.Mutex
+	// signers caches the parsed DNSSEC keys by their DNSKEY record
+	signers = map[string]*signingKey{}
+)
+
+// signingKey is a parsed DNSSEC key
+type signingKey struct {
+	key    *dns.DNSKEY
+	signer crypto.Signer
+}
+
+// zoneSigner holds the DNSSEC keys of a signed zone
+type zoneSigner struct {
+	zone     *addd.Zone
+	ksk, zsk []*signingKey
+}
+
+// signerOf returns the DNSSEC keys of zone, nil if the zone isn't signed
+func signerOf(zone *addd.Zone) *zoneSigner {
+	keys, err := addd.ZoneKeys(zone.Name)
+	if err != nil || len(keys) == 0 {
+		return nil
+	}
+	zs := &zoneSigner{zone: zone}
+	for _, k := range keys {
+		sk, err := parseZoneKey(k)
+		if err != nil {
+			addd.Log.WarningF("[DNS] DNSSEC key %d of %v ignored : %v", k.Tag, zone.Name, err)
+			continue
+		}
+		if k.KSK {
+			zs.ksk = append(zs.ksk, sk)
+		} else {
+			zs.zsk = append(zs.zsk, sk)
+		}
+	}
+	if len(zs.ksk) == 0 && len(zs.zsk) == 0 {
+		return nil
+	}
+	return zs
+}
+
+// parseZoneKey returns the parsed key k, from our cache if it was already parsed
+func parseZoneKey(k addd.ZoneKey) (*signingKey, error) {
+	signersLock.Lock()
+	defer signersLock.Unlock()
+	if sk, ok := signers[k.DNSKEY]; ok {
+		return sk, nil
+	}
+	key, signer, err := k.Parse()
+	if err != nil {
+		return nil, err
+	}
+	sk := &signingKey{key: key, signer: signer}
+	signers[k.DNSKEY] = sk
+	return sk, nil
+}
+
+// dnskeys returns the DNSKEY RRSet of the zone
+func (zs *zoneSigner) dnskeys() []dns.RR {
+	rrs := make([]dns.RR, 0, len(zs.ksk)+len(zs.zsk))
+	for _, sk := range append(append([]*signingKey{}, zs.ksk...), zs.zsk...) {
+		key := *sk.key
+		key.Hdr.Ttl = uint32(zs.zone.TTL)
+		rrs = append(rrs, &key)
+	}
+	return rrs
+}
+
+// sign returns the RRSIGs of rrs : the DNSKEY RRSet is signed by all the KSKs,
+// the others by the oldest ZSK so new ones are published before being used.
+// Zones with a single kind of keys use them for both.
+func (zs *zoneSigner) sign(rrs []dns.RR) []dns.RR {
+	keys := zs.zsk
+	if rrs[0].Header().Rrtype == dns.TypeDNSKEY && len(zs.ksk) > 0 || len(keys) == 0 {
+		keys = zs.ksk
+	}
+	if rrs[0].Header().Rrtype != dns.TypeDNSKEY {
+		keys = keys[:1]
+	}
+
+	// Signatures change once per hour only
+	inception := time.Now().Truncate(time.Hour).Add(-sigSkew)
+	sigs := make([]dns.RR, 0, len(keys))
+	for _, sk := range keys {
+		sig := &dns.RRSIG{
+			Hdr: dns.RR_Header{
+				Name:   rrs[0].Header().Name,
+				Rrtype: dns.TypeRRSIG,
+				Class:  dns.ClassINET,
+				Ttl:    rrs[0].Header().Ttl,
+			},
+			Algorithm:  sk.key.Algorithm,
+			SignerName: zs.zone.Name,
+			KeyTag:     sk.key.KeyTag(),
+			Inception:  uint32(inception.Unix()),
+			Expiration: uint32(inception.Add(sigValidity).Unix()),
+		}
+		if err := sig.Sign(sk.signer, rrs); err != nil {
+			addd.Log.WarningF("[DNS] Impossible to sign %v : %v", sig.Hdr.Name, err)
+			continue
+		}
+		sigs = append(sigs, sig)
+	}
+	return sigs
+}
+
+// denial returns the NSEC proving qname has no data of the type asked in view. It is a "black lie"
+// (draft-valsorda-dnsop-black-lies) : qname is always said to exist, NXDOMAIN become NODATA.
+func (zs *zoneSigner) denial(qname, view string) dns.RR {
+	ttl := zs.zone.Minimum
+	if zs.zone.TTL < ttl {
+		ttl = zs.zone.TTL
+	}
+	return &dns.NSEC{
+		Hdr: dns.RR_Header{
+			Name:   qname,
+			Rrtype: dns.TypeNSEC,
+			Class:  dns.ClassINET,
+			Ttl:    uint32(ttl),
+		},
+		NextDomain: "\\000." + qname,
+		TypeBitMap: zs.types(qname, view),
+	}
+}
+
+// types returns the sorted types owned by name in view, or by the wildcard matching it, plus RRSIG and NSEC
+func (zs *zoneSigner) types(name, view string) []uint16 {
+	found := map[uint16]bool{
+		dns.TypeRRSIG: true,
+		dns.TypeNSEC:  true,
+	}
+	if name == zs.zone.Name {
+		found[dns.TypeSOA], found[dns.TypeNS], found[dns.TypeDNSKEY] = true, true, true
+	}
+	if addrs, err := nsAddrs(zs.zone, name); err == nil {
+		for _, rr := range addrs {
+			found[rr.Header().Rrtype] = true
+		}
+	}
+	owned, err := addd.ViewTypes(view, name)
+	if err == nil && len(owned) == 0 {
+		if wild, werr := addd.ViewWildcard(view, name); werr == nil && wild != "" {
+			owned, err = addd.ViewTypes(view, wild)
+		}
+	}
+	if err == nil {
+		for _, rtype := range owned {
+			if t, ok := dns.StringToType[rtype]; ok {
+				found[t] = true
+			}
+		}
+	}
+	types := make([]uint16, 0, len(found))
+	for t := range found {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return types
+}
+
+// dnssecReply signs the answer m to r if r has the DO bit (RFC 3225) and adds the NSEC of negative answers,
+// as seen by the client cl
+func dnssecReply(r, m *dns.Msg, cl *client) {
+	opt := r.IsEdns0()
+	if opt == nil || !opt.Do() {
+		return
+	}
+	// Zones are looked up once per reply
+	zones := map[string]*zoneSigner{}
+	signerFor := func(name string) *zoneSigner {
+		zone := zoneOf(name)
+		if zone == nil {
+			return nil
+		}
+		if zs, ok := zones[zone.Name]; ok {
+			return zs
+		}
+		zones[zone.Name] = signerOf(zone)
+		return zones[zone.Name]
+	}
+
+	if len(m.Answer) == 0 && len(r.Question) == 1 && (m.Rcode == dns.RcodeSuccess || m.Rcode == dns.RcodeNameError) {
+		qname := strings.ToLower(r.Question[0].Name)
+		if zs := signerFor(qname); zs != nil {
+			m.Rcode = dns.RcodeSuccess
+			m.Ns = append(m.Ns, zs.denial(qname, cl.view))
+		}
+	}
+
+	m.Answer = signSection(m.Answer, signerFor)
+	m.Ns = signSection(m.Ns, signerFor)
+	m.Extra = signSection(m.Extra, signerFor)
+}
+
+// signSection appends to rrs the RRSIGs of its RRSets belonging to signed zones
+func signSection(rrs []dns.RR, signerFor func(string) *zoneSigner) []dns.RR {
+	keys := make([]string, 0)
+	sets := make(map[string][]dns.RR)
+	for _, rr := range rrs {
+		header := rr.Header()
+		if header.Rrtype == dns.TypeRRSIG || header.Rrtype == dns.TypeOPT || header.Rrtype == dns.TypeTSIG {
+			continue
+		}
+		key := strings.ToLower(header.Name) + "_" + dns.Type(header.Rrtype).String()
+		if _, ok := sets[key]; !ok {
+			keys = append(keys, key)
+		}
+		sets[key] = append(sets[key], rr)
+	}
+	for _, key := range keys {
+		if zs := signerFor(sets[key][0].Header().Name); zs != nil {
+			rrs = append(rrs, zs.sign(sets[key])...)
+		}
+	}
+	return rrs
+}
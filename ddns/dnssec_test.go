@@ -0,0 +1,113 @@
+package ddns
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/redsux/addd/core"
+)
+
+// signedQuery returns the reply to a query with the DO bit
+func signedQuery(t *testing.T, qname string, qtype uint16) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetQuestion(qname, qtype)
+	r.SetEdns0(4096, true)
+	return exchange(t, tcpClient, r)
+}
+
+// verify checks the RRSIGs of the RRSet of type rtype in rrs with the keys
+func verify(t *testing.T, rrs []dns.RR, rtype uint16, keys []dns.RR) {
+	var set []dns.RR
+	var sigs []*dns.RRSIG
+	for _, rr := range rrs {
+		if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == rtype {
+			sigs = append(sigs, sig)
+		} else if rr.Header().Rrtype == rtype {
+			set = append(set, rr)
+		}
+	}
+	if len(set) == 0 || len(sigs) == 0 {
+		t.Errorf("%v RRSet of %v signed by %d RRSIGs", dns.TypeToString[rtype], set, len(sigs))
+		return
+	}
+	for _, sig := range sigs {
+		verified := false
+		for _, rr := range keys {
+			if key := rr.(*dns.DNSKEY); key.KeyTag() == sig.KeyTag {
+				verified = sig.Verify(key, set) == nil && sig.ValidityPeriod(time.Now())
+			}
+		}
+		if !verified {
+			t.Errorf("RRSIG %v of %v not verified", sig, set)
+		}
+	}
+}
+
+func TestDnssec(t *testing.T) {
+	useMemStore(t)
+	storeRRs(t, "www.example.com. 300 IN A 10.0.0.1", "*.dyn.example.com. 300 IN TXT \"dynamic\"")
+
+	// Without keys, nothing is signed
+	if m := signedQuery(t, "www.example.com.", dns.TypeA); len(m.Answer) != 1 {
+		t.Errorf("answers of an unsigned zone = %v", m.Answer)
+	}
+	ksk, err := addd.GenerateZoneKey("example.com", true, "ECDSAP256SHA256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := addd.GenerateZoneKey("example.com", false, "ECDSAP256SHA256"); err != nil {
+		t.Fatal(err)
+	}
+
+	m := signedQuery(t, "example.com.", dns.TypeDNSKEY)
+	keys := []dns.RR{}
+	for _, rr := range m.Answer {
+		if rr.Header().Rrtype == dns.TypeDNSKEY {
+			keys = append(keys, rr)
+		}
+	}
+	if len(keys) != 2 {
+		t.Fatalf("DNSKEY = %v", m.Answer)
+	}
+	// The DNSKEY RRSet is signed by the KSK only
+	verify(t, m.Answer, dns.TypeDNSKEY, keys)
+	if sigs := len(m.Answer) - len(keys); sigs != 1 || m.Answer[2].(*dns.RRSIG).KeyTag != ksk.Tag {
+		t.Errorf("DNSKEY RRSet signed by %v", m.Answer[2:])
+	}
+
+	m = signedQuery(t, "WWW.example.com.", dns.TypeA)
+	verify(t, m.Answer, dns.TypeA, keys)
+
+	// Without the DO bit, the answers are the same as before
+	r := new(dns.Msg)
+	r.SetQuestion("www.example.com.", dns.TypeA)
+	if m := exchange(t, tcpClient, r); len(m.Answer) != 1 {
+		t.Errorf("answers without DO = %v", m.Answer)
+	}
+
+	// Names without data are denied by a signed NSEC of their own
+	tests := []struct {
+		qname string
+		qtype uint16
+		types []uint16
+	}{
+		{"www.example.com.", dns.TypeAAAA, []uint16{dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC}},
+		{"none.example.com.", dns.TypeA, []uint16{dns.TypeRRSIG, dns.TypeNSEC}},
+		{"host.dyn.example.com.", dns.TypeA, []uint16{dns.TypeTXT, dns.TypeRRSIG, dns.TypeNSEC}},
+	}
+	for _, tt := range tests {
+		m := signedQuery(t, tt.qname, tt.qtype)
+		if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 0 {
+			t.Errorf("%v %v = %v %v", tt.qname, dns.TypeToString[tt.qtype], dns.RcodeToString[m.Rcode], m.Answer)
+			continue
+		}
+		verify(t, m.Ns, dns.TypeNSEC, keys)
+		for _, rr := range m.Ns {
+			if nsec, ok := rr.(*dns.NSEC); ok && !reflect.DeepEqual(nsec.TypeBitMap, tt.types) {
+				t.Errorf("NSEC of %v = %v, want the types %v", tt.qname, nsec, tt.types)
+			}
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package ddns
+
+import (
+	"errors"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// msgWriter is the dns.ResponseWriter of the messages received by another transport (DoH),
+// it keeps the packed reply. As our servers, it holds the status of the TSIG of the request
+// and signs the replies to which a TSIG is added.
+type msgWriter struct {
+	remote net.Addr
+	status error
+	mac    string
+	reply  []byte
+	err    error
+}
+
+// HandleMsg answers the packed DNS message req sent by remote through another transport,
+// like our TCP server does. Only queries are answered this way, zone transfers are refused.
+func HandleMsg(req []byte, remote net.IP) ([]byte, error) {
+	r := new(dns.Msg)
+	if err := r.Unpack(req); err != nil {
+		return nil, err
+	}
+	w := &msgWriter{remote: &net.TCPAddr{IP: remote}}
+
+	if r.Opcode != dns.OpcodeQuery {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeNotImplemented)
+		return m.Pack()
+	}
+	if len(r.Question) == 1 && (r.Question[0].Qtype == dns.TypeAXFR || r.Question[0].Qtype == dns.TypeIXFR) {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeRefused)
+		return m.Pack()
+	}
+	if t := r.IsTsig(); t != nil {
+		// The verification changes the ID of the message it's given
+		w.status, w.mac = dns.TsigVerifyWithProvider(append([]byte{}, req...), tsigProvider{}, "", false), t.MAC
+	}
+	handleDNSRequest(w, r)
+	if w.reply == nil && w.err == nil {
+		w.err = errors.New("No reply")
+	}
+	return w.reply, w.err
+}
+
+// LocalAddr implements dns.ResponseWriter
+func (w *msgWriter) LocalAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+// RemoteAddr implements dns.ResponseWriter
+func (w *msgWriter) RemoteAddr() net.Addr {
+	return w.remote
+}
+
+// WriteMsg implements dns.ResponseWriter, m is signed if a TSIG was added to it
+func (w *msgWriter) WriteMsg(m *dns.Msg) error {
+	if m.IsTsig() != nil {
+		w.reply, w.mac, w.err = dns.TsigGenerateWithProvider(m, tsigProvider{}, w.mac, false)
+		return w.err
+	}
+	w.reply, w.err = m.Pack()
+	return w.err
+}
+
+// Write implements dns.ResponseWriter
+func (w *msgWriter) Write(b []byte) (int, error) {
+	w.reply = append([]byte{}, b...)
+	return len(b), nil
+}
+
+// Close implements dns.ResponseWriter
+func (w *msgWriter) Close() error {
+	return nil
+}
+
+// TsigStatus implements dns.ResponseWriter
+func (w *msgWriter) TsigStatus() error {
+	return w.status
+}
+
+// TsigTimersOnly implements dns.ResponseWriter
+func (w *msgWriter) TsigTimersOnly(bool) {}
+
+// Hijack implements dns.ResponseWriter
+func (w *msgWriter) Hijack() {}
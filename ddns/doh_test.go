@@ -0,0 +1,71 @@
+package ddns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/redsux/addd/core"
+)
+
+func TestHandleMsg(t *testing.T) {
+	useMemStore(t)
+	storeRRs(t, "www.example.com. 300 IN A 10.0.0.1")
+	key, err := addd.ParseTsigKey("key.example.com:hmac-sha256:c2VjcmV0")
+	if err == nil {
+		err = addd.StoreTsigKey(key)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := net.IPv4(192, 0, 2, 1)
+
+	if _, err := HandleMsg([]byte{0, 1, 2}, client); err == nil {
+		t.Error("invalid message answered")
+	}
+
+	// Signed queries get signed replies
+	r := new(dns.Msg)
+	r.SetQuestion("www.example.com.", dns.TypeA)
+	r.SetTsig("key.example.com.", dns.HmacSHA256, 300, time.Now().Unix())
+	req, mac, err := dns.TsigGenerate(r, "c2VjcmV0", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := HandleMsg(req, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(reply); err != nil {
+		t.Fatal(err)
+	}
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 1 || m.IsTsig() == nil {
+		t.Fatalf("reply to a signed query = %v", m)
+	}
+	if err := dns.TsigVerify(reply, "c2VjcmV0", mac, false); err != nil {
+		t.Errorf("TSIG of the reply : %v", err)
+	}
+
+	// Badly signed queries get replies without signature
+	req[len(req)-10] ^= 0xff
+	if reply, err = HandleMsg(req, client); err != nil || m.Unpack(reply) != nil || m.IsTsig() != nil {
+		t.Errorf("reply to a badly signed query = %v, %v", m, err)
+	}
+
+	// Only queries are answered, dynamic updates go through our DNS server
+	u := new(dns.Msg)
+	u.SetUpdate("example.com.")
+	u.Insert([]dns.RR{mustRR("new.example.com. 300 IN A 10.0.0.2")})
+	req, err = u.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply, err = HandleMsg(req, client); err != nil || m.Unpack(reply) != nil || m.Rcode != dns.RcodeNotImplemented {
+		t.Errorf("reply to an update = %v, %v", m, err)
+	}
+	if _, err := addd.GetRRSet("new.example.com", "A"); err == nil {
+		t.Error("update applied over DoH")
+	}
+}
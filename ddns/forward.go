@@ -0,0 +1,270 @@
+package ddns
+
+import (
+	"container/list"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/redsux/addd/core"
+)
+
+const (
+	// forwardTimeout is the time given to an upstream resolver to answer
+	forwardTimeout = 2 * time.Second
+	// cacheSize is the maximum number of answers kept in our cache, the expired ones then the least recently used one
+	// are forgotten above
+	cacheSize = 10000
+	// cacheMaxTTL is the longest time an answer is kept in our cache
+	cacheMaxTTL = 24 * time.Hour
+)
+
+var (
+	forwardUpstreams = []string{}
+	forwardNets      = []*net.IPNet{}
+	forwardLock      sync.Mutex
+	forwardBest      int // index of the last upstream which answered
+
+	cacheLock    sync.Mutex
+	cacheEntries = map[string]*list.Element{}
+	cacheLRU     = list.New() // *cacheEntry, most recently used first
+)
+
+// cacheEntry is an answer of an upstream resolver with its reception and expiration times
+type cacheEntry struct {
+	key      string
+	msg      *dns.Msg
+	received time.Time
+	expires  time.Time
+}
+
+// SetForward defines the upstream resolvers (host[:port]) queried for the names outside
+// our zones, in their preference order, and the client networks (CIDR) allowed to use them
+func SetForward(upstreams, nets []string) error {
+	for _, upstream := range upstreams {
+		if upstream = strings.TrimSpace(upstream); upstream == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(upstream); err != nil {
+			upstream = net.JoinHostPort(upstream, "53")
+		}
+		forwardUpstreams = append(forwardUpstreams, upstream)
+	}
+	for _, cidr := range nets {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("Invalid forward network %v", cidr)
+		}
+		forwardNets = append(forwardNets, ipnet)
+	}
+	return nil
+}
+
+// allowForward returns true if r may be forwarded : the forwarder is enabled, the client
+// is allowed and asks for recursion
+func allowForward(w dns.ResponseWriter, r *dns.Msg) bool {
+	if len(forwardUpstreams) == 0 || r.Opcode != dns.OpcodeQuery || !r.RecursionDesired || len(r.Question) != 1 {
+		return false
+	}
+	if ip := remoteIP(w); ip != nil {
+		for _, ipnet := range forwardNets {
+			if ipnet.Contains(ip) {
+				return true
+			}
+		}
+	}
+	addd.Log.NoticeF("[DNS] Recursion refused to %v", w.RemoteAddr())
+	return false
+}
+
+// forward answers r from our cache or from our upstream resolvers
+func forward(w dns.ResponseWriter, r *dns.Msg) {
+	q := r.Question[0]
+	addd.Log.NoticeF("[DNS] Forward %v, %v", q.Name, dns.Type(q.Qtype))
+
+	key := cacheKey(r)
+	m := cacheGet(key)
+	if m == nil {
+		m = exchangeUpstream(r)
+		if m != nil {
+			cachePut(key, m)
+		}
+	}
+	if m == nil {
+		m = new(dns.Msg)
+		m.SetRcode(r, dns.RcodeServerFailure)
+	} else {
+		m = m.Copy()
+		m.Id = r.Id
+		// The cached answer holds the case of the first query, a resolver checks its own (0x20)
+		m.Question = append([]dns.Question{}, r.Question...)
+	}
+	m.RecursionAvailable = true
+	m.Authoritative = false
+
+	// Our own OPT and TSIG are added
+	extra := make([]dns.RR, 0, len(m.Extra))
+	for _, rr := range m.Extra {
+		if rrtype := rr.Header().Rrtype; rrtype != dns.TypeOPT && rrtype != dns.TypeTSIG {
+			extra = append(extra, rr)
+		}
+	}
+	m.Extra = extra
+	replyEdns(w, r, m)
+	signReply(w, r, m)
+	w.WriteMsg(m)
+}
+
+// exchangeUpstream sends r to our upstream resolvers, starting with the last one which answered,
+// and returns the first answer, nil if none answered
+func exchangeUpstream(r *dns.Msg) *dns.Msg {
+	q := new(dns.Msg)
+	q.SetQuestion(r.Question[0].Name, r.Question[0].Qtype)
+	q.Question[0].Qclass = r.Question[0].Qclass
+	q.CheckingDisabled = r.CheckingDisabled
+	do := false
+	if opt := r.IsEdns0(); opt != nil {
+		do = opt.Do()
+	}
+	q.SetEdns0(uint16(ednsSize), do)
+
+	forwardLock.Lock()
+	best := forwardBest
+	forwardLock.Unlock()
+
+	udp := &dns.Client{Net: "udp", Timeout: forwardTimeout}
+	tcp := &dns.Client{Net: "tcp", Timeout: forwardTimeout}
+	for i := range forwardUpstreams {
+		n := (best + i) % len(forwardUpstreams)
+		upstream := forwardUpstreams[n]
+		m, _, err := udp.Exchange(q, upstream)
+		if err == nil && m.Truncated {
+			m, _, err = tcp.Exchange(q, upstream)
+		}
+		if err != nil || m.Rcode == dns.RcodeServerFailure || m.Rcode == dns.RcodeRefused {
+			addd.Log.WarningF("[DNS] Upstream %v failed : %v", upstream, failure(m, err))
+			continue
+		}
+		if n != best {
+			forwardLock.Lock()
+			forwardBest = n
+			forwardLock.Unlock()
+		}
+		return m
+	}
+	return nil
+}
+
+// failure returns the reason why an upstream didn't answer
+func failure(m *dns.Msg, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return dns.RcodeToString[m.Rcode]
+}
+
+// cacheKey returns the key of the answers to r in our cache
+func cacheKey(r *dns.Msg) string {
+	q := r.Question[0]
+	do := false
+	if opt := r.IsEdns0(); opt != nil {
+		do = opt.Do()
+	}
+	return fmt.Sprintf("%s/%d/%d/%t/%t", strings.ToLower(q.Name), q.Qtype, q.Qclass, do, r.CheckingDisabled)
+}
+
+// cacheGet returns a copy of the answer stored with key, its TTLs decreased by the time spent in our cache
+func cacheGet(key string) *dns.Msg {
+	now := time.Now()
+	cacheLock.Lock()
+	e, ok := cacheEntries[key]
+	if !ok {
+		cacheLock.Unlock()
+		return nil
+	}
+	entry := e.Value.(*cacheEntry)
+	if !now.Before(entry.expires) {
+		delete(cacheEntries, key)
+		cacheLRU.Remove(e)
+		cacheLock.Unlock()
+		return nil
+	}
+	cacheLRU.MoveToFront(e)
+	cacheLock.Unlock()
+	m := entry.msg.Copy()
+	elapsed := uint32(now.Sub(entry.received) / time.Second)
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			switch header := rr.Header(); {
+			case header.Rrtype == dns.TypeOPT:
+			case header.Ttl > elapsed:
+				header.Ttl -= elapsed
+			default:
+				header.Ttl = 0
+			}
+		}
+	}
+	return m
+}
+
+// cachePut stores m with key for its lowest TTL, or for its SOA minimum if it is negative (RFC 2308, 5)
+func cachePut(key string, m *dns.Msg) {
+	if m.Truncated || (m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError) {
+		return
+	}
+	ttl := cacheMaxTTL
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			rttl := time.Duration(rr.Header().Ttl) * time.Second
+			if soa, ok := rr.(*dns.SOA); ok && len(m.Answer) == 0 && soa.Minttl < rr.Header().Ttl {
+				rttl = time.Duration(soa.Minttl) * time.Second
+			}
+			if rttl < ttl {
+				ttl = rttl
+			}
+		}
+	}
+	if len(m.Answer) == 0 && len(m.Ns) == 0 || ttl == 0 {
+		return
+	}
+
+	now := time.Now()
+	entry := &cacheEntry{
+		key:      key,
+		msg:      m.Copy(),
+		received: now,
+		expires:  now.Add(ttl),
+	}
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+	if e, ok := cacheEntries[key]; ok {
+		e.Value = entry
+		cacheLRU.MoveToFront(e)
+		return
+	}
+	if cacheLRU.Len() >= cacheSize {
+		for e := cacheLRU.Front(); e != nil; {
+			next := e.Next()
+			if old := e.Value.(*cacheEntry); !now.Before(old.expires) {
+				delete(cacheEntries, old.key)
+				cacheLRU.Remove(e)
+			}
+			e = next
+		}
+	}
+	if cacheLRU.Len() >= cacheSize {
+		oldest := cacheLRU.Back()
+		delete(cacheEntries, oldest.Value.(*cacheEntry).key)
+		cacheLRU.Remove(oldest)
+	}
+	cacheEntries[key] = cacheLRU.PushFront(entry)
+}
@@ -0,0 +1,215 @@
+package ddns
+
+import (
+	"container/list"
+	"fmt"
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// upstream serves on a local UDP port the replies of handler, counting the queries received
+func upstream(t *testing.T, handler func(r *dns.Msg) *dns.Msg) (string, *int32, func()) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries := new(int32)
+	server := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt32(queries, 1)
+		w.WriteMsg(handler(r))
+	})}
+	go server.ActivateAndServe()
+	return pc.LocalAddr().String(), queries, func() { server.Shutdown() }
+}
+
+// useForward enables our forwarder until the end of the test
+func useForward(t *testing.T, upstreams, nets []string) func() {
+	if err := SetForward(upstreams, nets); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		forwardUpstreams, forwardNets, forwardBest = []string{}, []*net.IPNet{}, 0
+		cacheEntries, cacheLRU = map[string]*list.Element{}, list.New()
+	}
+}
+
+// recursive returns a query with RD for qname
+func recursive(qname string, qtype uint16) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetQuestion(qname, qtype)
+	r.RecursionDesired = true
+	return r
+}
+
+func TestSetForward(t *testing.T) {
+	defer useForward(t, []string{"192.0.2.1", " ", "192.0.2.2:5353", "[2001:db8::1]:53"}, []string{"10.0.0.0/8", ""})()
+	want := []string{"192.0.2.1:53", "192.0.2.2:5353", "[2001:db8::1]:53"}
+	if !reflect.DeepEqual(forwardUpstreams, want) || len(forwardNets) != 1 {
+		t.Errorf("SetForward() = %v %v, want %v", forwardUpstreams, forwardNets, want)
+	}
+	if err := SetForward(nil, []string{"10.0.0.1"}); err == nil {
+		t.Error("SetForward() accepted an address without length")
+	}
+}
+
+func TestForward(t *testing.T) {
+	useMemStore(t)
+	refusing, refused, stop1 := upstream(t, func(r *dns.Msg) *dns.Msg {
+		m := new(dns.Msg)
+		return m.SetRcode(r, dns.RcodeRefused)
+	})
+	defer stop1()
+	answering, answered, stop2 := upstream(t, func(r *dns.Msg) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Answer = []dns.RR{mustRR(r.Question[0].Name + " 300 IN A 192.0.2.10")}
+		return m
+	})
+	defer stop2()
+	defer useForward(t, []string{refusing, answering}, []string{"192.0.2.0/24"})()
+
+	m := exchange(t, udpClient, recursive("WWW.Example.org.", dns.TypeA))
+	if m.Rcode != dns.RcodeSuccess || !m.RecursionAvailable || m.Authoritative {
+		t.Fatalf("forwarded reply = %v", m)
+	}
+	if got, want := answers(m), canonicalRRs("WWW.Example.org. 300 IN A 192.0.2.10"); !reflect.DeepEqual(got, want) {
+		t.Errorf("forwarded answers = %q, want %q", got, want)
+	}
+	// The upstream which answered is asked first, the answer is then cached with the case of each query
+	m = exchange(t, udpClient, recursive("www.example.ORG.", dns.TypeA))
+	if len(m.Answer) != 1 || m.Question[0].Name != "www.example.ORG." {
+		t.Errorf("cached reply = %v", m)
+	}
+	exchange(t, udpClient, recursive("ftp.example.org.", dns.TypeA))
+	if n1, n2 := atomic.LoadInt32(refused), atomic.LoadInt32(answered); n1 != 1 || n2 != 2 {
+		t.Errorf("upstreams queried %d and %d times, want 1 and 2", n1, n2)
+	}
+
+	// Other clients, queries without RD and our zones aren't forwarded
+	other := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 5353}
+	if m := exchange(t, other, recursive("www.example.org.", dns.TypeA)); m.Rcode != dns.RcodeRefused {
+		t.Errorf("forward to another network = %v", dns.RcodeToString[m.Rcode])
+	}
+	r := recursive("www.example.net.", dns.TypeA)
+	r.RecursionDesired = false
+	if m := exchange(t, udpClient, r); m.Rcode != dns.RcodeRefused {
+		t.Errorf("forward without RD = %v", dns.RcodeToString[m.Rcode])
+	}
+	if m := exchange(t, udpClient, recursive("www.example.com.", dns.TypeA)); !m.Authoritative {
+		t.Errorf("query of our zone forwarded : %v", m)
+	}
+	if n := atomic.LoadInt32(answered); n != 2 {
+		t.Errorf("upstream queried %d times, want 2", n)
+	}
+}
+
+func TestForwardFailure(t *testing.T) {
+	useMemStore(t)
+	refusing, _, stop := upstream(t, func(r *dns.Msg) *dns.Msg {
+		m := new(dns.Msg)
+		return m.SetRcode(r, dns.RcodeServerFailure)
+	})
+	defer stop()
+	defer useForward(t, []string{refusing}, []string{"192.0.2.0/24"})()
+	if m := exchange(t, udpClient, recursive("www.example.org.", dns.TypeA)); m.Rcode != dns.RcodeServerFailure || len(cacheEntries) != 0 {
+		t.Errorf("reply without upstream = %v, %d answers cached", dns.RcodeToString[m.Rcode], len(cacheEntries))
+	}
+}
+
+func TestCache(t *testing.T) {
+	defer useForward(t, nil, nil)()
+	r := recursive("www.example.org.", dns.TypeA)
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Answer = []dns.RR{mustRR("www.example.org. 300 IN A 192.0.2.10")}
+	m.Ns = []dns.RR{mustRR("example.org. 300 IN NS ns.example.org.")}
+	m.Extra = []dns.RR{mustRR("ns.example.org. 60 IN A 192.0.2.53")}
+	cachePut(cacheKey(r), m)
+
+	// Entries are kept for the lowest TTL, their TTLs decrease with time
+	entry := cacheEntries[cacheKey(r)].Value.(*cacheEntry)
+	if ttl := entry.expires.Sub(entry.received); ttl != time.Minute {
+		t.Errorf("answer cached for %v, want 1m0s", ttl)
+	}
+	entry.received = entry.received.Add(-10 * time.Second)
+	if got := cacheGet(cacheKey(r)); got == nil || got.Answer[0].Header().Ttl != 290 || got.Extra[0].Header().Ttl != 50 {
+		t.Errorf("cacheGet() = %v", got)
+	}
+	// TTLs don't wrap around once elapsed
+	entry.received = entry.received.Add(-55 * time.Second)
+	if got := cacheGet(cacheKey(r)); got == nil || got.Extra[0].Header().Ttl != 0 {
+		t.Errorf("cacheGet() = %v", got)
+	}
+	entry.expires = time.Now()
+	if got := cacheGet(cacheKey(r)); got != nil {
+		t.Errorf("cacheGet() = %v after expiration", got)
+	}
+
+	// Negative answers are kept for the SOA minimum
+	r = recursive("none.example.org.", dns.TypeA)
+	m = new(dns.Msg)
+	m.SetRcode(r, dns.RcodeNameError)
+	m.Ns = []dns.RR{mustRR("example.org. 3600 IN SOA ns.example.org. admin.example.org. 1 3600 600 86400 30")}
+	cachePut(cacheKey(r), m)
+	if e, ok := cacheEntries[cacheKey(r)]; !ok || e.Value.(*cacheEntry).expires.Sub(e.Value.(*cacheEntry).received) != 30*time.Second {
+		t.Errorf("negative answer cached = %v", e)
+	}
+
+	// Failures and truncated answers aren't kept
+	for _, rcode := range []int{dns.RcodeServerFailure, dns.RcodeSuccess} {
+		r = recursive("fail.example.org.", dns.TypeA)
+		m = new(dns.Msg)
+		m.SetRcode(r, rcode)
+		m.Answer = []dns.RR{mustRR("fail.example.org. 300 IN A 192.0.2.10")}
+		m.Truncated = rcode == dns.RcodeSuccess
+		cachePut(cacheKey(r), m)
+		if got := cacheGet(cacheKey(r)); got != nil {
+			t.Errorf("answer %v cached", m)
+		}
+	}
+}
+
+func TestCacheSize(t *testing.T) {
+	defer useForward(t, nil, nil)()
+	put := func(name string) string {
+		r := recursive(name, dns.TypeA)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Answer = []dns.RR{mustRR(name + " 300 IN A 192.0.2.10")}
+		cachePut(cacheKey(r), m)
+		return cacheKey(r)
+	}
+	first := put("first.example.org.")
+	keys := []string{first}
+	for i := 1; i < cacheSize; i++ {
+		keys = append(keys, put(fmt.Sprintf("host%d.example.org.", i)))
+	}
+	cacheEntries[keys[5]].Value.(*cacheEntry).expires = time.Now()
+	if cacheGet(first) == nil {
+		t.Fatal("first answer not cached")
+	}
+
+	// The expired answers are forgotten first, then the least recently used one
+	put("new1.example.org.")
+	if _, ok := cacheEntries[keys[5]]; ok {
+		t.Error("expired answer kept")
+	}
+	if _, ok := cacheEntries[keys[1]]; !ok {
+		t.Error("answer forgotten while another one expired")
+	}
+	put("new2.example.org.")
+	if _, ok := cacheEntries[keys[1]]; ok {
+		t.Error("least recently used answer kept")
+	}
+	if len(cacheEntries) != cacheSize || cacheLRU.Len() != cacheSize {
+		t.Errorf("%d answers, %d in the LRU, want %d", len(cacheEntries), cacheLRU.Len(), cacheSize)
+	}
+	if cacheGet(first) == nil {
+		t.Error("answer used again forgotten")
+	}
+}
@@ -0,0 +1,185 @@
+package ddns
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/redsux/addd/core"
+)
+
+const (
+	// geoPoll is the interval between checks of our region file
+	geoPoll = time.Minute
+)
+
+var (
+	geoLock     sync.Mutex
+	geoFile     string
+	geoEntries  []geoEntry
+	geoModified time.Time
+	geoChecked  time.Time
+)
+
+// geoEntry maps the clients of a network to a region
+type geoEntry struct {
+	ipnet  *net.IPNet
+	region string
+}
+
+// client is who a query is answered for : its view and the address selecting geo answers,
+// the one of its EDNS Client Subnet (RFC 7871) if any
+type client struct {
+	view  string
+	addr  net.IP
+	ecs   *dns.EDNS0_SUBNET
+	scope uint8 // prefix length of the network the answer was selected for
+}
+
+// SetGeo reads the regions of the clients from file, made of 'CIDR region' lines
+// ('#' starts a comment), it is read again when modified
+func SetGeo(file string) error {
+	geoLock.Lock()
+	defer geoLock.Unlock()
+	geoFile = file
+	return loadGeo()
+}
+
+// loadGeo reads our region file if it was modified since the last time
+func loadGeo() error {
+	info, err := os.Stat(geoFile)
+	if err != nil {
+		return err
+	}
+	if !info.ModTime().After(geoModified) {
+		return nil
+	}
+	f, err := os.Open(geoFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	entries := make([]geoEntry, 0)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return fmt.Errorf("Line %d of %v is not 'CIDR region'", n, geoFile)
+		}
+		_, ipnet, err := net.ParseCIDR(fields[0])
+		if err != nil {
+			return fmt.Errorf("Line %d of %v has an invalid network %v", n, geoFile, fields[0])
+		}
+		entries = append(entries, geoEntry{ipnet: ipnet, region: strings.ToLower(fields[1])})
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if !geoModified.IsZero() {
+		addd.Log.NoticeF("[DNS] Regions reloaded from %v", geoFile)
+	}
+	geoEntries, geoModified = entries, info.ModTime()
+	return nil
+}
+
+// regionOf returns the region of ip with the prefix length of its network,
+// an empty region if unknown
+func regionOf(ip net.IP) (string, int) {
+	geoLock.Lock()
+	defer geoLock.Unlock()
+	if geoFile == "" || ip == nil {
+		return "", 0
+	}
+	if now := time.Now(); now.Sub(geoChecked) > geoPoll {
+		geoChecked = now
+		if err := loadGeo(); err != nil {
+			addd.Log.WarningF("[DNS] Couldn't reload the regions : %v", err)
+		}
+	}
+	region, longest := "", -1
+	for _, entry := range geoEntries {
+		if ones, _ := entry.ipnet.Mask.Size(); ones > longest && entry.ipnet.Contains(ip) {
+			region, longest = entry.region, ones
+		}
+	}
+	if longest < 0 {
+		return "", 0
+	}
+	return region, longest
+}
+
+// newClient returns the view and the address of the client sending r
+func newClient(w dns.ResponseWriter, r *dns.Msg) *client {
+	key := ""
+	if t := validTsig(w, r); t != nil {
+		key = t.Hdr.Name
+	}
+	cl := &client{
+		view: addd.MatchView(remoteIP(w), key),
+		addr: remoteIP(w),
+	}
+	if opt := r.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+				cl.ecs = ecs
+				// A source prefix of 0 asks not to use the client's address
+				if ecs.SourceNetmask > 0 && ecs.Address != nil {
+					cl.addr = ecs.Address
+				}
+			}
+		}
+	}
+	return cl
+}
+
+// selectRRSet returns the records of set selected for the client.
+// Selections apply to the default view, the RRSets of other views are sent whole.
+func (cl *client) selectRRSet(set *addd.RRSet) *addd.RRSet {
+	if set.View != "" {
+		return set
+	}
+	sel, err := addd.GetSelection(set.Name, set.Type)
+	if err != nil {
+		return set
+	}
+	region := ""
+	if sel.Mode == addd.SelectGeo {
+		var bits int
+		region, bits = regionOf(cl.addr)
+		if cl.ecs != nil && cl.ecs.SourceNetmask > 0 {
+			// The answer of an unknown client is valid for its whole subnet
+			if region == "" {
+				bits = int(cl.ecs.SourceNetmask)
+			}
+			if uint8(bits) > cl.scope {
+				cl.scope = uint8(bits)
+			}
+		}
+	}
+	return sel.Select(set, region)
+}
+
+// echoSubnet adds to m the EDNS Client Subnet of the request with the scope of the answer (RFC 7871, 7.2.1)
+func (cl *client) echoSubnet(r, m *dns.Msg) {
+	if cl == nil || cl.ecs == nil {
+		return
+	}
+	m.SetEdns0(uint16(ednsSize), r.IsEdns0().Do())
+	ecs := *cl.ecs
+	ecs.SourceScope = cl.scope
+	opt := m.IsEdns0()
+	opt.Option = append(opt.Option, &ecs)
+}
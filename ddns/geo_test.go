@@ -0,0 +1,148 @@
+package ddns
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/redsux/addd/core"
+)
+
+// useGeo reads the regions from a file holding content until the end of the test
+func useGeo(t *testing.T, content string) func() {
+	f, err := ioutil.TempFile("", "addd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(content)
+	f.Close()
+	if err := SetGeo(f.Name()); err != nil {
+		os.Remove(f.Name())
+		t.Fatal(err)
+	}
+	return func() {
+		os.Remove(f.Name())
+		geoFile, geoEntries, geoModified, geoChecked = "", nil, time.Time{}, time.Time{}
+	}
+}
+
+func TestRegionOf(t *testing.T) {
+	defer useGeo(t, "# Our regions\n10.0.0.0/8 EU\n10.1.0.0/16 us # a subnet\n\n2001:db8::/32 asia\n")()
+	tests := []struct {
+		ip     string
+		region string
+		bits   int
+	}{
+		{"10.2.0.1", "eu", 8},
+		{"10.1.0.1", "us", 16},
+		{"2001:db8::1", "asia", 32},
+		{"192.0.2.1", "", 0},
+	}
+	for _, tt := range tests {
+		if region, bits := regionOf(net.ParseIP(tt.ip)); region != tt.region || bits != tt.bits {
+			t.Errorf("regionOf(%v) = %v/%v, want %v/%v", tt.ip, region, bits, tt.region, tt.bits)
+		}
+	}
+
+	// Invalid files are refused, the regions read before are kept
+	for _, content := range []string{"10.0.0.0/8\n", "10.0.0.1 eu\n"} {
+		if err := ioutil.WriteFile(geoFile, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		later := time.Now().Add(time.Minute)
+		os.Chtimes(geoFile, later, later)
+		if err := loadGeo(); err == nil {
+			t.Errorf("regions file %q accepted", content)
+		}
+	}
+	if region, _ := regionOf(net.ParseIP("10.1.0.1")); region != "us" {
+		t.Errorf("regionOf() = %v after an invalid file, want us", region)
+	}
+}
+
+func TestQuerySelection(t *testing.T) {
+	useMemStore(t)
+	defer useGeo(t, "10.0.0.0/8 eu\n10.1.0.0/16 us\n")()
+	storeRRs(t,
+		"www.example.com. 300 IN A 192.0.2.1",
+		"www.example.com. 300 IN A 192.0.2.2",
+		"www.example.com. 300 IN A 192.0.2.3",
+		"ftp.example.com. 300 IN A 192.0.2.1",
+		"ftp.example.com. 300 IN A 192.0.2.2",
+	)
+	for _, sel := range []*addd.Selection{
+		{Name: "www.example.com", Type: "A", Mode: addd.SelectGeo, Regions: map[string][]string{
+			"eu": {"192.0.2.1"}, "us": {"192.0.2.2"}, "default": {"192.0.2.3"}}},
+		{Name: "ftp.example.com", Type: "A", Mode: addd.SelectFailover, Order: []string{"192.0.2.2"}},
+	} {
+		if err := addd.StoreSelection(sel); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// query returns the addresses answered to a query of qname from remote with the client subnet,
+	// and the scope of the subnet echoed
+	query := func(qname string, remote net.Addr, subnet string) ([]string, int) {
+		r := new(dns.Msg)
+		r.SetQuestion(qname, dns.TypeA)
+		if subnet != "" {
+			_, ipnet, _ := net.ParseCIDR(subnet)
+			bits, _ := ipnet.Mask.Size()
+			r.SetEdns0(4096, false)
+			r.IsEdns0().Option = append(r.IsEdns0().Option, &dns.EDNS0_SUBNET{
+				Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: uint8(bits), Address: ipnet.IP,
+			})
+		}
+		m := exchange(t, remote, r)
+		addrs := make([]string, 0)
+		for _, rr := range m.Answer {
+			addrs = append(addrs, rr.(*dns.A).A.String())
+		}
+		scope := -1
+		if opt := m.IsEdns0(); opt != nil {
+			for _, o := range opt.Option {
+				if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+					scope = int(ecs.SourceScope)
+				}
+			}
+		}
+		return addrs, scope
+	}
+	eu := &net.UDPAddr{IP: net.IPv4(10, 2, 0, 1), Port: 5353}
+	tests := []struct {
+		qname  string
+		remote net.Addr
+		subnet string
+		want   []string
+		scope  int
+	}{
+		{"www.example.com.", eu, "", []string{"192.0.2.1"}, -1},
+		{"www.example.com.", udpClient, "", []string{"192.0.2.3"}, -1},
+		// The client subnet takes precedence over the client's address
+		{"www.example.com.", udpClient, "10.1.2.0/24", []string{"192.0.2.2"}, 16},
+		{"www.example.com.", eu, "192.0.2.0/24", []string{"192.0.2.3"}, 24},
+		{"www.example.com.", eu, "0.0.0.0/0", []string{"192.0.2.1"}, 0},
+		{"ftp.example.com.", udpClient, "", []string{"192.0.2.2"}, -1},
+		{"ftp.example.com.", udpClient, "10.1.2.0/24", []string{"192.0.2.2"}, 0},
+	}
+	for _, tt := range tests {
+		addrs, scope := query(tt.qname, tt.remote, tt.subnet)
+		if !reflect.DeepEqual(addrs, tt.want) || scope != tt.scope {
+			t.Errorf("%v from %v (subnet %q) = %v, scope %d, want %v, scope %d", tt.qname, tt.remote, tt.subnet, addrs, scope, tt.want, tt.scope)
+		}
+	}
+	// The RRSets of a view are sent whole, the selection being the default view's one
+	if err := addd.StoreView(&addd.View{Name: "lab", Networks: []string{"172.16.0.0/12"}}); err != nil {
+		t.Fatal(err)
+	}
+	storeViewRRs(t, "lab", "ftp.example.com. 300 IN A 192.0.2.1", "ftp.example.com. 300 IN A 192.0.2.2")
+	addrs, _ := query("ftp.example.com.", &net.UDPAddr{IP: net.IPv4(172, 16, 0, 9), Port: 5353}, "")
+	if sort.Strings(addrs); !reflect.DeepEqual(addrs, []string{"192.0.2.1", "192.0.2.2"}) {
+		t.Errorf("ftp.example.com. from the view lab = %v", addrs)
+	}
+}
@@ -0,0 +1,107 @@
+package ddns
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/redsux/addd/core"
+)
+
+const (
+	// notifyRetries is the number of NOTIFY sent to a secondary before giving up
+	notifyRetries = 5
+	// notifyDelay is the first delay between two NOTIFY, doubled after each try
+	notifyDelay = time.Second
+)
+
+var (
+	notifyTargets = []string{}
+	notifyLock    sync.Mutex
+	notifyPending = map[string]bool{} // zone@target waiting for a NOTIFY
+	notifyRunning = map[string]bool{} // zone@target currently notified
+)
+
+// SetNotify defines the secondaries (host[:port]) notified after each change of our zones
+func SetNotify(targets []string) {
+	for _, target := range targets {
+		if target = strings.TrimSpace(target); target == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			target = net.JoinHostPort(target, "53")
+		}
+		notifyTargets = append(notifyTargets, target)
+	}
+	if len(notifyTargets) > 0 {
+		addd.OnCommit(notifyChange)
+	}
+}
+
+// notifyChange queues a NOTIFY of zone to every secondary
+func notifyChange(zone string, serial uint32) {
+	addd.Log.DebugF("[DNS] %v serial %d committed, notify %v", zone, serial, notifyTargets)
+	for _, target := range notifyTargets {
+		queueNotify(zone, target)
+	}
+}
+
+// queueNotify runs a single sender per zone and target, changes made while
+// it's running are coalesced in one more NOTIFY
+func queueNotify(zone, target string) {
+	key := zone + "@" + target
+	notifyLock.Lock()
+	defer notifyLock.Unlock()
+	notifyPending[key] = true
+	if notifyRunning[key] {
+		return
+	}
+	notifyRunning[key] = true
+	go func() {
+		for {
+			notifyLock.Lock()
+			if !notifyPending[key] {
+				delete(notifyRunning, key)
+				notifyLock.Unlock()
+				return
+			}
+			delete(notifyPending, key)
+			notifyLock.Unlock()
+			sendNotify(zone, target)
+		}
+	}()
+}
+
+// sendNotify sends a NOTIFY (RFC 1996) of zone to target, retrying with an exponential backoff
+func sendNotify(name, target string) {
+	zone, err := addd.GetZone(name)
+	if err != nil {
+		// Deleted in the meantime
+		return
+	}
+	m := new(dns.Msg)
+	m.SetNotify(zone.Name)
+	m.Answer = []dns.RR{getSoa(zone)}
+	client := &dns.Client{Net: "udp", Timeout: 2 * time.Second}
+
+	delay := notifyDelay
+	for try := 1; try <= notifyRetries; try++ {
+		r, _, err := client.Exchange(m, target)
+		if err == nil && r.Opcode == dns.OpcodeNotify && r.Rcode == dns.RcodeSuccess {
+			addd.Log.DebugF("[DNS] %v notified of %v changes", target, name)
+			return
+		}
+		if err == nil {
+			addd.Log.WarningF("[DNS] %v answered %v to NOTIFY of %v", target, dns.RcodeToString[r.Rcode], name)
+		} else {
+			addd.Log.WarningF("[DNS] NOTIFY of %v to %v failed (%d/%d) : %v", name, target, try, notifyRetries, err)
+		}
+		if try < notifyRetries {
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+	addd.Log.ErrorF("[DNS] %v couldn't be notified of %v changes", target, name)
+}
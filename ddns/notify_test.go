@@ -0,0 +1,61 @@
+package ddns
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/redsux/addd/core"
+)
+
+// secondary serves on a local UDP port, the NOTIFY received are sent to the returned channel
+func secondary(t *testing.T) (string, chan *dns.Msg, func()) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	notified := make(chan *dns.Msg, 10)
+	server := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		w.WriteMsg(m)
+		if r.Opcode == dns.OpcodeNotify {
+			notified <- r
+		}
+	})}
+	go server.ActivateAndServe()
+	return pc.LocalAddr().String(), notified, func() { server.Shutdown() }
+}
+
+func TestSetNotify(t *testing.T) {
+	defer func() { notifyTargets = []string{} }()
+	SetNotify([]string{"192.0.2.1", " ", "192.0.2.2:5353", "[2001:db8::1]:53"})
+	want := []string{"192.0.2.1:53", "192.0.2.2:5353", "[2001:db8::1]:53"}
+	if !reflect.DeepEqual(notifyTargets, want) {
+		t.Errorf("SetNotify() = %v, want %v", notifyTargets, want)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	useMemStore(t)
+	addr, notified, stop := secondary(t)
+	defer stop()
+	defer func() { notifyTargets = []string{} }()
+	SetNotify([]string{addr})
+
+	storeRRs(t, "www.example.com. 300 IN A 10.0.0.1")
+	select {
+	case r := <-notified:
+		serial, _ := addd.GetSerial("example.com")
+		if len(r.Question) != 1 || r.Question[0].Name != "example.com." || r.Question[0].Qtype != dns.TypeSOA {
+			t.Errorf("NOTIFY of %v", r.Question)
+		}
+		if len(r.Answer) != 1 || r.Answer[0].(*dns.SOA).Serial != serial {
+			t.Errorf("NOTIFY with %v, want the serial %v", r.Answer, serial)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("secondary not notified")
+	}
+}
@@ -0,0 +1,189 @@
+package ddns
+
+import (
+	"container/list"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/redsux/addd/core"
+)
+
+const (
+	// rrlIPv4Prefix and rrlIPv6Prefix are the client prefixes sharing a bucket
+	rrlIPv4Prefix = 24
+	rrlIPv6Prefix = 56
+	// rrlSize is the number of buckets kept, the least recently used one is forgotten above
+	rrlSize = 100000
+)
+
+var (
+	rrlRate   float64 // responses per second, 0 when disabled
+	rrlSlip   int
+	rrlExempt = []*net.IPNet{}
+
+	rrlLock    sync.Mutex
+	rrlBuckets = map[string]*list.Element{}
+	rrlLRU     = list.New() // *rrlBucket, most recently used first
+	rrlStats   RRLCounters
+)
+
+// RRLCounters are the numbers of UDP responses checked by our response rate limiting,
+// and of those exempted, dropped or sent truncated (slipped)
+type RRLCounters struct {
+	Responses uint64 `json:"responses"`
+	Exempted  uint64 `json:"exempted"`
+	Dropped   uint64 `json:"dropped"`
+	Slipped   uint64 `json:"slipped"`
+}
+
+// rrlBucket holds the tokens of identical responses to a client prefix
+type rrlBucket struct {
+	key     string
+	tokens  float64
+	updated time.Time
+	limited int // responses over the rate since the bucket was created, for the slip
+}
+
+// rrlWriter applies the response rate limiting to the replies written to a UDP client
+type rrlWriter struct {
+	dns.ResponseWriter
+	req *dns.Msg
+}
+
+// SetRateLimit enables the response rate limiting of UDP replies : rate identical responses
+// per second are sent to a client prefix, then only one out of slip is sent truncated
+// (none if slip is 0) so legitimate clients retry over TCP. Clients of the networks
+// exempt (CIDR) aren't limited.
+func SetRateLimit(rate, slip int, exempt []string) error {
+	if rate < 0 || slip < 0 {
+		return fmt.Errorf("Invalid rate limit %v/s, slip %v", rate, slip)
+	}
+	for _, cidr := range exempt {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("Invalid rate limit exempted network %v", cidr)
+		}
+		rrlExempt = append(rrlExempt, ipnet)
+	}
+	rrlRate, rrlSlip = float64(rate), slip
+	return nil
+}
+
+// RateLimitCounters returns the counters of our response rate limiting
+func RateLimitCounters() RRLCounters {
+	return RRLCounters{
+		Responses: atomic.LoadUint64(&rrlStats.Responses),
+		Exempted:  atomic.LoadUint64(&rrlStats.Exempted),
+		Dropped:   atomic.LoadUint64(&rrlStats.Dropped),
+		Slipped:   atomic.LoadUint64(&rrlStats.Slipped),
+	}
+}
+
+// rateLimited returns w limiting the replies to r if it is a query sent over UDP
+func rateLimited(w dns.ResponseWriter, r *dns.Msg) dns.ResponseWriter {
+	if rrlRate == 0 || r.Opcode != dns.OpcodeQuery || !isUDP(w) {
+		return w
+	}
+	return &rrlWriter{ResponseWriter: w, req: r}
+}
+
+// WriteMsg sends m, a truncated reply or nothing, depending on the tokens left to the client
+func (w *rrlWriter) WriteMsg(m *dns.Msg) error {
+	atomic.AddUint64(&rrlStats.Responses, 1)
+	ip := remoteIP(w)
+	for _, ipnet := range rrlExempt {
+		if ip != nil && ipnet.Contains(ip) {
+			atomic.AddUint64(&rrlStats.Exempted, 1)
+			return w.ResponseWriter.WriteMsg(m)
+		}
+	}
+
+	key := rrlPrefix(ip) + "/" + rrlClass(m)
+	now := time.Now()
+	rrlLock.Lock()
+	b := rrlBucketOf(key, now)
+	b.tokens += now.Sub(b.updated).Seconds() * rrlRate
+	if b.tokens > rrlRate {
+		b.tokens = rrlRate
+	}
+	b.updated = now
+	allowed, slip := b.tokens >= 1, false
+	if allowed {
+		b.tokens--
+	} else {
+		b.limited++
+		slip = rrlSlip > 0 && b.limited%rrlSlip == 0
+	}
+	rrlLock.Unlock()
+
+	switch {
+	case allowed:
+		return w.ResponseWriter.WriteMsg(m)
+	case slip:
+		atomic.AddUint64(&rrlStats.Slipped, 1)
+		tc := new(dns.Msg)
+		tc.SetRcode(w.req, m.Rcode)
+		tc.Authoritative = m.Authoritative
+		tc.RecursionAvailable = m.RecursionAvailable
+		tc.Truncated = true
+		return w.ResponseWriter.WriteMsg(tc)
+	}
+	atomic.AddUint64(&rrlStats.Dropped, 1)
+	addd.Log.DebugF("[DNS] Rate limit, response to %v dropped", w.RemoteAddr())
+	return nil
+}
+
+// rrlBucketOf returns the bucket of key, a new full one if missing.
+// The least recently used bucket is forgotten when we have rrlSize of them, rrlLock must be held.
+func rrlBucketOf(key string, now time.Time) *rrlBucket {
+	if e, ok := rrlBuckets[key]; ok {
+		rrlLRU.MoveToFront(e)
+		return e.Value.(*rrlBucket)
+	}
+	if rrlLRU.Len() >= rrlSize {
+		oldest := rrlLRU.Back()
+		delete(rrlBuckets, oldest.Value.(*rrlBucket).key)
+		rrlLRU.Remove(oldest)
+	}
+	b := &rrlBucket{key: key, tokens: rrlRate, updated: now}
+	rrlBuckets[key] = rrlLRU.PushFront(b)
+	return b
+}
+
+// rrlPrefix returns the client prefix of ip
+func rrlPrefix(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(rrlIPv4Prefix, 32)).String()
+	}
+	if ip != nil {
+		return ip.Mask(net.CIDRMask(rrlIPv6Prefix, 128)).String()
+	}
+	return ""
+}
+
+// rrlClass returns what makes responses identical : the question of the positive answers,
+// the zone of the negative ones (so random names share a bucket), the rcode of the errors
+func rrlClass(m *dns.Msg) string {
+	switch {
+	case m.Rcode == dns.RcodeSuccess && len(m.Answer) > 0 && len(m.Question) > 0:
+		return strings.ToLower(m.Question[0].Name) + "/" + dns.Type(m.Question[0].Qtype).String()
+	case m.Rcode == dns.RcodeSuccess || m.Rcode == dns.RcodeNameError:
+		for _, rr := range m.Ns {
+			if rr.Header().Rrtype == dns.TypeSOA {
+				return strings.ToLower(rr.Header().Name) + "/" + dns.RcodeToString[m.Rcode]
+			}
+		}
+		if len(m.Question) > 0 {
+			return strings.ToLower(m.Question[0].Name) + "/" + dns.RcodeToString[m.Rcode]
+		}
+	}
+	return "error/" + dns.RcodeToString[m.Rcode]
+}
@@ -0,0 +1,138 @@
+package ddns
+
+import (
+	"container/list"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// useRateLimit enables the response rate limiting until the end of the test
+func useRateLimit(t *testing.T, rate, slip int, exempt []string) func() {
+	if err := SetRateLimit(rate, slip, exempt); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		rrlRate, rrlSlip, rrlExempt = 0, 0, []*net.IPNet{}
+		rrlBuckets, rrlLRU = map[string]*list.Element{}, list.New()
+		rrlStats = RRLCounters{}
+	}
+}
+
+// limited sends n queries of qname from remote and returns how many replies were written, and truncated
+func limited(t *testing.T, remote net.Addr, qname string, n int) (int, int) {
+	sent, truncated := 0, 0
+	for i := 0; i < n; i++ {
+		r := new(dns.Msg)
+		r.SetQuestion(qname, dns.TypeA)
+		w := &testWriter{remote: remote}
+		handleDNSRequest(w, r)
+		if w.msg != nil {
+			sent++
+			if w.msg.Truncated {
+				truncated++
+			}
+		}
+	}
+	return sent, truncated
+}
+
+func TestRateLimit(t *testing.T) {
+	useMemStore(t)
+	storeRRs(t, "www.example.com. 300 IN A 10.0.0.1")
+	defer useRateLimit(t, 2, 3, []string{"198.51.100.0/24", " "})()
+
+	// 2 answers are sent, then one out of 3 is sent truncated
+	if sent, truncated := limited(t, udpClient, "www.example.com.", 8); sent != 4 || truncated != 2 {
+		t.Errorf("%d replies sent, %d truncated, want 4 and 2", sent, truncated)
+	}
+	// The clients of the same prefix share the bucket, other responses have their own
+	neighbour := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 200), Port: 5353}
+	if sent, _ := limited(t, neighbour, "www.example.com.", 1); sent != 0 {
+		t.Error("response sent to a client of the same prefix")
+	}
+	if sent, _ := limited(t, udpClient, "ns.example.com.", 2); sent != 2 {
+		t.Errorf("%d other responses sent, want 2", sent)
+	}
+	// Negative answers of a zone are identical, whatever the name asked
+	if sent, _ := limited(t, udpClient, "a.example.com.", 1); sent != 1 {
+		t.Error("NXDOMAIN not sent")
+	}
+	if sent, _ := limited(t, udpClient, "b.example.com.", 1); sent != 1 {
+		t.Error("NXDOMAIN not sent")
+	}
+	if sent, _ := limited(t, udpClient, "c.example.com.", 1); sent != 0 {
+		t.Error("third NXDOMAIN of the zone sent")
+	}
+	// TCP clients and the networks exempted aren't limited
+	if sent, _ := limited(t, tcpClient, "www.example.com.", 5); sent != 5 {
+		t.Errorf("%d responses sent over TCP, want 5", sent)
+	}
+	exempted := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 5353}
+	if sent, _ := limited(t, exempted, "www.example.com.", 5); sent != 5 {
+		t.Errorf("%d responses sent to an exempted client, want 5", sent)
+	}
+	// Only the responses to queries are limited
+	for i := 0; i < 5; i++ {
+		r := new(dns.Msg)
+		r.SetNotify("example.com.")
+		w := &testWriter{remote: udpClient}
+		handleDNSRequest(w, r)
+		if w.msg == nil {
+			t.Fatalf("response to the NOTIFY %d dropped", i)
+		}
+	}
+
+	want := RRLCounters{Responses: 19, Exempted: 5, Dropped: 6, Slipped: 2}
+	if got := RateLimitCounters(); got != want {
+		t.Errorf("RateLimitCounters() = %+v, want %+v", got, want)
+	}
+}
+
+func TestSetRateLimit(t *testing.T) {
+	defer useRateLimit(t, 0, 0, nil)()
+	if err := SetRateLimit(-1, 2, nil); err == nil {
+		t.Error("negative rate accepted")
+	}
+	if err := SetRateLimit(5, 2, []string{"198.51.100.1"}); err == nil {
+		t.Error("exempted address without length accepted")
+	}
+	tests := []struct {
+		ip   net.IP
+		want string
+	}{
+		{net.IPv4(192, 0, 2, 200), "192.0.2.0"},
+		{net.ParseIP("2001:db8:1:2ff::1"), "2001:db8:1:200::"},
+		{nil, ""},
+	}
+	for _, tt := range tests {
+		if got := rrlPrefix(tt.ip); got != tt.want {
+			t.Errorf("rrlPrefix(%v) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestRateLimitBuckets(t *testing.T) {
+	defer useRateLimit(t, 5, 0, nil)()
+	now := time.Now()
+	rrlLock.Lock()
+	defer rrlLock.Unlock()
+	for i := 0; i < rrlSize; i++ {
+		rrlBucketOf(fmt.Sprintf("bucket%d", i), now)
+	}
+	// The first bucket used again, the second one is the least recently used
+	rrlBucketOf("bucket0", now).tokens = 1
+	rrlBucketOf("new", now)
+	if len(rrlBuckets) != rrlSize || rrlLRU.Len() != rrlSize {
+		t.Errorf("%d buckets, %d in the LRU, want %d", len(rrlBuckets), rrlLRU.Len(), rrlSize)
+	}
+	if _, ok := rrlBuckets["bucket1"]; ok {
+		t.Error("least recently used bucket kept")
+	}
+	if b := rrlBucketOf("bucket0", now); b.tokens != 1 {
+		t.Errorf("bucket used again forgotten, %v tokens", b.tokens)
+	}
+}
@@ -2,7 +2,7 @@ package ddns
 
 import (
 	"fmt"
-	"math/rand"
+	"net"
 	"strconv"
 	"strings"
 	"time"
@@ -11,222 +11,406 @@ import (
 	"github.com/redsux/addd/core"
 )
 
-var (
-	domain = "."
-	serial = 1 + rand.Intn(4294967294) // random DNS SOA serial
+const (
+	// maxChase is the longest CNAME chain followed by lookup
+	maxChase = 8
 )
 
-func noDotDomain() string {
-	return strings.TrimLeft(domain, ".")
-}
+// ednsSize is the largest UDP payload we advertise and send with EDNS0
+var ednsSize = 1232
 
-func getSoa() *dns.SOA {
-	strSoa := fmt.Sprintf("$ORIGIN %s\n@ SOA ns.%s admin. %d 3600 1800 604800 %d", domain, noDotDomain(), serial, 604800)
-	soa, err := dns.NewRR(strSoa)
-	if err != nil {
-		panic(err)
-	}
-	return soa.(*dns.SOA)
-}
+// queryRecord appends to m the answer to q for the client cl
+func queryRecord(q *dns.Question, m *dns.Msg, cl *client) int {
+	qname := strings.ToLower(q.Name)
+	qtype := dns.Type(q.Qtype).String()
 
-func getNS() *dns.NS {
-	strNS := fmt.Sprintf("%s %d IN NS ns.%s", domain, 604800, noDotDomain())
-	ns, err := dns.NewRR(strNS)
-	if err != nil {
-		panic(err)
+	if cl.view != "" {
+		addd.Log.NoticeF("[DNS] Query %v, %v (view %v)", qname, qtype, cl.view)
+	} else {
+		addd.Log.NoticeF("[DNS] Query %v, %v", qname, qtype)
+	}
+	zone := zoneOf(qname)
+	if zone == nil {
+		return dns.RcodeRefused
+	}
+	switch q.Qtype {
+	case dns.TypeSOA:
+		if zone.Name != qname {
+			return missing(qname, cl.view)
+		}
+		m.Answer = append(m.Answer, getSoa(zone))
+		if ns, err := getNsA(zone); err == nil {
+			m.Extra = append(m.Extra, ns...)
+		}
+	case dns.TypeNS:
+		if zone.Name != qname {
+			return missing(qname, cl.view)
+		}
+		m.Answer = append(m.Answer, getNS(zone)...)
+		if ns, err := getNsA(zone); err == nil {
+			m.Extra = append(m.Extra, ns...)
+		}
+	case dns.TypeDNSKEY:
+		if zone.Name != qname {
+			return missing(qname, cl.view)
+		}
+		if zs := signerOf(zone); zs != nil {
+			m.Answer = append(m.Answer, zs.dnskeys()...)
+		}
+	case dns.TypeANY:
+		qtype = "A"
+		fallthrough
+	case dns.TypeA, dns.TypeAAAA:
+		if addrs, err := nsAddrs(zone, qname); err != nil {
+			addd.Log.DebugF(err.Error())
+		} else if addrs != nil {
+			m.Answer = append(m.Answer, filterType(addrs, dns.StringToType[qtype])...)
+			break
+		}
+		fallthrough
+	case dns.TypeCNAME, dns.TypeTXT, dns.TypeCAA, dns.TypePTR:
+		return lookup(qname, qtype, m, cl)
+	case dns.TypeMX, dns.TypeSRV:
+		rcode := lookup(qname, qtype, m, cl)
+		appendGlue(m, cl)
+		return rcode
+	default:
+		return missing(qname, cl.view)
 	}
-	return ns.(*dns.NS)
+	return dns.RcodeSuccess
 }
 
-func getNsA() ([]dns.RR, error) {
-	ips, err := addd.IPs()
+// missing returns the rcode of an empty answer :
+// NODATA (NOERROR) if qname exists with other types in view, NXDOMAIN otherwise
+func missing(qname, view string) int {
+	if zone := zoneOf(qname); zone != nil && (zone.Name == qname || isNsName(zone, qname)) {
+		return dns.RcodeSuccess
+	}
+	exists, err := addd.ViewNameExists(view, qname)
 	if err != nil {
-		return nil, err
+		addd.Log.DebugF("[DNS] %v", err)
+		return dns.RcodeServerFailure
 	}
-	ns := make([]dns.RR, 0)
-	for _, ip := range ips {
-		strRr := fmt.Sprintf("%s %d IN A %s", "ns."+noDotDomain(), 604800, ip)
-		rr, err := dns.NewRR(strRr)
-		if err != nil {
-			return nil, err
-		}
-		ns = append(ns, rr)
+	if exists {
+		return dns.RcodeSuccess
 	}
-	return ns, nil
+	return dns.RcodeNameError
 }
 
-func updateRecord(r dns.RR, q *dns.Question) int {
-	header := r.Header()
-    rname := header.Name
-    rtype := dns.Type(header.Rrtype).String()
-
-	addd.Log.NoticeF("[DNS] Update %v, %v", rname, rtype)
-	if strings.TrimLeft(rname, ".") == strings.Trim("ns."+ domain, ".")  {
-		addd.Log.Warning("[DNS] try to update NS records")
-		return dns.RcodeRefused
-	}
+// lookup appends the RRSet qname/qtype selected for cl to m, following in-zone CNAME chains.
+// Nothing is appended when the chain loops or is too long.
+func lookup(qname, qtype string, m *dns.Msg, cl *client) int {
+	answers := len(m.Answer)
+	visited := make(map[string]bool)
+	for len(visited) < maxChase {
+		if visited[qname] {
+			addd.Log.WarningF("[DNS] CNAME loop detected on %v", qname)
+			m.Answer = m.Answer[:answers]
+			return dns.RcodeServerFailure
+		}
+		visited[qname] = true
 
-	// If "update delete" (cf. https://godoc.org/github.com/miekg/dns#hdr-DYNAMIC_UPDATES )
-	// 	3.4.2.6 - Table Of Metavalues Used In Update Section
-	//  	CLASS    TYPE     RDATA    Meaning                     Function
-	// 		---------------------------------------------------------------
-	//  	ANY      ANY      empty    Delete all RRsets from name dns.RemoveName
-	//  	ANY      rrset    empty    Delete an RRset             dns.RemoveRRset
-	//  	NONE     rrset    rr       Delete an RR from RRset     dns.Remove
-	//  	zone     rrset    rr       Add to an RRset             dns.Insert
-	if header.Class == dns.ClassNONE || (header.Class == dns.ClassANY && header.Rdlength == 0) {
-		if rec, err := addd.GetRecord(rname, rtype); err == nil {
-			if err := addd.DeleteRecord(rec); err != nil {
-				addd.Log.ErrorF("[DNS] impossible to delete %v %v", rec.Name, rec.Type)
-				addd.Log.DebugF("[DNS] %v", err)
-				return dns.RcodeServerFailure
+		synthesized := false
+		set, err := addd.ResolveRRSet(cl.view, qname, qtype)
+		cname, cerr := addd.ResolveRRSet(cl.view, qname, "CNAME")
+		if err != nil && cerr != nil {
+			// Explicit records take precedence over wildcards (RFC 4592)
+			if wild, werr := addd.ViewWildcard(cl.view, qname); werr == nil && wild != "" {
+				set, err = addd.ResolveRRSet(cl.view, wild, qtype)
+				cname, cerr = addd.ResolveRRSet(cl.view, wild, "CNAME")
+				synthesized = true
 			}
-		} else {
-			return dns.RcodeNameError
 		}
-	} else { // "update add"
-		rec, err := addd.NewRecordFromDNS(r)
-		if err != nil {
-			addd.Log.ErrorF("[DNS] Record creation impossible :  %v.", err)
-			return dns.RcodeServerFailure
+		if err == nil {
+			return appendRRSet(cl.selectRRSet(set), qname, m)
 		}
-		if err := addd.StoreRecord(rec); err != nil {
-			addd.Log.ErrorF("[DNS] Impossible to store %v %v", rec.Name, rec.Type)
-			addd.Log.DebugF("[DNS] %v", err)
-			return dns.RcodeServerFailure
+		if qtype == "CNAME" || cerr != nil || cname.Empty() {
+			if synthesized {
+				// The wildcard exists, only the type is missing
+				return dns.RcodeSuccess
+			}
+			return missing(qname, cl.view)
+		}
+		if rcode := appendRRSet(cname, qname, m); rcode != dns.RcodeSuccess {
+			return rcode
+		}
+		// Out of zone targets are left to the resolver
+		qname = cname.Records[0].Data()
+		if !isServed(qname) {
+			return dns.RcodeSuccess
 		}
 	}
-	return dns.RcodeSuccess
+	addd.Log.WarningF("[DNS] CNAME chain too long from %v", qname)
+	m.Answer = m.Answer[:answers]
+	return dns.RcodeServerFailure
 }
 
-func queryRecord(q *dns.Question, m *dns.Msg) int {
-	qname := strings.ToLower(q.Name)
-	qtype := dns.Type(q.Qtype).String()
+// appendRRSet adds set to the answer section with owner as name (synthesized wildcards)
+func appendRRSet(set *addd.RRSet, owner string, m *dns.Msg) int {
+	rrs, err := set.DNSRR()
+	if err != nil {
+		addd.Log.DebugF("[DNS] %v", err)
+		return dns.RcodeServerFailure
+	}
+	for _, rr := range rrs {
+		rr.Header().Name = owner
+	}
+	m.Answer = append(m.Answer, rrs...)
+	return dns.RcodeSuccess
+}
 
-	addd.Log.NoticeF("[DNS] Query %v, %v", qname, qtype)
-	switch q.Qtype {
-	case dns.TypeSOA:
-		m.Answer = append(m.Answer, getSoa())
-		if ns, err := getNsA(); err == nil {
-			m.Extra = append(m.Extra, ns...)
-		}
-	case dns.TypeNS:
-		m.Answer = append(m.Answer, getNS())
-	case dns.TypeANY:
-		qtype = "A"
-		fallthrough
-	case dns.TypeA:
-		if strings.TrimRight(qname,".") == strings.TrimRight("ns."+domain,".") {
-			if ns, err := getNsA(); err == nil {
-				m.Answer = append(m.Answer, ns...)
-			} else {
-				addd.Log.DebugF(err.Error())
-			}
-			break
-		}
-		fallthrough
-	case dns.TypeAAAA:
-		readRR, err := addd.GetRecord(qname, qtype)
-		if err != nil {
-			return dns.RcodeNameError
+// appendGlue adds to the additional section the addresses of in-zone MX and SRV targets selected for cl
+func appendGlue(m *dns.Msg, cl *client) {
+	for _, rr := range m.Answer {
+		var target string
+		switch a := rr.(type) {
+		case *dns.MX:
+			target = a.Mx
+		case *dns.SRV:
+			target = a.Target
+		default:
+			continue
 		}
-		rr, err := readRR.DNSRR()
-		if err != nil {
-			return dns.RcodeServerFailure
+		if !isServed(target) {
+			continue
 		}
-		if rr.Header().Name != qname {
-			return dns.RcodeBadName
+		for _, rtype := range []string{"A", "AAAA"} {
+			if set, err := addd.ResolveRRSet(cl.view, target, rtype); err == nil {
+				if rrs, err := cl.selectRRSet(set).DNSRR(); err == nil {
+					m.Extra = append(m.Extra, rrs...)
+				}
+			}
 		}
-		m.Answer = append(m.Answer, rr)
-	default:
-		return dns.RcodeNotImplemented
 	}
-	return dns.RcodeSuccess
 }
 
 func handleDNSRequest(w dns.ResponseWriter, r *dns.Msg) {
+	if r.Opcode == dns.OpcodeQuery && len(r.Question) == 1 {
+		switch r.Question[0].Qtype {
+		case dns.TypeAXFR, dns.TypeIXFR:
+			transferZone(w, r)
+			return
+		}
+	}
+
+	if r.Opcode == dns.OpcodeUpdate && !authUpdate(w, r) {
+		return
+	}
+	w = rateLimited(w, r)
+
 	m := new(dns.Msg)
 	m.SetRcode(r, dns.RcodeSuccess)
 	m.Authoritative = true
 	m.Compress = false
 	m.Answer = make([]dns.RR, 0)
 	m.Extra = make([]dns.RR, 0)
-	m.Ns = []dns.RR{getSoa()}
 
-	switch r.Opcode {
-	case dns.OpcodeQuery:
+	// Only EDNS version 0 is known (RFC 6891, 6.1.3)
+	if opt := r.IsEdns0(); opt != nil && opt.Version() != 0 {
+		m.Authoritative = false
+		m.Rcode = dns.RcodeBadVers
+		replyEdns(w, r, m)
+		signReply(w, r, m)
+		w.WriteMsg(m)
+		return
+	}
+
+	var (
+		zone *addd.Zone
+		cl   *client
+	)
+	if len(r.Question) > 0 {
+		zone = zoneOf(r.Question[0].Name)
+	}
+
+	switch {
+	case zone == nil && allowForward(w, r):
+		forward(w, r)
+		return
+	case zone == nil:
+		// Not one of our zones
+		m.Authoritative = false
+		m.Rcode = dns.RcodeRefused
+	case r.Opcode == dns.OpcodeQuery:
+		m.Ns = []dns.RR{getSoa(zone)}
+		cl = newClient(w, r)
 		for _, question := range r.Question {
-			if r := queryRecord(&question, m); r > m.Rcode {
+			if r := queryRecord(&question, m, cl); r > m.Rcode {
 				m.Rcode = r
 			}
 		}
-	case dns.OpcodeUpdate:
-		for _, question := range r.Question {
-			for _, rr := range r.Ns {
-				if r := updateRecord(rr, &question); r > m.Rcode {
-					m.Rcode = r
-				}
-			}
-		}
+	case r.Opcode == dns.OpcodeUpdate:
+		m.Rcode = updateZone(zone, r, updateKey(w, r))
+		m.Ns = []dns.RR{getSoa(zone)}
 	default:
 		m.Rcode = dns.RcodeNotImplemented
 	}
 
-	addd.Log.DebugF("[DNS] Nb Anwsers = %v\tRcode = %v",len(m.Answer), dns.RcodeToString[m.Rcode])
+	addd.Log.DebugF("[DNS] Nb Anwsers = %v\tRcode = %v", len(m.Answer), dns.RcodeToString[m.Rcode])
 
 	if len(m.Answer) > 0 && m.Rcode != dns.RcodeSuccess {
 		m.Rcode = dns.RcodeSuccess
 	}
- 
+
+	if zone != nil && r.Opcode == dns.OpcodeQuery {
+		dnssecReply(r, m, cl)
+	}
+
+	cl.echoSubnet(r, m)
+	replyEdns(w, r, m)
+	signReply(w, r, m)
+	w.WriteMsg(m)
+}
+
+// signReply adds a TSIG to m, with the algorithm of the request r, if it was validly signed.
+// Our servers sign it when m is written.
+func signReply(w dns.ResponseWriter, r, m *dns.Msg) {
 	if r.IsTsig() != nil {
-		if w.TsigStatus() == nil {
-			if rtsig, ok := r.Extra[len(r.Extra)-1].(*dns.TSIG); ok {
-				m.SetTsig(rtsig.Hdr.Name, dns.HmacMD5, 300, time.Now().Unix())
-			}
+		if t := validTsig(w, r); t != nil {
+			m.SetTsig(t.Hdr.Name, t.Algorithm, 300, time.Now().Unix())
 		} else {
-			addd.Log.WarningF("TSIG Status : %v", w.TsigStatus().Error())
+			addd.Log.WarningF("TSIG Status : %v", tsigStatus(w, r))
 		}
 	}
+}
 
-	w.WriteMsg(m)
+// validTsig returns the TSIG of r if it is signed by one of our keys with its algorithm
+func validTsig(w dns.ResponseWriter, r *dns.Msg) *dns.TSIG {
+	if tsigStatus(w, r) != nil {
+		return nil
+	}
+	return r.IsTsig()
 }
 
-func Serve(root, name, secret string, port int) {
-	if !strings.HasSuffix(root, ".") {
-		root = root + "."
+// tsigStatus returns why the TSIG of r isn't valid, nil if it is.
+// w reports the result of the verification made by our server when r was received.
+func tsigStatus(w dns.ResponseWriter, r *dns.Msg) error {
+	t := r.IsTsig()
+	if t == nil {
+		return dns.ErrSig
 	}
-	if strings.HasPrefix(root, ".") && root != "." {
-		root = strings.TrimLeft(root, ".")
+	if err := w.TsigStatus(); err != nil {
+		return err
 	}
+	key, err := addd.GetTsigKey(t.Hdr.Name)
+	if err != nil {
+		return dns.ErrSecret
+	}
+	if !strings.EqualFold(key.Algorithm, t.Algorithm) {
+		return dns.ErrKeyAlg
+	}
+	return nil
+}
 
-	root = strings.ToLower(root)
+// isUDP returns true if the request has been received on our UDP listener
+func isUDP(w dns.ResponseWriter) bool {
+	_, ok := w.RemoteAddr().(*net.UDPAddr)
+	return ok
+}
 
-	if _, ok := dns.IsDomainName(root); ok {
-		domain = root
+// remoteIP returns the client's address
+func remoteIP(w dns.ResponseWriter) net.IP {
+	switch addr := w.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+	return nil
+}
 
-		dns.HandleFunc(root, handleDNSRequest)
+// SetEdnsSize defines the largest UDP payload we advertise and send with EDNS0 (RFC 6891, 6.2.5)
+func SetEdnsSize(size int) {
+	if size < dns.MinMsgSize {
+		size = dns.MinMsgSize
+	}
+	if size > dns.MaxMsgSize {
+		size = dns.MaxMsgSize
+	}
+	ednsSize = size
+}
 
-		server := &dns.Server{Addr: ":" + strconv.Itoa(port), Net: "udp"}
-		if name != "" && secret != "" {
-			server.TsigSecret = map[string]string{name: secret}
+// udpSize returns the buffer size advertised by the client (EDNS0), limited to ours,
+// or the RFC 1035 default
+func udpSize(r *dns.Msg) int {
+	if opt := r.IsEdns0(); opt != nil && int(opt.UDPSize()) > dns.MinMsgSize {
+		if int(opt.UDPSize()) > ednsSize {
+			return ednsSize
 		}
+		return int(opt.UDPSize())
+	}
+	return dns.MinMsgSize
+}
 
-		err := server.ListenAndServe()
-		defer server.Shutdown()
+// replyEdns adds our OPT record to m if the request r had one, echoing its DO bit,
+// then ensures m fits in the client's buffer
+func replyEdns(w dns.ResponseWriter, r, m *dns.Msg) {
+	if opt := r.IsEdns0(); opt != nil && m.IsEdns0() == nil {
+		// Extended rcodes (>15) are packed by miekg/dns in our OPT record
+		m.SetEdns0(uint16(ednsSize), opt.Do())
+	}
+	if !isUDP(w) {
+		m.Compress = m.Len() > dns.MaxMsgSize
+		return
+	}
+	// Names are compressed only when needed, else TC is set so the client retries over TCP
+	size := udpSize(r)
+	if t := r.IsTsig(); t != nil {
+		// Room is kept for the TSIG added by signReply, as large as the request's one
+		size -= len(t.Hdr.Name) + len(t.Algorithm) + int(t.MACSize) + 30
+	}
+	if m.Len() > size {
+		m.Compress = true
+		truncate(m, size)
+	}
+}
 
-		if err != nil {
-			addd.Log.Error("Failed to setup the udp server.")
-			panic(err.Error())
+// truncate drops the records at the end of m until it fits in size bytes : additional ones
+// but our OPT first, then the authority and answer ones which set TC (RFC 2181 9)
+func truncate(m *dns.Msg, size int) {
+	var opt, extra []dns.RR
+	for _, rr := range m.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			opt = append(opt, rr)
+		} else {
+			extra = append(extra, rr)
 		}
-	} else {
-		addd.Log.ErrorF("Root domain %v invalid.", root)
+	}
+	for len(extra) > 0 && m.Len() > size {
+		extra = extra[:len(extra)-1]
+		m.Extra = append(append([]dns.RR{}, extra...), opt...)
+	}
+	for len(m.Ns) > 0 && m.Len() > size {
+		m.Ns, m.Truncated = m.Ns[:len(m.Ns)-1], true
+	}
+	for len(m.Answer) > 0 && m.Len() > size {
+		m.Answer, m.Truncated = m.Answer[:len(m.Answer)-1], true
 	}
 }
 
-func ExtractTSIG(tsig string) (name, secret string) {
-	if tsig != "" {
-		a := strings.SplitN(tsig, ":", 2)
-		name, secret = dns.Fqdn(a[0]), a[1]
+// Serve starts the UDP, TCP and DoT listeners answering for all our zones.
+// TSIG are verified and signed with our keys as they are when each request is received.
+func Serve(port int) {
+	// Zones can be added at any time, the handler checks if a request belongs to one of them
+	dns.HandleFunc(".", handleDNSRequest)
+
+	addr := ":" + strconv.Itoa(port)
+	servers := []*dns.Server{
+		{Addr: addr, Net: "udp"},
+		{Addr: addr, Net: "tcp"},
+	}
+	if dotConfig != nil {
+		servers = append(servers, &dns.Server{Addr: dotAddr, Net: "tcp-tls", TLSConfig: dotConfig})
+	}
+	errs := make(chan error, len(servers))
+	for _, server := range servers {
+		server.TsigProvider = tsigProvider{}
+		server.MsgAcceptFunc = acceptMsg
+		go func(srv *dns.Server) {
+			errs <- fmt.Errorf("%s: %v", srv.Net, srv.ListenAndServe())
+		}(server)
 	}
-	return
+	err := <-errs
+	addd.Log.ErrorF("Failed to setup the dns server (%v).", err)
+	panic(err.Error())
 }
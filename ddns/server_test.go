@@ -0,0 +1,585 @@
+package ddns
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/redsux/addd/core"
+	"github.com/redsux/addd/core/dbtest"
+)
+
+// testWriter is a dns.ResponseWriter keeping the replies written for a client at remote.
+// As our servers, it signs the replies to which a TSIG is added.
+type testWriter struct {
+	remote net.Addr
+	tsig   error    // status of the request's TSIG
+	mac    string   // MAC of the request then of the last reply, see receive
+	msg    *dns.Msg // the last reply
+	msgs   []*dns.Msg
+}
+
+func (w *testWriter) LocalAddr() net.Addr  { return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53} }
+func (w *testWriter) RemoteAddr() net.Addr { return w.remote }
+func (w *testWriter) WriteMsg(m *dns.Msg) error {
+	if m.IsTsig() == nil {
+		w.msg, w.msgs = m, append(w.msgs, m)
+		return nil
+	}
+	buf, mac, err := dns.TsigGenerateWithProvider(m, tsigProvider{}, w.mac, false)
+	if err != nil {
+		return err
+	}
+	w.mac = mac
+	_, err = w.Write(buf)
+	return err
+}
+func (w *testWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.msg, w.msgs = m, append(w.msgs, m)
+	return len(b), nil
+}
+func (w *testWriter) Close() error        { return nil }
+func (w *testWriter) TsigStatus() error   { return w.tsig }
+func (w *testWriter) TsigTimersOnly(bool) {}
+func (w *testWriter) Hijack()             {}
+
+var (
+	udpClient = &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5353}
+	tcpClient = &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5353}
+)
+
+// useMemStore opens an in-memory DB holding the zone example.com, members are the addresses of the cluster
+func useMemStore(t *testing.T, members ...string) {
+	if err := addd.NewDB(dbtest.NewStore(members...)); err != nil {
+		t.Fatal(err)
+	}
+	useZones(t, "example.com.")
+}
+
+// useZones creates the zones named, with our default values
+func useZones(t *testing.T, names ...string) {
+	for _, name := range names {
+		if err := addd.StoreZone(addd.DefaultZone(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func mustRR(s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		panic(err)
+	}
+	return rr
+}
+
+// storeRRs stores the records of the RRs given in their presentation format
+func storeRRs(t *testing.T, rrs ...string) {
+	for _, s := range rrs {
+		rec, err := addd.NewRecordFromDNS(mustRR(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := addd.StoreRecord(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// answers returns the answers of m in the dns package's format
+func answers(m *dns.Msg) []string {
+	lst := make([]string, 0, len(m.Answer))
+	for _, rr := range m.Answer {
+		lst = append(lst, rr.String())
+	}
+	return lst
+}
+
+// canonicalRRs returns the RRs of lst in the dns package's format
+func canonicalRRs(lst ...string) []string {
+	rrs := make([]string, 0, len(lst))
+	for _, s := range lst {
+		rrs = append(rrs, mustRR(s).String())
+	}
+	return rrs
+}
+
+// receive passes r to handleDNSRequest as our servers do once its TSIG verified, with the status of w
+func receive(w *testWriter, r *dns.Msg) {
+	if t := r.IsTsig(); t != nil {
+		w.mac = t.MAC
+	}
+	handleDNSRequest(w, r)
+}
+
+// exchange returns the reply of handleDNSRequest to r received from remote
+func exchange(t *testing.T, remote net.Addr, r *dns.Msg) *dns.Msg {
+	w := &testWriter{remote: remote}
+	receive(w, r)
+	if w.msg == nil {
+		t.Fatal("no reply written")
+	}
+	return w.msg
+}
+
+func TestTruncate(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("www.example.com.", dns.TypeA)
+	for i := 1; i <= 10; i++ {
+		rr, _ := dns.NewRR(fmt.Sprintf("www.example.com. 300 IN A 10.0.0.%d", i))
+		m.Answer = append(m.Answer, rr)
+	}
+	ns, _ := dns.NewRR("example.com. 300 IN NS ns.example.com.")
+	m.Ns = []dns.RR{ns}
+	for i := 1; i <= 3; i++ {
+		rr, _ := dns.NewRR(fmt.Sprintf("ns.example.com. 300 IN A 10.0.1.%d", i))
+		m.Extra = append(m.Extra, rr)
+	}
+
+	// Sizes of the message without its additional records, and with only 6 answers
+	short := m.Copy()
+	short.Extra = nil
+	noExtra := short.Len()
+	short.Ns, short.Answer = nil, short.Answer[:6]
+	sixAnswers := short.Len()
+
+	tests := []struct {
+		size              int
+		answer, ns, extra int
+		truncated         bool
+	}{
+		{m.Len(), 10, 1, 3, false},
+		{m.Len() - 1, 10, 1, 2, false},
+		{noExtra, 10, 1, 0, false},
+		{noExtra - 1, 10, 0, 0, true},
+		{sixAnswers, 6, 0, 0, true},
+		{0, 0, 0, 0, true},
+	}
+	for _, tt := range tests {
+		c := m.Copy()
+		truncate(c, tt.size)
+		if len(c.Answer) != tt.answer || len(c.Ns) != tt.ns || len(c.Extra) != tt.extra || c.Truncated != tt.truncated {
+			t.Errorf("truncate(%d) kept %d/%d/%d records, TC %v, want %d/%d/%d, TC %v", tt.size,
+				len(c.Answer), len(c.Ns), len(c.Extra), c.Truncated, tt.answer, tt.ns, tt.extra, tt.truncated)
+		}
+		if tt.size > 0 && c.Len() > tt.size {
+			t.Errorf("truncate(%d) left %d bytes", tt.size, c.Len())
+		}
+	}
+}
+
+func TestHandleDNSRequestTruncated(t *testing.T) {
+	// The A records of our name server are those of all the members of our cluster
+	members := make([]string, 0, 40)
+	for i := 1; i <= cap(members); i++ {
+		members = append(members, fmt.Sprintf("10.0.0.%d", i))
+	}
+	useMemStore(t, members...)
+
+	tests := []struct {
+		name      string
+		remote    net.Addr
+		bufsize   uint16
+		truncated bool
+	}{
+		{"UDP", udpClient, 0, true},
+		{"UDP with a small EDNS0 buffer", udpClient, 256, true},
+		{"UDP with a large EDNS0 buffer", udpClient, 4096, false},
+		{"TCP", tcpClient, 0, false},
+	}
+	for _, tt := range tests {
+		r := new(dns.Msg)
+		r.SetQuestion("ns.example.com.", dns.TypeA)
+		size := dns.MinMsgSize
+		if tt.bufsize > 0 {
+			r.SetEdns0(tt.bufsize, false)
+			if tt.bufsize > dns.MinMsgSize {
+				size = int(tt.bufsize)
+			}
+		}
+		m := exchange(t, tt.remote, r)
+		if m.Truncated != tt.truncated {
+			t.Errorf("%s: TC = %v, want %v", tt.name, m.Truncated, tt.truncated)
+		}
+		if tt.truncated && (len(m.Answer) == 0 || len(m.Answer) >= len(members)) {
+			t.Errorf("%s: %d answers for %d members", tt.name, len(m.Answer), len(members))
+		}
+		if !tt.truncated && len(m.Answer) != len(members) {
+			t.Errorf("%s: %d answers, want %d", tt.name, len(m.Answer), len(members))
+		}
+		if _, udp := tt.remote.(*net.UDPAddr); udp && m.Len() > size {
+			t.Errorf("%s: reply of %d bytes for a buffer of %d", tt.name, m.Len(), size)
+		}
+	}
+}
+
+func TestQueryRRSet(t *testing.T) {
+	useMemStore(t)
+	storeRRs(t, "www.example.com. 300 IN A 10.0.0.1", "www.example.com. 300 IN A 10.0.0.2")
+	r := new(dns.Msg)
+	r.SetQuestion("WWW.example.com.", dns.TypeA)
+	if m := exchange(t, udpClient, r); m.Rcode != dns.RcodeSuccess || len(m.Answer) != 2 {
+		t.Errorf("A query = %v, %d answers, want all the RRSet", dns.RcodeToString[m.Rcode], len(m.Answer))
+	}
+
+	// An update deletes a single member of the RRSet
+	u := new(dns.Msg)
+	u.SetUpdate("example.com.")
+	u.Remove([]dns.RR{mustRR("www.example.com. 0 IN A 10.0.0.1")})
+	if m := exchange(t, udpClient, u); m.Rcode != dns.RcodeSuccess {
+		t.Fatalf("update = %v", dns.RcodeToString[m.Rcode])
+	}
+	if m := exchange(t, udpClient, r); len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "10.0.0.2" {
+		t.Errorf("A query after the update = %v", m.Answer)
+	}
+}
+
+func TestLookupCNAME(t *testing.T) {
+	useMemStore(t)
+	storeRRs(t,
+		"www.example.com. 300 IN CNAME web.example.com.",
+		"web.example.com. 300 IN CNAME host.example.com.",
+		"host.example.com. 300 IN A 10.0.0.1",
+		"ext.example.com. 300 IN CNAME www.example.org.",
+		"loop1.example.com. 300 IN CNAME loop2.example.com.",
+		"loop2.example.com. 300 IN CNAME loop1.example.com.",
+		"c0.example.com. 300 IN CNAME c1.example.com.",
+		"c1.example.com. 300 IN CNAME c2.example.com.",
+		"c2.example.com. 300 IN CNAME c3.example.com.",
+		"c3.example.com. 300 IN CNAME c4.example.com.",
+		"c4.example.com. 300 IN CNAME c5.example.com.",
+		"c5.example.com. 300 IN CNAME c6.example.com.",
+		"c6.example.com. 300 IN CNAME c7.example.com.",
+		"c7.example.com. 300 IN CNAME c8.example.com.",
+		"c8.example.com. 300 IN CNAME c9.example.com.",
+	)
+	tests := []struct {
+		qname string
+		qtype uint16
+		rcode int
+		want  []string
+	}{
+		{"www.example.com.", dns.TypeA, dns.RcodeSuccess, []string{
+			"www.example.com. 300 IN CNAME web.example.com.",
+			"web.example.com. 300 IN CNAME host.example.com.",
+			"host.example.com. 300 IN A 10.0.0.1",
+		}},
+		{"www.example.com.", dns.TypeCNAME, dns.RcodeSuccess, []string{"www.example.com. 300 IN CNAME web.example.com."}},
+		{"host.example.com.", dns.TypeA, dns.RcodeSuccess, []string{"host.example.com. 300 IN A 10.0.0.1"}},
+		// Out of zone targets are left to the resolver
+		{"ext.example.com.", dns.TypeA, dns.RcodeSuccess, []string{"ext.example.com. 300 IN CNAME www.example.org."}},
+		{"www.example.com.", dns.TypeAAAA, dns.RcodeSuccess, []string{
+			"www.example.com. 300 IN CNAME web.example.com.",
+			"web.example.com. 300 IN CNAME host.example.com.",
+		}},
+		{"none.example.com.", dns.TypeA, dns.RcodeNameError, []string{}},
+		// The partial chain isn't sent when it loops or is too long
+		{"loop1.example.com.", dns.TypeA, dns.RcodeServerFailure, []string{}},
+		{"c0.example.com.", dns.TypeA, dns.RcodeServerFailure, []string{}},
+		{"c2.example.com.", dns.TypeTXT, dns.RcodeSuccess, []string{
+			"c2.example.com. 300 IN CNAME c3.example.com.",
+			"c3.example.com. 300 IN CNAME c4.example.com.",
+			"c4.example.com. 300 IN CNAME c5.example.com.",
+			"c5.example.com. 300 IN CNAME c6.example.com.",
+			"c6.example.com. 300 IN CNAME c7.example.com.",
+			"c7.example.com. 300 IN CNAME c8.example.com.",
+			"c8.example.com. 300 IN CNAME c9.example.com.",
+		}},
+	}
+	for _, tt := range tests {
+		r := new(dns.Msg)
+		r.SetQuestion(tt.qname, tt.qtype)
+		m := exchange(t, udpClient, r)
+		if got, want := answers(m), canonicalRRs(tt.want...); m.Rcode != tt.rcode || !reflect.DeepEqual(got, want) {
+			t.Errorf("%v %v = %v %q, want %v %q", tt.qname, dns.TypeToString[tt.qtype],
+				dns.RcodeToString[m.Rcode], got, dns.RcodeToString[tt.rcode], want)
+		}
+	}
+
+	// A record added beside a CNAME is silently ignored (RFC 2136, 3.4.2.2)
+	u := new(dns.Msg)
+	u.SetUpdate("example.com.")
+	u.Insert([]dns.RR{mustRR("www.example.com. 300 IN A 10.0.0.2")})
+	if m := exchange(t, udpClient, u); m.Rcode != dns.RcodeSuccess {
+		t.Errorf("update = %v", dns.RcodeToString[m.Rcode])
+	}
+	if _, err := addd.GetRRSet("www.example.com", "A"); err == nil {
+		t.Error("A record stored beside a CNAME")
+	}
+}
+
+func TestLookupGlue(t *testing.T) {
+	useMemStore(t)
+	storeRRs(t,
+		"example.com. 300 IN MX 10 mail.example.com.",
+		"example.com. 300 IN MX 20 mx.example.org.",
+		"mail.example.com. 300 IN A 10.0.0.1",
+		"mail.example.com. 300 IN AAAA 2001:db8::1",
+		"_sip._tcp.example.com. 300 IN SRV 10 60 5060 sip.example.com.",
+		"sip.example.com. 300 IN A 10.0.0.2",
+	)
+	tests := []struct {
+		qname string
+		qtype uint16
+		extra []string
+	}{
+		{"example.com.", dns.TypeMX, []string{"mail.example.com. 300 IN A 10.0.0.1", "mail.example.com. 300 IN AAAA 2001:db8::1"}},
+		{"_sip._tcp.example.com.", dns.TypeSRV, []string{"sip.example.com. 300 IN A 10.0.0.2"}},
+	}
+	for _, tt := range tests {
+		r := new(dns.Msg)
+		r.SetQuestion(tt.qname, tt.qtype)
+		m := exchange(t, udpClient, r)
+		extra := make([]string, 0, len(m.Extra))
+		for _, rr := range m.Extra {
+			extra = append(extra, rr.String())
+		}
+		if m.Rcode != dns.RcodeSuccess || len(m.Answer) == 0 || !reflect.DeepEqual(extra, canonicalRRs(tt.extra...)) {
+			t.Errorf("%v %v = %v, %d answers, additional %q", tt.qname, dns.TypeToString[tt.qtype],
+				dns.RcodeToString[m.Rcode], len(m.Answer), extra)
+		}
+	}
+}
+
+func TestQueryReverse(t *testing.T) {
+	defer addd.SetReverse(nil)
+	useMemStore(t)
+	if err := addd.SetReverse([]string{"10.0.0.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	useZones(t, addd.ReverseZones()...)
+	storeRRs(t, "www.example.com. 300 IN A 10.0.0.1")
+
+	r := new(dns.Msg)
+	r.SetQuestion("1.0.0.10.in-addr.arpa.", dns.TypePTR)
+	m := exchange(t, udpClient, r)
+	if want := canonicalRRs("1.0.0.10.in-addr.arpa. 300 IN PTR www.example.com."); !reflect.DeepEqual(answers(m), want) {
+		t.Errorf("PTR query = %q, want %q", answers(m), want)
+	}
+	if len(m.Ns) != 1 || m.Ns[0].Header().Name != "0.0.10.in-addr.arpa." {
+		t.Errorf("PTR query authority = %v", m.Ns)
+	}
+}
+
+func TestLookupWildcard(t *testing.T) {
+	useMemStore(t)
+	storeRRs(t,
+		"*.example.com. 300 IN A 10.0.0.1",
+		"*.example.com. 300 IN TXT \"wild\"",
+		"www.example.com. 300 IN A 10.0.0.2",
+		"*.dyn.example.com. 300 IN CNAME www.example.com.",
+	)
+	tests := []struct {
+		qname string
+		qtype uint16
+		rcode int
+		want  []string
+	}{
+		{"foo.example.com.", dns.TypeA, dns.RcodeSuccess, []string{"foo.example.com. 300 IN A 10.0.0.1"}},
+		{"a.b.example.com.", dns.TypeTXT, dns.RcodeSuccess, []string{"a.b.example.com. 300 IN TXT \"wild\""}},
+		// Explicit records take precedence over wildcards
+		{"www.example.com.", dns.TypeA, dns.RcodeSuccess, []string{"www.example.com. 300 IN A 10.0.0.2"}},
+		{"www.example.com.", dns.TypeTXT, dns.RcodeSuccess, []string{}},
+		{"foo.example.com.", dns.TypeMX, dns.RcodeSuccess, []string{}},
+		{"host.dyn.example.com.", dns.TypeA, dns.RcodeSuccess, []string{
+			"host.dyn.example.com. 300 IN CNAME www.example.com.",
+			"www.example.com. 300 IN A 10.0.0.2",
+		}},
+	}
+	for _, tt := range tests {
+		r := new(dns.Msg)
+		r.SetQuestion(tt.qname, tt.qtype)
+		m := exchange(t, udpClient, r)
+		if got, want := answers(m), canonicalRRs(tt.want...); m.Rcode != tt.rcode || !reflect.DeepEqual(got, want) {
+			t.Errorf("%v %v = %v %q, want %v %q", tt.qname, dns.TypeToString[tt.qtype],
+				dns.RcodeToString[m.Rcode], got, dns.RcodeToString[tt.rcode], want)
+		}
+	}
+}
+
+func TestQueryNoData(t *testing.T) {
+	useMemStore(t)
+	storeRRs(t,
+		"www.example.com. 300 IN A 10.0.0.1",
+		"host.sub.example.com. 300 IN A 10.0.0.2",
+		"*.example.com. 300 IN TXT \"wild\"",
+	)
+	tests := []struct {
+		qname string
+		qtype uint16
+		rcode int
+	}{
+		{"www.example.com.", dns.TypeAAAA, dns.RcodeSuccess},
+		{"www.example.com.", dns.TypeHINFO, dns.RcodeSuccess},
+		{"www.example.com.", dns.TypeSOA, dns.RcodeSuccess},
+		// Empty non-terminal
+		{"sub.example.com.", dns.TypeA, dns.RcodeSuccess},
+		{"example.com.", dns.TypeA, dns.RcodeSuccess},
+		{"ns.example.com.", dns.TypeAAAA, dns.RcodeSuccess},
+		{"none.sub.example.com.", dns.TypeA, dns.RcodeNameError},
+		{"none.sub.example.com.", dns.TypeNS, dns.RcodeNameError},
+		{"*.sub.example.com.", dns.TypeA, dns.RcodeNameError},
+	}
+	for _, tt := range tests {
+		r := new(dns.Msg)
+		r.SetQuestion(tt.qname, tt.qtype)
+		m := exchange(t, udpClient, r)
+		if m.Rcode != tt.rcode || len(m.Answer) != 0 {
+			t.Errorf("%v %v = %v, %d answers, want %v", tt.qname, dns.TypeToString[tt.qtype],
+				dns.RcodeToString[m.Rcode], len(m.Answer), dns.RcodeToString[tt.rcode])
+		}
+		// The SOA of the zone is sent for negative caching
+		if len(m.Ns) != 1 || m.Ns[0].Header().Rrtype != dns.TypeSOA {
+			t.Errorf("%v %v authority = %v", tt.qname, dns.TypeToString[tt.qtype], m.Ns)
+		}
+	}
+}
+
+func TestSOASerial(t *testing.T) {
+	useMemStore(t)
+	r := new(dns.Msg)
+	r.SetQuestion("example.com.", dns.TypeSOA)
+	serial := func() uint32 {
+		m := exchange(t, udpClient, r)
+		if len(m.Answer) != 1 {
+			t.Fatalf("SOA query = %v", m.Answer)
+		}
+		return m.Answer[0].(*dns.SOA).Serial
+	}
+	before := serial()
+	storeRRs(t, "www.example.com. 300 IN A 10.0.0.1")
+	if after := serial(); after != before+1 {
+		t.Errorf("serial %v => %v after a change", before, after)
+	}
+}
+
+func TestSignReply(t *testing.T) {
+	useMemStore(t)
+	for _, spec := range []string{"md5.example.com:c2VjcmV0", "sha.example.com:hmac-sha256:c2VjcmV0"} {
+		key, err := addd.ParseTsigKey(spec)
+		if err == nil {
+			err = addd.StoreTsigKey(key)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		keyname, algorithm string
+		tsig               error
+		signed             bool
+	}{
+		{"sha.example.com.", dns.HmacSHA256, nil, true},
+		{"md5.example.com.", dns.HmacMD5, nil, true},
+		{"sha.example.com.", dns.HmacSHA256, dns.ErrSig, false},
+		{"sha.example.com.", dns.HmacMD5, nil, false},
+		{"none.example.com.", dns.HmacSHA256, nil, false},
+	}
+	for _, tt := range tests {
+		r := new(dns.Msg)
+		r.SetQuestion("example.com.", dns.TypeSOA)
+		r.SetTsig(tt.keyname, tt.algorithm, 300, time.Now().Unix())
+		w := &testWriter{remote: udpClient, tsig: tt.tsig}
+		receive(w, r)
+		got := w.msg.IsTsig()
+		switch {
+		case tt.signed && (got == nil || got.Hdr.Name != tt.keyname || got.Algorithm != tt.algorithm):
+			t.Errorf("reply to %v %v signed with %v", tt.keyname, tt.algorithm, got)
+		case !tt.signed && got != nil:
+			t.Errorf("reply to %v %v (%v) signed", tt.keyname, tt.algorithm, tt.tsig)
+		}
+	}
+}
+
+func TestTruncateKeepsOPT(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("www.example.com.", dns.TypeA)
+	for i := 1; i <= 3; i++ {
+		m.Extra = append(m.Extra, mustRR(fmt.Sprintf("ns.example.com. 300 IN A 10.0.1.%d", i)))
+	}
+	m.SetEdns0(1232, true)
+	size := m.Len() - 1
+	truncate(m, size)
+	if len(m.Extra) != 3 || m.IsEdns0() == nil || m.Truncated {
+		t.Errorf("truncate(%d) left %v, TC %v", size, m.Extra, m.Truncated)
+	}
+}
+
+func TestEdns(t *testing.T) {
+	useMemStore(t)
+	defer SetEdnsSize(ednsSize)
+
+	r := new(dns.Msg)
+	r.SetQuestion("ns.example.com.", dns.TypeA)
+	if m := exchange(t, udpClient, r); m.IsEdns0() != nil {
+		t.Errorf("OPT replied to a request without: %v", m.IsEdns0())
+	}
+	r.SetEdns0(4096, true)
+	m := exchange(t, udpClient, r)
+	if opt := m.IsEdns0(); opt == nil || !opt.Do() || opt.UDPSize() != 1232 || m.Rcode != dns.RcodeSuccess {
+		t.Errorf("reply to EDNS0 = %v %v", dns.RcodeToString[m.Rcode], opt)
+	}
+
+	// The client's buffer is limited to ours
+	SetEdnsSize(100)
+	if got := ednsSize; got != dns.MinMsgSize {
+		t.Errorf("SetEdnsSize(100) = %v", got)
+	}
+	SetEdnsSize(1400)
+	if got := udpSize(r); got != 1400 {
+		t.Errorf("udpSize() = %v, want 1400", got)
+	}
+
+	// Only the version 0 is known
+	r.IsEdns0().SetVersion(1)
+	m = exchange(t, udpClient, r)
+	if m.Rcode != dns.RcodeBadVers || m.IsEdns0() == nil || len(m.Answer) > 0 {
+		t.Errorf("reply to EDNS1 = %v %v", dns.RcodeToString[m.Rcode], m)
+	}
+}
+
+func TestEdnsTsigRoom(t *testing.T) {
+	members := make([]string, 0, 40)
+	for i := 1; i <= cap(members); i++ {
+		members = append(members, fmt.Sprintf("10.0.0.%d", i))
+	}
+	useMemStore(t, members...)
+	key, err := addd.ParseTsigKey("key.example.com:hmac-sha256:c2VjcmV0")
+	if err == nil {
+		err = addd.StoreTsigKey(key)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := new(dns.Msg)
+	r.SetQuestion("ns.example.com.", dns.TypeA)
+	r.SetEdns0(600, false)
+	r.SetTsig("key.example.com.", dns.HmacSHA256, 300, time.Now().Unix())
+	// Signed, the room kept depends on the size of its MAC
+	buf, _, err := dns.TsigGenerate(r, key.Secret, "", false)
+	if err == nil {
+		err = r.Unpack(buf)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := exchange(t, udpClient, r)
+	if !m.Truncated || m.IsTsig() == nil {
+		t.Fatalf("signed reply TC %v, TSIG %v", m.Truncated, m.IsTsig())
+	}
+	if m.IsEdns0() == nil {
+		t.Error("OPT dropped from the truncated reply")
+	}
+	// Its names were compressed to fit
+	if m.Compress = true; m.Len() > 600 {
+		t.Errorf("signed reply of %d bytes for a buffer of 600", m.Len())
+	}
+}
@@ -0,0 +1,82 @@
+package ddns
+
+import (
+	"crypto/tls"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redsux/addd/core"
+)
+
+var (
+	dotAddr   string
+	dotConfig *tls.Config
+)
+
+// certLoader provides the certificate read from its files, reloaded when they change
+type certLoader struct {
+	certFile, keyFile string
+	lock              sync.Mutex
+	cert              *tls.Certificate
+	modified          time.Time
+}
+
+// SetDoT enables our DNS-over-TLS listener (RFC 7858) on port with the certificate/key pair
+// read from certFile and keyFile, they are reloaded when modified
+func SetDoT(port int, certFile, keyFile string) error {
+	loader := &certLoader{certFile: certFile, keyFile: keyFile}
+	if _, err := loader.load(); err != nil {
+		return err
+	}
+	dotAddr = ":" + strconv.Itoa(port)
+	dotConfig = &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return loader.load()
+		},
+	}
+	return nil
+}
+
+// load returns our certificate, read again if one of its files changed since the last time
+func (l *certLoader) load() (*tls.Certificate, error) {
+	modified, err := lastModified(l.certFile, l.keyFile)
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if err != nil || !modified.After(l.modified) {
+		if l.cert == nil {
+			return nil, err
+		}
+		// Keep the current certificate while its files are being replaced
+		return l.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		if l.cert == nil {
+			return nil, err
+		}
+		addd.Log.WarningF("[DNS] Couldn't reload the DoT certificate : %v", err)
+		return l.cert, nil
+	}
+	if l.cert != nil {
+		addd.Log.Notice("[DNS] DoT certificate reloaded")
+	}
+	l.cert, l.modified = &cert, modified
+	return l.cert, nil
+}
+
+// lastModified returns the most recent modification time of files
+func lastModified(files ...string) (last time.Time, err error) {
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return last, err
+		}
+		if info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+	}
+	return last, nil
+}
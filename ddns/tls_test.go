@@ -0,0 +1,109 @@
+package ddns
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert writes a new self-signed certificate for name and its key in dir, modified at mtime
+func writeCert(t *testing.T, dir, name string, mtime time.Time) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]*pem.Block{
+		"cert.pem": {Type: "CERTIFICATE", Bytes: der},
+		"key.pem":  {Type: "EC PRIVATE KEY", Bytes: key},
+	}
+	for file, block := range files {
+		path := filepath.Join(dir, file)
+		if err := ioutil.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// certName returns the name of the certificate provided by our DoT configuration
+func certName(t *testing.T) string {
+	cert, err := dotConfig.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestSetDoT(t *testing.T) {
+	dir, err := ioutil.TempDir("", "addd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() { dotAddr, dotConfig = "", nil }()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	if err := SetDoT(853, certFile, keyFile); err == nil || dotConfig != nil {
+		t.Error("DoT enabled without certificate")
+	}
+	now := time.Now()
+	writeCert(t, dir, "old.example.com", now.Add(-time.Minute))
+	if err := SetDoT(853, certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	if dotAddr != ":853" || dotConfig.MinVersion != tls.VersionTLS12 {
+		t.Errorf("SetDoT() = %v %+v", dotAddr, dotConfig)
+	}
+	if name := certName(t); name != "old.example.com" {
+		t.Errorf("certificate of %v, want old.example.com", name)
+	}
+
+	// The certificate is reloaded once modified
+	writeCert(t, dir, "new.example.com", now)
+	if name := certName(t); name != "new.example.com" {
+		t.Errorf("certificate of %v after its renewal, want new.example.com", name)
+	}
+	// A certificate being replaced is kept
+	if err := ioutil.WriteFile(keyFile, []byte("partial"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(keyFile, now.Add(time.Minute), now.Add(time.Minute))
+	if name := certName(t); name != "new.example.com" {
+		t.Errorf("certificate of %v while invalid, want new.example.com", name)
+	}
+	os.Remove(certFile)
+	if name := certName(t); name != "new.example.com" {
+		t.Errorf("certificate of %v while missing, want new.example.com", name)
+	}
+}
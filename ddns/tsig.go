@@ -0,0 +1,70 @@
+package ddns
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/redsux/addd/core"
+)
+
+// tsigHashes are the hashes of the HMAC algorithms of our keys
+var tsigHashes = map[string]func() hash.Hash{
+	dns.HmacMD5:    md5.New,
+	dns.HmacSHA1:   sha1.New,
+	dns.HmacSHA256: sha256.New,
+	dns.HmacSHA512: sha512.New,
+}
+
+// tsigProvider is the dns.TsigProvider of our servers, it signs and verifies the TSIG
+// with our keys as they are when each message is handled, so the servers don't have to be restarted
+// when our keys change. The framing of the messages and the time checks are left to miekg/dns.
+type tsigProvider struct{}
+
+// Generate implements dns.TsigProvider, it returns the MAC of msg with the key of t
+func (tsigProvider) Generate(msg []byte, t *dns.TSIG) ([]byte, error) {
+	key, err := addd.GetTsigKey(t.Hdr.Name)
+	if err != nil {
+		return nil, dns.ErrSecret
+	}
+	newHash, ok := tsigHashes[strings.ToLower(t.Algorithm)]
+	if !ok || !strings.EqualFold(key.Algorithm, t.Algorithm) {
+		return nil, dns.ErrKeyAlg
+	}
+	secret, err := base64.StdEncoding.DecodeString(key.Secret)
+	if err != nil {
+		return nil, dns.ErrSecret
+	}
+	h := hmac.New(newHash, secret)
+	h.Write(msg)
+	return h.Sum(nil), nil
+}
+
+// Verify implements dns.TsigProvider, it checks the MAC of t is the one of msg with its key
+func (p tsigProvider) Verify(msg []byte, t *dns.TSIG) error {
+	want, err := p.Generate(msg, t)
+	if err != nil {
+		return err
+	}
+	mac, err := hex.DecodeString(t.MAC)
+	if err != nil || !hmac.Equal(mac, want) {
+		return dns.ErrSig
+	}
+	return nil
+}
+
+// acceptMsg is the dns.MsgAcceptFunc of our servers, every request reaches our handler
+// which checks it depending on its opcode. Responses are ignored.
+func acceptMsg(dh dns.Header) dns.MsgAcceptAction {
+	if dh.Bits&(1<<15) != 0 {
+		return dns.MsgIgnore
+	}
+	return dns.MsgAccept
+}
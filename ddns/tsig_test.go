@@ -0,0 +1,247 @@
+package ddns
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/redsux/addd/core"
+)
+
+// signedPacket returns r packed and signed with keyname and secret, at the time signed
+func signedPacket(t *testing.T, r *dns.Msg, keyname, secret string, signed time.Time) []byte {
+	r.SetTsig(keyname, dns.HmacSHA256, 300, signed.Unix())
+	buf, _, err := dns.TsigGenerate(r, secret, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+// replyMAC returns the MAC of the signed reply m to a request whose MAC is reqMAC, computed again with our keys
+func replyMAC(t *testing.T, m *dns.Msg, reqMAC string) string {
+	m = m.Copy()
+	rt := m.IsTsig()
+	rt.MAC, rt.MACSize = "", 0
+	_, mac, err := dns.TsigGenerateWithProvider(m, tsigProvider{}, reqMAC, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mac
+}
+
+// serveUDP starts a UDP server as Serve does, and returns its address
+func serveUDP(t *testing.T) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{
+		PacketConn:    pc,
+		TsigProvider:  tsigProvider{},
+		MsgAcceptFunc: acceptMsg,
+		Handler:       dns.HandlerFunc(handleDNSRequest),
+	}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+// sendPacket sends the packed message buf to addr and returns its reply, unpacked and as received
+func sendPacket(t *testing.T, addr string, buf []byte) (*dns.Msg, []byte) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, dns.MaxMsgSize)
+	n, err := conn.Read(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(reply[:n]); err != nil {
+		t.Fatal(err)
+	}
+	return m, reply[:n]
+}
+
+// useTsigKey stores the TSIG key of spec
+func useTsigKey(t *testing.T, spec string) *addd.TsigKey {
+	key, err := addd.ParseTsigKey(spec)
+	if err == nil {
+		err = addd.StoreTsigKey(key)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestTsigProvider(t *testing.T) {
+	useMemStore(t)
+	key := useTsigKey(t, "key.example.com:hmac-sha256:c2VjcmV0")
+	query := func() *dns.Msg {
+		r := new(dns.Msg)
+		r.SetQuestion("www.example.com.", dns.TypeA)
+		return r
+	}
+
+	tests := []struct {
+		name, keyname, secret string
+		signed                time.Time
+		err                   error
+	}{
+		{"valid", "key.example.com.", "c2VjcmV0", time.Now(), nil},
+		{"other secret", "key.example.com.", "b3RoZXI=", time.Now(), dns.ErrSig},
+		{"unknown key", "none.example.com.", "c2VjcmV0", time.Now(), dns.ErrSecret},
+		{"out of the fudge", "key.example.com.", "c2VjcmV0", time.Now().Add(-time.Hour), dns.ErrTime},
+		{"out of the fudge with another secret", "key.example.com.", "b3RoZXI=", time.Now().Add(-time.Hour), dns.ErrSig},
+	}
+	for _, tt := range tests {
+		buf := signedPacket(t, query(), tt.keyname, tt.secret, tt.signed)
+		if err := dns.TsigVerifyWithProvider(buf, tsigProvider{}, "", false); err != tt.err {
+			t.Errorf("%s: TsigVerifyWithProvider() = %v, want %v", tt.name, err, tt.err)
+		}
+	}
+
+	// The algorithm must be the one of the key
+	r := query()
+	r.SetTsig("key.example.com.", dns.HmacSHA1, 300, time.Now().Unix())
+	if _, _, err := dns.TsigGenerateWithProvider(r, tsigProvider{}, "", false); err != dns.ErrKeyAlg {
+		t.Errorf("TsigGenerateWithProvider() with another algorithm = %v", err)
+	}
+
+	// A key changed is used as soon as stored
+	key.Secret = "b3RoZXI="
+	if err := addd.StoreTsigKey(key); err != nil {
+		t.Fatal(err)
+	}
+	if err := dns.TsigVerifyWithProvider(signedPacket(t, query(), "key.example.com.", "b3RoZXI=", time.Now()), tsigProvider{}, "", false); err != nil {
+		t.Errorf("query signed with the new secret: %v", err)
+	}
+	if err := dns.TsigVerifyWithProvider(signedPacket(t, query(), "key.example.com.", "c2VjcmV0", time.Now()), tsigProvider{}, "", false); err != dns.ErrSig {
+		t.Errorf("query signed with the old secret: %v", err)
+	}
+}
+
+func TestServeTsig(t *testing.T) {
+	useMemStore(t)
+	key := useTsigKey(t, "key.example.com:hmac-sha256:c2VjcmV0")
+	storeRRs(t, "www.example.com. 300 IN A 10.0.0.1")
+	addr := serveUDP(t)
+
+	query := func() *dns.Msg {
+		r := new(dns.Msg)
+		r.SetQuestion("www.example.com.", dns.TypeA)
+		return r
+	}
+	valid := signedPacket(t, query(), "key.example.com.", "c2VjcmV0", time.Now())
+	tampered := append([]byte{}, valid...)
+	tampered[2] ^= 1 // RD
+
+	tests := []struct {
+		name   string
+		buf    []byte
+		signed bool
+	}{
+		{"valid", valid, true},
+		// Whatever the error field of its TSIG says
+		{"other secret", signedPacket(t, query(), "key.example.com.", "b3RoZXI=", time.Now()), false},
+		{"tampered", tampered, false},
+		{"replayed out of the fudge", signedPacket(t, query(), "key.example.com.", "c2VjcmV0", time.Now().Add(-time.Hour)), false},
+		{"unknown key", signedPacket(t, query(), "none.example.com.", "c2VjcmV0", time.Now()), false},
+	}
+	r := new(dns.Msg)
+	if err := r.Unpack(valid); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		m, reply := sendPacket(t, addr, tt.buf)
+		rt := m.IsTsig()
+		switch {
+		case (rt != nil) != tt.signed || len(m.Answer) != 1:
+			t.Errorf("%s: reply %v, TSIG %v", tt.name, m.Answer, rt)
+		case tt.signed:
+			if err := dns.TsigVerify(reply, "c2VjcmV0", r.IsTsig().MAC, false); err != nil {
+				t.Errorf("%s: reply badly signed: %v", tt.name, err)
+			}
+		}
+	}
+
+	// Identical requests are verified on their own, a replay within the fudge is valid (RFC 8945, 5.2.3)
+	var wg sync.WaitGroup
+	replies := make([]*dns.Msg, 4)
+	for i := range replies {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			replies[i], _ = sendPacket(t, addr, valid)
+		}(i)
+	}
+	wg.Wait()
+	for i, m := range replies {
+		if rt := m.IsTsig(); rt == nil || rt.MAC == "" || len(m.Answer) != 1 {
+			t.Errorf("replay %d: reply %v, TSIG %v", i, m.Answer, rt)
+		}
+	}
+
+	// A key changed is used by the running server
+	key.Secret = "b3RoZXI="
+	if err := addd.StoreTsigKey(key); err != nil {
+		t.Fatal(err)
+	}
+	if m, _ := sendPacket(t, addr, valid); m.IsTsig() != nil {
+		t.Errorf("request signed with the old secret: reply signed %v", m.IsTsig())
+	}
+	if m, _ := sendPacket(t, addr, signedPacket(t, query(), "key.example.com.", "b3RoZXI=", time.Now())); m.IsTsig() == nil {
+		t.Error("request signed with the new secret: reply not signed")
+	}
+}
+
+func TestServeSignedUpdate(t *testing.T) {
+	useMemStore(t)
+	useTsigKey(t, "key.example.com:hmac-sha256:c2VjcmV0")
+	if err := SetUpdateAuth(true, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { updateSigned, updateNets = false, []*net.IPNet{} }()
+	addr := serveUDP(t)
+
+	update := func(address string) *dns.Msg {
+		u := new(dns.Msg)
+		u.SetUpdate("example.com.")
+		u.Insert([]dns.RR{mustRR("www.example.com. 300 IN A " + address)})
+		return u
+	}
+	tampered := signedPacket(t, update("10.0.0.1"), "key.example.com.", "c2VjcmV0", time.Now())
+	tampered[bytes.Index(tampered, net.IPv4(10, 0, 0, 1).To4())+3] = 2
+
+	tests := []struct {
+		name    string
+		buf     []byte
+		rcode   int
+		tsigErr int
+	}{
+		{"tampered", tampered, dns.RcodeNotAuth, dns.RcodeBadSig},
+		{"replayed out of the fudge", signedPacket(t, update("10.0.0.3"), "key.example.com.", "c2VjcmV0", time.Now().Add(-time.Hour)), dns.RcodeNotAuth, dns.RcodeBadTime},
+		{"valid", signedPacket(t, update("10.0.0.4"), "key.example.com.", "c2VjcmV0", time.Now()), dns.RcodeSuccess, dns.RcodeSuccess},
+	}
+	for _, tt := range tests {
+		m, _ := sendPacket(t, addr, tt.buf)
+		if rt := m.IsTsig(); m.Rcode != tt.rcode || rt == nil || int(rt.Error) != tt.tsigErr {
+			t.Errorf("%s: update = %v, TSIG %v", tt.name, dns.RcodeToString[m.Rcode], rt)
+		}
+	}
+	set, err := addd.GetRRSet("www.example.com", "A")
+	if err != nil || len(set.Records) != 1 || set.Records[0].Data() != "10.0.0.4" {
+		t.Errorf("records = %v, %v, want the valid update only", set, err)
+	}
+}
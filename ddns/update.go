@@ -0,0 +1,396 @@
+package ddns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/redsux/addd/core"
+)
+
+var (
+	// errUpdateRcode aborts the commit of an update refused with a rcode
+	errUpdateRcode = errors.New("Update refused")
+
+	updateSigned bool
+	updateNets   = []*net.IPNet{}
+)
+
+// SetUpdateAuth defines if dynamic updates must be signed by one of our TSIG keys,
+// except the unsigned ones sent from nets (CIDR)
+func SetUpdateAuth(signed bool, nets []string) error {
+	updateSigned = signed
+	for _, cidr := range nets {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("Invalid update network %v", cidr)
+		}
+		updateNets = append(updateNets, ipnet)
+	}
+	return nil
+}
+
+// authUpdate returns true if the update r may be processed, else the refusal has been sent :
+// NOTAUTH for an unsigned update, NOTAUTH with the TSIG error (RFC 2845, 4.5) for a bad signature
+func authUpdate(w dns.ResponseWriter, r *dns.Msg) bool {
+	if !updateSigned {
+		return true
+	}
+	t := r.IsTsig()
+	if t == nil {
+		if ip := remoteIP(w); ip != nil {
+			for _, ipnet := range updateNets {
+				if ipnet.Contains(ip) {
+					return true
+				}
+			}
+		}
+		addd.Log.WarningF("[DNS] Unsigned update refused to %v", w.RemoteAddr())
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeNotAuth)
+		w.WriteMsg(m)
+		return false
+	}
+	err := tsigStatus(w, r)
+	if err == nil {
+		return true
+	}
+	addd.Log.WarningF("[DNS] Update signed by %v refused to %v : %v", t.Hdr.Name, w.RemoteAddr(), err)
+
+	tsigErr := dns.RcodeBadSig
+	switch err {
+	case dns.ErrSecret, dns.ErrKeyAlg:
+		tsigErr = dns.RcodeBadKey
+	case dns.ErrTime:
+		tsigErr = dns.RcodeBadTime
+	}
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeNotAuth)
+	now := time.Now().Unix()
+	rt := &dns.TSIG{
+		Hdr: dns.RR_Header{
+			Name:   t.Hdr.Name,
+			Rrtype: dns.TypeTSIG,
+			Class:  dns.ClassANY,
+		},
+		Algorithm:  t.Algorithm,
+		TimeSigned: uint64(now),
+		Fudge:      t.Fudge,
+		OrigId:     r.Id,
+		Error:      uint16(tsigErr),
+	}
+	if tsigErr == dns.RcodeBadTime {
+		// Our time, for the client to check its clock (RFC 8945, 5.2.3)
+		rt.OtherLen, rt.OtherData = 6, fmt.Sprintf("%012x", now)
+	}
+	// Our servers sign the BADTIME reply only, the other ones keep a TSIG without MAC (RFC 8945, 5.3.2)
+	m.Extra = append(m.Extra, rt)
+	w.WriteMsg(m)
+	return false
+}
+
+// updateZone processes an UPDATE message (RFC 2136, 3) signed by key (nil if unsigned) and returns its rcode
+func updateZone(zone *addd.Zone, r *dns.Msg, key *addd.TsigKey) int {
+	// Zone section (RFC 2136, 3.1)
+	if len(r.Question) != 1 || r.Question[0].Qtype != dns.TypeSOA {
+		return dns.RcodeFormatError
+	}
+	if zone.Name != strings.ToLower(r.Question[0].Name) {
+		return dns.RcodeNotAuth
+	}
+
+	// Prerequisites are evaluated and all the changes committed at once (RFC 2136, 3.4.2),
+	// no other change can happen in between
+	rcode := dns.RcodeSuccess
+	batch := addd.NewBatch()
+	batch.Do(func(s *addd.Stage) error {
+		if rcode = checkPrereq(s, zone, r.Answer); rcode != dns.RcodeSuccess {
+			addd.Log.NoticeF("[DNS] Update of %v refused by prerequisites : %v", zone.Name, dns.RcodeToString[rcode])
+			return errUpdateRcode
+		}
+		if rcode = prescanUpdate(zone, r.Ns); rcode != dns.RcodeSuccess {
+			return errUpdateRcode
+		}
+		if rcode = checkPolicy(key, r.Ns); rcode != dns.RcodeSuccess {
+			return errUpdateRcode
+		}
+		for _, rr := range r.Ns {
+			if rcode = stageUpdate(s, rr); rcode != dns.RcodeSuccess {
+				return errUpdateRcode
+			}
+		}
+		return nil
+	})
+	if err := batch.Commit(); err == errUpdateRcode {
+		return rcode
+	} else if err != nil {
+		addd.Log.ErrorF("[DNS] Impossible to update %v", zone.Name)
+		addd.Log.DebugF("[DNS] %v", err)
+		return dns.RcodeServerFailure
+	}
+	return dns.RcodeSuccess
+}
+
+// checkPrereq evaluates the prerequisite section (RFC 2136, 3.2) against the RRSets of s
+func checkPrereq(s *addd.Stage, zone *addd.Zone, prereqs []dns.RR) int {
+	// Value dependent prerequisites are compared by RRSet (RFC 2136, 3.2.5)
+	wanted := make(map[string][]dns.RR)
+	keys := make([]string, 0)
+
+	for _, rr := range prereqs {
+		header := rr.Header()
+		name := strings.ToLower(header.Name)
+		if header.Ttl != 0 {
+			return dns.RcodeFormatError
+		}
+		if !dns.IsSubDomain(zone.Name, name) {
+			return dns.RcodeNotZone
+		}
+		switch header.Class {
+		case dns.ClassANY:
+			if header.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+			if header.Rrtype == dns.TypeANY {
+				// Name is in use
+				if !nameInUse(s, zone, name) {
+					return dns.RcodeNameError
+				}
+			} else if len(existing(s, zone, name, header.Rrtype)) == 0 {
+				// RRset exists (value independent)
+				return dns.RcodeNXRrset
+			}
+		case dns.ClassNONE:
+			if header.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+			if header.Rrtype == dns.TypeANY {
+				// Name is not in use
+				if nameInUse(s, zone, name) {
+					return dns.RcodeYXDomain
+				}
+			} else if len(existing(s, zone, name, header.Rrtype)) != 0 {
+				// RRset does not exist
+				return dns.RcodeYXRrset
+			}
+		case dns.ClassINET:
+			// RRset exists (value dependent)
+			key := name + "_" + dns.Type(header.Rrtype).String()
+			if _, ok := wanted[key]; !ok {
+				keys = append(keys, key)
+			}
+			wanted[key] = append(wanted[key], rr)
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+
+	for _, key := range keys {
+		rrs := wanted[key]
+		header := rrs[0].Header()
+		if !sameRRs(rrs, existing(s, zone, strings.ToLower(header.Name), header.Rrtype)) {
+			return dns.RcodeNXRrset
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// prescanUpdate checks the update section before any change (RFC 2136, 3.4.1)
+func prescanUpdate(zone *addd.Zone, updates []dns.RR) int {
+	for _, rr := range updates {
+		header := rr.Header()
+		if !dns.IsSubDomain(zone.Name, header.Name) {
+			return dns.RcodeNotZone
+		}
+		switch header.Class {
+		case dns.ClassINET:
+			if isMetaType(header.Rrtype) || header.Rrtype == dns.TypeANY {
+				return dns.RcodeFormatError
+			}
+		case dns.ClassANY:
+			if header.Ttl != 0 || header.Rdlength != 0 || isMetaType(header.Rrtype) {
+				return dns.RcodeFormatError
+			}
+		case dns.ClassNONE:
+			if header.Ttl != 0 || isMetaType(header.Rrtype) || header.Rrtype == dns.TypeANY {
+				return dns.RcodeFormatError
+			}
+		default:
+			return dns.RcodeFormatError
+		}
+		if isNsName(zone, header.Name) {
+			addd.Log.Warning("[DNS] try to update NS records")
+			return dns.RcodeRefused
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// checkPolicy refuses the whole update if key isn't allowed to change one of its RRSets,
+// or if it isn't validly signed (key is nil) while policies are defined
+func checkPolicy(key *addd.TsigKey, updates []dns.RR) int {
+	if key == nil {
+		if addd.PoliciesEnabled() {
+			addd.Log.Warning("[DNS] Update without a valid signature refused by the update policies")
+			return dns.RcodeRefused
+		}
+		return dns.RcodeSuccess
+	}
+	for _, rr := range updates {
+		header := rr.Header()
+		rtype := dns.Type(header.Rrtype).String()
+		if !key.Allows(header.Name, rtype) {
+			addd.Log.WarningF("[DNS] Update of %v %v refused to key %v by its policies", header.Name, rtype, key.Name)
+			return dns.RcodeRefused
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// updateKey returns the TSIG key which validly signed r, nil if none
+func updateKey(w dns.ResponseWriter, r *dns.Msg) *addd.TsigKey {
+	if t := validTsig(w, r); t != nil {
+		if key, err := addd.GetTsigKey(t.Hdr.Name); err == nil {
+			return key
+		}
+	}
+	return nil
+}
+
+// stageUpdate applies to s the change of one RR of the update section (RFC 2136, 3.4.2)
+func stageUpdate(s *addd.Stage, r dns.RR) int {
+	header := r.Header()
+	rname := header.Name
+	rtype := dns.Type(header.Rrtype).String()
+
+	addd.Log.NoticeF("[DNS] Update %v, %v", rname, rtype)
+
+	// If "update delete" (cf. https://godoc.org/github.com/miekg/dns#hdr-DYNAMIC_UPDATES )
+	// 	3.4.2.6 - Table Of Metavalues Used In Update Section
+	//  	CLASS    TYPE     RDATA    Meaning                     Function
+	// 		---------------------------------------------------------------
+	//  	ANY      ANY      empty    Delete all RRsets from name dns.RemoveName
+	//  	ANY      rrset    empty    Delete an RRset             dns.RemoveRRset
+	//  	NONE     rrset    rr       Delete an RR from RRset     dns.Remove
+	//  	zone     rrset    rr       Add to an RRset             dns.Insert
+	var err error
+	switch {
+	case header.Class == dns.ClassANY && header.Rrtype == dns.TypeANY:
+		err = s.DeleteName(rname)
+	case header.Class == dns.ClassANY:
+		err = s.DeleteRRSet(rname, rtype)
+	case header.Class == dns.ClassNONE:
+		rec, rerr := addd.NewRecordFromDNS(r)
+		if rerr != nil {
+			addd.Log.ErrorF("[DNS] Record creation impossible :  %v.", rerr)
+			return dns.RcodeFormatError
+		}
+		// Deleting a missing RR is not an error (RFC 2136, 3.4.2.4)
+		var set *addd.RRSet
+		if set, err = s.RRSet(rname, rtype); err == nil {
+			set.Remove(rec)
+		}
+	default: // "update add"
+		rec, rerr := addd.NewRecordFromDNS(r)
+		if rerr != nil {
+			addd.Log.ErrorF("[DNS] Record creation impossible :  %v.", rerr)
+			return dns.RcodeFormatError
+		}
+		var sets []*addd.RRSet
+		if sets, err = s.Name(rname); err != nil {
+			break
+		}
+		// CNAME and other data can't coexist, conflicting adds are silently ignored (RFC 2136, 3.4.2.2)
+		for _, set := range sets {
+			if (set.Type == "CNAME") != (rec.Type == "CNAME") {
+				addd.Log.WarningF("[DNS] Ignore update %v %v : %v", rname, rtype, addd.ErrCNAMEConflict)
+				return dns.RcodeSuccess
+			}
+		}
+		err = s.StoreRecord(rec)
+	}
+	if err != nil {
+		addd.Log.ErrorF("[DNS] Impossible to update %v %v", rname, rtype)
+		addd.Log.DebugF("[DNS] %v", err)
+		return dns.RcodeServerFailure
+	}
+	return dns.RcodeSuccess
+}
+
+// nameInUse returns true if name owns at least one RR (RFC 2136, 2.4.4)
+func nameInUse(s *addd.Stage, zone *addd.Zone, name string) bool {
+	if zone.Name == name {
+		return true
+	}
+	sets, err := s.Name(name)
+	return err == nil && len(sets) > 0
+}
+
+// existing returns the RRSet of name with the type rtype as served by us
+func existing(s *addd.Stage, zone *addd.Zone, name string, rtype uint16) []dns.RR {
+	if zone.Name == name {
+		switch rtype {
+		case dns.TypeSOA:
+			return []dns.RR{getSoa(zone)}
+		case dns.TypeNS:
+			return getNS(zone)
+		}
+	}
+	set, err := s.RRSet(name, dns.Type(rtype).String())
+	if err != nil {
+		return nil
+	}
+	rrs, err := set.DNSRR()
+	if err != nil {
+		return nil
+	}
+	return rrs
+}
+
+// sameRRs returns true if a and b hold the same RDATA, whatever their order and TTL
+func sameRRs(a, b []dns.RR) bool {
+	set := func(rrs []dns.RR) map[string]bool {
+		m := make(map[string]bool)
+		for _, rr := range rrs {
+			m[rdata(rr)] = true
+		}
+		return m
+	}
+	sa, sb := set(a), set(b)
+	if len(sa) != len(sb) {
+		return false
+	}
+	for k := range sa {
+		if !sb[k] {
+			return false
+		}
+	}
+	return true
+}
+
+// rdata returns a comparable form of the type and RDATA of rr
+func rdata(rr dns.RR) string {
+	if rec, err := addd.NewRecordFromDNS(rr); err == nil {
+		return rec.Type + " " + rec.Data()
+	}
+	// Types we don't store (SOA, NS) only hold names, compared case insensitively
+	rr = dns.Copy(rr)
+	header := rr.Header()
+	header.Name, header.Ttl, header.Class = ".", 0, dns.ClassINET
+	return strings.ToLower(rr.String())
+}
+
+// isMetaType returns true for the types which can't appear in a zone
+func isMetaType(rtype uint16) bool {
+	switch rtype {
+	case dns.TypeAXFR, dns.TypeIXFR, dns.TypeMAILA, dns.TypeMAILB, dns.TypeOPT, dns.TypeTSIG:
+		return true
+	}
+	return false
+}
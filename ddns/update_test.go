@@ -0,0 +1,377 @@
+package ddns
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/redsux/addd/core"
+)
+
+// rrset returns an RR without RDATA standing for the RRSet of name with the type rtype
+func rrset(name string, rtype uint16) dns.RR {
+	return &dns.ANY{Hdr: dns.RR_Header{Name: name, Rrtype: rtype, Class: dns.ClassINET}}
+}
+
+// zoneRecords returns the records of our zones in the dns package's format, sorted
+func zoneRecords(t *testing.T) []string {
+	recs, err := addd.ListRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lst := make([]string, 0, len(recs))
+	for _, rec := range recs {
+		lst = append(lst, rec.String())
+	}
+	lst = canonicalRRs(lst...)
+	sort.Strings(lst)
+	return lst
+}
+
+func TestUpdateZone(t *testing.T) {
+	stored := []string{
+		"mail.example.com. 300 IN A 10.0.0.2",
+		"www.example.com. 300 IN A 10.0.0.1",
+		"www.example.com. 300 IN TXT \"web\"",
+	}
+	tests := []struct {
+		name    string
+		zone    string
+		prereqs func(m *dns.Msg)
+		updates func(m *dns.Msg)
+		rcode   int
+		want    []string // the stored records are expected if nil
+	}{
+		{
+			name:  "zone not served",
+			zone:  "example.org.",
+			rcode: dns.RcodeNotAuth,
+		},
+		{
+			name:    "name in use",
+			prereqs: func(m *dns.Msg) { m.NameUsed([]dns.RR{rrset("www.example.com.", dns.TypeANY)}) },
+			updates: func(m *dns.Msg) { m.Insert([]dns.RR{mustRR("new.example.com. 300 IN A 10.0.0.3")}) },
+			want: []string{
+				"mail.example.com. 300 IN A 10.0.0.2",
+				"new.example.com. 300 IN A 10.0.0.3",
+				"www.example.com. 300 IN A 10.0.0.1",
+				"www.example.com. 300 IN TXT \"web\"",
+			},
+		},
+		{
+			name:    "zone apex in use",
+			prereqs: func(m *dns.Msg) { m.NameUsed([]dns.RR{rrset("example.com.", dns.TypeANY)}) },
+		},
+		{
+			name:    "name not in use",
+			prereqs: func(m *dns.Msg) { m.NameUsed([]dns.RR{rrset("new.example.com.", dns.TypeANY)}) },
+			updates: func(m *dns.Msg) { m.Insert([]dns.RR{mustRR("new.example.com. 300 IN A 10.0.0.3")}) },
+			rcode:   dns.RcodeNameError,
+		},
+		{
+			name:    "name unused",
+			prereqs: func(m *dns.Msg) { m.NameNotUsed([]dns.RR{rrset("new.example.com.", dns.TypeANY)}) },
+		},
+		{
+			name:    "name used",
+			prereqs: func(m *dns.Msg) { m.NameNotUsed([]dns.RR{rrset("www.example.com.", dns.TypeANY)}) },
+			updates: func(m *dns.Msg) { m.RemoveName([]dns.RR{rrset("www.example.com.", dns.TypeANY)}) },
+			rcode:   dns.RcodeYXDomain,
+		},
+		{
+			name:    "RRSet exists",
+			prereqs: func(m *dns.Msg) { m.RRsetUsed([]dns.RR{rrset("www.example.com.", dns.TypeA)}) },
+			updates: func(m *dns.Msg) { m.RemoveRRset([]dns.RR{rrset("www.example.com.", dns.TypeA)}) },
+			want: []string{
+				"mail.example.com. 300 IN A 10.0.0.2",
+				"www.example.com. 300 IN TXT \"web\"",
+			},
+		},
+		{
+			name:    "SOA exists",
+			prereqs: func(m *dns.Msg) { m.RRsetUsed([]dns.RR{rrset("example.com.", dns.TypeSOA)}) },
+		},
+		{
+			name:    "RRSet missing",
+			prereqs: func(m *dns.Msg) { m.RRsetUsed([]dns.RR{rrset("www.example.com.", dns.TypeMX)}) },
+			rcode:   dns.RcodeNXRrset,
+		},
+		{
+			name:    "RRSet doesn't exist",
+			prereqs: func(m *dns.Msg) { m.RRsetNotUsed([]dns.RR{rrset("www.example.com.", dns.TypeMX)}) },
+		},
+		{
+			name:    "RRSet existing",
+			prereqs: func(m *dns.Msg) { m.RRsetNotUsed([]dns.RR{rrset("www.example.com.", dns.TypeA)}) },
+			rcode:   dns.RcodeYXRrset,
+		},
+		{
+			name: "RRSet with the values",
+			prereqs: func(m *dns.Msg) {
+				m.Used([]dns.RR{mustRR("www.example.com. 0 IN A 10.0.0.1"), mustRR("mail.example.com. 0 IN A 10.0.0.2")})
+			},
+			updates: func(m *dns.Msg) { m.Remove([]dns.RR{mustRR("mail.example.com. 0 IN A 10.0.0.2")}) },
+			want: []string{
+				"www.example.com. 300 IN A 10.0.0.1",
+				"www.example.com. 300 IN TXT \"web\"",
+			},
+		},
+		{
+			name:    "RRSet with other values",
+			prereqs: func(m *dns.Msg) { m.Used([]dns.RR{mustRR("www.example.com. 0 IN A 10.0.0.9")}) },
+			rcode:   dns.RcodeNXRrset,
+		},
+		{
+			name: "RRSet with more values",
+			prereqs: func(m *dns.Msg) {
+				m.Used([]dns.RR{mustRR("www.example.com. 0 IN A 10.0.0.1"), mustRR("www.example.com. 0 IN A 10.0.0.9")})
+			},
+			rcode: dns.RcodeNXRrset,
+		},
+		{
+			name:    "prerequisite outside the zone",
+			prereqs: func(m *dns.Msg) { m.NameUsed([]dns.RR{rrset("www.example.org.", dns.TypeANY)}) },
+			rcode:   dns.RcodeNotZone,
+		},
+		{
+			name: "prerequisite with a TTL",
+			prereqs: func(m *dns.Msg) {
+				m.Answer = append(m.Answer, &dns.ANY{Hdr: dns.RR_Header{Name: "www.example.com.", Rrtype: dns.TypeA, Class: dns.ClassANY, Ttl: 300}})
+			},
+			rcode: dns.RcodeFormatError,
+		},
+		{
+			name: "update outside the zone",
+			updates: func(m *dns.Msg) {
+				m.Insert([]dns.RR{mustRR("new.example.com. 300 IN A 10.0.0.3"), mustRR("www.example.org. 300 IN A 10.0.0.4")})
+			},
+			rcode: dns.RcodeNotZone,
+		},
+		{
+			name:    "update of a meta type",
+			updates: func(m *dns.Msg) { m.Ns = append(m.Ns, rrset("www.example.com.", dns.TypeAXFR)) },
+			rcode:   dns.RcodeFormatError,
+		},
+		{
+			name: "add of an unsupported type",
+			updates: func(m *dns.Msg) {
+				m.Insert([]dns.RR{mustRR("new.example.com. 300 IN A 10.0.0.3"), mustRR("www.example.com. 300 IN HINFO \"cpu\" \"os\"")})
+			},
+			rcode: dns.RcodeFormatError,
+		},
+		{
+			name: "deletion with a TTL",
+			updates: func(m *dns.Msg) {
+				m.Ns = append(m.Ns, &dns.ANY{Hdr: dns.RR_Header{Name: "www.example.com.", Rrtype: dns.TypeA, Class: dns.ClassANY, Ttl: 300}})
+			},
+			rcode: dns.RcodeFormatError,
+		},
+		{
+			name: "update of a name server",
+			updates: func(m *dns.Msg) {
+				m.Insert([]dns.RR{mustRR("new.example.com. 300 IN A 10.0.0.3"), mustRR("ns.example.com. 300 IN A 10.0.0.4")})
+			},
+			rcode: dns.RcodeRefused,
+		},
+		{
+			name:    "CNAME beside data",
+			updates: func(m *dns.Msg) { m.Insert([]dns.RR{mustRR("www.example.com. 300 IN CNAME web.example.com.")}) },
+		},
+		{
+			name: "RRSets replaced by a CNAME",
+			updates: func(m *dns.Msg) {
+				m.RemoveName([]dns.RR{rrset("www.example.com.", dns.TypeANY)})
+				m.Insert([]dns.RR{mustRR("www.example.com. 300 IN CNAME web.example.com.")})
+			},
+			want: []string{
+				"mail.example.com. 300 IN A 10.0.0.2",
+				"www.example.com. 300 IN CNAME web.example.com.",
+			},
+		},
+		{
+			name: "CNAME replaced",
+			updates: func(m *dns.Msg) {
+				m.Insert([]dns.RR{mustRR("web.example.com. 300 IN CNAME host1.example.com.")})
+				m.Insert([]dns.RR{mustRR("web.example.com. 300 IN CNAME host2.example.com.")})
+			},
+			want: []string{
+				"mail.example.com. 300 IN A 10.0.0.2",
+				"web.example.com. 300 IN CNAME host2.example.com.",
+				"www.example.com. 300 IN A 10.0.0.1",
+				"www.example.com. 300 IN TXT \"web\"",
+			},
+		},
+		{
+			name: "failed prerequisite after a valid one",
+			prereqs: func(m *dns.Msg) {
+				m.RRsetUsed([]dns.RR{rrset("www.example.com.", dns.TypeA)})
+				m.NameNotUsed([]dns.RR{rrset("mail.example.com.", dns.TypeANY)})
+			},
+			updates: func(m *dns.Msg) { m.RemoveName([]dns.RR{rrset("www.example.com.", dns.TypeANY)}) },
+			rcode:   dns.RcodeYXDomain,
+		},
+		{
+			name:    "missing record deleted",
+			updates: func(m *dns.Msg) { m.Remove([]dns.RR{mustRR("www.example.com. 0 IN A 10.0.0.9")}) },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useMemStore(t)
+			storeRRs(t, stored...)
+			zone, err := addd.GetZone("example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			m := new(dns.Msg)
+			if tt.zone == "" {
+				tt.zone = zone.Name
+			}
+			m.SetUpdate(tt.zone)
+			if tt.prereqs != nil {
+				tt.prereqs(m)
+			}
+			if tt.updates != nil {
+				tt.updates(m)
+			}
+			// The update is read as it is received
+			buf, err := m.Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := new(dns.Msg)
+			if err := r.Unpack(buf); err != nil {
+				t.Fatal(err)
+			}
+
+			if rcode := updateZone(zone, r, nil); rcode != tt.rcode {
+				t.Errorf("updateZone() = %v, want %v", dns.RcodeToString[rcode], dns.RcodeToString[tt.rcode])
+			}
+			want := stored
+			if tt.want != nil {
+				want = tt.want
+			}
+			want = canonicalRRs(want...)
+			sort.Strings(want)
+			if got := zoneRecords(t); !reflect.DeepEqual(got, want) {
+				t.Errorf("records = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestUpdatePolicy(t *testing.T) {
+	useMemStore(t)
+	key, err := addd.ParseTsigKey("host.example.com:hmac-sha256:c2VjcmV0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key.Policies = []addd.Policy{{Match: "self"}, {Match: "wildcard", Name: "*.dyn.example.com", Types: []string{"A"}}}
+	if err := addd.StoreTsigKey(key); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		keyname string // unsigned if empty
+		rrs     []string
+		rcode   int
+	}{
+		{"host.example.com.", []string{"host.example.com. 300 IN TXT \"self\"", "a.dyn.example.com. 300 IN A 10.0.0.1"}, dns.RcodeSuccess},
+		// A single RR refused refuses the whole update
+		{"host.example.com.", []string{"b.dyn.example.com. 300 IN A 10.0.0.2", "b.dyn.example.com. 300 IN TXT \"b\""}, dns.RcodeRefused},
+		{"host.example.com.", []string{"www.example.com. 300 IN A 10.0.0.3"}, dns.RcodeRefused},
+		// Once policies are defined, unsigned updates are refused
+		{"", []string{"www.example.com. 300 IN A 10.0.0.3"}, dns.RcodeRefused},
+	}
+	for _, tt := range tests {
+		u := new(dns.Msg)
+		u.SetUpdate("example.com.")
+		for _, rr := range tt.rrs {
+			u.Insert([]dns.RR{mustRR(rr)})
+		}
+		if tt.keyname != "" {
+			u.SetTsig(tt.keyname, dns.HmacSHA256, 300, time.Now().Unix())
+		}
+		if m := exchange(t, udpClient, u); m.Rcode != tt.rcode {
+			t.Errorf("update of %q = %v, want %v", tt.rrs, dns.RcodeToString[m.Rcode], dns.RcodeToString[tt.rcode])
+		}
+	}
+	want := canonicalRRs(
+		"a.dyn.example.com. 300 IN A 10.0.0.1",
+		"host.example.com. 300 IN TXT \"self\"",
+	)
+	if got := zoneRecords(t); !reflect.DeepEqual(got, want) {
+		t.Errorf("records = %q, want %q", got, want)
+	}
+}
+
+func TestUpdateAuth(t *testing.T) {
+	useMemStore(t)
+	key, err := addd.ParseTsigKey("host.example.com:hmac-sha256:c2VjcmV0")
+	if err == nil {
+		err = addd.StoreTsigKey(key)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SetUpdateAuth(true, []string{"192.0.2.0/28", ""}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { updateSigned, updateNets = false, []*net.IPNet{} }()
+	if err := SetUpdateAuth(true, []string{"192.0.2.1"}); err == nil {
+		t.Error("SetUpdateAuth() accepted an address without length")
+	}
+
+	other := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 5353}
+	tests := []struct {
+		name    string
+		remote  net.Addr
+		keyname string // unsigned if empty
+		tsig    error
+		rcode   int
+		tsigErr int // -1 if the reply has no TSIG
+	}{
+		{"unsigned from an allowed network", udpClient, "", nil, dns.RcodeSuccess, -1},
+		{"unsigned", other, "", nil, dns.RcodeNotAuth, -1},
+		{"signed", other, "host.example.com.", nil, dns.RcodeSuccess, dns.RcodeSuccess},
+		{"bad signature", other, "host.example.com.", dns.ErrSig, dns.RcodeNotAuth, dns.RcodeBadSig},
+		{"bad signature from an allowed network", udpClient, "host.example.com.", dns.ErrSig, dns.RcodeNotAuth, dns.RcodeBadSig},
+		{"unknown key", other, "none.example.com.", nil, dns.RcodeNotAuth, dns.RcodeBadKey},
+		{"bad time", other, "host.example.com.", dns.ErrTime, dns.RcodeNotAuth, dns.RcodeBadTime},
+	}
+	for _, tt := range tests {
+		u := new(dns.Msg)
+		u.SetUpdate("example.com.")
+		u.Insert([]dns.RR{mustRR("www.example.com. 300 IN A 10.0.0.1")})
+		if tt.keyname != "" {
+			u.SetTsig(tt.keyname, dns.HmacSHA256, 300, time.Now().Unix())
+		}
+		w := &testWriter{remote: tt.remote, tsig: tt.tsig}
+		receive(w, u)
+		if w.msg.Rcode != tt.rcode {
+			t.Errorf("%s: update = %v, want %v", tt.name, dns.RcodeToString[w.msg.Rcode], dns.RcodeToString[tt.rcode])
+		}
+		rt := w.msg.IsTsig()
+		switch {
+		case tt.tsigErr < 0 && rt != nil:
+			t.Errorf("%s: reply with %v", tt.name, rt)
+		case tt.tsigErr >= 0 && (rt == nil || int(rt.Error) != tt.tsigErr):
+			t.Errorf("%s: reply with %v, want the TSIG error %v", tt.name, rt, dns.RcodeToString[tt.tsigErr])
+		case tt.tsigErr == dns.RcodeBadTime:
+			// Signed with the MAC of the request, at our time. TsigVerify refuses any NOTAUTH message.
+			if mac := replyMAC(t, w.msg, u.IsTsig().MAC); rt.MAC == "" || rt.MAC != mac ||
+				rt.OtherLen != 6 || rt.OtherData != fmt.Sprintf("%012x", rt.TimeSigned) {
+				t.Errorf("%s: reply with %v badly signed, want the MAC %v", tt.name, rt, mac)
+			}
+		case tt.tsigErr > 0 && rt.MAC != "":
+			t.Errorf("%s: reply signed", tt.name)
+		}
+	}
+	if _, err := addd.GetRRSet("www.example.com", "A"); err != nil {
+		t.Error("authorized update not applied")
+	}
+}
@@ -0,0 +1,143 @@
+package ddns
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/redsux/addd/core"
+)
+
+// storeViewRRs stores in view the records of the RRs given in their presentation format
+func storeViewRRs(t *testing.T, view string, rrs ...string) {
+	for _, s := range rrs {
+		rec, err := addd.NewRecordFromDNS(mustRR(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		set, err := addd.GetViewRRSet(view, rec.Name, rec.Type)
+		if err != nil {
+			set = addd.NewRRSet(rec.Name, rec.Type)
+		}
+		set.Add(rec)
+		if err := addd.StoreViewRRSet(view, set); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestQueryViews(t *testing.T) {
+	useMemStore(t)
+	for _, view := range []*addd.View{
+		{Name: "internal", Networks: []string{"10.0.0.0/8"}},
+		{Name: "vpn", Keys: []string{"vpn.example.com"}},
+	} {
+		if err := addd.StoreView(view); err != nil {
+			t.Fatal(err)
+		}
+	}
+	key, err := addd.ParseTsigKey("vpn.example.com:hmac-sha256:c2VjcmV0")
+	if err == nil {
+		err = addd.StoreTsigKey(key)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	storeRRs(t,
+		"www.example.com. 300 IN A 192.0.2.1",
+		"mail.example.com. 300 IN A 192.0.2.2",
+		"example.com. 300 IN MX 10 mail.example.com.",
+	)
+	storeViewRRs(t, "internal",
+		"www.example.com. 300 IN A 10.0.0.1",
+		"mail.example.com. 300 IN A 10.0.0.2",
+		"web.example.com. 300 IN CNAME www.example.com.",
+		"*.lab.example.com. 300 IN A 10.0.0.9",
+	)
+	storeViewRRs(t, "vpn", "www.example.com. 300 IN A 10.8.0.1")
+
+	internal := &net.UDPAddr{IP: net.IPv4(10, 1, 2, 3), Port: 5353}
+	tests := []struct {
+		remote net.Addr
+		key    string
+		qname  string
+		qtype  uint16
+		rcode  int
+		want   []string
+	}{
+		{udpClient, "", "www.example.com.", dns.TypeA, dns.RcodeSuccess, []string{"www.example.com. 300 IN A 192.0.2.1"}},
+		{internal, "", "www.example.com.", dns.TypeA, dns.RcodeSuccess, []string{"www.example.com. 300 IN A 10.0.0.1"}},
+		{udpClient, "vpn.example.com.", "www.example.com.", dns.TypeA, dns.RcodeSuccess, []string{"www.example.com. 300 IN A 10.8.0.1"}},
+		// The key takes precedence over the network
+		{internal, "vpn.example.com.", "www.example.com.", dns.TypeA, dns.RcodeSuccess, []string{"www.example.com. 300 IN A 10.8.0.1"}},
+		// Missing names and types come from the default view
+		{udpClient, "vpn.example.com.", "mail.example.com.", dns.TypeA, dns.RcodeSuccess, []string{"mail.example.com. 300 IN A 192.0.2.2"}},
+		{internal, "", "example.com.", dns.TypeMX, dns.RcodeSuccess, []string{"example.com. 300 IN MX 10 mail.example.com."}},
+		// CNAME chains are followed in the view
+		{internal, "", "web.example.com.", dns.TypeA, dns.RcodeSuccess, []string{"web.example.com. 300 IN CNAME www.example.com.", "www.example.com. 300 IN A 10.0.0.1"}},
+		{udpClient, "", "web.example.com.", dns.TypeA, dns.RcodeNameError, []string{}},
+		{internal, "", "web.example.com.", dns.TypeTXT, dns.RcodeSuccess, []string{"web.example.com. 300 IN CNAME www.example.com."}},
+		// Wildcards match in their view only
+		{internal, "", "host.lab.example.com.", dns.TypeA, dns.RcodeSuccess, []string{"host.lab.example.com. 300 IN A 10.0.0.9"}},
+		{udpClient, "", "host.lab.example.com.", dns.TypeA, dns.RcodeNameError, []string{}},
+	}
+	for _, tt := range tests {
+		r := new(dns.Msg)
+		r.SetQuestion(tt.qname, tt.qtype)
+		w := &testWriter{remote: tt.remote}
+		if tt.key != "" {
+			r.SetTsig(tt.key, dns.HmacSHA256, 300, time.Now().Unix())
+		}
+		receive(w, r)
+		m := w.msg
+		if m.Rcode != tt.rcode || !reflect.DeepEqual(answers(m), canonicalRRs(tt.want...)) {
+			t.Errorf("%v %v from %v (key %q) = %v %q, want %v %q", tt.qname, dns.TypeToString[tt.qtype], tt.remote, tt.key,
+				dns.RcodeToString[m.Rcode], answers(m), dns.RcodeToString[tt.rcode], tt.want)
+		}
+		if tt.qtype == dns.TypeMX && (len(m.Extra) != 1 || m.Extra[0].(*dns.A).A.String() != "10.0.0.2") {
+			t.Errorf("glue of the MX in the view = %v", m.Extra)
+		}
+	}
+}
+
+func TestDenialInView(t *testing.T) {
+	useMemStore(t)
+	if err := addd.StoreView(&addd.View{Name: "internal", Networks: []string{"10.0.0.0/8"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := addd.GenerateZoneKey("example.com", true, "ECDSAP256SHA256"); err != nil {
+		t.Fatal(err)
+	}
+	storeRRs(t, "www.example.com. 300 IN A 192.0.2.1")
+	storeViewRRs(t, "internal", "www.example.com. 300 IN TXT \"internal\"", "*.lab.example.com. 300 IN MX 10 www.example.com.")
+
+	// The NSEC lists the types of the client's view, those of a wildcard matched included
+	internal := &net.TCPAddr{IP: net.IPv4(10, 1, 2, 3), Port: 5353}
+	tests := []struct {
+		remote net.Addr
+		qname  string
+		types  []uint16
+	}{
+		{internal, "www.example.com.", []uint16{dns.TypeA, dns.TypeTXT, dns.TypeRRSIG, dns.TypeNSEC}},
+		{tcpClient, "www.example.com.", []uint16{dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC}},
+		{internal, "host.lab.example.com.", []uint16{dns.TypeMX, dns.TypeRRSIG, dns.TypeNSEC}},
+		{tcpClient, "host.lab.example.com.", []uint16{dns.TypeRRSIG, dns.TypeNSEC}},
+	}
+	for _, tt := range tests {
+		r := new(dns.Msg)
+		r.SetQuestion(tt.qname, dns.TypeAAAA)
+		r.SetEdns0(4096, true)
+		m := exchange(t, tt.remote, r)
+		var types []uint16
+		for _, rr := range m.Ns {
+			if nsec, ok := rr.(*dns.NSEC); ok {
+				types = nsec.TypeBitMap
+			}
+		}
+		if !reflect.DeepEqual(types, tt.types) {
+			t.Errorf("NSEC of %v from %v = %v, want %v", tt.qname, tt.remote, types, tt.types)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package ddns
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/redsux/addd/core"
+)
+
+const (
+	// maxXfrSize is the size from which a new message is started during a transfer
+	maxXfrSize = 16384
+)
+
+var (
+	xfrNets = []*net.IPNet{}
+	xfrKeys = map[string]bool{}
+)
+
+// SetTransfer defines who may transfer our zones : client networks (CIDR) and/or TSIG key names
+func SetTransfer(nets, keys []string) error {
+	for _, cidr := range nets {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("Invalid transfer network %v", cidr)
+		}
+		xfrNets = append(xfrNets, ipnet)
+	}
+	for _, key := range keys {
+		if key = strings.TrimSpace(key); key != "" {
+			xfrKeys[dns.Fqdn(strings.ToLower(key))] = true
+		}
+	}
+	return nil
+}
+
+// allowTransfer returns true if the client's address or its valid TSIG key is allowed
+func allowTransfer(w dns.ResponseWriter, r *dns.Msg) bool {
+	if t := validTsig(w, r); t != nil && xfrKeys[strings.ToLower(t.Hdr.Name)] {
+		return true
+	}
+	if ip := remoteIP(w); ip != nil {
+		for _, ipnet := range xfrNets {
+			if ipnet.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// zoneContent returns all the RRs of the zone name, starting with its SOA and NS records,
+// the SOA matching the RRs read with it
+func zoneContent(name string) ([]dns.RR, error) {
+	zone, sets, err := addd.ZoneContent(name)
+	if err != nil {
+		return nil, err
+	}
+	rrs := append([]dns.RR{getSoa(zone)}, getNS(zone)...)
+	if ns, err := getNsA(zone); err == nil {
+		rrs = append(rrs, ns...)
+	}
+	for _, set := range sets {
+		setRRs, err := set.DNSRR()
+		if err != nil {
+			return nil, err
+		}
+		rrs = append(rrs, setRRs...)
+	}
+	return rrs, nil
+}
+
+// transferZone answers an AXFR (RFC 5936) or IXFR (RFC 1995) query, the zone is streamed over several messages
+func transferZone(w dns.ResponseWriter, r *dns.Msg) {
+	q := r.Question[0]
+	name := strings.ToLower(q.Name)
+	addd.Log.NoticeF("[DNS] Transfer %v to %v", name, w.RemoteAddr())
+
+	fail := func(rcode int) {
+		m := new(dns.Msg)
+		m.SetRcode(r, rcode)
+		signReply(w, r, m)
+		w.WriteMsg(m)
+	}
+	if (isUDP(w) && q.Qtype == dns.TypeAXFR) || !allowTransfer(w, r) {
+		addd.Log.WarningF("[DNS] Transfer of %v refused to %v", name, w.RemoteAddr())
+		fail(dns.RcodeRefused)
+		return
+	}
+	zone := zoneOf(name)
+	if zone == nil || zone.Name != name {
+		fail(dns.RcodeNotAuth)
+		return
+	}
+
+	if q.Qtype == dns.TypeIXFR {
+		if len(r.Ns) == 0 {
+			fail(dns.RcodeFormatError)
+			return
+		}
+		if client, ok := r.Ns[0].(*dns.SOA); ok {
+			if rrs, err := zoneChanges(zone, client.Serial); err == nil {
+				sendChanges(w, r, rrs)
+				return
+			}
+			addd.Log.DebugF("[DNS] Journal unavailable since %d, full transfer of %v", client.Serial, zone)
+		}
+		if isUDP(w) {
+			// The client has to retry over TCP
+			sendChanges(w, r, []dns.RR{getSoa(zone)})
+			return
+		}
+	}
+
+	rrs, err := zoneContent(zone.Name)
+	if err != nil {
+		addd.Log.ErrorF("[DNS] Impossible to list %v : %v", zone, err)
+		fail(dns.RcodeServerFailure)
+		return
+	}
+	streamRRs(w, r, append(rrs, rrs[0]))
+}
+
+// streamRRs writes rrs as answers of r, splitted in messages of maxXfrSize bytes
+func streamRRs(w dns.ResponseWriter, r *dns.Msg, rrs []dns.RR) {
+	newMsg := func() *dns.Msg {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Authoritative = true
+		m.Compress = true
+		return m
+	}
+	m := newMsg()
+	for i, rr := range rrs {
+		m.Answer = append(m.Answer, rr)
+		if m.Len() < maxXfrSize && i < len(rrs)-1 {
+			continue
+		}
+		signReply(w, r, m)
+		if err := w.WriteMsg(m); err != nil {
+			addd.Log.WarningF("[DNS] Transfer to %v interrupted : %v", w.RemoteAddr(), err)
+			return
+		}
+		// The next messages are signed with the timers only (RFC 8945, 5.3.1)
+		w.TsigTimersOnly(true)
+		m = newMsg()
+	}
+}
+
+// zoneChanges returns the IXFR answer of zone since serial : the current SOA followed
+// by each change as "old SOA, removed RRs, new SOA, added RRs" and the current SOA again
+func zoneChanges(zone *addd.Zone, serial uint32) ([]dns.RR, error) {
+	cur := getSoa(zone)
+	if !serialLess(serial, cur.Serial) {
+		// Up to date
+		return []dns.RR{cur}, nil
+	}
+	entries, err := addd.Journal(zone.Name, serial)
+	if err != nil {
+		return nil, err
+	}
+	rrs := []dns.RR{cur}
+	for _, entry := range entries {
+		rrs = append(rrs, soaAt(zone, entry.From))
+		if rrs, err = appendZoneRecords(rrs, zone, entry.Removed); err != nil {
+			return nil, err
+		}
+		rrs = append(rrs, soaAt(zone, entry.To))
+		if rrs, err = appendZoneRecords(rrs, zone, entry.Added); err != nil {
+			return nil, err
+		}
+	}
+	return append(rrs, cur), nil
+}
+
+// appendZoneRecords appends to rrs the records belonging to zone
+func appendZoneRecords(rrs []dns.RR, zone *addd.Zone, records []addd.Record) ([]dns.RR, error) {
+	for _, rec := range records {
+		if !inZone(zone, rec.Name) {
+			continue
+		}
+		rr, err := rec.DNSRR()
+		if err != nil {
+			return nil, err
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs, nil
+}
+
+// sendChanges writes an IXFR answer, over UDP only the SOA is sent if it doesn't fit (RFC 1995, 2)
+func sendChanges(w dns.ResponseWriter, r *dns.Msg, rrs []dns.RR) {
+	if !isUDP(w) {
+		streamRRs(w, r, rrs)
+		return
+	}
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	m.Compress = true
+	m.Answer = rrs
+	if m.Len() > udpSize(r) {
+		m.Answer = rrs[:1]
+	}
+	signReply(w, r, m)
+	w.WriteMsg(m)
+}
+
+// inZone returns true if zone is the closest zone of name
+func inZone(zone *addd.Zone, name string) bool {
+	owner := zoneOf(name)
+	return owner != nil && owner.Name == zone.Name
+}
+
+// serialLess compares serials with the RFC 1982 arithmetic
+func serialLess(a, b uint32) bool {
+	return a != b && int32(b-a) > 0
+}
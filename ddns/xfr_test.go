@@ -0,0 +1,276 @@
+package ddns
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/redsux/addd/core"
+)
+
+// useTransfer allows the transfers from nets and keys until the end of the test
+func useTransfer(t *testing.T, nets, keys []string) func() {
+	if err := SetTransfer(nets, keys); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		xfrNets, xfrKeys = []*net.IPNet{}, map[string]bool{}
+	}
+}
+
+// transfer returns the RRs of all the messages replied to an AXFR of zone from remote, the last rcode
+// and the number of messages. The request is signed with keyname if set, its signature is valid if tsig is nil.
+func transfer(t *testing.T, remote net.Addr, zone string, keyname string, tsig error) ([]dns.RR, int, int) {
+	r := new(dns.Msg)
+	r.SetQuestion(zone, dns.TypeAXFR)
+	if keyname != "" {
+		r.SetTsig(keyname, dns.HmacMD5, 300, time.Now().Unix())
+	}
+	w := &testWriter{remote: remote, tsig: tsig}
+	receive(w, r)
+	if w.msg == nil {
+		t.Fatal("no reply written")
+	}
+	rrs := []dns.RR{}
+	for _, m := range w.msgs {
+		rrs = append(rrs, m.Answer...)
+	}
+	return rrs, w.msg.Rcode, len(w.msgs)
+}
+
+func TestTransferACL(t *testing.T) {
+	useMemStore(t)
+	defer useTransfer(t, []string{"192.0.2.0/28", " "}, []string{"Xfr.Example.com", "sha.example.com"})()
+	other := &net.TCPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 5353}
+	for _, spec := range []string{"xfr.example.com:hmac-md5:c2VjcmV0", "other.example.com:c2VjcmV0", "sha.example.com:hmac-sha256:c2VjcmV0"} {
+		key, err := addd.ParseTsigKey(spec)
+		if err == nil {
+			err = addd.StoreTsigKey(key)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		remote  net.Addr
+		zone    string
+		keyname string
+		tsig    error
+		rcode   int
+	}{
+		{"allowed network", tcpClient, "example.com.", "", nil, dns.RcodeSuccess},
+		{"over UDP", udpClient, "example.com.", "", nil, dns.RcodeRefused},
+		{"other network", other, "example.com.", "", nil, dns.RcodeRefused},
+		{"allowed key", other, "example.com.", "xfr.example.com.", nil, dns.RcodeSuccess},
+		{"invalid signature", other, "example.com.", "xfr.example.com.", dns.ErrSig, dns.RcodeRefused},
+		{"other key", other, "example.com.", "other.example.com.", nil, dns.RcodeRefused},
+		{"key with another algorithm", other, "example.com.", "sha.example.com.", nil, dns.RcodeRefused},
+		{"not a zone", tcpClient, "www.example.com.", "", nil, dns.RcodeNotAuth},
+		{"zone not served", tcpClient, "example.org.", "", nil, dns.RcodeNotAuth},
+	}
+	for _, tt := range tests {
+		if _, rcode, _ := transfer(t, tt.remote, tt.zone, tt.keyname, tt.tsig); rcode != tt.rcode {
+			t.Errorf("%s: AXFR = %v, want %v", tt.name, dns.RcodeToString[rcode], dns.RcodeToString[tt.rcode])
+		}
+	}
+	if err := SetTransfer([]string{"192.0.2.1"}, nil); err == nil {
+		t.Error("SetTransfer() accepted an address without length")
+	}
+}
+
+func TestTransferContent(t *testing.T) {
+	defer addd.SetReverse(nil)
+	useMemStore(t)
+	defer useTransfer(t, []string{"192.0.2.0/24"}, nil)()
+	if err := addd.SetReverse([]string{"10.0.0.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	useZones(t, addd.ReverseZones()...)
+
+	// Enough records to need several messages
+	rrs := []string{"www.example.com. 300 IN A 10.0.0.1"}
+	text := strings.Repeat("x", 200)
+	for i := 0; i < 200; i++ {
+		rrs = append(rrs, fmt.Sprintf("txt%d.example.com. 300 IN TXT \"%s\"", i, text))
+	}
+	storeRRs(t, rrs...)
+
+	got, rcode, msgs := transfer(t, tcpClient, "example.com.", "", nil)
+	if rcode != dns.RcodeSuccess || msgs < 2 {
+		t.Fatalf("AXFR = %v in %d messages", dns.RcodeToString[rcode], msgs)
+	}
+	// SOA, NS, the A of our name server, then our records and the SOA again
+	if want := 3 + len(rrs) + 1; len(got) != want {
+		t.Errorf("AXFR = %d RRs, want %d", len(got), want)
+	}
+	first, ok1 := got[0].(*dns.SOA)
+	last, ok2 := got[len(got)-1].(*dns.SOA)
+	if !ok1 || !ok2 || first.Hdr.Name != "example.com." || first.String() != last.String() {
+		t.Errorf("AXFR starts with %v and ends with %v", got[0], got[len(got)-1])
+	}
+	if _, ok := got[1].(*dns.NS); !ok {
+		t.Errorf("AXFR has %v after the SOA, want the NS", got[1])
+	}
+	for _, rr := range got {
+		if !dns.IsSubDomain("example.com.", rr.Header().Name) {
+			t.Errorf("AXFR of example.com. has %v", rr)
+		}
+	}
+
+	// The PTR records belong to the reverse zone
+	got, rcode, _ = transfer(t, tcpClient, "0.0.10.in-addr.arpa.", "", nil)
+	if rcode != dns.RcodeSuccess || len(got) != 5 || got[3].String() != mustRR("1.0.0.10.in-addr.arpa. 300 IN PTR www.example.com.").String() {
+		t.Errorf("AXFR of the reverse zone = %v %v", dns.RcodeToString[rcode], got)
+	}
+}
+
+func TestSerialLess(t *testing.T) {
+	tests := []struct {
+		a, b uint32
+		want bool
+	}{
+		{1, 2, true},
+		{2, 1, false},
+		{1, 1, false},
+		{0xffffffff, 1, true},
+		{1, 0xffffffff, false},
+		{1, 0x80000000, true},
+		{1, 0x80000001, false},
+		{0x80000000, 1, false},
+	}
+	for _, tt := range tests {
+		if got := serialLess(tt.a, tt.b); got != tt.want {
+			t.Errorf("serialLess(%v, %v) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+// soaStrings returns rrs as strings, the SOA ones reduced to their serial
+func soaStrings(rrs []dns.RR) []string {
+	lst := make([]string, 0, len(rrs))
+	for _, rr := range rrs {
+		if soa, ok := rr.(*dns.SOA); ok {
+			lst = append(lst, fmt.Sprintf("SOA %d", soa.Serial))
+		} else {
+			lst = append(lst, rr.String())
+		}
+	}
+	return lst
+}
+
+// journalChanges stores then deletes records from the serial 1, up to the serial 4
+func journalChanges(t *testing.T) {
+	if serial, err := addd.GetSerial("example.com"); err != nil || serial != 1 {
+		t.Fatalf("GetSerial() = %v, %v", serial, err)
+	}
+	storeRRs(t, "www.example.com. 300 IN A 10.0.0.1", "www.example.com. 300 IN A 10.0.0.2")
+	rec, err := addd.NewRecordFromDNS(mustRR("www.example.com. 300 IN A 10.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := addd.DeleteRecord(rec); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestZoneChanges(t *testing.T) {
+	useMemStore(t)
+	journalChanges(t)
+	zone, err := addd.GetZone("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		serial uint32
+		want   []string
+		err    error
+	}{
+		{1, []string{
+			"SOA 4",
+			"SOA 1", "SOA 2", "www.example.com. 300 IN A 10.0.0.1",
+			"SOA 2", "SOA 3", "www.example.com. 300 IN A 10.0.0.2",
+			"SOA 3", "www.example.com. 300 IN A 10.0.0.1", "SOA 4",
+			"SOA 4",
+		}, nil},
+		{3, []string{
+			"SOA 4",
+			"SOA 3", "www.example.com. 300 IN A 10.0.0.1", "SOA 4",
+			"SOA 4",
+		}, nil},
+		{4, []string{"SOA 4"}, nil},
+		{5, []string{"SOA 4"}, nil},
+		{0x80000005, nil, addd.ErrJournalMissing},
+	}
+	for _, tt := range tests {
+		rrs, err := zoneChanges(zone, tt.serial)
+		if err != tt.err {
+			t.Errorf("zoneChanges(%v) = %v, want %v", tt.serial, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		want := make([]string, 0, len(tt.want))
+		for _, s := range tt.want {
+			if strings.HasPrefix(s, "SOA ") {
+				want = append(want, s)
+			} else {
+				want = append(want, mustRR(s).String())
+			}
+		}
+		if got := soaStrings(rrs); !reflect.DeepEqual(got, want) {
+			t.Errorf("zoneChanges(%v) = %q, want %q", tt.serial, got, want)
+		}
+	}
+}
+
+func TestIncrementalTransfer(t *testing.T) {
+	useMemStore(t)
+	defer useTransfer(t, []string{"192.0.2.0/24"}, nil)()
+	journalChanges(t)
+
+	ixfr := func(remote net.Addr, serial uint32) *testWriter {
+		r := new(dns.Msg)
+		r.SetIxfr("example.com.", serial, "ns.example.com.", "admin.")
+		w := &testWriter{remote: remote}
+		handleDNSRequest(w, r)
+		return w
+	}
+	// Over UDP, the changes are sent if they fit
+	w := ixfr(udpClient, 3)
+	if got := soaStrings(w.msg.Answer); w.msg.Rcode != dns.RcodeSuccess || len(got) != 5 || got[0] != "SOA 4" {
+		t.Errorf("IXFR over UDP = %v %q", dns.RcodeToString[w.msg.Rcode], got)
+	}
+	// A serial out of the journal gets the SOA over UDP, the full zone over TCP
+	w = ixfr(udpClient, 0x80000005)
+	if got := soaStrings(w.msg.Answer); !reflect.DeepEqual(got, []string{"SOA 4"}) {
+		t.Errorf("IXFR over UDP without journal = %q", got)
+	}
+	w = ixfr(tcpClient, 0x80000005)
+	all := []dns.RR{}
+	for _, m := range w.msgs {
+		all = append(all, m.Answer...)
+	}
+	if got := soaStrings(all); len(got) != 5 || got[0] != "SOA 4" || got[3] != mustRR("www.example.com. 300 IN A 10.0.0.2").String() {
+		t.Errorf("IXFR over TCP without journal = %q", got)
+	}
+	// The transfer restrictions still apply
+	w = ixfr(&net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 5353}, 3)
+	if w.msg.Rcode != dns.RcodeRefused {
+		t.Errorf("IXFR from another network = %v", dns.RcodeToString[w.msg.Rcode])
+	}
+	r := new(dns.Msg)
+	r.SetQuestion("example.com.", dns.TypeIXFR)
+	w = &testWriter{remote: tcpClient}
+	handleDNSRequest(w, r)
+	if w.msg.Rcode != dns.RcodeFormatError {
+		t.Errorf("IXFR without SOA = %v", dns.RcodeToString[w.msg.Rcode])
+	}
+}
@@ -0,0 +1,133 @@
+package ddns
+
+import (
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/redsux/addd/core"
+)
+
+// zoneOf returns the closest served zone containing name, nil if none
+func zoneOf(name string) *addd.Zone {
+	zone, err := addd.ZoneOf(name)
+	if err != nil {
+		return nil
+	}
+	return zone
+}
+
+// isServed returns true if name belongs to one of our zones
+func isServed(name string) bool {
+	return zoneOf(name) != nil
+}
+
+// getSoa returns the SOA of zone with its current serial
+func getSoa(zone *addd.Zone) *dns.SOA {
+	return soaAt(zone, zone.Serial)
+}
+
+// soaAt returns the SOA of zone with the given serial
+func soaAt(zone *addd.Zone, serial uint32) *dns.SOA {
+	return &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   zone.Name,
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    uint32(zone.TTL),
+		},
+		Ns:      dns.Fqdn(strings.ToLower(zone.NS[0])),
+		Mbox:    dns.Fqdn(strings.ToLower(zone.Mbox)),
+		Serial:  serial,
+		Refresh: uint32(zone.Refresh),
+		Retry:   uint32(zone.Retry),
+		Expire:  uint32(zone.Expire),
+		Minttl:  uint32(zone.Minimum),
+	}
+}
+
+// getNS returns the NS records of zone
+func getNS(zone *addd.Zone) []dns.RR {
+	rrs := make([]dns.RR, 0, len(zone.NS))
+	for _, ns := range zone.NS {
+		rrs = append(rrs, &dns.NS{
+			Hdr: dns.RR_Header{
+				Name:   zone.Name,
+				Rrtype: dns.TypeNS,
+				Class:  dns.ClassINET,
+				Ttl:    uint32(zone.TTL),
+			},
+			Ns: dns.Fqdn(strings.ToLower(ns)),
+		})
+	}
+	return rrs
+}
+
+// isNsName returns true if name is one of the name servers of zone, inside zone
+func isNsName(zone *addd.Zone, name string) bool {
+	name = dns.Fqdn(strings.ToLower(name))
+	for _, ns := range zone.NS {
+		if dns.Fqdn(strings.ToLower(ns)) == name && dns.IsSubDomain(zone.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// getNsA returns the addresses of our members for every in-zone name server of zone
+// without stored addresses
+func getNsA(zone *addd.Zone) ([]dns.RR, error) {
+	rrs := make([]dns.RR, 0)
+	for _, ns := range zone.NS {
+		addrs, err := nsAddrs(zone, ns)
+		if err != nil {
+			return nil, err
+		}
+		rrs = append(rrs, addrs...)
+	}
+	return rrs, nil
+}
+
+// nsAddrs returns the addresses of our members as A/AAAA records of name,
+// nil if name isn't an in-zone name server of zone or has stored addresses
+func nsAddrs(zone *addd.Zone, name string) ([]dns.RR, error) {
+	name = dns.Fqdn(strings.ToLower(name))
+	if !isNsName(zone, name) {
+		return nil, nil
+	}
+	for _, rtype := range []string{"A", "AAAA"} {
+		if _, err := addd.GetRRSet(name, rtype); err == nil {
+			return nil, nil
+		}
+	}
+	ips, err := addd.IPs()
+	if err != nil {
+		return nil, err
+	}
+	rrs := make([]dns.RR, 0, len(ips))
+	for _, addr := range ips {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			continue
+		}
+		hdr := dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: uint32(zone.TTL)}
+		if ip4 := ip.To4(); ip4 != nil {
+			rrs = append(rrs, &dns.A{Hdr: hdr, A: ip4})
+		} else {
+			hdr.Rrtype = dns.TypeAAAA
+			rrs = append(rrs, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	return rrs, nil
+}
+
+// filterType returns the rrs of type rrtype
+func filterType(rrs []dns.RR, rrtype uint16) []dns.RR {
+	result := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == rrtype {
+			result = append(result, rr)
+		}
+	}
+	return result
+}
@@ -0,0 +1,97 @@
+package ddns
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/redsux/addd/core"
+)
+
+func TestQueryZones(t *testing.T) {
+	useMemStore(t, "192.0.2.53")
+	zone := addd.DefaultZone("example.org")
+	zone.NS, zone.Mbox, zone.TTL, zone.Refresh = []string{"ns1.example.org", "ns.example.com"}, "hostmaster.example.org", 3600, 7200
+	if err := addd.StoreZone(zone); err != nil {
+		t.Fatal(err)
+	}
+	storeRRs(t, "www.example.org. 300 IN A 10.0.0.1")
+
+	tests := []struct {
+		qname string
+		qtype uint16
+		rcode int
+		want  []string
+		extra []string
+	}{
+		{"example.org.", dns.TypeSOA, dns.RcodeSuccess, []string{
+			"example.org. 3600 IN SOA ns1.example.org. hostmaster.example.org. 2 7200 1800 604800 604800",
+		}, []string{"ns1.example.org. 3600 IN A 192.0.2.53"}},
+		// Only our in-zone name servers get the addresses of our members
+		{"example.org.", dns.TypeNS, dns.RcodeSuccess, []string{
+			"example.org. 3600 IN NS ns1.example.org.",
+			"example.org. 3600 IN NS ns.example.com.",
+		}, []string{"ns1.example.org. 3600 IN A 192.0.2.53"}},
+		{"ns1.example.org.", dns.TypeA, dns.RcodeSuccess, []string{"ns1.example.org. 3600 IN A 192.0.2.53"}, nil},
+		{"ns1.example.org.", dns.TypeAAAA, dns.RcodeSuccess, []string{}, nil},
+		{"www.example.org.", dns.TypeA, dns.RcodeSuccess, []string{"www.example.org. 300 IN A 10.0.0.1"}, nil},
+		{"www.example.org.", dns.TypeSOA, dns.RcodeSuccess, []string{}, nil},
+		{"none.example.org.", dns.TypeA, dns.RcodeNameError, []string{}, nil},
+		{"www.example.com.", dns.TypeA, dns.RcodeNameError, []string{}, nil},
+		// Not one of our zones
+		{"www.example.net.", dns.TypeA, dns.RcodeRefused, []string{}, nil},
+	}
+	for _, tt := range tests {
+		r := new(dns.Msg)
+		r.SetQuestion(tt.qname, tt.qtype)
+		m := exchange(t, udpClient, r)
+		if got, want := answers(m), canonicalRRs(tt.want...); m.Rcode != tt.rcode || !reflect.DeepEqual(got, want) {
+			t.Errorf("%v %v = %v %q, want %v %q", tt.qname, dns.TypeToString[tt.qtype],
+				dns.RcodeToString[m.Rcode], got, dns.RcodeToString[tt.rcode], want)
+		}
+		if tt.extra != nil && !reflect.DeepEqual(canonicalRRs(rrStrings(m.Extra)...), canonicalRRs(tt.extra...)) {
+			t.Errorf("%v %v additional = %v, want %q", tt.qname, dns.TypeToString[tt.qtype], m.Extra, tt.extra)
+		}
+		if m.Rcode == dns.RcodeRefused && (m.Authoritative || len(m.Ns) != 0) {
+			t.Errorf("%v %v refused with authority %v", tt.qname, dns.TypeToString[tt.qtype], m.Ns)
+		}
+	}
+}
+
+func TestUpdateZones(t *testing.T) {
+	useMemStore(t)
+	useZones(t, "example.org")
+	tests := []struct {
+		zone, rr string
+		rcode    int
+	}{
+		{"example.org.", "www.example.org. 300 IN A 10.0.0.1", dns.RcodeSuccess},
+		{"example.org.", "www.example.com. 300 IN A 10.0.0.1", dns.RcodeNotZone},
+		{"www.example.org.", "www.example.org. 300 IN A 10.0.0.2", dns.RcodeNotAuth},
+		{"example.org.", "ns.example.org. 300 IN A 10.0.0.3", dns.RcodeRefused},
+		{"example.net.", "www.example.net. 300 IN A 10.0.0.1", dns.RcodeRefused},
+	}
+	for _, tt := range tests {
+		u := new(dns.Msg)
+		u.SetUpdate(tt.zone)
+		u.Insert([]dns.RR{mustRR(tt.rr)})
+		if m := exchange(t, udpClient, u); m.Rcode != tt.rcode {
+			t.Errorf("update of %v in %v = %v, want %v", tt.rr, tt.zone, dns.RcodeToString[m.Rcode], dns.RcodeToString[tt.rcode])
+		}
+	}
+	if serial, _ := addd.GetSerial("example.org"); serial != 2 {
+		t.Errorf("serial of example.org = %v after an update, want 2", serial)
+	}
+	if serial, _ := addd.GetSerial("example.com"); serial != 1 {
+		t.Errorf("serial of example.com = %v, want 1", serial)
+	}
+}
+
+// rrStrings returns the presentation format of rrs
+func rrStrings(rrs []dns.RR) []string {
+	lst := make([]string, 0, len(rrs))
+	for _, rr := range rrs {
+		lst = append(lst, rr.String())
+	}
+	return lst
+}
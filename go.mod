@@ -0,0 +1,13 @@
+module github.com/redsux/addd
+
+go 1.20
+
+require (
+	github.com/apsdehal/go-logger v0.0.0-20180806132704-c7c567764688
+	github.com/boltdb/bolt v1.3.1
+	github.com/gin-contrib/cors v0.0.0-20190101123304-5e7acb10687f
+	github.com/gin-contrib/static v1.1.2
+	github.com/gin-gonic/gin v1.9.1
+	github.com/miekg/dns v1.1.50
+	github.com/redsux/habolt v0.0.0-20180913112040-1c8c94f9a2c5
+)